@@ -0,0 +1,193 @@
+package monte
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// maxAuthMessageSize is the maximum size of a message exchanged by an authentication handshake.
+const maxAuthMessageSize = 4096
+
+// pskNonceSize is the size of the nonce a PSK server handshaker challenges its client with.
+const pskNonceSize = 32
+
+const (
+	authAccepted byte = 0
+	authRejected byte = 1
+)
+
+// NewTokenClientHandshaker returns a Handshaker that presents token, such as a bearer token, to a server
+// handshaker returned by NewTokenServerHandshaker, and fails with an error matching ErrAuthRejected should the
+// server reject it. As the token is sent as is, it should only be chained after a handshaker that encrypts the
+// connection via ChainHandshakers.
+func NewTokenClientHandshaker(token string) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		if len(token) > maxAuthMessageSize {
+			return nil, fmt.Errorf("token exceeds %d bytes: %w", maxAuthMessageSize, ErrMessageTooLarge)
+		}
+
+		bc := AsBufferedConn(conn)
+
+		err := writeAuthMessage(bc, []byte(token))
+		if err != nil {
+			return nil, err
+		}
+
+		return bc, readAuthResult(bc)
+	})
+}
+
+// NewTokenServerHandshaker returns a Handshaker that reads the token a client presents via a handshaker returned
+// by NewTokenClientHandshaker, and calls validate with it such that the connection is rejected before it is
+// handed to a Handler. Should validate return an error, the client is notified that it was rejected, and the
+// handshake fails with an error matching ErrAuthRejected.
+func NewTokenServerHandshaker(validate func(token string) error) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		bc := AsBufferedConn(conn)
+
+		token, err := readAuthMessage(bc)
+		if err != nil {
+			return nil, err
+		}
+
+		return bc, writeAuthResult(bc, validate(string(token)))
+	})
+}
+
+// NewPSKClientHandshaker returns a Handshaker that proves knowledge of the pre-shared key key registered for
+// identity to a server handshaker returned by NewPSKServerHandshaker, and fails with an error matching
+// ErrAuthRejected should the server reject the proof. The key is never sent. Rather, the server challenges the
+// client with a random nonce, over which the client computes an HMAC-SHA256 keyed with key, such that proofs may
+// not be replayed across connections.
+func NewPSKClientHandshaker(identity string, key []byte) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		if len(identity) > 255 {
+			return nil, errors.New("psk identity must be at most 255 bytes")
+		}
+
+		bc := AsBufferedConn(conn)
+
+		nonce, err := readAuthMessage(bc)
+		if err != nil {
+			return nil, err
+		}
+		if len(nonce) != pskNonceSize {
+			return nil, fmt.Errorf("psk nonce must be %d bytes, got %d bytes", pskNonceSize, len(nonce))
+		}
+
+		msg := append([]byte{byte(len(identity))}, identity...)
+		msg = append(msg, pskProof(key, nonce, identity)...)
+
+		err = writeAuthMessage(bc, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		return bc, readAuthResult(bc)
+	})
+}
+
+// NewPSKServerHandshaker returns a Handshaker that challenges a client handshaker returned by
+// NewPSKClientHandshaker to prove knowledge of the pre-shared key registered for the identity it claims, which
+// lookup returns. Should lookup return an error, or the client's proof not match, the client is notified that
+// it was rejected, and the handshake fails with an error matching ErrAuthRejected. The identity of clients that
+// are accepted is reported as their PeerInfo identity.
+func NewPSKServerHandshaker(lookup func(identity string) ([]byte, error)) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		bc := AsBufferedConn(conn)
+
+		nonce := make([]byte, pskNonceSize)
+
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		err = writeAuthMessage(bc, nonce)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		msg, err := readAuthMessage(bc)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+		if len(msg) == 0 || len(msg) != 1+int(msg[0])+sha256.Size {
+			return nil, PeerInfo{}, writeAuthResult(bc, errors.New("malformed psk proof"))
+		}
+
+		identity, proof := string(msg[1:1+msg[0]]), msg[1+msg[0]:]
+
+		key, err := lookup(identity)
+		if err == nil && !hmac.Equal(proof, pskProof(key, nonce, identity)) {
+			err = fmt.Errorf("invalid psk proof for identity %q", identity)
+		}
+
+		err = writeAuthResult(bc, err)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+		return bc, PeerInfo{Identity: identity}, nil
+	})
+}
+
+// pskProof computes the proof that the client claiming identity knows key, given the nonce the server challenged
+// it with.
+func pskProof(key, nonce []byte, identity string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("monte psk"))
+	mac.Write(nonce)
+	mac.Write([]byte(identity))
+	return mac.Sum(nil)
+}
+
+func writeAuthMessage(bc BufferedConn, msg []byte) error {
+	_, err := bc.Write(msg)
+	if err != nil {
+		return err
+	}
+	return bc.Flush()
+}
+
+// readAuthMessage reads a single message from bc. It relies on bc preserving message boundaries, as do the
+// BufferedConns established by the handshakers that authentication handshakers are chained after.
+func readAuthMessage(bc BufferedConn) ([]byte, error) {
+	buf := make([]byte, maxAuthMessageSize)
+	n, err := bc.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// writeAuthResult notifies our peer whether it was authenticated, and returns err wrapped such that it matches
+// ErrAuthRejected.
+func writeAuthResult(bc BufferedConn, err error) error {
+	result := authAccepted
+	if err != nil {
+		result = authRejected
+	}
+
+	werr := writeAuthMessage(bc, []byte{result})
+	if err != nil {
+		return wrapError(ErrAuthRejected, err)
+	}
+	return werr
+}
+
+// readAuthResult reads whether our peer authenticated us, and returns ErrAuthRejected should it not have.
+func readAuthResult(bc BufferedConn) error {
+	msg, err := readAuthMessage(bc)
+	if err != nil {
+		return err
+	}
+	if len(msg) != 1 || msg[0] != authAccepted {
+		return ErrAuthRejected
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+)
+
+// handshakePipe runs client and server handshakers over either end of an encrypted in-memory connection, and
+// returns the errors they fail with.
+func handshakePipe(t *testing.T, client, server Handshaker) (clientErr, serverErr error) {
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := ChainHandshakers(DefaultServerHandshaker, server).Handshake(bob)
+		errs <- err
+	}()
+
+	_, clientErr = ChainHandshakers(DefaultClientHandshaker, client).Handshake(alice)
+	return clientErr, <-errs
+}
+
+func TestTokenHandshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewTokenServerHandshaker(func(token string) error {
+		if token != "secret" {
+			return errors.New("unknown token")
+		}
+		return nil
+	})
+
+	clientErr, serverErr := handshakePipe(t, NewTokenClientHandshaker("secret"), server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	clientErr, serverErr = handshakePipe(t, NewTokenClientHandshaker("guess"), server)
+	require.True(t, errors.Is(clientErr, ErrAuthRejected))
+	require.True(t, errors.Is(serverErr, ErrAuthRejected))
+}
+
+func TestPSKHandshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	server := NewPSKServerHandshaker(func(identity string) ([]byte, error) {
+		if identity != "alice" {
+			return nil, errors.New("unknown identity")
+		}
+		return []byte("alice's key"), nil
+	})
+
+	clientErr, serverErr := handshakePipe(t, NewPSKClientHandshaker("alice", []byte("alice's key")), server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	// Clients that do not know the key of the identity they claim, or claim an unknown identity, are rejected.
+
+	clientErr, serverErr = handshakePipe(t, NewPSKClientHandshaker("alice", []byte("bob's key")), server)
+	require.True(t, errors.Is(clientErr, ErrAuthRejected))
+	require.True(t, errors.Is(serverErr, ErrAuthRejected))
+
+	clientErr, serverErr = handshakePipe(t, NewPSKClientHandshaker("bob", []byte("bob's key")), server)
+	require.True(t, errors.Is(clientErr, ErrAuthRejected))
+	require.True(t, errors.Is(serverErr, ErrAuthRejected))
+}
+
+func TestServerTokenHandshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{
+		Handler: EchoHandler{},
+		Handshaker: ChainHandshakers(DefaultServerHandshaker, NewTokenServerHandshaker(func(token string) error {
+			if token != "secret" {
+				return errors.New("unknown token")
+			}
+			return nil
+		})),
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{
+		Addr:       ln.Addr().String(),
+		Handshaker: ChainHandshakers(DefaultClientHandshaker, NewTokenClientHandshaker("secret")),
+	}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	rejected := &Client{
+		Addr:       ln.Addr().String(),
+		Handshaker: ChainHandshakers(DefaultClientHandshaker, NewTokenClientHandshaker("guess")),
+	}
+	defer rejected.Shutdown()
+
+	_, err = rejected.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrAuthRejected))
+}
+
+func TestServerPeerInfo(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	identities := make(chan string, 1)
+
+	srv := &Server{
+		Handshaker: ChainHandshakers(DefaultServerHandshaker, NewPSKServerHandshaker(func(identity string) ([]byte, error) {
+			return []byte("alice's key"), nil
+		})),
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply([]byte(ctx.Conn().Peer().Identity))
+		}),
+		OnConnect: func(conn *Conn) error {
+			identities <- conn.Peer().Identity
+			return nil
+		},
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{
+		Addr:       ln.Addr().String(),
+		Handshaker: ChainHandshakers(DefaultClientHandshaker, NewPSKClientHandshaker("alice", []byte("alice's key"))),
+	}
+	defer client.Shutdown()
+
+	// The identity authenticated by the handshake is carried through to connection callbacks and handlers.
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "alice", res)
+	require.Equal(t, "alice", <-identities)
+}
@@ -0,0 +1,96 @@
+//go:build go1.21
+// +build go1.21
+
+// Call and HandleCall are only built by Go 1.21 and later, which honor the go1.21 build constraint above in
+// raising the language version of this file past that of the module, such that the module itself may keep
+// supporting versions of Go that predate generics.
+
+package monte
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Call sends req, marshalled by the Codec of one of client's connections and prefixed with opcode op, as a
+// request for a handler registered via HandleCall with our peer's Mux, and returns its response unmarshalled into
+// a Resp. Should Resp be a pointer type, a value for it to point to is allocated. It otherwise behaves as
+// Client.RequestContext does.
+func Call[Req, Resp any](ctx context.Context, client *Client, op uint16, req Req) (Resp, error) {
+	var res Resp
+
+	conn, err := client.Get()
+	if err != nil {
+		return res, err
+	}
+
+	codec := conn.getCodec()
+
+	buf := acquireBuffer(0)
+	defer releaseBuffer(buf)
+
+	buf.B, err = codec.Marshal(AppendOp(buf.B, op, nil), req)
+	if err != nil {
+		return res, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	// The request is copied into a frame of its own once sent, such that its buffer may be reused for the
+	// response.
+
+	buf.B, err = conn.RequestContext(ctx, buf.B[:0], buf.B)
+	if err != nil {
+		return res, err
+	}
+
+	res, err = decodeValue[Resp](codec, buf.B)
+	if err != nil {
+		return res, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return res, nil
+}
+
+// HandleCall registers fn with mux as the handler for requests with opcode op sent via Call, which are
+// unmarshalled into a Req by the Codec of the connection they were sent over. Should fn return an error, or the
+// request fail to be unmarshalled, the request is rejected via Context.Reject. The Resp fn returns is otherwise
+// marshalled and sent as the request's response. Messages that are not requests are passed to fn, though what it
+// returns is dropped.
+func HandleCall[Req, Resp any](mux *Mux, op uint16, fn func(ctx *Context, req Req) (Resp, error)) {
+	mux.HandleFunc(op, func(ctx *Context) error {
+		codec := ctx.Conn().getCodec()
+
+		req, err := decodeValue[Req](codec, ctx.Body())
+		if err != nil {
+			return ignoreStale(ctx.Reject(fmt.Errorf("failed to decode request: %w", err)))
+		}
+
+		res, err := fn(ctx, req)
+		if ctx.Seq() == 0 {
+			return nil
+		}
+		if err != nil {
+			return ignoreStale(ctx.Reject(err))
+		}
+
+		buf := acquireBuffer(0)
+		defer releaseBuffer(buf)
+
+		buf.B, err = codec.Marshal(buf.B, res)
+		if err != nil {
+			return ignoreStale(ctx.Reject(fmt.Errorf("failed to encode response: %w", err)))
+		}
+		return ignoreStale(ctx.Reply(buf.B))
+	})
+}
+
+// decodeValue unmarshals buf into a T via codec. Should T be a pointer type, a value for it to point to is
+// allocated and unmarshalled into, rather than a pointer to a nil pointer.
+func decodeValue[T any](codec Codec, buf []byte) (T, error) {
+	var v T
+	var dst interface{} = &v
+	if t := reflect.TypeOf(&v).Elem(); t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem()).Interface().(T)
+		dst = v
+	}
+	return v, codec.Unmarshal(buf, dst)
+}
@@ -0,0 +1,106 @@
+//go:build go1.21
+// +build go1.21
+
+package monte
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+)
+
+type sumRequest struct {
+	Values []int `json:"values"`
+}
+
+type sumResponse struct {
+	Sum int `json:"sum"`
+}
+
+func TestCall(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var mux Mux
+
+	HandleCall(&mux, 1, func(ctx *Context, req sumRequest) (*sumResponse, error) {
+		if len(req.Values) == 0 {
+			return nil, errors.New("nothing to sum")
+		}
+		res := &sumResponse{}
+		for _, v := range req.Values {
+			res.Sum += v
+		}
+		return res, nil
+	})
+
+	server := &Server{Handler: &mux}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	// Pointer and non-pointer response types are both decoded into.
+
+	res, err := Call[sumRequest, *sumResponse](context.Background(), client, 1, sumRequest{Values: []int{1, 2, 3}})
+	require.NoError(t, err)
+	require.Equal(t, 6, res.Sum)
+
+	sum, err := Call[sumRequest, sumResponse](context.Background(), client, 1, sumRequest{Values: []int{4, 5}})
+	require.NoError(t, err)
+	require.Equal(t, 9, sum.Sum)
+
+	_, err = Call[sumRequest, sumResponse](context.Background(), client, 1, sumRequest{})
+	require.True(t, errors.Is(err, ErrRequestRejected))
+	require.Contains(t, err.Error(), "nothing to sum")
+
+	// Requests that may not be decoded into the handler's request type are rejected.
+
+	_, err = Call[string, sumResponse](context.Background(), client, 1, "hello")
+	require.True(t, errors.Is(err, ErrRequestRejected))
+	require.Contains(t, err.Error(), "failed to decode request")
+}
+
+func TestCallProtoCodec(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var mux Mux
+
+	HandleCall(&mux, 1, func(ctx *Context, req *echoMessage) (*vtEchoMessage, error) {
+		return &vtEchoMessage{echoMessage{Text: req.Text + " world"}}, nil
+	})
+
+	server := &Server{Handler: &mux, Codec: ProtoCodec{}}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String(), Codec: ProtoCodec{}}
+	defer client.Shutdown()
+
+	res, err := Call[*echoMessage, *echoMessage](context.Background(), client, 1, &echoMessage{Text: "hello"})
+	require.NoError(t, err)
+	require.Equal(t, "hello world", res.Text)
+}
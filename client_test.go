@@ -1,11 +1,15 @@
 package monte
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -37,6 +41,538 @@ func TestClientHandshakeTimeout(t *testing.T) {
 	}
 }
 
+func TestClientWarmup(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	handshakes := uint32(0)
+
+	handshaker := func(conn net.Conn) (BufferedConn, error) {
+		atomic.AddUint32(&handshakes, 1)
+		return DefaultClientHandshaker(conn)
+	}
+
+	server := &Server{Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply(ctx.Body()) })}
+	client := &Client{Addr: ln.Addr().String(), Handshaker: HandshakerFunc(handshaker), MaxConns: 2}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	require.NoError(t, client.Warmup(ctx, 4))
+	require.EqualValues(t, 2, atomic.LoadUint32(&handshakes))
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, []byte("hello"), res)
+
+	require.EqualValues(t, 2, atomic.LoadUint32(&handshakes))
+}
+
+func TestClientWarmupUnreachable(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	client := &Client{Addr: addr, WarmupRetryInterval: 10 * time.Millisecond}
+	defer client.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	err = client.Warmup(ctx, 1)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Contains(t, err.Error(), "last error")
+}
+
+func TestClientOnError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+
+	// Every failed dial attempt is reported, as no connection is established over which to report it.
+
+	var errs []error
+
+	client := &Client{
+		Addr:            ln.Addr().String(),
+		NumDialAttempts: 2,
+		DialBackoff:     time.Millisecond,
+		OnError: func(conn *Conn, err error) {
+			require.Nil(t, conn)
+			errs = append(errs, err)
+		},
+	}
+	defer client.Shutdown()
+
+	require.Error(t, client.Send([]byte("hello")))
+	require.Len(t, errs, 2)
+	for _, err := range errs {
+		var opErr *net.OpError
+		require.True(t, errors.As(err, &opErr))
+	}
+}
+
+func TestClientDialBackoff(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	// The first three handshakes fail, such that the client backs off for 5-10ms, 10-20ms, then 20-40ms.
+
+	handshakes := uint32(0)
+
+	handshaker := func(conn net.Conn) (BufferedConn, error) {
+		if atomic.AddUint32(&handshakes, 1) <= 3 {
+			return nil, errors.New("handshake failed")
+		}
+		return DefaultClientHandshaker(conn)
+	}
+
+	server := &Server{Handler: EchoHandler{}}
+	client := &Client{
+		Addr:            ln.Addr().String(),
+		Handshaker:      HandshakerFunc(handshaker),
+		NumDialAttempts: 5,
+		DialBackoff:     10 * time.Millisecond,
+		MaxDialBackoff:  40 * time.Millisecond,
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	start := time.Now()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(35*time.Millisecond))
+	require.EqualValues(t, 4, atomic.LoadUint32(&handshakes))
+
+	for i := 1; i <= 8; i++ {
+		d := client.dialBackoff(i)
+		require.LessOrEqual(t, int64(d), int64(40*time.Millisecond))
+		require.GreaterOrEqual(t, int64(d), int64(5*time.Millisecond))
+	}
+}
+
+func TestClientDialBackoffShutdown(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	client := &Client{Addr: addr, NumDialAttempts: 100, DialBackoff: time.Hour}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Shutdown()
+	}()
+
+	_, err = client.Request(nil, []byte("hello"))
+	require.Error(t, err)
+}
+
+// pipeListener is a net.Listener that accepts in-memory connections dialed via its DialContext.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (ln *pipeListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *pipeListener) Close() error {
+	ln.once.Do(func() { close(ln.closed) })
+	return nil
+}
+
+func (ln *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestClientDialer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln := newPipeListener()
+
+	srv := &Server{Handler: EchoHandler{}}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	var dialed []string
+
+	client := &Client{
+		Addr: "example.com:4444",
+		Dialer: DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+addr)
+			return ln.DialContext(ctx, network, addr)
+		}),
+	}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+	require.Equal(t, []string{"tcp example.com:4444"}, dialed)
+}
+
+func TestClientFailover(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	serve := func(ln net.Listener, name string) *Server {
+		srv := &Server{Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply([]byte(name)) })}
+		go func() {
+			require.NoError(t, srv.Serve(ln))
+		}()
+		return srv
+	}
+
+	// The primary address is unreachable until it is listened on again later.
+
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, primary.Close())
+
+	backup, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	backupSrv := serve(backup, "backup")
+	defer func() {
+		backupSrv.Shutdown()
+		require.NoError(t, backup.Close())
+	}()
+
+	client := &Client{
+		Addr:             primary.Addr().String(),
+		BackupAddrs:      []string{backup.Addr().String()},
+		FailbackInterval: 10 * time.Millisecond,
+		NumDialAttempts:  1,
+	}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "backup", res)
+
+	// Once the primary address is reachable again, the client fails back to it.
+
+	ln, err := net.Listen("tcp", primary.Addr().String())
+	require.NoError(t, err)
+
+	primarySrv := serve(ln, "primary")
+	defer func() {
+		primarySrv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	require.Eventually(t, func() bool {
+		res, err := client.Request(nil, []byte("hello"))
+		return err == nil && string(res) == "primary"
+	}, time.Second, time.Millisecond)
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	require.Zero(t, client.addrIndex)
+	require.False(t, client.probing)
+}
+
+func TestClientResolve(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	serve := func(name string) (string, func()) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv := &Server{Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply([]byte(name)) })}
+		go func() {
+			require.NoError(t, srv.Serve(ln))
+		}()
+
+		return ln.Addr().String(), func() {
+			srv.Shutdown()
+			require.NoError(t, ln.Close())
+		}
+	}
+
+	a, closeA := serve("a")
+	defer closeA()
+
+	b, closeB := serve("b")
+	defer closeB()
+
+	var (
+		mu        sync.Mutex
+		endpoints = []string{a}
+	)
+
+	setEndpoints := func(addrs ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		endpoints = addrs
+	}
+
+	client := &Client{
+		Addr:            "service.example.com:4444",
+		ResolveInterval: 10 * time.Millisecond,
+		Resolver: ResolverFunc(func(ctx context.Context, addr string) ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), endpoints...), nil
+		}),
+	}
+	defer client.Shutdown()
+
+	connected := func(addr string) int {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+
+		n := 0
+		for _, cc := range client.conns {
+			if cc.addr == addr {
+				n++
+			}
+		}
+		return n
+	}
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "a", res)
+
+	// Endpoints that are newly resolved are connected to.
+
+	setEndpoints(a, b)
+	require.Eventually(t, func() bool { return connected(b) == 1 }, time.Second, time.Millisecond)
+
+	// Connections to endpoints that are no longer resolved are drained, and new connections are dialed to the
+	// endpoints that remain.
+
+	setEndpoints(b)
+	require.Eventually(t, func() bool { return connected(a) == 0 }, time.Second, time.Millisecond)
+
+	for i := 0; i < 8; i++ {
+		res, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, "b", res)
+	}
+}
+
+func TestClientBalancer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	var (
+		mu     sync.Mutex
+		counts = make(map[*Conn]int)
+	)
+
+	server := &Server{Handler: HandlerFunc(func(ctx *Context) error {
+		mu.Lock()
+		counts[ctx.Conn()]++
+		mu.Unlock()
+		return ctx.Reply(ctx.Body())
+	})}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Idle connections are favored in the order they were dialed by default, whereas requests are spread evenly
+	// across connections when balanced round-robin.
+
+	for _, test := range []struct {
+		balancer Balancer
+		expected []int
+	}{
+		{balancer: nil, expected: []int{0, 0, 9}},
+		{balancer: RoundRobinBalancer(), expected: []int{3, 3, 3}},
+	} {
+		client := &Client{Addr: ln.Addr().String(), MaxConns: 3, Balancer: test.balancer}
+		require.NoError(t, client.Warmup(ctx, 3))
+
+		mu.Lock()
+		counts = make(map[*Conn]int)
+		mu.Unlock()
+
+		for i := 0; i < 9; i++ {
+			res, err := client.Request(nil, []byte("hello"))
+			require.NoError(t, err)
+			require.EqualValues(t, "hello", res)
+		}
+
+		client.Shutdown()
+
+		mu.Lock()
+		actual := make([]int, 0, 3)
+		for _, n := range counts {
+			actual = append(actual, n)
+		}
+		for len(actual) < 3 {
+			actual = append(actual, 0)
+		}
+		sort.Ints(actual)
+		mu.Unlock()
+
+		require.EqualValues(t, test.expected, actual)
+	}
+}
+
+func TestClientOnConnectOnDisconnect(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	received := make(chan string, 2)
+
+	server := &Server{Handler: HandlerFunc(func(ctx *Context) error {
+		received <- string(ctx.Body())
+		return ctx.Reply(ctx.Body())
+	})}
+
+	connected := make(chan *Conn, 1)
+	disconnected := make(chan error, 1)
+
+	client := &Client{
+		Addr: ln.Addr().String(),
+		OnConnect: func(conn *Conn) error {
+			connected <- conn
+			return conn.Send([]byte("auth"))
+		},
+		OnDisconnect: func(conn *Conn, err error) {
+			disconnected <- err
+		},
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		client.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+	require.Equal(t, conn, <-connected)
+
+	require.EqualValues(t, "auth", <-received)
+	require.EqualValues(t, "hello", <-received)
+
+	server.Shutdown()
+
+	require.True(t, errors.Is(<-disconnected, ErrPeerGoodbye))
+}
+
+func TestClientOnConnectError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	errOnConnect := errors.New("on connect failed")
+
+	var server Server
+
+	client := &Client{
+		Addr:      ln.Addr().String(),
+		OnConnect: func(conn *Conn) error { return errOnConnect },
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	require.True(t, errors.Is(client.Send([]byte("hello")), errOnConnect))
+}
+
 func TestClientSend(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -47,9 +583,151 @@ func TestClientSend(t *testing.T) {
 	ln, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
 
-	var server Server
+	var server Server
+
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+		require.EqualValues(t, 0, atomic.LoadUint32(&c))
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < m; j++ {
+				require.NoError(t, client.Send([]byte(fmt.Sprintf("[%d] hello %d", i, j))))
+				atomic.AddUint32(&c, ^uint32(0))
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestClientRequest(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	n := 4
+	m := 1024
+	c := uint32(n * m * 2)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	handler := func(ctx *Context) error {
+		atomic.AddUint32(&c, ^uint32(0))
+		return ctx.Reply([]byte("a reply!"))
+	}
+
+	var server Server
+	server.Handler = HandlerFunc(handler)
+
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+		require.EqualValues(t, 0, atomic.LoadUint32(&c))
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < m; j++ {
+				res, err := client.Request(nil, []byte(fmt.Sprintf("[%d] hello %d", i, j)))
+				require.NoError(t, err)
+				require.EqualValues(t, []byte("a reply!"), res)
+				atomic.AddUint32(&c, ^uint32(0))
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestClientRequestRouting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	// Every connection assigns sequence numbers independently, such that the same sequence numbers are in use
+	// across multiple connections at once. Responses must still only be routed to their own requests.
+
+	server := &Server{Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply(ctx.Body()) })}
+	client := &Client{Addr: ln.Addr().String(), MaxConns: 4}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	n := 8
+	m := 256
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < m; j++ {
+				req := []byte(fmt.Sprintf("[%d] hello %d", i, j))
+				res, err := client.Request(nil, req)
+				require.NoError(t, err)
+				require.EqualValues(t, req, res)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestClientRequestLargeResponses(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	large := make([]byte, 64*1024)
+	_, err = rand.Read(large)
+	require.NoError(t, err)
+
+	handler := func(ctx *Context) error {
+		if string(ctx.Body()) == "large" {
+			return ctx.Reply(large)
+		}
+		return ctx.Reply(ctx.Body())
+	}
 
-	client := &Client{Addr: ln.Addr().String()}
+	server := &Server{Handler: HandlerFunc(handler), ReadBufferSize: 1024}
+	client := &Client{Addr: ln.Addr().String(), ReadBufferSize: 1024, MaxConns: 1}
 
 	go func() {
 		require.NoError(t, server.Serve(ln))
@@ -60,9 +738,11 @@ func TestClientSend(t *testing.T) {
 		client.Shutdown()
 
 		require.NoError(t, ln.Close())
-		require.EqualValues(t, 0, atomic.LoadUint32(&c))
 	}()
 
+	n := 4
+	m := 64
+
 	var wg sync.WaitGroup
 	wg.Add(n)
 
@@ -70,8 +750,16 @@ func TestClientSend(t *testing.T) {
 		go func(i int) {
 			defer wg.Done()
 			for j := 0; j < m; j++ {
-				require.NoError(t, client.Send([]byte(fmt.Sprintf("[%d] hello %d", i, j))))
-				atomic.AddUint32(&c, ^uint32(0))
+				if (i+j)%4 == 0 {
+					res, err := client.Request(nil, []byte("large"))
+					require.NoError(t, err)
+					require.EqualValues(t, large, res)
+					continue
+				}
+				req := []byte(fmt.Sprintf("[%d] hello %d", i, j))
+				res, err := client.Request(nil, req)
+				require.NoError(t, err)
+				require.EqualValues(t, req, res)
 			}
 		}(i)
 	}
@@ -79,24 +767,66 @@ func TestClientSend(t *testing.T) {
 	wg.Wait()
 }
 
-func TestClientRequest(t *testing.T) {
+func TestClientRequestFrameTooLarge(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
-	n := 4
-	m := 1024
-	c := uint32(n * m * 2)
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply(make([]byte, 2048)) })}
+	client := &Client{Addr: ln.Addr().String(), MaxFrameSize: 1024}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	_, err = client.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestClientRequestCancel(t *testing.T) {
+	defer goleak.VerifyNone(t)
 
 	ln, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
 
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+
 	handler := func(ctx *Context) error {
-		atomic.AddUint32(&c, ^uint32(0))
-		return ctx.Reply([]byte("a reply!"))
+		if string(ctx.Body()) != "hello" {
+			return ctx.Reply(ctx.Body())
+		}
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+
+		// Replies to cancelled requests are dropped rather than sent to a sender that is no longer waiting.
+
+		if err := ctx.Reply([]byte("orphaned")); !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("expected reply to be dropped, got: %w", err)
+		}
+		return nil
 	}
 
-	var server Server
-	server.Handler = HandlerFunc(handler)
+	var responses uint32
 
+	server := &Server{
+		Handler:            HandlerFunc(handler),
+		ConcurrentHandlers: true,
+		OnWrite: func(frame []byte) {
+			if bytes.HasSuffix(frame, []byte("orphaned")) {
+				atomic.AddUint32(&responses, 1)
+			}
+		},
+	}
 	client := &Client{Addr: ln.Addr().String()}
 
 	go func() {
@@ -108,25 +838,196 @@ func TestClientRequest(t *testing.T) {
 		client.Shutdown()
 
 		require.NoError(t, ln.Close())
-		require.EqualValues(t, 0, atomic.LoadUint32(&c))
 	}()
 
-	var wg sync.WaitGroup
-	wg.Add(n)
+	ctx, cancel := context.WithCancel(context.Background())
 
-	for i := 0; i < n; i++ {
-		go func(i int) {
-			defer wg.Done()
-			for j := 0; j < m; j++ {
-				res, err := client.Request(nil, []byte(fmt.Sprintf("[%d] hello %d", i, j)))
-				require.NoError(t, err)
-				require.EqualValues(t, []byte("a reply!"), res)
-				atomic.AddUint32(&c, ^uint32(0))
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err = client.RequestContext(ctx, nil, []byte("hello"))
+	require.True(t, errors.Is(err, context.Canceled))
+
+	select {
+	case err := <-cancelled:
+		require.True(t, errors.Is(err, context.Canceled))
+	case <-time.After(1 * time.Second):
+		t.Fatal("server handler was not cancelled")
+	}
+
+	// The connection remains usable after a request on it has been cancelled.
+
+	res, err := client.Request(nil, []byte("world"))
+	require.NoError(t, err)
+	require.EqualValues(t, "world", res)
+
+	require.EqualValues(t, 0, atomic.LoadUint32(&responses))
+}
+
+func TestClientRequestDeadline(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	timeout := 100 * time.Millisecond
+
+	type result struct {
+		deadline time.Duration
+		ok       bool
+		err      error
+		reply    error
+	}
+
+	handled := make(chan result, 1)
+
+	handler := func(ctx *Context) error {
+		var res result
+
+		deadline, ok := ctx.Deadline()
+		res.deadline, res.ok = time.Until(deadline), ok
+
+		<-ctx.Done()
+		res.err = ctx.Err()
+		res.reply = ctx.Reply([]byte("late"))
+
+		handled <- res
+		return nil
+	}
+
+	server := &Server{Handler: HandlerFunc(handler)}
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err = client.RequestContext(ctx, nil, []byte("hello"))
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// Wait for the handler to observe the deadline before shutting down the server, which would otherwise
+	// cancel the handler's context first.
+
+	res := <-handled
+	require.True(t, res.ok)
+	require.True(t, res.deadline <= timeout)
+	require.True(t, errors.Is(res.err, context.DeadlineExceeded))
+	require.True(t, errors.Is(res.reply, ErrRequestTimeout))
+	require.True(t, errors.Is(res.reply, context.DeadlineExceeded))
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{
+		Handler: HandlerFunc(func(ctx *Context) error {
+			if string(ctx.Body()) == "slow" {
+				select {
+				case <-time.After(200 * time.Millisecond):
+				case <-ctx.Done():
+					return nil
+				}
 			}
-		}(i)
+			return ignoreStale(ctx.Reply(ctx.Body()))
+		}),
+		ConcurrentHandlers: true,
 	}
 
-	wg.Wait()
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String(), RequestTimeout: 50 * time.Millisecond}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("fast"))
+	require.NoError(t, err)
+	require.EqualValues(t, "fast", res)
+
+	// Requests that are not responded to in time fail, and are no longer pending.
+
+	_, err = client.Request(nil, []byte("slow"))
+	require.True(t, errors.Is(err, ErrRequestTimeout))
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+	require.Empty(t, conn.PendingRequests())
+
+	// A deadline passed via RequestContext overrides RequestTimeout.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err = client.RequestContext(ctx, nil, []byte("slow"))
+	require.NoError(t, err)
+	require.EqualValues(t, "slow", res)
+}
+
+func TestClientRequestHandlerTimeout(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		t.Run(fmt.Sprintf("concurrent=%t", concurrent), func(t *testing.T) {
+			defer goleak.VerifyNone(t)
+
+			ln, err := net.Listen("tcp", ":0")
+			require.NoError(t, err)
+
+			timeout := 50 * time.Millisecond
+
+			// The handler sleeps well past its timeout without observing its context.
+
+			replied := make(chan error, 1)
+
+			handler := func(ctx *Context) error {
+				time.Sleep(4 * timeout)
+				replied <- ctx.Reply([]byte("late"))
+				return nil
+			}
+
+			server := &Server{Handler: HandlerFunc(handler), HandlerTimeout: timeout, ConcurrentHandlers: concurrent}
+			client := &Client{Addr: ln.Addr().String()}
+
+			go func() {
+				require.NoError(t, server.Serve(ln))
+			}()
+
+			defer func() {
+				server.Shutdown()
+				client.Shutdown()
+
+				require.NoError(t, ln.Close())
+			}()
+
+			start := time.Now()
+
+			_, err = client.Request(nil, []byte("hello"))
+			require.True(t, errors.Is(err, ErrHandlerTimeout))
+			require.True(t, errors.Is(err, ErrRequestTimeout))
+			require.Less(t, int64(time.Since(start)), int64(4*timeout))
+
+			err = <-replied
+			require.True(t, errors.Is(err, ErrRequestTimeout))
+		})
+	}
 }
 
 func BenchmarkSend(b *testing.B) {
@@ -356,3 +1257,166 @@ func BenchmarkParallelRequest(b *testing.B) {
 		}
 	})
 }
+
+func TestClientEchoHandler(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{Handler: EchoHandler{}}
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	// Messages that are not requests are not echoed back.
+
+	require.NoError(t, client.Send([]byte("ignored")))
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+}
+
+func BenchmarkEcho(b *testing.B) {
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(b, err)
+
+	server := &Server{Handler: EchoHandler{}}
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(b, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(b, ln.Close())
+	}()
+
+	buf := make([]byte, 128)
+	_, err = rand.Read(buf)
+	require.NoError(b, err)
+
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	start := time.Now()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var res []byte
+		for pb.Next() {
+			var err error
+			res, err = client.Request(res[:0], buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !bytes.Equal(res, buf) {
+				b.Fatalf("expected echoed response, got '%s'", string(res))
+			}
+		}
+	})
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "req/s")
+}
+
+func TestClientFailFastIfDisconnected(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	client := &Client{Addr: addr, FailFastIfDisconnected: true, DialTimeout: time.Second}
+	defer client.Shutdown()
+
+	start := time.Now()
+
+	_, err = client.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrNotConnected))
+	require.True(t, errors.Is(client.Send([]byte("hello")), ErrNotConnected))
+
+	require.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+}
+
+func TestClientFailFastIfDisconnectedOnceConnected(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{Handler: EchoHandler{}}
+	client := &Client{Addr: ln.Addr().String(), FailFastIfDisconnected: true}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	require.NoError(t, client.Warmup(context.Background(), 1))
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+}
+
+func TestClientUnsolicitedMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	pushed := make(chan []byte, 1)
+
+	// The server pushes a message as soon as a client connects, and otherwise echoes requests.
+
+	server := &Server{
+		Handler:   EchoHandler{},
+		OnConnect: func(conn *Conn) error { return conn.SendNoWait([]byte("pushed")) },
+	}
+	client := &Client{
+		Addr: ln.Addr().String(),
+		Handler: HandlerFunc(func(ctx *Context) error {
+			require.Zero(t, ctx.Seq())
+			pushed <- append([]byte(nil), ctx.Body()...)
+			return nil
+		}),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	require.EqualValues(t, "pushed", <-pushed)
+}
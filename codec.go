@@ -0,0 +1,49 @@
+package monte
+
+import "encoding/json"
+
+var DefaultCodec Codec = JSONCodec{}
+
+// Codec marshals the values sent as the payloads of requests and responses via Call, and unmarshals the values
+// handled via HandleCall, such that requests may be typed without having to hand-roll their encoding. A Codec
+// must be safe for concurrent use.
+type Codec interface {
+	// Marshal appends the encoding of v to dst.
+	Marshal(dst []byte, v interface{}) ([]byte, error)
+
+	// Unmarshal decodes buf into v, which is a pointer. It must not retain buf.
+	Unmarshal(buf []byte, v interface{}) error
+}
+
+// NamedCodec is a Codec that may be negotiated by a version handshake. Name identifies it to our peer, which must
+// support a codec of the same name that encodes values the same way. See Capabilities.Codecs.
+type NamedCodec struct {
+	Name  string
+	Codec Codec
+}
+
+// JSONNamedCodec returns a NamedCodec named "json" that encodes values via JSONCodec.
+func JSONNamedCodec() NamedCodec { return NamedCodec{Name: "json", Codec: JSONCodec{}} }
+
+// MsgpackNamedCodec returns a NamedCodec named "msgpack" that encodes values via MsgpackCodec.
+func MsgpackNamedCodec() NamedCodec { return NamedCodec{Name: "msgpack", Codec: MsgpackCodec{}} }
+
+// ProtoNamedCodec returns a NamedCodec named "proto" that encodes values via ProtoCodec.
+func ProtoNamedCodec() NamedCodec { return NamedCodec{Name: "proto", Codec: ProtoCodec{}} }
+
+var _ Codec = JSONCodec{}
+
+// JSONCodec is a Codec that encodes values as JSON via encoding/json.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, buf...), nil
+}
+
+func (JSONCodec) Unmarshal(buf []byte, v interface{}) error {
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,114 @@
+package monte
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// compressionIdentity is the name of the lack of compression, which is always offered and is picked should our
+// peer support none of the compressors offered. Naming it ensures that no message exchanged during a compression
+// handshake is empty, as empty writes may not be sent at all over conns that do not frame messages.
+const compressionIdentity = "identity"
+
+// maxCompressorsSize is the maximum size of the list of compressors that may be offered during a compression
+// handshake.
+const maxCompressorsSize = 1024
+
+// Compressor is a compression algorithm that may be negotiated by a compression handshake. Name identifies it to
+// our peer, and must neither contain a comma nor be "identity". Decorator wraps the established connection such
+// that messages are compressed with it. Algorithms such as snappy or zstd may be negotiated by wrapping their
+// implementations in a Decorator.
+type Compressor struct {
+	Name      string
+	Decorator Decorator
+}
+
+// DeflateCompressor returns a Compressor named "deflate" that compresses messages at the given level via a
+// FlateConn. See FlateDecorator.
+func DeflateCompressor(level int) Compressor {
+	return Compressor{Name: "deflate", Decorator: FlateDecorator(level)}
+}
+
+// NewCompressionClientHandshaker returns a Handshaker that offers cs to our peer in order of preference, and
+// wraps the connection with whichever of them our peer picks via NewCompressionServerHandshaker. Should our peer
+// support none of cs, messages are left uncompressed.
+//
+// As compressed messages leak information about their contents through their size, it should be chained after
+// an encrypting handshaker only when payloads never mix secrets with data an attacker controls.
+func NewCompressionClientHandshaker(cs ...Compressor) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		bc := AsBufferedConn(conn)
+
+		names := make([][]byte, 0, len(cs)+1)
+		for _, c := range cs {
+			names = append(names, []byte(c.Name))
+		}
+		names = append(names, []byte(compressionIdentity))
+		if err := writeCompressors(bc, bytes.Join(names, []byte(","))); err != nil {
+			return nil, err
+		}
+
+		name, err := readMessageFrom(bc, nil, maxCompressorsSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read picked compressor: %w", err)
+		}
+		if string(name) == compressionIdentity {
+			return bc, nil
+		}
+		for _, c := range cs {
+			if c.Name == string(name) {
+				return c.Decorator.Decorate(bc), nil
+			}
+		}
+		return nil, fmt.Errorf("peer picked compressor %q, which was not offered", name)
+	})
+}
+
+// NewCompressionServerHandshaker returns a Handshaker that picks the first of cs that our peer offered via
+// NewCompressionClientHandshaker, and wraps the connection with it. Should our peer have offered none of cs,
+// messages are left uncompressed.
+func NewCompressionServerHandshaker(cs ...Compressor) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		bc := AsBufferedConn(conn)
+
+		offered, err := readMessageFrom(bc, nil, maxCompressorsSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offered compressors: %w", err)
+		}
+
+		var picked *Compressor
+	search:
+		for i := range cs {
+			for _, name := range bytes.Split(offered, []byte(",")) {
+				if cs[i].Name == string(name) {
+					picked = &cs[i]
+					break search
+				}
+			}
+		}
+
+		if picked == nil {
+			if err := writeCompressors(bc, []byte(compressionIdentity)); err != nil {
+				return nil, err
+			}
+			return bc, nil
+		}
+		if err := writeCompressors(bc, []byte(picked.Name)); err != nil {
+			return nil, err
+		}
+		return picked.Decorator.Decorate(bc), nil
+	})
+}
+
+// writeCompressors writes and flushes the names of compressors offered or picked during a compression
+// handshake.
+func writeCompressors(conn BufferedConn, names []byte) error {
+	if _, err := conn.Write(names); err != nil {
+		return fmt.Errorf("failed to write compressors: %w", err)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to write compressors: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package monte
+
+import (
+	"compress/flate"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+)
+
+func TestCompressionHandshake(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	noop := Compressor{Name: "noop", Decorator: DecoratorFunc(func(conn BufferedConn) BufferedConn { return conn })}
+	deflate := DeflateCompressor(flate.BestSpeed)
+
+	handshake := func(client, server Handshaker) (BufferedConn, BufferedConn) {
+		alice, bob := net.Pipe()
+		t.Cleanup(func() {
+			_ = alice.Close()
+			_ = bob.Close()
+		})
+
+		type result struct {
+			conn BufferedConn
+			err  error
+		}
+
+		done := make(chan result)
+		go func() {
+			conn, err := server.Handshake(bob)
+			done <- result{conn, err}
+		}()
+
+		a, err := client.Handshake(alice)
+		require.NoError(t, err)
+
+		b := <-done
+		require.NoError(t, b.err)
+
+		return a, b.conn
+	}
+
+	// The server picks the first of its compressors that the client offered.
+
+	a, b := handshake(
+		NewCompressionClientHandshaker(noop, deflate),
+		NewCompressionServerHandshaker(deflate, noop),
+	)
+	require.IsType(t, (*FlateConn)(nil), a)
+	require.IsType(t, (*FlateConn)(nil), b)
+
+	written := make(chan error)
+	go func() {
+		_, err := a.Write([]byte("hello world"))
+		written <- err
+	}()
+
+	msg, err := readMessageFrom(b, nil, 1024)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello world", msg)
+	require.NoError(t, <-written)
+
+	// Messages are left uncompressed should the client and server share no compressor.
+
+	a, b = handshake(NewCompressionClientHandshaker(noop), NewCompressionServerHandshaker(deflate))
+	require.IsType(t, unbufferedConn{}, a)
+	require.IsType(t, unbufferedConn{}, b)
+
+	a, b = handshake(NewCompressionClientHandshaker(), NewCompressionServerHandshaker())
+	require.IsType(t, unbufferedConn{}, a)
+	require.IsType(t, unbufferedConn{}, b)
+}
@@ -1,50 +1,379 @@
 package monte
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/lithdew/bytesutil"
-	"github.com/valyala/bytebufferpool"
 	"io"
+	"net"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var DefaultSeqOffset uint32 = 1
 var DefaultSeqDelta uint32 = 2
+var DefaultMaxFrameSize = 1024 * 1024
+var DefaultMaxMessageSize = 16 * 1024 * 1024
+var DefaultMaxMissedPongs = 3
+var DefaultMaxFlushRetries = 3
+var DefaultMinKeepAliveInterval = time.Second
+
+// MinFrameSize is the smallest MaxFrameSize a Conn runs with, such that the header of every fragment fits within a
+// frame with room to spare for its payload. Smaller sizes, be they configured or negotiated, are raised to it.
+const MinFrameSize = 512
+
+// Priority designates the order in which queued messages are written.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+)
 
 type Conn struct {
+	counters connCounters // kept first such that its counters are 64-bit aligned on 32-bit platforms
+
 	Handler Handler
 
+	// StreamHandler, if set, handles messages our peer writes in fragments as their fragments arrive, rather than
+	// Handler handling them once they have been reassembled. Messages written via WriteFrom that fit within a
+	// single frame are still handled by Handler. StreamHandler is called from a goroutine of its own regardless
+	// of ConcurrentHandlers, with a Context whose Body is empty, and is not wrapped by middleware. The read loop
+	// blocks until each fragment is read or StreamHandler returns, such that StreamHandler must not wait on
+	// responses to requests of its own before having read the message in its entirety. MaxMessageSize does not
+	// apply to messages handled by StreamHandler.
+	StreamHandler StreamHandler
+
 	ReadBufferSize  int
 	WriteBufferSize int
 
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// IdleTimeout, if positive, closes the connection with an error matching ErrIdleTimeout should no frame be
+	// read from our peer within it, such that peers that abandoned the connection do not hold on to it forever.
+	// Should ReadTimeout be positive and shorter, ReadTimeout elapses first. Pings and pongs count as frames, such
+	// that peers that keep the connection alive via KeepAliveInterval are never considered idle.
+	IdleTimeout time.Duration
+
+	// RequestTimeout, if positive, bounds how long requests wait for their response, after which they fail with
+	// an error matching ErrRequestTimeout and their sequence number is freed. Unlike ReadTimeout and
+	// WriteTimeout, it bounds the lifetime of a request rather than that of an I/O operation. It may be
+	// overridden per request by passing a context with a deadline to RequestContext.
+	RequestTimeout time.Duration
+
+	// Framer, if set, frames every message written to and read from the conn passed to Handle via a FramedConn,
+	// for conns that do not preserve message boundaries, or whose peer expects messages to be framed a certain
+	// way. Both ends of a connection must be framed the same way.
+	Framer Framer
+
+	// OnConnect, if set, is called once the connection has been established and its read and write loops have
+	// started, before the connection is made available for use. Should it return an error, the connection is
+	// closed.
+	OnConnect func(conn *Conn) error
+
+	// OnDisconnect, if set, is called with the reason the connection was closed once its read and write loops
+	// have exited.
+	OnDisconnect func(conn *Conn, err error)
+
+	// OnError, if set, is called with errors that the connection otherwise suppresses as they do not warrant
+	// closing it, such as failures to notify our peer that a request was cancelled. Errors that close the
+	// connection are passed to OnDisconnect instead.
+	OnError func(conn *Conn, err error)
+
+	// Logger, if set, logs the connection being established and closed, and errors that are otherwise
+	// suppressed, such as failures to notify our peer that a request was cancelled.
+	Logger Logger
+
+	// Tracer, if set, instruments requests with distributed tracing, propagating trace context from the requests
+	// we send to the handlers of our peer. Both ends of a connection must be running a version of this package
+	// that understands trace context, though only the ends that instrument requests need a Tracer.
+	Tracer Tracer
+
+	// Codec marshals and unmarshals the values sent and received via Call and HandleCall. It defaults to
+	// DefaultCodec, and is replaced by the codec negotiated by a version handshake should one have been. Both
+	// ends of a connection must use the same Codec.
+	Codec Codec
+
+	// MaxFrameSize is the maximum size of a frame that may be read. Frames larger than ReadBufferSize are read
+	// into their own buffer. It is only respected should the underlying connection implement MessageReader, as
+	// frames read from other connections may be no larger than ReadBufferSize. Messages, requests, and responses
+	// that do not fit within MaxFrameSize are transparently written in fragments that do, and are reassembled by
+	// our peer before being handled, such that both ends of a connection must agree on MaxFrameSize. Frames that
+	// exceed the limit close the connection with an error matching ErrMessageTooLarge. It may be no smaller than
+	// MinFrameSize.
+	MaxFrameSize int
+
+	// MaxMessageSize is the maximum size of a message that may be reassembled from the fragments written by our
+	// peer, be it via WriteFrom, SendStream, or by sending a message that does not fit within MaxFrameSize. Should
+	// a message being reassembled exceed it, the connection is closed with ErrMessageTooLarge.
+	MaxMessageSize int
+
+	// MaxWriteSize is the maximum size of a message payload that may be written. Writes with a payload
+	// exceeding it fail with ErrMessageTooLarge before being queued. Zero disables the check.
+	MaxWriteSize int
+
+	// MaxFramesPerSecond and MaxBytesPerSecond, if positive, bound the rate at which frames and bytes are read
+	// from our peer via token buckets that may burst up to a second's worth of budget. Should RateLimiter be set,
+	// it bounds the rate instead. Peers that exceed their budget are throttled by no longer reading from them
+	// until their budget refills, which in turn applies backpressure to their writes, or, should
+	// CloseOnRateLimit be set, are disconnected with ErrRateLimited.
+	MaxFramesPerSecond int
+	MaxBytesPerSecond  int
+	RateLimiter        RateLimiter
+	CloseOnRateLimit   bool
+
 	SeqOffset uint32
 	SeqDelta  uint32
 
+	// ManualFlush, if true, only flushes written messages to the underlying connection when Flush is called, or
+	// when the connection is gracefully closed. Writes that are waited on are then considered complete once they
+	// have been written to the underlying connection's buffer rather than once they have been flushed. Requests
+	// are not flushed either, such that Request waits indefinitely, and RequestContext until its ctx is done,
+	// should Flush not be called after sending them.
+	ManualFlush bool
+
+	// FlushInterval, if positive, defers flushing written messages by up to FlushInterval since the first of
+	// them was written, such that small writes made under load are coalesced into fewer flushes at the cost of a
+	// bounded amount of latency. Writes that are waited on, and requests, only complete once flushed. Explicit
+	// calls to Flush, and closing the connection, flush immediately. It is ignored should ManualFlush be set.
+	FlushInterval time.Duration
+
+	// MaxBatchBytes, if positive, flushes messages whose flush is being deferred by FlushInterval as soon as
+	// they amount to at least MaxBatchBytes bytes, rather than waiting for FlushInterval to elapse.
+	MaxBatchBytes int
+
+	// MaxPendingWrites and MaxPendingBytes, if positive, bound the number of messages and the number of bytes
+	// that may be queued for the write loop to pick up, such that a slow peer may not cause queued writes to
+	// grow without bound. Writes that would exceed either limit block until the write loop frees up room, or,
+	// should FailFastIfQueueFull be set and the write not be waited on, fail immediately with
+	// ErrWriteQueueFull. A message larger than MaxPendingBytes is only queued once the queue is empty. Frames
+	// that do not carry a message, such as pings and cancellations, are never held back. SendContext waits for
+	// room regardless of its context, as its context only applies once its message is queued.
+	MaxPendingWrites int
+	MaxPendingBytes  int
+
+	// FailFastIfQueueFull, if true, fails writes that are not waited on, such as those made via SendNoWait and
+	// Respond, and requests, with ErrWriteQueueFull rather than blocking should the write queue be full.
+	FailFastIfQueueFull bool
+
+	// MaxFlushRetries is the maximum number of times a flush that failed with an error matching ErrFlushRetryable
+	// is retried before the connection is closed.
+	MaxFlushRetries int
+
+	// AbortWritesOnReadError, if true, aborts all queued writes that have yet to be picked up by the write loop
+	// should the read loop fail, rather than attempting to write them before closing the connection. Writes that
+	// were already picked up are still flushed and resolved with the outcome of their flush.
+	AbortWritesOnReadError bool
+
+	// KeepAliveInterval, if positive, is the interval at which pings are sent to our peer to detect half-open
+	// connections. Each ping is sent after a random duration between 80% and 100% of KeepAliveInterval, such
+	// that pings across many connections do not fire in lockstep. Should MaxMissedPongs consecutive pings go
+	// unanswered, the connection is closed with ErrPeerUnresponsive. Pings and pongs are flushed as soon as they
+	// are written, even should ManualFlush be set.
+	KeepAliveInterval time.Duration
+	MaxMissedPongs    int
+
+	// KeepAliveIdleOnly, if true, only pings our peer once a keepalive interval passes without any frame being
+	// read from it, as any frame our peer sends is as much proof that it is alive as a pong. Connections that
+	// are busy are then not burdened with pings, while idle connections are kept alive through NATs and
+	// firewalls that drop idle flows.
+	KeepAliveIdleOnly bool
+
+	// AdvertiseKeepAliveInterval, if positive, is sent to our peer once the connection is established as the
+	// interval at which we expect to be pinged, such that peers that adopt it are not disconnected for being
+	// idle should ReadTimeout be set. It should be set comfortably below ReadTimeout.
+	AdvertiseKeepAliveInterval time.Duration
+
+	// AdoptKeepAliveInterval, if true, pings our peer at the interval it advertises should KeepAliveInterval not
+	// be positive. No pings are sent until an interval is advertised.
+	AdoptKeepAliveInterval bool
+
+	// MinKeepAliveInterval is the shortest interval advertised by our peer that is adopted, such that a peer may
+	// not have us ping it in a tight loop. Shorter intervals are ignored. It defaults to
+	// DefaultMinKeepAliveInterval.
+	MinKeepAliveInterval time.Duration
+
+	// OnRead and OnWrite, if set, are called from the read and write loops with the raw bytes of every frame
+	// read from or written to the underlying connection. The slices are borrowed from the loops' buffers and
+	// are only valid for the duration of the call, and must be copied should they be retained.
+	OnRead  func(frame []byte)
+	OnWrite func(frame []byte)
+
+	// OnQueueWait, if set, is called from the write loop with how long each written message waited between being
+	// queued and being flushed, which allows for telling apart latency caused by a slow connection from latency
+	// caused by slow processing. Writes are only timestamped should it be set.
+	OnQueueWait func(d time.Duration)
+
+	// ConcurrentHandlers, if true, calls Handler for each incoming message in its own goroutine rather than
+	// from the read loop. This allows for handlers to observe requests being cancelled by their sender. Should
+	// a handler return an error, the connection is closed and Handle returns the error.
+	ConcurrentHandlers bool
+
+	// HandlerTimeout, if positive, bounds how long Handler may take to respond to a request. The context passed
+	// to Handler is cancelled once it elapses, and should Handler not have replied via Context.Reply by then,
+	// our peer is sent a response that fails its request with ErrHandlerTimeout. Responses sent via Respond are
+	// not accounted for, and are dropped by our peer should they be written after the timeout response.
+	HandlerTimeout time.Duration
+
 	mu   sync.Mutex
 	once sync.Once
 
-	writerQueue []*pendingWrite
-	writerCond  sync.Cond
-	writerDone  bool
+	middleware []Middleware // registered via Use
+	handler    Handler      // Handler wrapped by middleware, set once the connection is handled
+
+	fragmentMu sync.Mutex // held while writing the fragments of a message, as only one may be fragmented at a time
+
+	streams *streamSet // logical streams opened via OpenStream or by our peer, created once first needed
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	handlers   sync.WaitGroup
+	handlerErr error // first error returned by a handler called outside of the read loop
+	inflight   map[uint32]context.CancelFunc
+	values     sync.Map // values set via SetValue for the lifetime of the connection
+
+	handled net.Conn // conn being handled, whose addresses are reported by RemoteAddr and LocalAddr
+	peer    PeerInfo // our peer as authenticated by the handshake the connection was established with
+
+	writerQueue  []*pendingWrite
+	writerUrgent []*pendingWrite // writes with PriorityHigh, which are written before those in writerQueue
+	writerCond   sync.Cond
+	writerDone   bool
+	writerRoom   sync.Cond // signalled once the write loop frees up room in the write queues
+	queuedBytes  int       // number of bytes queued in writerQueue and writerUrgent
 
 	reqs map[uint32]*pendingRequest
-	seq  uint32
+	seq  uint32 // last assigned sequence number, accessed atomically
+
+	closing  bool          // set once CloseGracefully is called, after which new writes and requests are rejected
+	idle     chan struct{} // closed once no requests are pending nor handled, should CloseGracefully be waiting on them
+	handling int32         // number of handlers that have yet to return, accessed atomically
+	shutdown chan struct{} // closed by CloseGracefully to stop handling the connection
+
+	pings      uint32                                 // number of consecutive pings that are yet to be answered, accessed atomically
+	active     uint32                                 // set once a frame is read should KeepAliveIdleOnly be set, accessed atomically
+	keepAlive  int64                                  // keepalive interval advertised by our peer, accessed atomically
+	advertised chan struct{}                          // closed once keepAlive is adopted
+	after      func(d time.Duration) <-chan time.Time // overrides the clock used to schedule pings if set
 }
 
 func (c *Conn) NumPendingWrites() int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return len(c.writerQueue)
+	return len(c.writerQueue) + len(c.writerUrgent)
+}
+
+// RemoteAddr returns the address of our peer, or nil should the connection not yet be handled. Connections
+// served by a Server from a trusted proxy report the address of the client the proxy accepted the connection
+// from. See Server.TrustedProxies.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handled == nil {
+		return nil
+	}
+	return c.handled.RemoteAddr()
+}
+
+// Peer returns our peer as authenticated by the handshake the connection was established with, which is only
+// reported by handshakers that implement ContextHandshaker. It is available from OnConnect onwards.
+func (c *Conn) Peer() PeerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer
+}
+
+// LocalAddr returns our address, or nil should the connection not yet be handled.
+func (c *Conn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handled == nil {
+		return nil
+	}
+	return c.handled.LocalAddr()
+}
+
+// PendingRequestInfo describes a request that is awaiting a response.
+type PendingRequestInfo struct {
+	Seq uint32        // sequence number of the request
+	Age time.Duration // time elapsed since the request was made
+}
+
+// PendingRequests returns a snapshot of all requests that are awaiting a response, oldest first. It is meant for
+// debugging connections that appear to be hung.
+func (c *Conn) PendingRequests() []PendingRequestInfo {
+	c.once.Do(c.init)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	infos := make([]PendingRequestInfo, 0, len(c.reqs))
+	for seq, pr := range c.reqs {
+		infos = append(infos, PendingRequestInfo{Seq: seq, Age: now.Sub(pr.start)})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Age > infos[j].Age })
+
+	return infos
 }
 
+// Handle handles conn until done is closed or the connection fails. Once done is closed, our peer is notified
+// that we are shutting down, and all messages queued beforehand, including those sent via SendNoWait, are
+// written and flushed one final time before conn is closed, such that they make it onto the wire. Should the
+// connection instead fail, e.g. because a write or flush failed or our peer stopped answering pings, conn is
+// closed without a final flush being attempted, and all queued messages fail with an error matching
+// ErrConnClosed.
 func (c *Conn) Handle(done chan struct{}, conn BufferedConn) error {
+	return c.handle(done, conn, nil)
+}
+
+// handle handles conn until done is closed or conn fails. ready, if not nil, is called with the result of
+// OnConnect once the connection is ready for use.
+func (c *Conn) handle(done chan struct{}, conn BufferedConn, ready func(err error)) error {
 	c.once.Do(c.init)
 
+	c.handler = c.chainHandler()
+
+	c.mu.Lock()
+	c.handled = conn
+	c.mu.Unlock()
+
+	// Frames larger than our peer may read are fragmented should a version handshake have negotiated a smaller
+	// MaxFrameSize than ours, and values are marshalled with the codec it negotiated, should it have.
+
+	c.mu.Lock()
+	negotiated := c.peer.Negotiated
+	c.mu.Unlock()
+
+	if negotiated != nil {
+		if negotiated.MaxFrameSize < c.getMaxFrameSize() {
+			c.MaxFrameSize = negotiated.MaxFrameSize
+		}
+		if negotiated.codec != nil {
+			c.Codec = negotiated.codec
+		}
+	}
+
+	if c.Framer != nil {
+		fc := NewFramedConn(conn)
+		fc.Framer = c.Framer
+		conn = fc
+	}
+
+	if c.AdvertiseKeepAliveInterval > 0 {
+		err := c.sendPing(frameHeader{flags: flagPing | flagDeadline, timeout: c.AdvertiseKeepAliveInterval})
+		if err != nil {
+			c.suppress("failed to advertise keepalive interval", err)
+		}
+	}
+
 	writerDone := make(chan error)
 	go func() {
 		writerDone <- c.writeLoop(conn)
@@ -59,96 +388,756 @@ func (c *Conn) Handle(done chan struct{}, conn BufferedConn) error {
 
 	var err error
 
-	select {
-	case <-done:
+	if c.OnConnect != nil {
+		err = c.OnConnect(c)
+	}
+
+	if ready != nil {
+		ready(err)
+	}
+
+	if err != nil {
+		c.getLogger().Warn("connection rejected by OnConnect", "remote_addr", remoteAddr{conn}, "err", err)
+	} else {
+		c.getLogger().Debug("connection established", "remote_addr", remoteAddr{conn})
+	}
+
+	if err != nil {
 		c.closeWriter()
-		err = <-writerDone
+		<-writerDone
 		conn.Close()
-		if err == nil {
-			err = <-readerDone
-		} else {
-			<-readerDone
+		<-readerDone
+	} else {
+		var (
+			keepAliveStop chan struct{}
+			keepAliveDone chan error
+		)
+
+		if c.KeepAliveInterval > 0 || c.AdoptKeepAliveInterval {
+			keepAliveStop = make(chan struct{})
+			keepAliveDone = make(chan error)
+			go func() {
+				keepAliveDone <- c.keepAliveLoop(keepAliveStop)
+				close(keepAliveDone)
+			}()
 		}
+
+		err = c.wait(done, conn, writerDone, readerDone, keepAliveDone)
+
+		if keepAliveStop != nil {
+			close(keepAliveStop)
+			<-keepAliveDone
+		}
+	}
+
+	c.cancel()
+	c.handlers.Wait()
+
+	c.mu.Lock()
+	if c.handlerErr != nil {
+		err = c.handlerErr
+	}
+	c.mu.Unlock()
+
+	c.getLogger().Debug("connection closed", "remote_addr", remoteAddr{conn}, "err", err)
+
+	if c.OnDisconnect != nil {
+		c.OnDisconnect(c, err)
+	}
+
+	return err
+}
+
+// wait waits until either done is closed, CloseGracefully is called, either of the read or write loops exit, or
+// the keepalive loop reports that our peer is unresponsive, and then stops both the read and write loops. The
+// Conn's context is cancelled as soon as conn is closed, such that a handler blocking the read loop may return.
+func (c *Conn) wait(done chan struct{}, conn BufferedConn, writerDone, readerDone, keepAliveDone chan error) error {
+	var err error
+
+	select {
+	case <-done:
+		err = c.goodbye(conn, writerDone, readerDone)
+	case <-c.shutdown:
+		err = c.goodbye(conn, writerDone, readerDone)
 	case err = <-writerDone:
 		c.closeWriter()
 		conn.Close()
+		c.cancel()
 		if err == nil {
 			err = <-readerDone
 		} else {
 			<-readerDone
 		}
 	case err = <-readerDone:
-		c.closeWriter()
+		if c.AbortWritesOnReadError {
+			c.abortWriter(err)
+		} else {
+			c.closeWriter()
+		}
 		if err == nil {
 			err = <-writerDone
 		} else {
 			<-writerDone
 		}
 		conn.Close()
+	case err = <-keepAliveDone:
+		c.closeWriter()
+		conn.Close()
+		c.cancel()
+		<-writerDone
+		<-readerDone
 	}
 
 	return err
 }
 
-func (c *Conn) Send(payload []byte) error       { c.once.Do(c.init); return c.send(0, payload) }
-func (c *Conn) SendNoWait(payload []byte) error { c.once.Do(c.init); return c.sendNoWait(0, payload) }
+// goodbye notifies our peer that we are gracefully shutting down, and closes conn once all queued writes have
+// been flushed.
+func (c *Conn) goodbye(conn BufferedConn, writerDone, readerDone chan error) error {
+	_ = c.sendNoWait(frameHeader{flags: flagGoodbye}, PriorityNormal, nil)
+	c.closeWriter()
+	err := <-writerDone
+	conn.Close()
+	c.cancel()
+	if err == nil {
+		err = <-readerDone
+	} else {
+		<-readerDone
+	}
+	return err
+}
+
+func (c *Conn) Send(payload []byte) error {
+	c.once.Do(c.init)
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+	return c.send(frameHeader{}, PriorityNormal, payload)
+}
+
+// SendContext sends payload, and waits until it has been written or ctx is done. Should ctx be done while payload
+// is still queued, it is removed from the queue and ctx.Err() is returned. Should the write loop have already
+// picked it up, SendContext waits for it to be written regardless, which is bounded by WriteTimeout.
+func (c *Conn) SendContext(ctx context.Context, payload []byte) error {
+	c.once.Do(c.init)
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	err = c.checkClosing()
+	if err != nil {
+		return err
+	}
+
+	h := frameHeader{}
+
+	payload, err = c.intercept(h, payload)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkWriteSize(payload)
+	if err != nil {
+		return err
+	}
+
+	buf := acquireBuffer(h.size() + len(payload))
+	defer releaseBuffer(buf)
+
+	copy(h.encode(buf.B), payload)
+
+	return c.writeContext(ctx, buf, PriorityNormal, 0)
+}
+
+// SendNoWait queues payload to be sent, and returns without waiting for it to be written. Payload is copied into a
+// pooled buffer before being queued, such that the caller retains ownership of payload and may reuse it as soon as
+// SendNoWait returns. The same holds for every other method that sends a payload.
+func (c *Conn) SendNoWait(payload []byte) error {
+	c.once.Do(c.init)
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+	return c.sendNoWait(frameHeader{}, PriorityNormal, payload)
+}
+
+// SendOnStream sends payload on the stream identified by stream. Streams are local to the Conn and designate the
+// order in which queued messages are written: messages queued on different streams are written in round-robin
+// order, such that a stream with many queued messages does not starve the others, while messages queued on the
+// same stream are written in the order they were queued. Messages sent via Send are sent on stream 0, and
+// messages with PriorityHigh are still written before any others.
+func (c *Conn) SendOnStream(stream uint32, payload []byte) error {
+	c.once.Do(c.init)
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+	return c.sendOnStream(frameHeader{}, PriorityNormal, stream, payload)
+}
+
+// SendOnStreamNoWait is SendOnStream without waiting for payload to be written.
+func (c *Conn) SendOnStreamNoWait(stream uint32, payload []byte) error {
+	c.once.Do(c.init)
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+	return c.sendOnStreamNoWait(frameHeader{}, PriorityNormal, stream, payload)
+}
+
+// WriteFrom sends the next size bytes read from r as a single message. The message is written in fragments that
+// each fit within WriteBufferSize, such that it is never held in memory in its entirety, and is handled by our
+// peer's StreamHandler should it have one, or is otherwise reassembled by our peer before being handled. Should r
+// fail or be exhausted before size bytes are read from it, our peer is notified to discard the fragments written
+// so far and the error is returned.
+//
+// Only one message may be written in fragments at a time, such that calls to WriteFrom and SendStream are
+// serialized. Other messages may still be written while a message is being written via WriteFrom.
+func (c *Conn) WriteFrom(r io.Reader, size int64) error {
+	c.once.Do(c.init)
+
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+
+	if c.MaxWriteSize > 0 && size > int64(c.MaxWriteSize) {
+		return fmt.Errorf("max is %d bytes, got %d bytes: %w", c.MaxWriteSize, size, ErrMessageTooLarge)
+	}
+
+	chunk := c.getFragmentSize()
+
+	if size <= int64(chunk) {
+		buf := acquireBuffer(frameHeader{}.size() + int(size))
+		defer releaseBuffer(buf)
+
+		_, err := io.ReadFull(r, frameHeader{}.encode(buf.B))
+		if err != nil {
+			return err
+		}
+		return c.write(buf, PriorityNormal, 0)
+	}
+
+	return c.writeFragments(r, size)
+}
+
+// SendStream sends everything read from r until it returns io.EOF as a single message, without ever holding the
+// message in memory in its entirety. Unlike WriteFrom, the size of the message need not be known upfront. The
+// message is always written in fragments that each fit within WriteBufferSize, such that it is handled by our
+// peer's StreamHandler should it have one, and is otherwise reassembled by our peer before being handled. Should
+// r fail, or the message exceed MaxWriteSize, our peer is notified to discard the fragments written so far and
+// the error is returned.
+//
+// Calls to SendStream and WriteFrom are serialized, as only one message may be written in fragments at a time.
+func (c *Conn) SendStream(r io.Reader) error {
+	c.once.Do(c.init)
+
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+
+	return c.writeFragments(r, -1)
+}
+
+// getFragmentSize returns the size of the payload of every fragment but the last of a message written in
+// fragments.
+func (c *Conn) getFragmentSize() int {
+	chunk := c.getWriteBufferSize() - frameHeader{}.size()
+	if chunk < 1 {
+		chunk = 1
+	}
+	return chunk
+}
+
+// writeFragments writes the next size bytes read from r as a single message in fragments, or everything read from
+// r until it returns io.EOF should size be negative.
+func (c *Conn) writeFragments(r io.Reader, size int64) error {
+	chunk := c.getFragmentSize()
+
+	c.fragmentMu.Lock()
+	defer c.fragmentMu.Unlock()
+
+	// Every fragment is read while the fragment before it is being written.
+
+	var prev *pendingWrite
+
+	wait := func() error {
+		if prev == nil {
+			return nil
+		}
+		prev.wg.Wait()
+		err := prev.err
+		releaseBuffer(prev.buf)
+		releasePendingWrite(prev)
+		prev = nil
+		return err
+	}
+
+	abort := func(err error) error {
+		if werr := wait(); werr != nil {
+			return werr
+		}
+		_ = c.sendNoWait(frameHeader{flags: flagMore | flagCancel}, PriorityNormal, nil)
+		return err
+	}
+
+	var written int64
+
+	for {
+		h := frameHeader{flags: flagMore}
+		n := chunk
+		if size >= 0 && size <= int64(chunk) {
+			h.flags, n = flagLast, int(size)
+		}
+
+		buf := acquireBuffer(h.size() + n)
+
+		n, err := io.ReadFull(r, h.encode(buf.B))
+		if size < 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) { // r is exhausted
+			h.flags, err = flagLast, nil
+			h.encode(buf.B)
+			buf.B = buf.B[:h.size()+n]
+		}
+		if err != nil {
+			releaseBuffer(buf)
+			return abort(fmt.Errorf("failed to read fragment: %w", err))
+		}
+
+		written += int64(n)
+		if size < 0 && c.MaxWriteSize > 0 && written > int64(c.MaxWriteSize) {
+			releaseBuffer(buf)
+			return abort(fmt.Errorf("max is %d bytes, got at least %d bytes: %w", c.MaxWriteSize, written,
+				ErrMessageTooLarge))
+		}
+
+		err = wait()
+		if err != nil {
+			releaseBuffer(buf)
+			return err
+		}
+
+		prev, err = c.preparePendingWrite(buf, true, PriorityNormal, 0)
+		if err != nil {
+			releaseBuffer(buf)
+			return err
+		}
+
+		if h.flags&flagLast != 0 {
+			break
+		}
+		if size >= 0 {
+			size -= int64(n)
+		}
+	}
+
+	return wait()
+}
+
+// Responder sends responses to requests without waiting for them to be written, such that they may be sent from
+// a handler called from a connection's read loop without blocking it.
+type Responder interface {
+	Respond(seq uint32, buf []byte) error
+}
+
+var _ Responder = (*Conn)(nil)
+
+// Respond queues buf to be written as a response to the request with sequence number seq, which may be obtained
+// from the request's Context via Seq, and returns without waiting for it to be written. Should seq be zero, buf
+// is sent as a plain message.
+func (c *Conn) Respond(seq uint32, buf []byte) error {
+	c.once.Do(c.init)
+
+	h := frameHeader{seq: seq}
+	if seq != 0 {
+		h.flags |= flagResponse
+	}
+	return c.sendNoWait(h, PriorityNormal, buf)
+}
+
+// SendPriority sends payload with the given priority. Messages with PriorityHigh are written before any
+// messages with PriorityNormal that are queued, while messages of the same priority are written in the order
+// they were queued.
+func (c *Conn) SendPriority(prio Priority, payload []byte) error {
+	c.once.Do(c.init)
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+	return c.send(frameHeader{}, prio, payload)
+}
+
+// Flush forces all messages queued before it to be written and flushed to the underlying connection, and waits
+// until they have been flushed.
+func (c *Conn) Flush() error {
+	c.once.Do(c.init)
+
+	pw, err := c.preparePendingWrite(nil, true, PriorityNormal, 0)
+	if err != nil {
+		return err
+	}
+	defer releasePendingWrite(pw)
+	pw.wg.Wait()
+	return pw.err
+}
 
+// Request sends payload as a request, and waits for its response, which is read into dst should it be large
+// enough to hold it. Responses are matched to their request by sequence number as they are read by the read loop.
+// Should RequestTimeout be positive, Request waits no longer than it. See RequestContext for sending a request
+// that may be cancelled or that has a deadline.
 func (c *Conn) Request(dst []byte, payload []byte) ([]byte, error) {
+	return c.RequestContext(context.Background(), dst, payload)
+}
+
+// RequestContext sends a request and waits for its response until ctx is done. Should ctx have a deadline, the
+// time remaining until the deadline is sent along with the request such that the peer's handler may observe it.
+// Should ctx be done before a response is received, the peer is notified that the request has been cancelled,
+// and any late response to it is dropped. Should ctx have no deadline and RequestTimeout be positive, the request
+// is given a deadline RequestTimeout from now.
+func (c *Conn) RequestContext(ctx context.Context, dst []byte, payload []byte) ([]byte, error) {
+	if c.Tracer == nil {
+		return c.request(ctx, dst, payload, nil)
+	}
+
+	trace, end := c.Tracer.StartRequest(ctx, c, payload)
+	if len(trace) > maxTraceSize {
+		err := fmt.Errorf("max trace context size is %d bytes, got %d bytes", maxTraceSize, len(trace))
+		end(err)
+		return nil, err
+	}
+
+	res, err := c.request(ctx, dst, payload, trace)
+	end(err)
+
+	return res, err
+}
+
+// request sends a request carrying trace context trace, should it not be nil, and waits for its response. See
+// RequestContext.
+func (c *Conn) request(ctx context.Context, dst []byte, payload []byte, trace []byte) ([]byte, error) {
 	c.once.Do(c.init)
 
+	if _, ok := ctx.Deadline(); !ok && c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.checkClosing()
+	if err != nil {
+		return nil, err
+	}
+
 	pr := acquirePendingRequest(dst)
 	defer releasePendingRequest(pr)
 
-	pr.wg.Add(1)
+	seq := c.registerRequest(pr)
+
+	h := frameHeader{seq: seq}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.flags |= flagDeadline
+		h.timeout = time.Until(deadline)
+	}
+	if trace != nil {
+		h.flags |= flagTimeout
+		h.trace = trace
+	}
+
+	err = c.sendNoWait(h, PriorityNormal, payload)
+	if err != nil {
+		if !c.abortRequest(seq, pr) {
+			return pr.dst, pr.err
+		}
+		return nil, err
+	}
+
+	select {
+	case <-pr.done:
+		return pr.dst, pr.err
+	case <-ctx.Done():
+	}
+
+	if !c.abortRequest(seq, pr) {
+		return pr.dst, pr.err
+	}
+
+	if err := c.sendNoWait(frameHeader{seq: seq, flags: flagCancel}, PriorityHigh, nil); err != nil {
+		c.suppress("failed to cancel request", err, "seq", seq)
+	}
 
-	seq := c.next()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, wrapError(ErrRequestTimeout, ctx.Err())
+	}
+
+	return nil, ctx.Err()
+}
 
+// abortRequest stops waiting for a response to the request with sequence number seq. It reports false if the
+// request was resolved in the meantime, in which case pr holds the request's result.
+func (c *Conn) abortRequest(seq uint32, pr *pendingRequest) bool {
 	c.mu.Lock()
-	c.reqs[seq] = pr
+	_, pending := c.reqs[seq]
+	if pending {
+		c.deleteRequest(seq)
+	}
 	c.mu.Unlock()
 
-	err := c.sendNoWait(seq, payload)
+	if !pending {
+		<-pr.done
+	}
 
-	if err != nil {
-		pr.wg.Done()
+	return pending
+}
 
-		c.mu.Lock()
-		delete(c.reqs, seq)
+// deleteRequest deletes the pending request with sequence number seq, and signals CloseGracefully should no
+// more requests be pending. c.mu must be held.
+func (c *Conn) deleteRequest(seq uint32) {
+	delete(c.reqs, seq)
+	c.checkIdle()
+}
+
+// checkIdle signals CloseGracefully should no requests be pending nor handlers be running. c.mu must be held.
+func (c *Conn) checkIdle() {
+	if c.idle != nil && len(c.reqs) == 0 && atomic.LoadInt32(&c.handling) == 0 {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// doneHandling marks a handler as having returned, and signals CloseGracefully should it be the last.
+func (c *Conn) doneHandling() {
+	if atomic.AddInt32(&c.handling, -1) != 0 {
+		return
+	}
+	c.mu.Lock()
+	c.checkIdle()
+	c.mu.Unlock()
+}
+
+// checkClosing returns ErrConnClosing should CloseGracefully have been called.
+func (c *Conn) checkClosing() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return ErrConnClosing
+	}
+	return nil
+}
+
+// CloseGracefully stops the connection from accepting new writes and requests, which fail with ErrConnClosing,
+// waits for all pending requests to be resolved and for all handlers handling our peer's messages to return, and
+// then flushes all queued writes and closes the connection the same way it would be should the done channel
+// passed to Handle be closed. CloseGracefully waits until the connection is closed, and returns immediately
+// should it already be closed. Should ctx be done beforehand, the connection is closed regardless and ctx.Err()
+// is returned without waiting for it to be closed. As it waits for handlers to return, handlers must call it from
+// a goroutine of their own.
+func (c *Conn) CloseGracefully(ctx context.Context) error {
+	c.once.Do(c.init)
+
+	c.mu.Lock()
+	if c.closing {
 		c.mu.Unlock()
-		return nil, err
+		return ErrConnClosing
 	}
+	c.closing = true
 
-	pr.wg.Wait()
+	idle := make(chan struct{})
+	c.idle = idle
+	c.checkIdle()
+	c.mu.Unlock()
+
+	var err error
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.ctx.Done():
+		return nil
+	}
+
+	close(c.shutdown)
 
-	return pr.dst, pr.err
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.ctx.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *Conn) init() {
 	c.reqs = make(map[uint32]*pendingRequest)
+	c.inflight = make(map[uint32]context.CancelFunc)
 	c.writerCond.L = &c.mu
+	c.writerRoom.L = &c.mu
+	c.shutdown = make(chan struct{})
+	c.advertised = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctx, c.cancel = &connContext{Context: ctx, conn: c}, cancel
+	c.seq = c.getSeqOffset() - c.getSeqDelta()
+}
+
+func (c *Conn) send(h frameHeader, prio Priority, payload []byte) error {
+	return c.sendOnStream(h, prio, 0, payload)
+}
+
+func (c *Conn) sendNoWait(h frameHeader, prio Priority, payload []byte) error {
+	return c.sendOnStreamNoWait(h, prio, 0, payload)
+}
+
+func (c *Conn) sendOnStream(h frameHeader, prio Priority, stream uint32, payload []byte) error {
+	payload, err := c.intercept(h, payload)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkWriteSize(payload)
+	if err != nil {
+		return err
+	}
+
+	if h.size()+len(payload) > c.getMaxFrameSize() {
+		return c.sendFragmented(h, payload, true)
+	}
+
+	buf := acquireBuffer(h.size() + len(payload))
+	defer releaseBuffer(buf)
+
+	copy(h.encode(buf.B), payload)
+
+	return c.write(buf, prio, stream)
+}
+
+func (c *Conn) sendOnStreamNoWait(h frameHeader, prio Priority, stream uint32, payload []byte) error {
+	payload, err := c.intercept(h, payload)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkWriteSize(payload)
+	if err != nil {
+		return err
+	}
+
+	if h.size()+len(payload) > c.getMaxFrameSize() {
+		return c.sendFragmented(h, payload, false)
+	}
+
+	buf := acquireBuffer(h.size() + len(payload))
+	copy(h.encode(buf.B), payload)
+	return c.writeNoWait(buf, prio, stream)
+}
+
+// sendFragmented queues payload, which does not fit within a single frame, to be written in fragments that each
+// fit within MaxFrameSize, and waits for the last of them to be written should wait be true. Every fragment
+// carries the sequence number of h and whether it is a response, while the last fragment carries h in its
+// entirety, such that our peer handles the reassembled message as it would have had it fit within a single frame.
+//
+// Fragments are queued on stream 0 regardless of the stream the message was sent on, as the fragments of
+// different messages must not be interleaved.
+func (c *Conn) sendFragmented(h frameHeader, payload []byte, wait bool) error {
+	max := c.getMaxFrameSize()
+
+	last := h
+	last.flags |= flagLast
+
+	// Fragments carry no more than a sequence number and flags, which always fit within MinFrameSize, while the
+	// last fragment may carry trace context that leaves no room for its payload.
+
+	if last.size() >= max {
+		return fmt.Errorf("frame header of %d bytes leaves no room within max frame size of %d bytes: %w",
+			last.size(), max, ErrMessageTooLarge)
+	}
+
+	c.fragmentMu.Lock()
+	defer c.fragmentMu.Unlock()
+
+	abort := func(err error) error {
+		_ = c.sendNoWait(frameHeader{flags: flagMore | flagCancel}, PriorityNormal, nil)
+		return err
+	}
+
+	for last.size()+len(payload) > max {
+		fh := frameHeader{seq: h.seq, flags: flagMore | h.flags&flagResponse}
+
+		n := max - fh.size()
+		if n > len(payload) {
+			n = len(payload)
+		}
+
+		buf := acquireBuffer(fh.size() + n)
+		copy(fh.encode(buf.B), payload[:n])
+
+		if err := c.writeNoWait(buf, PriorityNormal, 0); err != nil {
+			releaseBuffer(buf)
+			return abort(err)
+		}
+
+		payload = payload[n:]
+	}
+
+	buf := acquireBuffer(last.size() + len(payload))
+	copy(last.encode(buf.B), payload)
+
+	if !wait {
+		err := c.writeNoWait(buf, PriorityNormal, 0)
+		if err != nil {
+			releaseBuffer(buf)
+			return abort(err)
+		}
+		return nil
+	}
+
+	defer releaseBuffer(buf)
+
+	err := c.write(buf, PriorityNormal, 0)
+	if err != nil {
+		return abort(err)
+	}
+	return nil
 }
 
-func (c *Conn) send(seq uint32, payload []byte) error {
-	buf := bytebufferpool.Get()
-	defer bytebufferpool.Put(buf)
+// sendSharedNoWait queues shared, which holds a message frame carrying payload, to be written without waiting for
+// it to be written, such that the same frame may be queued to several connections without being copied. Should
+// the connection have middleware that intercepts the payloads it sends, or the frame not fit within its
+// MaxFrameSize, payload is sent on its own instead, such that it is fragmented should it need to be.
+func (c *Conn) sendSharedNoWait(shared *byteBuffer, payload []byte) error {
+	if c.intercepts() || len(shared.B) > c.getMaxFrameSize() {
+		return c.SendNoWait(payload)
+	}
 
-	buf.B = bytesutil.ExtendSlice(buf.B, 4+len(payload))
-	binary.BigEndian.PutUint32(buf.B[:4], seq)
-	copy(buf.B[4:], payload)
+	c.once.Do(c.init)
+	if err := c.checkClosing(); err != nil {
+		return err
+	}
+	if err := c.checkWriteSize(payload); err != nil {
+		return err
+	}
 
-	return c.write(buf)
+	atomic.AddInt32(&shared.refs, 1)
+	err := c.writeNoWait(shared, PriorityNormal, 0)
+	if err != nil {
+		releaseBuffer(shared)
+	}
+	return err
 }
 
-func (c *Conn) sendNoWait(seq uint32, payload []byte) error {
-	buf := bytebufferpool.Get()
-	buf.B = bytesutil.ExtendSlice(buf.B, 4+len(payload))
-	binary.BigEndian.PutUint32(buf.B[:4], seq)
-	copy(buf.B[4:], payload)
-	return c.writeNoWait(buf)
+func (c *Conn) checkWriteSize(payload []byte) error {
+	if c.MaxWriteSize > 0 && len(payload) > c.MaxWriteSize {
+		return fmt.Errorf("max is %d bytes, got %d bytes: %w", c.MaxWriteSize, len(payload), ErrMessageTooLarge)
+	}
+	return nil
 }
 
-func (c *Conn) write(buf *bytebufferpool.ByteBuffer) error {
-	pw, err := c.preparePendingWrite(buf, true)
+func (c *Conn) write(buf *byteBuffer, prio Priority, stream uint32) error {
+	pw, err := c.preparePendingWrite(buf, true, prio, stream)
 	if err != nil {
 		return err
 	}
@@ -157,35 +1146,226 @@ func (c *Conn) write(buf *bytebufferpool.ByteBuffer) error {
 	return pw.err
 }
 
-func (c *Conn) writeNoWait(buf *bytebufferpool.ByteBuffer) error {
-	_, err := c.preparePendingWrite(buf, false)
+// writeContext queues buf to be written, and waits until it has been written or ctx is done, in which case buf is
+// removed from the queue should the write loop not have picked it up yet.
+func (c *Conn) writeContext(ctx context.Context, buf *byteBuffer, prio Priority, stream uint32) error {
+	if ctx.Done() == nil {
+		return c.write(buf, prio, stream)
+	}
+
+	pw, err := c.preparePendingWrite(buf, true, prio, stream)
+	if err != nil {
+		return err
+	}
+	defer releasePendingWrite(pw)
+
+	written := make(chan struct{})
+	go func() {
+		pw.wg.Wait()
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		return pw.err
+	case <-ctx.Done():
+	}
+
+	if c.dequeueWrite(pw) {
+		pw.complete(ctx.Err())
+	}
+	<-written
+
+	return pw.err
+}
+
+// dequeueWrite removes pw from the write queues. It reports false should pw not be queued, in which case it has
+// already been picked up by the write loop, or failed because the connection was closed.
+func (c *Conn) dequeueWrite(pw *pendingWrite) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, queue := range []*[]*pendingWrite{&c.writerQueue, &c.writerUrgent} {
+		for i := range *queue {
+			if (*queue)[i] == pw {
+				*queue = append((*queue)[:i], (*queue)[i+1:]...)
+				if pw.buf != nil {
+					c.queuedBytes -= len(pw.buf.B)
+				}
+				c.writerRoom.Broadcast()
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *Conn) writeNoWait(buf *byteBuffer, prio Priority, stream uint32) error {
+	_, err := c.preparePendingWrite(buf, false, prio, stream)
 	return err
 }
 
-func (c *Conn) preparePendingWrite(buf *bytebufferpool.ByteBuffer, wait bool) (*pendingWrite, error) {
+func (c *Conn) preparePendingWrite(buf *byteBuffer, wait bool, prio Priority, stream uint32) (*pendingWrite, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if buf != nil && len(buf.B) > 4 && (c.MaxPendingWrites > 0 || c.MaxPendingBytes > 0) && carriesMessage(buf.B[4]) {
+		for !c.writerDone && c.queueFull(len(buf.B)) {
+			if !wait && c.FailFastIfQueueFull {
+				return nil, ErrWriteQueueFull
+			}
+			c.writerRoom.Wait()
+		}
+	}
+
 	if c.writerDone {
-		return nil, fmt.Errorf("node is shut down: %w", io.EOF)
+		return nil, ErrConnClosed
 	}
 
 	pw := acquirePendingWrite(buf, wait)
+	pw.stream = stream
+	if c.OnQueueWait != nil {
+		pw.queued = time.Now()
+	}
 	if wait {
 		pw.wg.Add(1)
 	}
 
-	c.writerQueue = append(c.writerQueue, pw)
+	// The write loop only ever waits for writes while both queues are empty, so it only needs to be woken up
+	// should this write be the first to be queued since it last drained them.
+
+	empty := len(c.writerQueue) == 0 && len(c.writerUrgent) == 0
+
+	if prio == PriorityHigh {
+		c.writerUrgent = append(c.writerUrgent, pw)
+	} else {
+		c.writerQueue = append(c.writerQueue, pw)
+	}
+	if buf != nil {
+		c.queuedBytes += len(buf.B)
+	}
+
+	if empty {
+		c.writerCond.Signal()
+	}
+
+	return pw, nil
+}
+
+// queueFull reports whether queueing a write of size bytes would exceed MaxPendingWrites or MaxPendingBytes.
+// c.mu must be held.
+func (c *Conn) queueFull(size int) bool {
+	n := len(c.writerQueue) + len(c.writerUrgent)
+	if c.MaxPendingWrites > 0 && n >= c.MaxPendingWrites {
+		return true
+	}
+	return c.MaxPendingBytes > 0 && n > 0 && c.queuedBytes+size > c.MaxPendingBytes
+}
+
+func (c *Conn) closeWriter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writerDone = true
+	c.writerCond.Signal()
+	c.writerRoom.Broadcast()
+}
+
+// abortWriter stops the write loop once it has flushed the writes it has already dequeued, and fails all writes
+// that have yet to be dequeued with an error wrapping err.
+func (c *Conn) abortWriter(err error) {
+	c.failPendingWrites(wrapError(ErrConnClosed, err))
+}
+
+// failPendingWrites stops any further writes from being queued, and fails all writes that are still queued
+// with err.
+func (c *Conn) failPendingWrites(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writerDone = true
 	c.writerCond.Signal()
+	c.writerRoom.Broadcast()
+
+	for _, pw := range c.writerUrgent {
+		pw.complete(err)
+	}
+	for _, pw := range c.writerQueue {
+		pw.complete(err)
+	}
+
+	c.writerUrgent = c.writerUrgent[:0]
+	c.writerQueue = c.writerQueue[:0]
+	c.queuedBytes = 0
+}
+
+// ConnConfig is the configuration a Conn is running with, once defaults have been applied to settings that
+// were left unset.
+type ConnConfig struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	RequestTimeout time.Duration
+
+	MaxFrameSize   int
+	MaxMessageSize int
+	MaxWriteSize   int
+
+	SeqOffset uint32
+	SeqDelta  uint32
 
-	return pw, nil
+	ManualFlush            bool
+	FlushInterval          time.Duration
+	MaxBatchBytes          int
+	MaxPendingWrites       int
+	MaxPendingBytes        int
+	FailFastIfQueueFull    bool
+	MaxFlushRetries        int
+	AbortWritesOnReadError bool
+	ConcurrentHandlers     bool
+	HandlerTimeout         time.Duration
+
+	// KeepAliveInterval is the interval at which pings are sent, which is the interval advertised by our peer
+	// should it have been adopted, or zero should no pings be sent.
+	KeepAliveInterval          time.Duration
+	MaxMissedPongs             int
+	KeepAliveIdleOnly          bool
+	AdvertiseKeepAliveInterval time.Duration
 }
 
-func (c *Conn) closeWriter() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.writerDone = true
-	c.writerCond.Signal()
+// Config returns the configuration the connection is running with, which is handy for logging and debugging.
+func (c *Conn) Config() ConnConfig {
+	return ConnConfig{
+		ReadBufferSize:             c.getReadBufferSize(),
+		WriteBufferSize:            c.getWriteBufferSize(),
+		ReadTimeout:                c.getReadTimeout(),
+		WriteTimeout:               c.getWriteTimeout(),
+		IdleTimeout:                c.IdleTimeout,
+		RequestTimeout:             c.RequestTimeout,
+		MaxFrameSize:               c.getMaxFrameSize(),
+		MaxMessageSize:             c.getMaxMessageSize(),
+		MaxWriteSize:               c.MaxWriteSize,
+		SeqOffset:                  c.getSeqOffset(),
+		SeqDelta:                   c.getSeqDelta(),
+		ManualFlush:                c.ManualFlush,
+		FlushInterval:              c.FlushInterval,
+		MaxBatchBytes:              c.MaxBatchBytes,
+		MaxPendingWrites:           c.MaxPendingWrites,
+		MaxPendingBytes:            c.MaxPendingBytes,
+		FailFastIfQueueFull:        c.FailFastIfQueueFull,
+		MaxFlushRetries:            c.getMaxFlushRetries(),
+		AbortWritesOnReadError:     c.AbortWritesOnReadError,
+		ConcurrentHandlers:         c.ConcurrentHandlers,
+		HandlerTimeout:             c.HandlerTimeout,
+		KeepAliveInterval:          c.getKeepAliveInterval(),
+		MaxMissedPongs:             c.getMaxMissedPongs(),
+		KeepAliveIdleOnly:          c.KeepAliveIdleOnly,
+		AdvertiseKeepAliveInterval: c.AdvertiseKeepAliveInterval,
+	}
 }
 
 func (c *Conn) getHandler() Handler {
@@ -195,6 +1375,21 @@ func (c *Conn) getHandler() Handler {
 	return c.Handler
 }
 
+func (c *Conn) getLogger() Logger {
+	if c.Logger == nil {
+		return DefaultLogger
+	}
+	return c.Logger
+}
+
+// suppress reports err, which is not worth closing the connection over, to Logger and OnError.
+func (c *Conn) suppress(msg string, err error, args ...interface{}) {
+	c.getLogger().Debug(msg, append(args, "err", err)...)
+	if c.OnError != nil {
+		c.OnError(c, err)
+	}
+}
+
 func (c *Conn) getReadBufferSize() int {
 	if c.ReadBufferSize <= 0 {
 		return DefaultReadBufferSize
@@ -223,6 +1418,37 @@ func (c *Conn) getWriteTimeout() time.Duration {
 	return c.WriteTimeout
 }
 
+func (c *Conn) getMaxFrameSize() int {
+	if c.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	if c.MaxFrameSize < MinFrameSize {
+		return MinFrameSize
+	}
+	return c.MaxFrameSize
+}
+
+func (c *Conn) getCodec() Codec {
+	if c.Codec == nil {
+		return DefaultCodec
+	}
+	return c.Codec
+}
+
+func (c *Conn) getMaxMessageSize() int {
+	if c.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return c.MaxMessageSize
+}
+
+func (c *Conn) getMaxFlushRetries() int {
+	if c.MaxFlushRetries <= 0 {
+		return DefaultMaxFlushRetries
+	}
+	return c.MaxFlushRetries
+}
+
 func (c *Conn) getSeqOffset() uint32 {
 	if c.SeqOffset == 0 {
 		return DefaultSeqOffset
@@ -237,100 +1463,249 @@ func (c *Conn) getSeqDelta() uint32 {
 	return c.SeqDelta
 }
 
+// next returns the next sequence number to assign to a request. Sequence numbers start from SeqOffset and are
+// incremented by SeqDelta, skipping 0 should they wrap around.
 func (c *Conn) next() uint32 {
+	for {
+		seq := atomic.AddUint32(&c.seq, c.getSeqDelta())
+		if seq != 0 {
+			return seq
+		}
+	}
+}
+
+// registerRequest assigns pr a sequence number that is not in use by any other pending request.
+func (c *Conn) registerRequest(pr *pendingRequest) uint32 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.seq == 0 {
-		c.seq = c.getSeqOffset()
-	} else {
-		c.seq += c.getSeqDelta()
+	for {
+		seq := c.next()
+		if _, exists := c.reqs[seq]; !exists {
+			c.reqs[seq] = pr
+			return seq
+		}
 	}
-	return c.seq
 }
 
+// writeLoop writes queued messages to conn until closeWriter is called, after which all messages that are still
+// queued are written and conn is flushed one final time before it returns. Callers must only close conn once it
+// returns. Should a write or flush fail, writeLoop returns without attempting a final flush.
 func (c *Conn) writeLoop(conn BufferedConn) error {
 	var queue []*pendingWrite
+	var sched streamScheduler
 	var err error
 
+	unflushed := false // set while bytes written to conn have yet to be flushed
+
+	// Should conn be able to write several messages at once, every drain is written via a single call to
+	// WriteBuffers rather than via a call to Write per message.
+
+	bw, _ := conn.(BuffersWriter)
+	var vecs net.Buffers
+
+	// Writes whose flush is deferred by FlushInterval are held in batch until the flush that carries them. timer
+	// wakes the write loop once the flush is due.
+
+	var (
+		batch   []*pendingWrite
+		batched int
+		flushAt time.Time
+		timer   *time.Timer
+	)
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
 	for {
 		c.mu.Lock()
-		for !c.writerDone && len(c.writerQueue) == 0 {
+		for !c.writerDone && len(c.writerQueue) == 0 && len(c.writerUrgent) == 0 {
+			if len(batch) > 0 && !time.Now().Before(flushAt) {
+				break
+			}
 			c.writerCond.Wait()
 		}
 		done := c.writerDone
 
-		if n := len(c.writerQueue) - cap(queue); n > 0 {
+		// Every drain takes the entirety of both queues, such that urgent writes jump ahead of normal writes
+		// without ever being able to starve them. Normal writes are interleaved across the streams they were
+		// queued on.
+
+		if n := len(c.writerUrgent) + len(c.writerQueue) - cap(queue); n > 0 {
 			queue = append(queue[:cap(queue)], make([]*pendingWrite, n)...)
 		}
-		queue = queue[:len(c.writerQueue)]
+		queue = queue[:len(c.writerUrgent)+len(c.writerQueue)]
 
-		copy(queue, c.writerQueue)
+		urgent := copy(queue, c.writerUrgent)
+		copy(queue[urgent:], c.writerQueue)
+		sched.interleave(queue[urgent:])
 
+		c.writerUrgent = c.writerUrgent[:0]
 		c.writerQueue = c.writerQueue[:0]
+		c.queuedBytes = 0
+		c.writerRoom.Broadcast()
 		c.mu.Unlock()
 
-		if done && len(queue) == 0 {
+		if done && len(queue) == 0 && len(batch) == 0 {
 			break
 		}
 
 		timeout := c.getWriteTimeout()
 		if timeout > 0 {
 			err = conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+
+		flush := !c.ManualFlush
+		explicit := false
+
+		for _, pw := range queue {
 			if err != nil {
-				for _, pw := range queue {
-					if pw.wait {
-						pw.err = err
-						pw.wg.Done()
-					} else {
-						bytebufferpool.Put(pw.buf)
-						releasePendingWrite(pw)
-					}
-				}
 				break
 			}
+			if pw.buf == nil { // explicit flush
+				flush, explicit = true, true
+				continue
+			}
+			if c.OnWrite != nil {
+				c.OnWrite(pw.buf.B)
+			}
+			if bw != nil {
+				vecs = append(vecs, pw.buf.B)
+			} else {
+				_, err = conn.Write(pw.buf.B)
+				if err == nil {
+					c.counters.wrote(len(pw.buf.B))
+				}
+			}
+			batched += len(pw.buf.B)
+			unflushed = true
 		}
 
-		for _, pw := range queue {
+		if len(vecs) > 0 {
 			if err == nil {
-				_, err = conn.Write(pw.buf.B)
+				bufs := vecs // WriteBuffers consumes bufs
+				_, err = bw.WriteBuffers(&bufs)
 			}
-			if pw.wait {
-				pw.err = err
-				pw.wg.Done()
-			} else {
-				bytebufferpool.Put(pw.buf)
-				releasePendingWrite(pw)
+			if err == nil {
+				for _, b := range vecs {
+					c.counters.wrote(len(b))
+				}
+			}
+			for i := range vecs {
+				vecs[i] = nil
 			}
+			vecs = vecs[:0]
 		}
 
-		if err != nil {
-			break
+		if c.FlushInterval > 0 && flush {
+			if len(batch) == 0 && len(queue) > 0 {
+				flushAt = time.Now().Add(c.FlushInterval)
+				if timer == nil {
+					timer = time.AfterFunc(c.FlushInterval, c.wakeWriter)
+				} else {
+					timer.Reset(c.FlushInterval)
+				}
+			}
+			batch = append(batch, queue...)
+
+			due := err != nil || explicit || done || !time.Now().Before(flushAt) ||
+				(c.MaxBatchBytes > 0 && batched >= c.MaxBatchBytes)
+			if !due {
+				continue
+			}
+
+			queue = append(queue[:0], batch...)
+			batch = batch[:0]
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+		if flush {
+			batched = 0
+		}
+
+		if err == nil && flush {
+			err = c.flush(conn)
+			unflushed = false
+		}
+
+		if err == nil && c.OnQueueWait != nil {
+			now := time.Now()
+			for _, pw := range queue {
+				if pw.buf != nil {
+					c.OnQueueWait(now.Sub(pw.queued))
+				}
+			}
+		}
+
+		// A write is only considered successful once the flush that carries it onto the wire succeeds, or,
+		// should flushes be manual, once it has been written to conn.
+		for _, pw := range queue {
+			pw.complete(err)
 		}
 
-		err = conn.Flush()
 		if err != nil {
 			break
 		}
 	}
 
+	if err == nil && unflushed {
+		err = c.flush(conn)
+	}
+
 	if err != nil {
+		c.failPendingWrites(err)
 		err = fmt.Errorf("write_loop: %w", err)
 	}
 
 	return err
 }
 
+// wakeWriter wakes the write loop, such that it may flush writes whose flush is due.
+func (c *Conn) wakeWriter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writerCond.Signal()
+}
+
+// flush flushes conn, retrying up to MaxFlushRetries times should the flush fail with an error matching
+// ErrFlushRetryable. Errors designating that conn is closed are never retried.
+func (c *Conn) flush(conn BufferedConn) error {
+	err := conn.Flush()
+	for i := 0; i < c.getMaxFlushRetries() && err != nil; i++ {
+		if !errors.Is(err, ErrFlushRetryable) || errors.Is(err, net.ErrClosed) {
+			break
+		}
+		err = conn.Flush()
+	}
+	return err
+}
+
 func (c *Conn) readLoop(conn BufferedConn) error {
-	buf := make([]byte, c.getReadBufferSize())
+	// Conns that are not MessageReaders are read from with one byte more than ReadBufferSize, such that frames
+	// that would otherwise be truncated to ReadBufferSize are detected.
+
+	buf := make([]byte, c.getReadBufferSize(), c.getReadBufferSize()+1)
+
+	mr, _ := conn.(MessageReader)
+	max := c.getMaxFrameSize()
 
 	var (
-		n   int
-		err error
+		n       int
+		frame   []byte
+		data    []byte
+		partial []byte         // message being reassembled from fragments
+		stream  *io.PipeWriter // message being streamed to StreamHandler
+		err     error
 	)
 
+	timeout, idle := c.getFrameTimeout()
+	limiter := c.getRateLimiter()
+
 	for {
-		timeout := c.getReadTimeout()
 		if timeout > 0 {
 			err = conn.SetReadDeadline(time.Now().Add(timeout))
 			if err != nil {
@@ -338,29 +1713,127 @@ func (c *Conn) readLoop(conn BufferedConn) error {
 			}
 		}
 
-		n, err = conn.Read(buf)
+		// Frames that do not fit in buf are read into their own buffer, such that buf is never grown.
+
+		if mr != nil {
+			frame, err = mr.ReadMessage(buf[:0], max)
+		} else {
+			n, err = conn.Read(buf[:cap(buf)])
+			frame = buf[:n]
+			if err == nil && n > len(buf) {
+				err = fmt.Errorf("frame exceeds read buffer size of %d bytes: %w", len(buf), ErrMessageTooLarge)
+			}
+		}
 		if err != nil {
 			break
 		}
 
-		data := buf[:n]
-		if len(data) < 4 {
-			err = fmt.Errorf("no sequence number to decode: %w", io.ErrUnexpectedEOF)
+		if c.KeepAliveIdleOnly {
+			atomic.StoreUint32(&c.active, 1)
+		}
+
+		c.counters.read(len(frame))
+
+		if limiter != nil {
+			if d := limiter.Reserve(len(frame)); d > 0 {
+				if c.CloseOnRateLimit {
+					err = ErrRateLimited
+					break
+				}
+				c.throttle(d)
+			}
+		}
+
+		if c.OnRead != nil {
+			c.OnRead(frame)
+		}
+
+		var h frameHeader
+
+		h, data, err = decodeFrameHeader(frame)
+		if err != nil {
 			break
 		}
 
-		seq := bytesutil.Uint32BE(data)
-		data = data[4:]
+		if h.flags&flagGoodbye != 0 {
+			err = ErrPeerGoodbye
+			break
+		}
 
-		c.mu.Lock()
-		pr, exists := c.reqs[seq]
-		if exists {
-			delete(c.reqs, seq)
+		if isStreamFrame(h.flags) {
+			err = c.handleStreamFrame(h.seq, data)
+			if err != nil {
+				break
+			}
+			continue
 		}
-		c.mu.Unlock()
 
-		if seq == 0 || !exists {
-			err = c.call(seq, data)
+		if h.flags&(flagMore|flagLast) != 0 {
+			if h.flags&flagCancel != 0 { // our peer aborted the message being reassembled or streamed
+				partial = partial[:0]
+				if stream != nil {
+					stream.CloseWithError(fmt.Errorf("peer aborted message: %w", io.ErrUnexpectedEOF))
+					stream = nil
+				}
+				continue
+			}
+
+			// Requests and responses are always reassembled, as are all messages should there be no
+			// StreamHandler. Every fragment of a request or response carries its sequence number.
+
+			if stream != nil || (c.StreamHandler != nil && h.seq == 0 && len(partial) == 0) {
+				stream = c.streamFragment(stream, h, data)
+				continue
+			}
+
+			if len(partial)+len(data) > c.getMaxMessageSize() {
+				err = fmt.Errorf("max is %d bytes, got at least %d bytes: %w",
+					c.getMaxMessageSize(), len(partial)+len(data), ErrMessageTooLarge)
+				break
+			}
+
+			partial = append(partial, data...)
+			if h.flags&flagMore != 0 {
+				continue
+			}
+
+			if h.flags&flagResponse != 0 {
+				c.resolve(h, partial)
+			} else if err = c.call(h, partial); err != nil {
+				err = fmt.Errorf("handler encountered an error: %w", err)
+				break
+			}
+
+			// Large reassembly buffers are not held on to once a message has been handled.
+
+			if cap(partial) > len(buf) {
+				partial = nil
+			}
+			partial = partial[:0]
+			continue
+		}
+
+		if h.flags&(flagCancel|flagResponse) == flagCancel {
+			c.cancelInflight(h.seq)
+			continue
+		}
+
+		if h.flags&flagPing != 0 {
+			if h.flags&flagResponse != 0 {
+				atomic.StoreUint32(&c.pings, 0)
+			} else {
+				if h.flags&flagDeadline != 0 {
+					c.adoptKeepAlive(h.timeout)
+				}
+				if err := c.sendPing(frameHeader{flags: flagPing | flagResponse}); err != nil {
+					c.suppress("failed to respond to ping", err)
+				}
+			}
+			continue
+		}
+
+		if h.flags&flagResponse == 0 {
+			err = c.call(h, data)
 			if err != nil {
 				err = fmt.Errorf("handler encountered an error: %w", err)
 				break
@@ -368,46 +1841,271 @@ func (c *Conn) readLoop(conn BufferedConn) error {
 			continue
 		}
 
-		// received response
+		c.resolve(h, data)
+	}
+
+	if stream != nil {
+		stream.CloseWithError(ErrConnClosed)
+	}
+
+	if idle && errors.Is(err, os.ErrDeadlineExceeded) {
+		err = wrapError(ErrIdleTimeout, err)
+	}
+
+	return fmt.Errorf("read_loop: %w", err)
+}
+
+// resolve resolves the request that the response with header h and payload data responds to.
+func (c *Conn) resolve(h frameHeader, data []byte) {
+	c.mu.Lock()
+	pr, exists := c.reqs[h.seq]
+	if exists {
+		c.deleteRequest(h.seq)
+	}
+	c.mu.Unlock()
+
+	if !exists { // the request was cancelled, or has already been responded to
+		return
+	}
 
+	if h.flags&flagTimeout != 0 {
+		pr.err = ErrHandlerTimeout
+	} else if h.flags&flagCancel != 0 {
+		pr.err = wrapError(ErrRequestRejected, errors.New(string(data)))
+	} else {
 		pr.dst = bytesutil.ExtendSlice(pr.dst, len(data))
 		copy(pr.dst, data)
+	}
+
+	pr.done <- struct{}{}
+}
 
-		pr.wg.Done()
+// getFrameTimeout returns how long the read loop waits for the next frame, which is the shorter of ReadTimeout and
+// IdleTimeout that is positive, and whether the connection is to be considered idle should it elapse.
+func (c *Conn) getFrameTimeout() (time.Duration, bool) {
+	timeout := c.getReadTimeout()
+	if c.IdleTimeout > 0 && (timeout <= 0 || c.IdleTimeout < timeout) {
+		return c.IdleTimeout, true
 	}
+	return timeout, false
+}
 
-	return fmt.Errorf("read_loop: %w", err)
+func (c *Conn) call(h frameHeader, data []byte) error {
+	atomic.AddInt32(&c.handling, 1)
+
+	if !c.ConcurrentHandlers {
+		defer c.doneHandling()
+
+		ctx := acquireContext(c, h.seq, data)
+		defer releaseContext(ctx)
+
+		if h.flags&flagDeadline != 0 {
+			var cancel context.CancelFunc
+			ctx.ctx, cancel = context.WithTimeout(c.ctx, h.timeout)
+			defer cancel()
+		}
+
+		if h.trace != nil && c.Tracer != nil {
+			ctx.ctx = c.Tracer.Extract(ctx.ctx, c, h.trace)
+		}
+
+		if c.HandlerTimeout > 0 {
+			defer c.startHandlerTimeout(ctx)()
+		}
+
+		return c.handler.HandleMessage(ctx)
+	}
+
+	ctx := acquireContext(c, h.seq, nil)
+	ctx.body = append(ctx.body[:0], data...)
+	ctx.buf = ctx.body
+
+	var cancel context.CancelFunc
+	if h.flags&flagDeadline != 0 {
+		ctx.ctx, cancel = context.WithTimeout(c.ctx, h.timeout)
+	} else {
+		ctx.ctx, cancel = context.WithCancel(c.ctx)
+	}
+
+	if h.trace != nil && c.Tracer != nil {
+		ctx.ctx = c.Tracer.Extract(ctx.ctx, c, h.trace)
+	}
+
+	if h.seq != 0 {
+		c.mu.Lock()
+		c.inflight[h.seq] = cancel
+		c.mu.Unlock()
+	}
+
+	c.handlers.Add(1)
+
+	go func() {
+		defer c.handlers.Done()
+		defer c.doneHandling()
+		defer releaseContext(ctx)
+		defer cancel()
+
+		if h.seq != 0 {
+			defer func() {
+				c.mu.Lock()
+				delete(c.inflight, h.seq)
+				c.mu.Unlock()
+			}()
+		}
+
+		if c.HandlerTimeout > 0 {
+			defer c.startHandlerTimeout(ctx)()
+		}
+
+		err := c.handler.HandleMessage(ctx)
+		if err != nil {
+			c.failHandler(err)
+		}
+	}()
+
+	return nil
+}
+
+// streamFragment passes a fragment of a message to the StreamHandler handling the message, calling StreamHandler
+// should the fragment be the first of the message. It returns the writer through which the fragments that follow
+// are to be passed, which is nil once the message is complete.
+func (c *Conn) streamFragment(w *io.PipeWriter, h frameHeader, data []byte) *io.PipeWriter {
+	if w == nil {
+		var r *io.PipeReader
+		r, w = io.Pipe()
+		c.callStream(h, r)
+	}
+
+	// Fragments written after StreamHandler returned are discarded.
+
+	_, _ = w.Write(data)
+
+	if h.flags&flagLast != 0 {
+		w.Close()
+		return nil
+	}
+	return w
+}
+
+// callStream calls StreamHandler with r from a goroutine of its own. r is closed once StreamHandler returns or
+// the connection is closed, such that the read loop never blocks on a message no longer being read.
+func (c *Conn) callStream(h frameHeader, r *io.PipeReader) {
+	atomic.AddInt32(&c.handling, 1)
+
+	ctx := acquireContext(c, h.seq, nil)
+
+	c.handlers.Add(1)
+
+	go func() {
+		defer c.handlers.Done()
+		defer c.doneHandling()
+		defer releaseContext(ctx)
+
+		returned := make(chan struct{})
+		defer close(returned)
+
+		go func() {
+			select {
+			case <-c.ctx.Done():
+				r.CloseWithError(ErrConnClosed)
+			case <-returned:
+				r.Close()
+			}
+		}()
+
+		err := c.StreamHandler.HandleStream(ctx, r)
+		if err != nil {
+			c.failHandler(err)
+		}
+	}()
 }
 
-func (c *Conn) call(seq uint32, data []byte) error {
-	ctx := acquireContext(c, seq, data)
-	defer releaseContext(ctx)
-	return c.getHandler().HandleMessage(ctx)
+// startHandlerTimeout bounds the handler being passed ctx by HandlerTimeout, and returns a function to be called
+// once the handler returns. Should ctx be for a request that the handler has yet to reply to once the timeout
+// elapses, a timeout response is sent in its place.
+func (c *Conn) startHandlerTimeout(ctx *Context) func() {
+	var cancel context.CancelFunc
+	ctx.ctx, cancel = context.WithTimeout(ctx.ctx, c.HandlerTimeout)
+
+	if ctx.seq == 0 {
+		return cancel
+	}
+
+	// The timer may fire after ctx is released back to its pool, and therefore must not refer to it.
+
+	seq, replied := ctx.seq, new(uint32)
+	ctx.replied = replied
+
+	timer := time.AfterFunc(c.HandlerTimeout, func() {
+		if !atomic.CompareAndSwapUint32(replied, 0, 1) {
+			return
+		}
+		err := c.sendNoWait(frameHeader{seq: seq, flags: flagResponse | flagTimeout}, PriorityHigh, nil)
+		if err != nil {
+			c.suppress("failed to respond to timed out request", err, "seq", seq)
+		}
+	})
+
+	return func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// failHandler closes the connection because a handler that was called outside of the read loop failed with err.
+// The error is reported by Handle should the connection not have already been closed for another reason.
+func (c *Conn) failHandler(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writerDone {
+		return
+	}
+
+	c.handlerErr = fmt.Errorf("handler encountered an error: %w", err)
+	c.writerDone = true
+	c.writerCond.Signal()
+}
+
+// cancelInflight cancels the context of the handler that is handling the request with sequence number seq.
+func (c *Conn) cancelInflight(seq uint32) {
+	c.mu.Lock()
+	cancel, exists := c.inflight[seq]
+	c.mu.Unlock()
+
+	if exists {
+		cancel()
+	}
 }
 
 func (c *Conn) close(err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if err == nil {
+		err = ErrConnClosed
+	} else {
+		err = wrapError(ErrConnClosed, err)
+	}
+
+	for _, pw := range c.writerUrgent {
+		pw.complete(err)
+	}
 	for _, pw := range c.writerQueue {
-		if pw.wait {
-			pw.err = err
-			pw.wg.Done()
-		} else {
-			bytebufferpool.Put(pw.buf)
-			releasePendingWrite(pw)
-		}
+		pw.complete(err)
 	}
 
+	c.writerUrgent = nil
 	c.writerQueue = nil
+	c.queuedBytes = 0
 
 	for seq := range c.reqs {
 		pr := c.reqs[seq]
 		pr.err = err
-		pr.wg.Done()
+		pr.done <- struct{}{}
 
-		delete(c.reqs, seq)
+		c.deleteRequest(seq)
 	}
 
-	c.seq = 0
+	atomic.StoreUint32(&c.seq, c.getSeqOffset()-c.getSeqDelta())
 }
@@ -0,0 +1,1548 @@
+package monte
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var _ BufferedConn = (*mockConn)(nil)
+
+// mockConn is a BufferedConn that records flushed writes, and whose flushes may be intercepted. Methods that are
+// not overridden panic.
+type mockConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	buffered [][]byte
+	written  [][]byte
+	flushes  int
+
+	flush func(n int) error
+	read  func(b []byte) (int, error)
+	close func()
+}
+
+func (m *mockConn) Read(b []byte) (int, error) { return m.read(b) }
+
+func (m *mockConn) Close() error {
+	if m.close != nil {
+		m.close()
+	}
+	return nil
+}
+
+func (m *mockConn) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buffered = append(m.buffered, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (m *mockConn) Flush() error {
+	m.mu.Lock()
+	m.flushes++
+	n := m.flushes
+	m.mu.Unlock()
+
+	if m.flush != nil {
+		err := m.flush(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.written = append(m.written, m.buffered...)
+	m.buffered = m.buffered[:0]
+	return nil
+}
+
+func (m *mockConn) numWritten() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.written)
+}
+
+func (m *mockConn) numBuffered() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buffered)
+}
+
+func enqueueTestWrite(t testing.TB, c *Conn, wait bool) *pendingWrite {
+	return enqueueTestWritePriority(t, c, wait, PriorityNormal, "hello")
+}
+
+func enqueueTestWritePriority(t testing.TB, c *Conn, wait bool, prio Priority, payload string) *pendingWrite {
+	buf := acquireBuffer(len(payload))
+	copy(buf.B, payload)
+
+	pw, err := c.preparePendingWrite(buf, wait, prio, 0)
+	require.NoError(t, err)
+
+	return pw
+}
+
+func TestWriteLoopFlushError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errFlush := errors.New("flush failed")
+
+	flushing := make(chan int)
+	resume := make(chan struct{})
+
+	conn := &mockConn{flush: func(n int) error {
+		flushing <- n
+		<-resume
+		if n == 2 {
+			return errFlush
+		}
+		return nil
+	}}
+
+	var c Conn
+	c.once.Do(c.init)
+
+	a := enqueueTestWrite(t, &c, true)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	// Queue up a second batch while the first batch is being flushed.
+
+	require.EqualValues(t, 1, <-flushing)
+
+	b := enqueueTestWrite(t, &c, true)
+	enqueueTestWrite(t, &c, false)
+	d := enqueueTestWrite(t, &c, true)
+
+	resume <- struct{}{}
+
+	a.wg.Wait()
+	require.NoError(t, a.err)
+
+	// Queue up a third batch while the second batch is being flushed.
+
+	require.EqualValues(t, 2, <-flushing)
+
+	e := enqueueTestWrite(t, &c, true)
+	enqueueTestWrite(t, &c, false)
+
+	resume <- struct{}{}
+
+	for _, pw := range []*pendingWrite{b, d, e} {
+		pw.wg.Wait()
+		require.True(t, errors.Is(pw.err, errFlush))
+	}
+
+	err := <-writerDone
+	require.True(t, errors.Is(err, errFlush))
+
+	require.Zero(t, c.NumPendingWrites())
+
+	_, err = c.preparePendingWrite(acquireBuffer(0), true, PriorityNormal, 0)
+	require.Error(t, err)
+}
+
+func TestWriteLoopRetryableFlush(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errRetry := fmt.Errorf("short write: %w", ErrFlushRetryable)
+
+	// The first flush fails transiently, and the second succeeds.
+
+	conn := &mockConn{flush: func(n int) error {
+		if n == 1 {
+			return errRetry
+		}
+		return nil
+	}}
+
+	var c Conn
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	pw := enqueueTestWrite(t, &c, true)
+	pw.wg.Wait()
+	require.NoError(t, pw.err)
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.Equal(t, 1, conn.numWritten())
+	require.Equal(t, 2, conn.flushes)
+}
+
+func TestWriteLoopRetryableFlushExhausted(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	for _, tc := range []struct {
+		err     error
+		flushes int
+	}{
+		// Flushes are retried up to MaxFlushRetries times.
+		{fmt.Errorf("short write: %w", ErrFlushRetryable), 3},
+
+		// Flushes to a closed connection are never retried.
+		{wrapError(ErrFlushRetryable, net.ErrClosed), 1},
+		{errors.New("flush failed"), 1},
+	} {
+		conn := &mockConn{flush: func(n int) error { return tc.err }}
+
+		c := &Conn{MaxFlushRetries: 2}
+		c.once.Do(c.init)
+
+		writerDone := make(chan error)
+		go func() {
+			writerDone <- c.writeLoop(conn)
+		}()
+
+		pw := enqueueTestWrite(t, c, true)
+		pw.wg.Wait()
+		require.True(t, errors.Is(pw.err, tc.err))
+
+		require.True(t, errors.Is(<-writerDone, tc.err))
+		require.Equal(t, tc.flushes, conn.flushes)
+	}
+}
+
+func TestConnMaxWriteSize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := &Conn{MaxWriteSize: 8}
+
+	buf := make([]byte, 9)
+
+	require.True(t, errors.Is(c.Send(buf), ErrMessageTooLarge))
+	require.True(t, errors.Is(c.SendNoWait(buf), ErrMessageTooLarge))
+
+	_, err := c.Request(nil, buf)
+	require.True(t, errors.Is(err, ErrMessageTooLarge))
+
+	require.Zero(t, c.NumPendingWrites())
+
+	require.NoError(t, c.SendNoWait(buf[:8]))
+	require.EqualValues(t, 1, c.NumPendingWrites())
+}
+
+func TestWriteLoopPriority(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn := &mockConn{}
+
+	var c Conn
+	c.once.Do(c.init)
+
+	for i := 0; i < 128; i++ {
+		enqueueTestWritePriority(t, &c, false, PriorityNormal, "normal")
+	}
+	enqueueTestWritePriority(t, &c, false, PriorityHigh, "urgent")
+	last := enqueueTestWritePriority(t, &c, true, PriorityNormal, "normal")
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	last.wg.Wait()
+	require.NoError(t, last.err)
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.Len(t, conn.written, 130)
+	require.EqualValues(t, "urgent", conn.written[0])
+	for _, b := range conn.written[1:] {
+		require.EqualValues(t, "normal", b)
+	}
+}
+
+func TestWriteLoopStreamFairness(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn := &mockConn{}
+
+	var c Conn
+	c.once.Do(c.init)
+
+	enqueue := func(stream uint32, prio Priority, payload string) *pendingWrite {
+		buf := acquireBuffer(len(payload))
+		copy(buf.B, payload)
+
+		pw, err := c.preparePendingWrite(buf, true, prio, stream)
+		require.NoError(t, err)
+
+		return pw
+	}
+
+	var writes []*pendingWrite
+
+	// A bulk stream queues a large backlog before a latency-sensitive stream queues a few messages.
+
+	for i := 0; i < 128; i++ {
+		writes = append(writes, enqueue(1, PriorityNormal, "bulk"))
+	}
+	for i := 0; i < 3; i++ {
+		writes = append(writes, enqueue(2, PriorityNormal, "latency"))
+	}
+	writes = append(writes, enqueue(2, PriorityHigh, "urgent"))
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	for _, pw := range writes {
+		pw.wg.Wait()
+		require.NoError(t, pw.err)
+		releasePendingWrite(pw)
+	}
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.Len(t, conn.written, 132)
+
+	expected := []string{"urgent", "bulk", "latency", "bulk", "latency", "bulk", "latency", "bulk"}
+	for i, b := range expected {
+		require.EqualValues(t, b, conn.written[i])
+	}
+	for _, b := range conn.written[len(expected):] {
+		require.EqualValues(t, "bulk", b)
+	}
+}
+
+func TestConnManualFlush(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn := &mockConn{}
+
+	c := &Conn{ManualFlush: true}
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Send([]byte("hello")))
+	}
+
+	require.EqualValues(t, 3, conn.numBuffered())
+	require.EqualValues(t, 0, conn.numWritten())
+
+	require.NoError(t, c.Flush())
+
+	require.EqualValues(t, 0, conn.numBuffered())
+	require.EqualValues(t, 3, conn.numWritten())
+
+	// Messages that have yet to be flushed must be flushed on a graceful close.
+
+	require.NoError(t, c.SendNoWait([]byte("hello")))
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.EqualValues(t, 4, conn.numWritten())
+}
+
+func TestConnFlushInterval(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	conn := &mockConn{}
+
+	c := &Conn{FlushInterval: 50 * time.Millisecond}
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	// Writes made within FlushInterval of one another are coalesced into a single flush, and writes that are
+	// waited on only complete once flushed.
+
+	for i := 0; i < 9; i++ {
+		require.NoError(t, c.SendNoWait([]byte("hello")))
+	}
+
+	start := time.Now()
+	require.NoError(t, c.Send([]byte("hello")))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(c.FlushInterval)/2)
+
+	require.EqualValues(t, 10, conn.numWritten())
+	require.EqualValues(t, 1, conn.flushes)
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	// Writes are flushed before FlushInterval elapses should they amount to MaxBatchBytes, or should Flush be
+	// called explicitly.
+
+	conn = &mockConn{}
+
+	c = &Conn{FlushInterval: time.Hour, MaxBatchBytes: 1}
+	c.once.Do(c.init)
+
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	require.NoError(t, c.Send([]byte("hello")))
+	require.EqualValues(t, 1, conn.numWritten())
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	conn = &mockConn{}
+
+	c = &Conn{FlushInterval: time.Hour}
+	c.once.Do(c.init)
+
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	require.NoError(t, c.SendNoWait([]byte("hello")))
+	require.NoError(t, c.Flush())
+	require.EqualValues(t, 1, conn.numWritten())
+
+	// Writes whose flush is deferred are flushed on a graceful close.
+
+	require.NoError(t, c.SendNoWait([]byte("hello")))
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.EqualValues(t, 2, conn.numWritten())
+}
+
+// vectoredConn is a mockConn that implements BuffersWriter.
+type vectoredConn struct {
+	*mockConn
+	calls int
+}
+
+func (v *vectoredConn) WriteBuffers(bufs *net.Buffers) (int64, error) {
+	v.calls++
+
+	var n int64
+	for _, b := range *bufs {
+		nn, err := v.Write(b)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	*bufs = nil
+	return n, nil
+}
+
+func TestConnWriteBuffers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var c Conn
+	c.once.Do(c.init)
+
+	// Messages drained from the write queue at once are written via a single call to WriteBuffers.
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.SendNoWait([]byte("hello")))
+	}
+
+	conn := &vectoredConn{mockConn: &mockConn{}}
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.Equal(t, 1, conn.calls)
+	require.Equal(t, 3, conn.numWritten())
+}
+
+func TestConnNextSeq(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := &Conn{SeqOffset: 1, SeqDelta: 2}
+	c.once.Do(c.init)
+
+	require.EqualValues(t, 1, c.next())
+	require.EqualValues(t, 3, c.next())
+
+	// Sequence numbers skip 0 and those still in use by pending requests should they wrap around.
+
+	c = &Conn{SeqOffset: ^uint32(0) - 1, SeqDelta: 1}
+	c.once.Do(c.init)
+
+	pr := acquirePendingRequest(nil)
+	defer releasePendingRequest(pr)
+
+	require.EqualValues(t, ^uint32(0)-1, c.registerRequest(pr))
+	require.EqualValues(t, ^uint32(0), c.next())
+	require.EqualValues(t, 1, c.next())
+
+	atomic.StoreUint32(&c.seq, ^uint32(0)-2)
+	require.EqualValues(t, ^uint32(0), c.registerRequest(pr))
+}
+
+func BenchmarkParallelRegisterRequest(b *testing.B) {
+	var c Conn
+	c.once.Do(c.init)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		pr := acquirePendingRequest(nil)
+		defer releasePendingRequest(pr)
+
+		for pb.Next() {
+			c.abortRequest(c.registerRequest(pr), pr)
+		}
+	})
+}
+
+func TestConnFlushOnClose(t *testing.T) {
+	for _, manual := range []bool{false, true} {
+		t.Run(fmt.Sprintf("manual=%t", manual), func(t *testing.T) {
+			defer goleak.VerifyNone(t)
+
+			closed := make(chan struct{})
+
+			conn := &mockConn{read: func(b []byte) (int, error) {
+				<-closed
+				return 0, net.ErrClosed
+			}}
+
+			// Record how many frames were flushed at the moment conn is closed.
+
+			flushedOnClose := -1
+			conn.close = func() {
+				flushedOnClose = conn.numWritten()
+				close(closed)
+			}
+
+			c := &Conn{ManualFlush: manual}
+
+			done := make(chan struct{})
+			handled := make(chan struct{})
+			go func() {
+				_ = c.Handle(done, conn)
+				close(handled)
+			}()
+
+			require.NoError(t, c.SendNoWait([]byte("last words")))
+			close(done)
+			<-handled
+
+			// The final message and the goodbye that follows it were flushed before conn was closed.
+
+			require.Equal(t, 2, flushedOnClose)
+			require.Zero(t, conn.numBuffered())
+
+			_, data, err := decodeFrameHeader(conn.written[0])
+			require.NoError(t, err)
+			require.EqualValues(t, "last words", data)
+
+			h, _, err := decodeFrameHeader(conn.written[1])
+			require.NoError(t, err)
+			require.EqualValues(t, flagGoodbye, h.flags)
+		})
+	}
+}
+
+func TestConnNoFlushOnError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errWrite := errors.New("write failed")
+
+	closed := make(chan struct{})
+
+	conn := &mockConn{
+		read: func(b []byte) (int, error) {
+			<-closed
+			return 0, net.ErrClosed
+		},
+		flush: func(n int) error { return errWrite },
+		close: func() { close(closed) },
+	}
+
+	c := &Conn{}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	handled := make(chan error)
+	go func() {
+		handled <- c.Handle(done, conn)
+	}()
+
+	err := c.Send([]byte("hello"))
+	require.True(t, errors.Is(err, errWrite))
+	require.True(t, errors.Is(<-handled, errWrite))
+
+	// No flush is attempted past the one that failed.
+
+	require.Equal(t, 1, conn.flushes)
+}
+
+func TestConnSendContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	flushing := make(chan struct{})
+	resume := make(chan struct{})
+
+	conn := &mockConn{flush: func(n int) error {
+		if n == 1 {
+			close(flushing)
+			<-resume
+		}
+		return nil
+	}}
+
+	var c Conn
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	// Stall the write loop on flushing the first write, such that the next write stays queued.
+
+	first := enqueueTestWrite(t, &c, true)
+	<-flushing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := c.SendContext(ctx, []byte("second"))
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Zero(t, c.NumPendingWrites())
+
+	close(resume)
+	first.wg.Wait()
+	require.NoError(t, first.err)
+
+	// Writes that are not cancelled are written as usual.
+
+	require.NoError(t, c.SendContext(context.Background(), []byte("third")))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, c.SendContext(ctx, []byte("fourth")))
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.Equal(t, 3, conn.numWritten())
+	require.EqualValues(t, "hello", conn.written[0])
+	for i, payload := range []string{"third", "fourth"} {
+		_, data, err := decodeFrameHeader(conn.written[i+1])
+		require.NoError(t, err)
+		require.EqualValues(t, payload, data)
+	}
+}
+
+func TestConnMaxPendingWrites(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	flushing := make(chan struct{})
+	resume := make(chan struct{})
+
+	conn := &mockConn{flush: func(n int) error {
+		if n == 1 {
+			close(flushing)
+			<-resume
+		}
+		return nil
+	}}
+
+	c := Conn{MaxPendingWrites: 2, MaxPendingBytes: 64, FailFastIfQueueFull: true}
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	// Stall the write loop on flushing the first write, such that the next writes stay queued.
+
+	first := enqueueTestWrite(t, &c, true)
+	<-flushing
+
+	require.NoError(t, c.SendNoWait([]byte("a")))
+	require.NoError(t, c.SendNoWait([]byte("b")))
+
+	// Writes that are not waited on fail fast once the queue is full, though pings are still queued.
+
+	require.True(t, errors.Is(c.SendNoWait([]byte("c")), ErrWriteQueueFull))
+	require.NoError(t, c.sendPing(frameHeader{flags: flagPing}))
+	require.Equal(t, 3, c.NumPendingWrites())
+
+	// Writes that are waited on block until the write loop frees up room.
+
+	sent := make(chan error)
+	go func() {
+		sent <- c.Send([]byte("d"))
+	}()
+
+	select {
+	case err := <-sent:
+		t.Fatalf("send did not block on a full queue: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(resume)
+	first.wg.Wait()
+	require.NoError(t, <-sent)
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.True(t, errors.Is(c.SendNoWait([]byte("e")), ErrConnClosed))
+
+	// Messages larger than MaxPendingBytes are only queued into an empty queue.
+
+	d := Conn{MaxPendingBytes: 64}
+	require.False(t, d.queueFull(128))
+
+	d.writerQueue = append(d.writerQueue, &pendingWrite{})
+	d.queuedBytes = 32
+
+	require.False(t, d.queueFull(32))
+	require.True(t, d.queueFull(33))
+}
+
+// discardConn is a BufferedConn that discards all writes made to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (discardConn) Flush() error                { return nil }
+
+func TestWriteLoopNoStalls(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	const numWriters = 16
+	const numWrites = 1000
+
+	conn := &mockConn{}
+
+	var c Conn
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	// Every writer waits for its write to be flushed before queueing its next, such that the write loop keeps
+	// alternating between waiting on an empty queue and draining a partial one. A missed wakeup stalls a writer.
+
+	var wg sync.WaitGroup
+	wg.Add(numWriters)
+
+	for i := 0; i < numWriters; i++ {
+		prio := PriorityNormal
+		if i%4 == 0 {
+			prio = PriorityHigh
+		}
+
+		go func(prio Priority) {
+			defer wg.Done()
+
+			for j := 0; j < numWrites; j++ {
+				pw := enqueueTestWritePriority(t, &c, true, prio, "hello")
+				pw.wg.Wait()
+				require.NoError(t, pw.err)
+				releasePendingWrite(pw)
+			}
+		}(prio)
+	}
+
+	writersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(writersDone)
+	}()
+
+	select {
+	case <-writersDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("write loop stalled")
+	}
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.Equal(t, numWriters*numWrites, conn.numWritten())
+}
+
+func BenchmarkParallelWriteNoWait(b *testing.B) {
+	var c Conn
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(discardConn{})
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := acquireBuffer(5)
+			copy(buf.B, "hello")
+
+			if err := c.writeNoWait(buf, PriorityNormal, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.StopTimer()
+
+	c.closeWriter()
+	if err := <-writerDone; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// pipeConns establishes a session between a and b over an in-memory pipe, and handles both of them until the
+// returned function is called.
+func pipeConns(t testing.TB, a, b *Conn) func() {
+	alice, bob := net.Pipe()
+
+	var as, bs Session
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		require.NoError(t, as.DoClient(alice))
+	}()
+
+	go func() {
+		defer wg.Done()
+		require.NoError(t, bs.DoServer(bob))
+	}()
+
+	wg.Wait()
+
+	done := make(chan struct{})
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		a.close(a.Handle(done, NewSessionConn(as.Suite(), alice)))
+	}()
+
+	go func() {
+		defer wg.Done()
+		b.close(b.Handle(done, NewSessionConn(bs.Suite(), bob)))
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func TestConnAbortWritesOnReadError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errRead := errors.New("read failed")
+
+	flushing := make(chan struct{})
+	resume := make(chan struct{})
+	readFail := make(chan struct{})
+
+	conn := &mockConn{
+		flush: func(n int) error {
+			if n == 1 {
+				close(flushing)
+				<-resume
+			}
+			return nil
+		},
+		read: func(b []byte) (int, error) {
+			<-readFail
+			return 0, errRead
+		},
+	}
+
+	c := &Conn{AbortWritesOnReadError: true}
+
+	handleDone := make(chan error)
+	go func() {
+		handleDone <- c.Handle(make(chan struct{}), conn)
+	}()
+
+	a := make(chan error)
+	go func() {
+		a <- c.Send([]byte("a"))
+	}()
+
+	<-flushing
+
+	b := make(chan error)
+	go func() {
+		b <- c.Send([]byte("b"))
+	}()
+
+	for c.NumPendingWrites() == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// The write that has yet to be picked up by the write loop is aborted without waiting for the write loop,
+	// while the write that is being flushed is resolved with the outcome of its flush.
+
+	close(readFail)
+
+	err := <-b
+	require.True(t, errors.Is(err, ErrConnClosed))
+	require.True(t, errors.Is(err, errRead))
+
+	close(resume)
+
+	require.NoError(t, <-a)
+	require.True(t, errors.Is(<-handleDone, errRead))
+
+	require.EqualValues(t, 1, conn.numWritten())
+}
+
+// frameRecorder records copies of the raw frames passed to an OnRead or OnWrite hook.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (r *frameRecorder) record(frame []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, append([]byte(nil), frame...))
+}
+
+func (r *frameRecorder) get(i int) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.frames[i]
+}
+
+func TestConnReadWriteHooks(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var aw, ar, bw, br frameRecorder
+
+	a := &Conn{OnRead: ar.record, OnWrite: aw.record}
+	b := &Conn{
+		OnRead:  br.record,
+		OnWrite: bw.record,
+		Handler: HandlerFunc(func(ctx *Context) error { return ctx.Reply([]byte("pong")) }),
+	}
+
+	defer pipeConns(t, a, b)()
+
+	res, err := a.Request(nil, []byte("ping"))
+	require.NoError(t, err)
+	require.EqualValues(t, "pong", res)
+
+	// The request is read by b exactly as it was written by a, and vice versa for the response.
+
+	require.Equal(t, aw.get(0), br.get(0))
+	require.Equal(t, bw.get(0), ar.get(0))
+
+	h, body, err := decodeFrameHeader(aw.get(0))
+	require.NoError(t, err)
+	require.NotZero(t, h.seq)
+	require.Zero(t, h.flags)
+	require.EqualValues(t, "ping", body)
+
+	rh, body, err := decodeFrameHeader(bw.get(0))
+	require.NoError(t, err)
+	require.Equal(t, h.seq, rh.seq)
+	require.Equal(t, flagResponse, rh.flags)
+	require.EqualValues(t, "pong", body)
+}
+
+func TestConnConcurrentHandlerError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	errHandler := errors.New("handler failed")
+
+	frames := make(chan []byte, 1)
+	closed := make(chan struct{})
+
+	var once sync.Once
+
+	conn := &mockConn{
+		read: func(b []byte) (int, error) {
+			select {
+			case frame := <-frames:
+				return copy(b, frame), nil
+			case <-closed:
+				return 0, io.EOF
+			}
+		},
+		close: func() { once.Do(func() { close(closed) }) },
+	}
+
+	c := &Conn{
+		ConcurrentHandlers: true,
+		Handler:            HandlerFunc(func(ctx *Context) error { return errHandler }),
+	}
+
+	frame := make([]byte, frameHeader{}.size())
+	frameHeader{seq: 1}.encode(frame)
+	frames <- frame
+
+	// The connection is closed with the handler's error rather than with the error the read loop fails with
+	// once the connection is closed.
+
+	err := c.Handle(make(chan struct{}), conn)
+	require.True(t, errors.Is(err, errHandler))
+}
+
+func TestConnRespond(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	a := &Conn{}
+	b := &Conn{Handler: HandlerFunc(func(ctx *Context) error {
+		return ctx.Responder().Respond(ctx.Seq(), ctx.Body())
+	})}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	var wg sync.WaitGroup
+	wg.Add(16)
+
+	for i := 0; i < 16; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 64; j++ {
+				req := []byte{byte(i), byte(j)}
+				res, err := a.Request(nil, req)
+				require.NoError(t, err)
+				require.EqualValues(t, req, res)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestConnEmptyMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	received := make(chan []byte, 16)
+
+	a := &Conn{}
+	b := &Conn{Handler: HandlerFunc(func(ctx *Context) error {
+		if ctx.Seq() == 0 {
+			received <- append([]byte(nil), ctx.Body()...)
+			return nil
+		}
+		if string(ctx.Body()) == "empty" {
+			return ctx.Reply(nil)
+		}
+		return ctx.Reply(ctx.Body())
+	})}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	// Empty requests and responses are delivered as empty payloads, interleaved with non-empty ones.
+
+	for _, tc := range []struct{ req, res string }{
+		{"", ""},
+		{"hello", "hello"},
+		{"empty", ""},
+		{"", ""},
+		{"world", "world"},
+	} {
+		require.NoError(t, a.Send([]byte(tc.req)))
+
+		res, err := a.Request(nil, []byte(tc.req))
+		require.NoError(t, err)
+		require.Len(t, res, len(tc.res))
+		require.EqualValues(t, tc.res, string(res))
+
+		require.EqualValues(t, tc.req, string(<-received))
+	}
+}
+
+func TestWriteLoopQueueWait(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var mu sync.Mutex
+	var waits []time.Duration
+
+	// Every flush after the first stalls for longer than the last.
+
+	conn := &mockConn{flush: func(n int) error {
+		time.Sleep(time.Duration(n-1) * 50 * time.Millisecond)
+		return nil
+	}}
+
+	c := &Conn{OnQueueWait: func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		waits = append(waits, d)
+	}}
+	c.once.Do(c.init)
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	for i := 0; i < 3; i++ {
+		pw := enqueueTestWrite(t, c, true)
+		pw.wg.Wait()
+		require.NoError(t, pw.err)
+		releasePendingWrite(pw)
+	}
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, waits, 3)
+	require.Less(t, int64(waits[0]), int64(50*time.Millisecond))
+	require.GreaterOrEqual(t, int64(waits[1]), int64(50*time.Millisecond))
+	require.GreaterOrEqual(t, int64(waits[2]), int64(100*time.Millisecond))
+}
+
+// errReader fails with err once the reader it wraps is exhausted.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func TestConnWriteFrom(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	received := make(chan []byte, 4)
+
+	a := &Conn{WriteBufferSize: 1024}
+	b := &Conn{Handler: HandlerFunc(func(ctx *Context) error {
+		received <- append([]byte(nil), ctx.Body()...)
+		return nil
+	})}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	payload := make([]byte, 100*1024+123)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	// Only size bytes are read from the reader, while messages written alongside are delivered separately.
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- a.WriteFrom(io.LimitReader(bytes.NewReader(append(payload, "trailing"...)), int64(len(payload))), int64(len(payload)))
+	}()
+
+	require.NoError(t, a.Send([]byte("interleaved")))
+	require.NoError(t, <-errs)
+
+	var messages [][]byte
+	messages = append(messages, <-received, <-received)
+	if string(messages[0]) != "interleaved" {
+		messages[0], messages[1] = messages[1], messages[0]
+	}
+	require.EqualValues(t, "interleaved", messages[0])
+	require.Equal(t, payload, messages[1])
+
+	// Messages that fit within a single frame are not fragmented.
+
+	require.NoError(t, a.WriteFrom(bytes.NewReader([]byte("small")), 5))
+	require.EqualValues(t, "small", <-received)
+
+	// A reader failing mid-stream aborts the message, which our peer discards.
+
+	errFailed := errors.New("reader failed")
+
+	err = a.WriteFrom(&errReader{r: bytes.NewReader(payload[:10*1024]), err: errFailed}, int64(len(payload)))
+	require.True(t, errors.Is(err, errFailed))
+
+	require.NoError(t, a.WriteFrom(bytes.NewReader(payload), int64(len(payload))))
+	require.Equal(t, payload, <-received)
+}
+
+func TestConnWriteFromMaxMessageSize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	disconnected := make(chan error, 1)
+
+	a := &Conn{WriteBufferSize: 1024}
+	b := &Conn{
+		MaxMessageSize: 4096,
+		OnDisconnect:   func(conn *Conn, err error) { disconnected <- err },
+	}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	_ = a.WriteFrom(bytes.NewReader(make([]byte, 8192)), 8192)
+
+	require.True(t, errors.Is(<-disconnected, ErrMessageTooLarge))
+}
+
+func TestConnFragmentLargeMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	received := make(chan []byte, 1)
+
+	a := &Conn{MaxFrameSize: 4096}
+	b := &Conn{MaxFrameSize: 4096, Handler: HandlerFunc(func(ctx *Context) error {
+		if ctx.Seq() == 0 {
+			received <- append([]byte(nil), ctx.Body()...)
+			return nil
+		}
+		return ctx.Reply(ctx.Body())
+	})}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	payload := make([]byte, 20*1024+123)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	// Messages, requests, and responses that do not fit within MaxFrameSize are transparently fragmented.
+
+	require.NoError(t, a.Send(payload))
+	require.Equal(t, payload, <-received)
+
+	require.NoError(t, a.SendNoWait(payload))
+	require.Equal(t, payload, <-received)
+
+	res, err := a.Request(nil, payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, res)
+}
+
+func TestConnTinyMaxFrameSize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	for _, size := range []int{1, 3, 5, MinFrameSize - 1} {
+		received := make(chan []byte, 1)
+
+		a := &Conn{MaxFrameSize: size}
+		b := &Conn{MaxFrameSize: size, Handler: HandlerFunc(func(ctx *Context) error {
+			if ctx.Seq() == 0 {
+				received <- append([]byte(nil), ctx.Body()...)
+				return nil
+			}
+			return ctx.Reply(ctx.Body())
+		})}
+
+		closer := pipeConns(t, a, b)
+
+		// Max frame sizes too small to fit a fragment are raised to MinFrameSize, rather than fragmenting messages
+		// forever or overflowing the frames they are encoded into.
+
+		require.Equal(t, MinFrameSize, a.Config().MaxFrameSize)
+
+		payload := make([]byte, 4*MinFrameSize+1)
+		_, err := rand.Read(payload)
+		require.NoError(t, err)
+
+		require.NoError(t, a.Send(payload))
+		require.Equal(t, payload, <-received)
+
+		res, err := a.Request(nil, payload)
+		require.NoError(t, err)
+		require.Equal(t, payload, res)
+
+		closer()
+	}
+}
+
+func TestConnMaxFrameSize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	disconnected := make(chan error, 1)
+
+	a := &Conn{}
+	b := &Conn{
+		MaxFrameSize: 4096,
+		OnDisconnect: func(conn *Conn, err error) { disconnected <- err },
+	}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	// Frames exceeding the MaxFrameSize of our peer close the connection rather than being truncated.
+
+	_ = a.SendNoWait(make([]byte, 8192))
+
+	require.True(t, errors.Is(<-disconnected, ErrMessageTooLarge))
+}
+
+func TestConnSendStream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	type result struct {
+		payload []byte
+		err     error
+	}
+
+	received := make(chan result, 1)
+
+	a := &Conn{WriteBufferSize: 1024, MaxWriteSize: 200 * 1024}
+	b := &Conn{StreamHandler: StreamHandlerFunc(func(ctx *Context, r io.Reader) error {
+		payload, err := ioutil.ReadAll(r)
+		received <- result{payload: payload, err: err}
+		return nil
+	})}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	payload := make([]byte, 100*1024+123)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	// Payloads are streamed to our peer's StreamHandler regardless of their size, including those that end on a
+	// fragment boundary and those small enough to fit within a single frame.
+
+	chunk := a.getFragmentSize()
+
+	for _, size := range []int{len(payload), 3 * chunk, 5, 0} {
+		require.NoError(t, a.SendStream(bytes.NewReader(payload[:size])))
+
+		res := <-received
+		require.NoError(t, res.err)
+		require.True(t, bytes.Equal(payload[:size], res.payload))
+	}
+
+	// A reader failing mid-stream aborts the message, which fails the reads of our peer's StreamHandler.
+
+	errFailed := errors.New("reader failed")
+
+	err = a.SendStream(&errReader{r: bytes.NewReader(payload[:10*1024]), err: errFailed})
+	require.True(t, errors.Is(err, errFailed))
+
+	res := <-received
+	require.True(t, errors.Is(res.err, io.ErrUnexpectedEOF))
+
+	// Messages exceeding MaxWriteSize are aborted once they do.
+
+	err = a.SendStream(bytes.NewReader(make([]byte, 300*1024)))
+	require.True(t, errors.Is(err, ErrMessageTooLarge))
+
+	res = <-received
+	require.True(t, errors.Is(res.err, io.ErrUnexpectedEOF))
+}
+
+func TestConnPendingRequests(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	a := &Conn{}
+	b := &Conn{} // never responds
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	require.Empty(t, a.PendingRequests())
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	for i := 0; i < 3; i++ {
+		go func() {
+			defer wg.Done()
+			_, err := a.RequestContext(ctx, nil, []byte("hello"))
+			require.True(t, errors.Is(err, context.Canceled))
+		}()
+
+		for len(a.PendingRequests()) != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	first := a.PendingRequests()
+	require.Len(t, first, 3)
+	for i := 1; i < len(first); i++ {
+		require.True(t, first[i-1].Age > first[i].Age)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	second := a.PendingRequests()
+	require.Len(t, second, 3)
+	for i := range second {
+		require.Equal(t, first[i].Seq, second[i].Seq)
+		require.True(t, second[i].Age > first[i].Age)
+	}
+
+	cancel()
+	wg.Wait()
+
+	require.Empty(t, a.PendingRequests())
+}
+
+func TestConnCloseGracefully(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	a := &Conn{}
+	b := &Conn{Handler: HandlerFunc(func(ctx *Context) error {
+		close(started)
+		<-release
+		return ctx.Reply([]byte("slow"))
+	})}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	type result struct {
+		res []byte
+		err error
+	}
+
+	slow := make(chan result, 1)
+	go func() {
+		res, err := a.Request(nil, []byte("hello"))
+		slow <- result{res: res, err: err}
+	}()
+
+	<-started
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- a.CloseGracefully(context.Background())
+	}()
+
+	// New writes and requests are rejected once the connection starts to be gracefully closed.
+
+	for a.checkClosing() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := a.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrConnClosing))
+	require.True(t, errors.Is(err, ErrConnClosed))
+	require.True(t, errors.Is(a.Send([]byte("hello")), ErrConnClosing))
+
+	// The pending request still completes before the connection is closed.
+
+	select {
+	case <-closed:
+		t.Fatal("connection closed before pending request completed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+
+	res := <-slow
+	require.NoError(t, res.err)
+	require.EqualValues(t, "slow", res.res)
+
+	require.NoError(t, <-closed)
+	require.Error(t, a.Context().Err())
+}
+
+func TestConnCloseGracefullyTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	a := &Conn{}
+	b := &Conn{} // never responds
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	pending := make(chan error, 1)
+	go func() {
+		_, err := a.Request(nil, []byte("hello"))
+		pending <- err
+	}()
+
+	for len(a.PendingRequests()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.True(t, errors.Is(a.CloseGracefully(ctx), context.DeadlineExceeded))
+	require.True(t, errors.Is(<-pending, ErrConnClosed))
+}
+
+func TestConnSendNoWaitCopiesPayload(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var c Conn
+	c.once.Do(c.init)
+
+	// Payloads may be reused once SendNoWait returns, even though they have yet to be written.
+
+	payload := []byte("hello")
+	require.NoError(t, c.SendNoWait(payload))
+	copy(payload, "world")
+
+	conn := &mockConn{}
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	require.Equal(t, 1, conn.numWritten())
+	_, data, err := decodeFrameHeader(conn.written[0])
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", data)
+}
@@ -0,0 +1,639 @@
+package monte
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"github.com/lithdew/bytesutil"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"time"
+)
+
+var (
+	DefaultRekeyAfterBytes int64 = 1 << 30
+	DefaultRekeyInterval         = time.Hour
+)
+
+// Decorator wraps a BufferedConn with another that transparently transforms the messages written to and read
+// from it, such as by compressing or encrypting them. Decorators preserve message boundaries: every message
+// written to a decorated conn is read back as exactly one message by our peer's matching decorator.
+type Decorator interface {
+	Decorate(conn BufferedConn) BufferedConn
+}
+
+type DecoratorFunc func(conn BufferedConn) BufferedConn
+
+func (fn DecoratorFunc) Decorate(conn BufferedConn) BufferedConn { return fn(conn) }
+
+// WrapConn wraps conn with each of ds in order, such that the first of ds is the closest to conn. Both ends of a
+// connection must be wrapped with the same decorators in the same order. To compress messages before they are
+// encrypted, the encrypting decorator must come first.
+func WrapConn(conn BufferedConn, ds ...Decorator) BufferedConn {
+	for _, d := range ds {
+		conn = d.Decorate(conn)
+	}
+	return conn
+}
+
+// readMessageFrom reads the next message from conn into dst, growing dst should the message not fit, and fails
+// should the message be larger than max bytes.
+func readMessageFrom(conn BufferedConn, dst []byte, max int) ([]byte, error) {
+	if mr, ok := conn.(MessageReader); ok {
+		return mr.ReadMessage(dst, max)
+	}
+	dst = bytesutil.ExtendSlice(dst, max)
+	n, err := conn.Read(dst)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// AEADChunkSize is the maximum number of bytes of a message that are sealed together by an AEADConn.
+const AEADChunkSize = 16 * 1024
+
+// aeadNonceSize is the size of the counter that prefixes the nonce of every sealed chunk.
+const aeadNonceSize = 8
+
+var (
+	_ BufferedConn  = (*AEADConn)(nil)
+	_ MessageReader = (*AEADConn)(nil)
+)
+
+// AEADConn is a BufferedConn that encrypts and authenticates every message written to the conn it decorates,
+// and decrypts and verifies every message read from it. Every message is split into chunks of at most
+// AEADChunkSize bytes, each sealed with a nonce counter that increases for every chunk, and the last chunk of
+// every message is sealed such that it may not be mistaken for any other. Messages that were modified,
+// truncated, reordered, or replayed are therefore rejected with ErrMessageTampered.
+//
+// AEADConns created via NewRekeyingAEADConn additionally rotate the key they seal with once RekeyAfterBytes
+// bytes have been sealed with it, or once RekeyInterval has elapsed since it was last rotated, such that
+// long-lived connections do not seal unbounded amounts of data with the same key. Rotations are signalled to our
+// peer in-band by a KEY_UPDATE message sealed with the key being rotated out, after which both ends derive the
+// next key from it. As messages are read in the order they were written, no message is lost to a rotation.
+//
+// AEADConns that decorate connections that may lose or reorder messages, such as UDP connections, must set
+// ReplayWindow. See ReplayWindow.
+//
+// AEADConn is not safe for concurrent use, though a single reader and a single writer may use it concurrently.
+type AEADConn struct {
+	BufferedConn
+
+	// ReplayWindow, if positive, makes the AEADConn tolerate messages that are lost or reordered. The nonce
+	// counter of every message is then sent ahead of it rather than being implied by the order in which messages
+	// are read, and messages are only accepted should none of their nonce counters have been accepted before,
+	// nor trail the highest nonce counter accepted by more than ReplayWindow, such that captured messages may
+	// not be replayed. Both ends of a connection must agree on whether ReplayWindow is set. Keys are not rotated
+	// while ReplayWindow is set, as a lost KEY_UPDATE message would leave both ends keyed differently.
+	ReplayWindow int
+
+	// RekeyAfterBytes is the number of bytes that may be sealed with the same key before it is rotated. It
+	// defaults to DefaultRekeyAfterBytes.
+	RekeyAfterBytes int64
+
+	// RekeyInterval is how long the same key may be sealed with before it is rotated. It defaults to
+	// DefaultRekeyInterval.
+	RekeyInterval time.Duration
+
+	seal cipher.AEAD
+	open cipher.AEAD
+
+	newSuite func(key []byte) (cipher.AEAD, error) // set should keys be rotated
+	sealKey  []byte
+	openKey  []byte
+	sealed   int64     // bytes sealed with the current seal key
+	rekeyed  time.Time // when the seal key was last rotated
+
+	wb  []byte // write buffer
+	rb  []byte // read buffer
+	cb  []byte // ciphertext buffer
+	wn  uint64 // write nonce
+	rn  uint64 // read nonce
+	wnb []byte // write nonce buffer
+	rnb []byte // read nonce buffer
+
+	window replayWindow // nonce counters accepted, should ReplayWindow be set
+}
+
+// NewAEADConn returns an AEADConn over conn that seals messages written to it with seal, and opens messages
+// read from it with open. Our peer must open with our seal and seal with our open. To avoid nonces being
+// reused, seal and open must not be keyed the same, and must not be used by any other AEADConn. As the keys of
+// seal and open are not known, they are never rotated.
+func NewAEADConn(conn BufferedConn, seal, open cipher.AEAD) *AEADConn {
+	return &AEADConn{BufferedConn: conn, seal: seal, open: open}
+}
+
+// NewRekeyingAEADConn returns an AEADConn over conn that seals messages written to it with a suite keyed with
+// sealKey, and opens messages read from it with a suite keyed with openKey, each of which is constructed by
+// newSuite. Both keys are periodically rotated. Our peer must open with our sealKey and seal with our openKey.
+func NewRekeyingAEADConn(
+	conn BufferedConn,
+	sealKey, openKey []byte,
+	newSuite func(key []byte) (cipher.AEAD, error),
+) (*AEADConn, error) {
+	seal, err := newSuite(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := newSuite(openKey)
+	if err != nil {
+		return nil, err
+	}
+	return &AEADConn{
+		BufferedConn: conn,
+		seal:         seal,
+		open:         open,
+		newSuite:     newSuite,
+		sealKey:      sealKey,
+		openKey:      openKey,
+		rekeyed:      time.Now(),
+	}, nil
+}
+
+// AEADDecorator returns a Decorator that encrypts messages with AES-256 GCM, keyed with keys derived from
+// secret, such as the shared key of a Session. Each direction is keyed separately, with client designating
+// whether ours is the client's end of the connection, such that nonces are never reused across directions.
+// Keys are periodically rotated. See NewRekeyingAEADConn.
+func AEADDecorator(secret []byte, client bool) (Decorator, error) {
+	return aeadDecorator(secret, client, newAESGCM)
+}
+
+// ChaCha20Poly1305Decorator returns a Decorator that encrypts messages with ChaCha20-Poly1305, keyed the same way
+// as by AEADDecorator. ChaCha20-Poly1305 outperforms AES GCM on hardware without AES instructions, such as
+// many ARM devices.
+func ChaCha20Poly1305Decorator(secret []byte, client bool) (Decorator, error) {
+	return aeadDecorator(secret, client, chacha20poly1305.New)
+}
+
+func aeadDecorator(secret []byte, client bool, newSuite func(key []byte) (cipher.AEAD, error)) (Decorator, error) {
+	clientKey, err := deriveKey(secret, "monte client")
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := deriveKey(secret, "monte server")
+	if err != nil {
+		return nil, err
+	}
+
+	if !client {
+		clientKey, serverKey = serverKey, clientKey
+	}
+
+	return DecoratorFunc(func(conn BufferedConn) BufferedConn {
+		// Keys derived via BLAKE-2b are always 32 bytes, which both AES-256 GCM and ChaCha20-Poly1305 never fail
+		// to be keyed with.
+		ac, _ := NewRekeyingAEADConn(conn, clientKey, serverKey, newSuite)
+		return ac
+	}), nil
+}
+
+// deriveKey derives a 32-byte key via BLAKE-2b over label, keyed by secret.
+func deriveKey(secret []byte, label string) ([]byte, error) {
+	h, err := blake2b.New256(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	h.Write([]byte(label))
+	return h.Sum(nil), nil
+}
+
+// newAESGCM returns an AES GCM suite keyed with key.
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aeadNonce writes the nonce of suite for the chunk with counter n into dst.
+func aeadNonce(dst []byte, suite cipher.AEAD, n uint64) []byte {
+	dst = bytesutil.ExtendSlice(dst, suite.NonceSize())
+	binary.BigEndian.PutUint64(dst[:aeadNonceSize], n)
+	for i := aeadNonceSize; i < len(dst); i++ {
+		dst[i] = 0
+	}
+	return dst
+}
+
+// aeadLastChunk and aeadNextChunk are the additional data with which the last chunk of a message and all other
+// chunks of a message are sealed. aeadKeyUpdate is the additional data with which KEY_UPDATE messages, which
+// have no plaintext, are sealed. Should ReplayWindow be set, the first chunk of every message is instead sealed
+// with aeadFirstLastChunk or aeadFirstNextChunk, such that the trailing chunks of a message may not be passed
+// off as a message of their own.
+var (
+	aeadLastChunk      = []byte{1}
+	aeadNextChunk      = []byte{0}
+	aeadKeyUpdate      = []byte{2}
+	aeadFirstLastChunk = []byte{5}
+	aeadFirstNextChunk = []byte{4}
+)
+
+// aeadChunkAD returns the additional data with which a chunk is sealed.
+func aeadChunkAD(first, last, windowed bool) []byte {
+	switch {
+	case windowed && first && last:
+		return aeadFirstLastChunk
+	case windowed && first:
+		return aeadFirstNextChunk
+	case last:
+		return aeadLastChunk
+	default:
+		return aeadNextChunk
+	}
+}
+
+func (c *AEADConn) Write(b []byte) (int, error) {
+	windowed := c.ReplayWindow > 0
+
+	if c.newSuite != nil && !windowed {
+		err := c.maybeRekey()
+		if err != nil {
+			return 0, err
+		}
+		c.sealed += int64(len(b))
+	}
+
+	n := len(b)
+
+	c.wb = c.wb[:0]
+
+	if windowed {
+		c.wb = bytesutil.ExtendSlice(c.wb, aeadNonceSize)
+		binary.BigEndian.PutUint64(c.wb, c.wn)
+	}
+
+	for first := true; ; first = false {
+		chunk := b
+		if len(chunk) > AEADChunkSize {
+			chunk = chunk[:AEADChunkSize]
+		}
+		ad := aeadChunkAD(first, len(chunk) == len(b), windowed)
+
+		c.wnb = aeadNonce(c.wnb, c.seal, c.wn)
+		c.wb = c.seal.Seal(c.wb, c.wnb, chunk, ad)
+		c.wn++
+
+		if len(chunk) == len(b) {
+			break
+		}
+		b = b[len(chunk):]
+	}
+
+	_, err := c.BufferedConn.Write(c.wb)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (c *AEADConn) Read(b []byte) (int, error) {
+	var err error
+	c.rb, err = c.ReadMessage(c.rb[:0], len(b))
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, c.rb), nil
+}
+
+// ReadMessage reads, decrypts, and verifies the next message into dst, growing dst should the message not fit.
+// KEY_UPDATE messages are consumed by rotating the key we open with, after which the next message is read.
+func (c *AEADConn) ReadMessage(dst []byte, max int) ([]byte, error) {
+	windowed := c.ReplayWindow > 0
+
+	overhead := c.open.Overhead()
+	sealed := AEADChunkSize + overhead
+
+	limit := max + (max/AEADChunkSize+1)*overhead
+	if windowed {
+		limit += aeadNonceSize
+	}
+
+	var err error
+	for {
+		c.cb, err = readMessageFrom(c.BufferedConn, c.cb[:0], limit)
+		if err != nil {
+			return nil, err
+		}
+		if c.newSuite == nil || windowed || len(c.cb) != overhead {
+			break
+		}
+
+		// Messages that have no plaintext are either empty messages, or KEY_UPDATE messages.
+
+		c.rnb = aeadNonce(c.rnb, c.open, c.rn)
+		_, err = c.open.Open(nil, c.rnb, c.cb, aeadKeyUpdate)
+		if err != nil {
+			break
+		}
+
+		c.openKey, c.open, err = c.nextKey(c.openKey)
+		if err != nil {
+			return nil, err
+		}
+		c.rn = 0
+	}
+
+	dst = dst[:0]
+
+	cb, rn := c.cb, c.rn
+	if windowed {
+		if len(cb) < aeadNonceSize {
+			return nil, fmt.Errorf("message is missing its nonce counter: %w", ErrMessageTampered)
+		}
+		cb, rn = cb[aeadNonceSize:], binary.BigEndian.Uint64(cb[:aeadNonceSize])
+	}
+
+	start := rn
+
+	for first := true; ; first = false {
+		chunk := cb
+		if len(chunk) > sealed {
+			chunk = chunk[:sealed]
+		}
+		ad := aeadChunkAD(first, len(chunk) == len(cb), windowed)
+
+		if windowed && !c.window.check(rn, c.ReplayWindow) {
+			return nil, fmt.Errorf("nonce counter %d was replayed or is too old: %w", rn, ErrMessageTampered)
+		}
+
+		c.rnb = aeadNonce(c.rnb, c.open, rn)
+		dst, err = c.open.Open(dst, c.rnb, chunk, ad)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open chunk: %w", ErrMessageTampered)
+		}
+		rn++
+
+		if len(chunk) == len(cb) {
+			break
+		}
+		cb = cb[len(chunk):]
+	}
+
+	// Nonce counters are only accepted once the message they seal is authenticated, such that forged messages
+	// may not advance the replay window.
+
+	if windowed {
+		for n := start; n < rn; n++ {
+			c.window.accept(n, c.ReplayWindow)
+		}
+	} else {
+		c.rn = rn
+	}
+
+	if len(dst) > max {
+		return nil, fmt.Errorf("max is %d bytes, got %d bytes: %w", max, len(dst), ErrMessageTooLarge)
+	}
+
+	return dst, nil
+}
+
+// maybeRekey rotates the key we seal with should RekeyAfterBytes bytes have been sealed with it, or should
+// RekeyInterval have elapsed since it was last rotated. Our peer is notified of the rotation via a KEY_UPDATE
+// message sealed with the key being rotated out, which is written ahead of the message about to be sealed.
+func (c *AEADConn) maybeRekey() error {
+	if c.sealed < c.getRekeyAfterBytes() && time.Since(c.rekeyed) < c.getRekeyInterval() {
+		return nil
+	}
+
+	c.wnb = aeadNonce(c.wnb, c.seal, c.wn)
+	c.wb = c.seal.Seal(c.wb[:0], c.wnb, nil, aeadKeyUpdate)
+
+	_, err := c.BufferedConn.Write(c.wb)
+	if err != nil {
+		return err
+	}
+
+	c.sealKey, c.seal, err = c.nextKey(c.sealKey)
+	if err != nil {
+		return err
+	}
+	c.wn, c.sealed, c.rekeyed = 0, 0, time.Now()
+
+	return nil
+}
+
+// nextKey derives the key that key is rotated to, along with a suite keyed with it.
+func (c *AEADConn) nextKey(key []byte) ([]byte, cipher.AEAD, error) {
+	next, err := deriveKey(key, "monte key update")
+	if err != nil {
+		return nil, nil, err
+	}
+	suite, err := c.newSuite(next)
+	if err != nil {
+		return nil, nil, err
+	}
+	return next, suite, nil
+}
+
+func (c *AEADConn) getRekeyAfterBytes() int64 {
+	if c.RekeyAfterBytes <= 0 {
+		return DefaultRekeyAfterBytes
+	}
+	return c.RekeyAfterBytes
+}
+
+func (c *AEADConn) getRekeyInterval() time.Duration {
+	if c.RekeyInterval <= 0 {
+		return DefaultRekeyInterval
+	}
+	return c.RekeyInterval
+}
+
+// replayWindow tracks which of the most recent nonce counters were accepted via a ring of bitmaps, as described
+// by RFC 6479.
+type replayWindow struct {
+	bits []uint64
+	top  uint64 // one more than the highest nonce counter accepted
+}
+
+// check reports whether n was not accepted before, and does not trail the highest nonce counter accepted by more
+// than size.
+func (w *replayWindow) check(n uint64, size int) bool {
+	if n >= w.top {
+		return true
+	}
+	if w.top-n > uint64(size) {
+		return false
+	}
+	return w.bits[(n/64)%uint64(len(w.bits))]&(1<<(n%64)) == 0
+}
+
+// accept marks n as accepted, sliding the window forward should n be the highest nonce counter accepted yet.
+func (w *replayWindow) accept(n uint64, size int) {
+	if w.bits == nil {
+		w.bits = make([]uint64, size/64+2)
+	}
+	blocks := uint64(len(w.bits))
+
+	if n >= w.top {
+		var from uint64
+		if w.top > 0 {
+			from = (w.top-1)/64 + 1
+		}
+		for block := from; block <= n/64 && block-from < blocks; block++ {
+			w.bits[block%blocks] = 0
+		}
+		w.top = n + 1
+	}
+
+	w.bits[(n/64)%blocks] |= 1 << (n % 64)
+}
+
+var (
+	_ BufferedConn  = (*FlateConn)(nil)
+	_ MessageReader = (*FlateConn)(nil)
+)
+
+// flateStored and flateDeflated prefix messages written by a FlateConn that are respectively left as is, or
+// compressed with DEFLATE.
+const (
+	flateStored byte = iota
+	flateDeflated
+)
+
+// FlateConn is a BufferedConn that compresses every message written to the conn it decorates with DEFLATE,
+// and decompresses every message read from it. Messages that do not shrink once compressed, such as those whose
+// payloads are already compressed, are written as is. Whether a message was compressed is marked on the message
+// itself, such that our peer's FlateConn need not be configured the same way.
+//
+// FlateConn is not safe for concurrent use, though a single reader and a single writer may use it concurrently.
+type FlateConn struct {
+	BufferedConn
+
+	// CompressThreshold is the size in bytes below which messages are written as is without being compressed,
+	// as small messages rarely shrink enough to be worth compressing. Zero compresses every message.
+	CompressThreshold int
+
+	fw *flate.Writer
+	fr io.ReadCloser
+
+	wb bytes.Buffer // write buffer
+	rb []byte       // read buffer
+	cb []byte       // compressed buffer
+	br bytes.Reader
+}
+
+// NewFlateConn returns a FlateConn over conn that compresses messages at the given level, which is any of the
+// levels accepted by flate.NewWriter.
+func NewFlateConn(conn BufferedConn, level int) (*FlateConn, error) {
+	fw, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return &FlateConn{BufferedConn: conn, fw: fw}, nil
+}
+
+// FlateDecorator returns a Decorator that compresses messages at the given level via a FlateConn. Should level
+// be invalid, flate.DefaultCompression is used.
+func FlateDecorator(level int) Decorator {
+	return FlateThresholdDecorator(level, 0)
+}
+
+// FlateThresholdDecorator returns a Decorator that compresses messages of at least threshold bytes at the given
+// level via a FlateConn. See FlateConn.CompressThreshold.
+func FlateThresholdDecorator(level, threshold int) Decorator {
+	return DecoratorFunc(func(conn BufferedConn) BufferedConn {
+		c, err := NewFlateConn(conn, level)
+		if err != nil {
+			c, _ = NewFlateConn(conn, flate.DefaultCompression)
+		}
+		c.CompressThreshold = threshold
+		return c
+	})
+}
+
+func (c *FlateConn) Write(b []byte) (int, error) {
+	if len(b) < c.CompressThreshold {
+		return c.writeStored(b)
+	}
+
+	c.wb.Reset()
+	c.wb.WriteByte(flateDeflated)
+
+	c.fw.Reset(&c.wb)
+	_, err := c.fw.Write(b)
+	if err == nil {
+		err = c.fw.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if c.wb.Len() > len(b) {
+		return c.writeStored(b)
+	}
+
+	_, err = c.BufferedConn.Write(c.wb.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeStored writes b as is without compressing it.
+func (c *FlateConn) writeStored(b []byte) (int, error) {
+	c.wb.Reset()
+	c.wb.WriteByte(flateStored)
+	c.wb.Write(b)
+
+	_, err := c.BufferedConn.Write(c.wb.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *FlateConn) Read(b []byte) (int, error) {
+	var err error
+	c.rb, err = c.ReadMessage(c.rb[:0], len(b))
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, c.rb), nil
+}
+
+// ReadMessage reads and decompresses the next message into dst, growing dst should the message not fit.
+func (c *FlateConn) ReadMessage(dst []byte, max int) ([]byte, error) {
+	var err error
+	c.cb, err = readMessageFrom(c.BufferedConn, c.cb[:0], max+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.cb) == 0 {
+		return nil, fmt.Errorf("no compression marker to decode: %w", io.ErrUnexpectedEOF)
+	}
+
+	switch c.cb[0] {
+	case flateStored:
+		return append(dst[:0], c.cb[1:]...), nil
+	case flateDeflated:
+	default:
+		return nil, fmt.Errorf("unknown compression marker %d", c.cb[0])
+	}
+
+	c.br.Reset(c.cb[1:])
+	if c.fr == nil {
+		c.fr = flate.NewReader(&c.br)
+	} else if err := c.fr.(flate.Resetter).Reset(&c.br, nil); err != nil {
+		return nil, err
+	}
+
+	// Read at most one byte past max to detect messages that decompress to more than max bytes.
+
+	w := bytes.NewBuffer(dst[:0])
+	n, err := w.ReadFrom(io.LimitReader(c.fr, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	if n > int64(max) {
+		return nil, fmt.Errorf("max is %d bytes, got more: %w", max, ErrMessageTooLarge)
+	}
+
+	return w.Bytes(), nil
+}
@@ -0,0 +1,318 @@
+package monte
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// messageConn is a BufferedConn that records every message written to it, and reads back the messages queued
+// in it one at a time.
+type messageConn struct {
+	net.Conn
+	msgs [][]byte
+}
+
+func (m *messageConn) Write(b []byte) (int, error) {
+	m.msgs = append(m.msgs, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (m *messageConn) Read(b []byte) (int, error) {
+	if len(m.msgs) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, m.msgs[0])
+	m.msgs = m.msgs[1:]
+	return n, nil
+}
+
+func (m *messageConn) Flush() error { return nil }
+
+// testDecorators returns the decorators for the client's and server's end of a connection, which encrypt
+// messages once they have been compressed.
+func testDecorators(t testing.TB) ([]Decorator, []Decorator) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	client, err := AEADDecorator(secret, true)
+	require.NoError(t, err)
+
+	server, err := AEADDecorator(secret, false)
+	require.NoError(t, err)
+
+	return []Decorator{client, FlateDecorator(flate.BestSpeed)}, []Decorator{server, FlateDecorator(flate.BestSpeed)}
+}
+
+func testPayloads(t testing.TB) [][]byte {
+	random := make([]byte, 3*AEADChunkSize+123)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	return [][]byte{
+		{},
+		[]byte("hello"),
+		random,
+		bytes.Repeat([]byte("monte"), 2*AEADChunkSize),
+		make([]byte, AEADChunkSize),
+	}
+}
+
+func TestWrapConnRoundTrip(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientDecorators, serverDecorators := testDecorators(t)
+
+	alice, bob := net.Pipe()
+
+	a := &Conn{}
+	b := &Conn{Handler: EchoHandler{}}
+
+	done := make(chan struct{})
+	handled := make(chan struct{}, 2)
+
+	go func() {
+		_ = a.Handle(done, WrapConn(AsBufferedConn(alice), clientDecorators...))
+		handled <- struct{}{}
+	}()
+
+	go func() {
+		_ = b.Handle(done, WrapConn(AsBufferedConn(bob), serverDecorators...))
+		handled <- struct{}{}
+	}()
+
+	for _, payload := range testPayloads(t) {
+		res, err := a.Request(nil, payload)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(payload, res))
+	}
+
+	close(done)
+	<-handled
+	<-handled
+}
+
+func TestAEADConnTamper(t *testing.T) {
+	clientDecorators, serverDecorators := testDecorators(t)
+
+	// seal returns every message that our peer would read once payloads are written.
+
+	seal := func(payloads ...[]byte) [][]byte {
+		var conn messageConn
+
+		w := WrapConn(&conn, clientDecorators[:1]...)
+		for _, payload := range payloads {
+			_, err := w.Write(payload)
+			require.NoError(t, err)
+		}
+
+		return conn.msgs
+	}
+
+	// open reads back every message from msgs, and returns the first error encountered.
+
+	open := func(msgs ...[]byte) error {
+		conn := messageConn{msgs: msgs}
+
+		r := WrapConn(&conn, serverDecorators[:1]...).(MessageReader)
+		for range msgs {
+			_, err := r.ReadMessage(nil, DefaultMaxFrameSize)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	random := make([]byte, 3*AEADChunkSize)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	// Seal with a fresh pair of decorators for every case, as nonces are tracked per decorated conn.
+
+	cases := map[string]func() [][]byte{
+		"flipped": func() [][]byte {
+			msgs := seal(random)
+			msgs[0][len(msgs[0])/2] ^= 1
+			return msgs
+		},
+		"truncated": func() [][]byte {
+			msgs := seal(random)
+			msgs[0] = msgs[0][:len(msgs[0])-AEADChunkSize-16]
+			return msgs
+		},
+		"replayed": func() [][]byte {
+			msgs := seal([]byte("hello"))
+			return append(msgs, msgs[0])
+		},
+		"reordered": func() [][]byte {
+			msgs := seal([]byte("hello"), []byte("world"))
+			msgs[0], msgs[1] = msgs[1], msgs[0]
+			return msgs
+		},
+	}
+
+	require.NoError(t, open(seal(random, []byte("hello"))...))
+
+	for name, tamper := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.True(t, errors.Is(open(tamper()...), ErrMessageTampered))
+		})
+	}
+}
+
+func TestFlateConnMaxSize(t *testing.T) {
+	var conn messageConn
+
+	_, err := WrapConn(&conn, FlateDecorator(flate.BestCompression)).Write(make([]byte, 1024))
+	require.NoError(t, err)
+	require.Less(t, len(conn.msgs[0]), 1024)
+
+	_, err = WrapConn(&conn, FlateDecorator(flate.BestCompression)).(MessageReader).ReadMessage(nil, 1023)
+	require.True(t, errors.Is(err, ErrMessageTooLarge))
+}
+
+func TestFlateConnCompressThreshold(t *testing.T) {
+	var conn messageConn
+
+	// Messages below the threshold are written as is, while those at or above it are compressed.
+
+	w := WrapConn(&conn, FlateThresholdDecorator(flate.BestSpeed, 1024))
+
+	_, err := w.Write(make([]byte, 1023))
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, 1024))
+	require.NoError(t, err)
+
+	require.Len(t, conn.msgs[0], 1024)
+	require.Less(t, len(conn.msgs[1]), 1024)
+
+	// Both are read back by a FlateConn regardless of its threshold.
+
+	r := WrapConn(&conn, FlateDecorator(flate.BestSpeed)).(MessageReader)
+	for _, size := range []int{1023, 1024} {
+		msg, err := r.ReadMessage(nil, 2048)
+		require.NoError(t, err)
+		require.Equal(t, make([]byte, size), msg)
+	}
+}
+
+func TestAEADConnRekey(t *testing.T) {
+	clientDecorators, serverDecorators := testDecorators(t)
+
+	var conn messageConn
+
+	w := clientDecorators[0].Decorate(&conn).(*AEADConn)
+	r := serverDecorators[0].Decorate(&conn).(*AEADConn)
+
+	key := w.sealKey
+
+	// The key we seal with is rotated before the message that follows the one that exceeds RekeyAfterBytes,
+	// and every time RekeyInterval elapses.
+
+	w.RekeyAfterBytes = 10
+
+	payloads := [][]byte{[]byte("hello world"), {}, []byte("hello"), []byte("world")}
+	for _, payload := range payloads {
+		_, err := w.Write(payload)
+		require.NoError(t, err)
+	}
+	require.Len(t, conn.msgs, len(payloads)+1)
+
+	w.RekeyInterval = time.Nanosecond
+
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Len(t, conn.msgs, len(payloads)+3)
+
+	require.NotEqual(t, key, w.sealKey)
+
+	// KEY_UPDATE messages are consumed by our peer, which rotates the key it opens with in step.
+
+	for _, payload := range append(payloads, []byte("hello")) {
+		msg, err := r.ReadMessage(nil, DefaultMaxFrameSize)
+		require.NoError(t, err)
+		require.Equal(t, string(payload), string(msg))
+	}
+	require.Equal(t, w.sealKey, r.openKey)
+
+	_, err = r.ReadMessage(nil, DefaultMaxFrameSize)
+	require.True(t, errors.Is(err, io.EOF))
+}
+
+func TestAEADConnReplayWindow(t *testing.T) {
+	clientDecorators, serverDecorators := testDecorators(t)
+
+	var conn messageConn
+
+	w := clientDecorators[0].Decorate(&conn).(*AEADConn)
+	r := serverDecorators[0].Decorate(&conn).(*AEADConn)
+
+	w.ReplayWindow, r.ReplayWindow = 64, 64
+
+	random := make([]byte, 2*AEADChunkSize)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, payload := range [][]byte{[]byte("hello"), []byte("world"), random, []byte("lost")} {
+		_, err := w.Write(payload)
+		require.NoError(t, err)
+	}
+	msgs := conn.msgs
+
+	open := func(msg []byte) ([]byte, error) {
+		conn.msgs = [][]byte{msg}
+		return r.ReadMessage(nil, DefaultMaxFrameSize)
+	}
+
+	// Messages that are reordered are accepted, though messages that are replayed are not.
+
+	for _, i := range []int{1, 0, 2} {
+		_, err := open(msgs[i])
+		require.NoError(t, err)
+	}
+
+	_, err = open(msgs[0])
+	require.True(t, errors.Is(err, ErrMessageTampered))
+
+	// The trailing chunks of a message may not be passed off as a message of their own.
+
+	_, err = w.Write(random)
+	require.NoError(t, err)
+
+	large := conn.msgs[0]
+
+	suffix := make([]byte, aeadNonceSize)
+	binary.BigEndian.PutUint64(suffix, binary.BigEndian.Uint64(large[:aeadNonceSize])+1)
+	suffix = append(suffix, large[aeadNonceSize+AEADChunkSize+16:]...)
+
+	_, err = open(suffix)
+	require.True(t, errors.Is(err, ErrMessageTampered))
+
+	msg, err := open(large)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(random, msg))
+
+	// Messages that trail the highest nonce counter accepted by more than the window are rejected.
+
+	for i := 0; i < 64; i++ {
+		_, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+	}
+
+	_, err = open(conn.msgs[len(conn.msgs)-1])
+	require.NoError(t, err)
+
+	_, err = open(msgs[3])
+	require.True(t, errors.Is(err, ErrMessageTampered))
+}
@@ -0,0 +1,117 @@
+package monte
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The following errors may be matched against errors returned by a Conn, Client, or Server via errors.Is.
+var (
+	// ErrConnClosed is returned when writing to or awaiting a response from a connection that has been closed.
+	// It matches io.EOF.
+	ErrConnClosed = fmt.Errorf("conn closed: %w", io.EOF)
+
+	// ErrConnClosing is returned when writing to or sending a request over a connection that is being gracefully
+	// closed via CloseGracefully. It matches ErrConnClosed.
+	ErrConnClosing = fmt.Errorf("conn closing: %w", ErrConnClosed)
+
+	// ErrNotConnected is returned by a Client with FailFastIfDisconnected set when writing to or sending a
+	// request over it while it has no established connection.
+	ErrNotConnected = errors.New("not connected")
+
+	// ErrRequestTimeout is returned when a response to a request is not received before the request's deadline.
+	// Errors returned by RequestContext that wrap it also match context.DeadlineExceeded, though ErrRequestTimeout
+	// itself does not.
+	ErrRequestTimeout = errors.New("request timed out")
+
+	// ErrHandlerTimeout is returned when our peer's handler did not respond to a request before its
+	// HandlerTimeout elapsed. It matches ErrRequestTimeout.
+	ErrHandlerTimeout = fmt.Errorf("handler timed out: %w", ErrRequestTimeout)
+
+	// ErrRequestRejected is returned when our peer's handler rejected a request via Context.Reject, such as a
+	// Mux that has no handler registered for the request's opcode. The reason the request was rejected is
+	// included in the error's message.
+	ErrRequestRejected = errors.New("request rejected")
+
+	// ErrWriteQueueFull is returned when writing a message that is not waited on to a connection whose write
+	// queue is full, should the connection be set to FailFastIfQueueFull.
+	ErrWriteQueueFull = errors.New("write queue full")
+
+	// ErrMessageTooLarge is returned when attempting to write a message whose payload exceeds the configured
+	// MaxWriteSize, and when a connection is closed because our peer sent a frame or message that exceeds
+	// MaxFrameSize or MaxMessageSize.
+	ErrMessageTooLarge = errors.New("message too large")
+
+	// ErrMessageTampered is returned when reading a message from an AEADConn whose authenticity could not be
+	// verified, such as one that was modified, truncated, reordered, or replayed.
+	ErrMessageTampered = errors.New("message tampered")
+
+	// ErrNoisePeerKey is returned by a Noise handshake should our peer's static key be rejected by VerifyPeer.
+	ErrNoisePeerKey = errors.New("noise peer static key rejected")
+
+	// ErrTLSPeerRejected is returned by a mutual TLS handshake should our peer's certificate be rejected by the
+	// handshake's verify callback.
+	ErrTLSPeerRejected = errors.New("tls peer rejected")
+
+	// ErrAuthRejected is returned by a token or PSK authentication handshake should the credentials our client
+	// presented be rejected by the server. See NewTokenServerHandshaker and NewPSKServerHandshaker.
+	ErrAuthRejected = errors.New("authentication rejected")
+
+	// ErrUnsupportedVersion is returned by a version handshake should our peer speak none of the protocol
+	// versions we speak, or not perform a version handshake at all. See NewVersionClientHandshaker.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrNoProtocol is returned by a protocol handshake should our peer support none of the application
+	// protocols we support. See NewProtocolClientHandshaker.
+	ErrNoProtocol = errors.New("no application protocol in common")
+
+	// ErrFlushRetryable may be wrapped by errors returned by a BufferedConn's Flush to designate that the flush
+	// failed transiently and may be retried. See BufferedConn.
+	ErrFlushRetryable = errors.New("flush may be retried")
+
+	// ErrPeerGoodbye is returned when a connection is closed because our peer gracefully shut down.
+	ErrPeerGoodbye = errors.New("peer said goodbye")
+
+	// ErrPeerUnresponsive is returned when a connection is closed because our peer did not answer MaxMissedPongs
+	// consecutive keepalive pings.
+	ErrPeerUnresponsive = errors.New("peer unresponsive")
+
+	// ErrIdleTimeout is returned when a connection is closed because no frame was read from our peer within its
+	// IdleTimeout.
+	ErrIdleTimeout = errors.New("idle timeout")
+
+	// ErrStreamReset is returned when reading from or writing to a Stream that was reset, such as by our peer
+	// refusing to accept it.
+	ErrStreamReset = errors.New("stream reset")
+
+	// ErrProxyHeader is returned when a connection accepted from a trusted proxy by a Server does not begin with
+	// a well-formed PROXY protocol header. See Server.TrustedProxies.
+	ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+	// ErrProxyRefused is returned when a Client fails to dial a connection because the proxy it dials through
+	// refused to establish a tunnel to the server, such as because the proxy failed to authenticate us. See
+	// Client.Proxy.
+	ErrProxyRefused = errors.New("proxy refused tunnel")
+
+	// ErrRateLimited is returned when a connection is closed because our peer exceeded the rate at which frames
+	// may be read from it, should the connection be set to CloseOnRateLimit.
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// wrappedError matches both sentinel and err via errors.Is and errors.As.
+type wrappedError struct {
+	sentinel error
+	err      error
+}
+
+func wrapError(sentinel, err error) error {
+	if err == nil || errors.Is(err, sentinel) {
+		return err
+	}
+	return &wrappedError{sentinel: sentinel, err: err}
+}
+
+func (e *wrappedError) Error() string        { return e.sentinel.Error() + ": " + e.err.Error() }
+func (e *wrappedError) Is(target error) bool { return errors.Is(e.sentinel, target) }
+func (e *wrappedError) Unwrap() error        { return e.err }
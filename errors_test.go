@@ -0,0 +1,78 @@
+package monte
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestErrConnClosed(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var c Conn
+	c.once.Do(c.init)
+	c.closeWriter()
+
+	err := c.Send([]byte("hello"))
+	require.True(t, errors.Is(err, ErrConnClosed))
+	require.True(t, errors.Is(err, io.EOF))
+
+	_, err = c.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestErrMessageTooLarge(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	c := &Conn{MaxWriteSize: 1}
+	require.True(t, errors.Is(c.SendNoWait([]byte("hello")), ErrMessageTooLarge))
+}
+
+func TestErrRequestTimeoutAndPeerGoodbye(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	received := make(chan struct{}, 2)
+
+	server := &Server{Handler: HandlerFunc(func(ctx *Context) error {
+		received <- struct{}{}
+		return nil
+	})}
+
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		client.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = client.RequestContext(ctx, nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrRequestTimeout))
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.False(t, errors.Is(ErrRequestTimeout, context.DeadlineExceeded))
+
+	<-received
+
+	go func() {
+		<-received
+		server.Shutdown()
+	}()
+
+	_, err = client.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrPeerGoodbye))
+	require.True(t, errors.Is(err, ErrConnClosed))
+}
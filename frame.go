@@ -0,0 +1,115 @@
+package monte
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lithdew/bytesutil"
+	"io"
+	"time"
+)
+
+const (
+	flagResponse uint8 = 1 << iota // frame is a response to a request with the same sequence number
+	flagDeadline                   // frame carries the time remaining before its sender gives up on a response
+	flagGoodbye                    // frame notifies that its sender is gracefully shutting down
+	flagCancel                     // frame cancels or, as a response, rejects the request with the same sequence number
+	flagPing                       // frame is a keepalive ping, or a pong should flagResponse be set
+	flagMore                       // frame is a fragment of a message continued by subsequent fragments
+	flagLast                       // frame is the last fragment of a message
+	flagTimeout                    // frame notifies that the handler of the request with the same sequence number timed out
+)
+
+// Frames with both flagMore and flagLast set, which never designate a fragment, belong to the logical stream
+// identified by their sequence number. See OpenStream.
+
+// maxTraceSize is the maximum size of the trace context a frame may carry.
+const maxTraceSize = 1<<16 - 1
+
+// carriesMessage reports whether a frame with the given flags carries a message, request, or response, rather than
+// solely serving to control the connection.
+func carriesMessage(flags uint8) bool {
+	if isStreamFrame(flags) { // flow-controlled by their stream instead
+		return false
+	}
+	if flags&(flagPing|flagGoodbye|flagCancel) != 0 {
+		return false
+	}
+	return flags&(flagTimeout|flagResponse) != flagTimeout|flagResponse
+}
+
+// isStreamFrame reports whether a frame with the given flags belongs to a logical stream.
+func isStreamFrame(flags uint8) bool {
+	return flags&(flagMore|flagLast) == flagMore|flagLast
+}
+
+// carriesTrace reports whether a frame with the given flags carries trace context, which is designated by
+// flagTimeout being set on a frame that is not a response.
+func carriesTrace(flags uint8) bool {
+	return flags&(flagTimeout|flagResponse) == flagTimeout
+}
+
+// frameHeader prefixes the contents of every message. It is laid out as a 32-bit unsigned sequence number,
+// followed by an 8-bit set of flags, followed by a 64-bit unsigned timeout in nanoseconds should flagDeadline
+// be set, followed by trace context prefixed with its 16-bit unsigned length should the frame carry any.
+type frameHeader struct {
+	seq     uint32
+	flags   uint8
+	timeout time.Duration
+	trace   []byte
+}
+
+func (h frameHeader) size() int {
+	n := 4 + 1
+	if h.flags&flagDeadline != 0 {
+		n += 8
+	}
+	if carriesTrace(h.flags) {
+		n += 2 + len(h.trace)
+	}
+	return n
+}
+
+func (h frameHeader) encode(dst []byte) []byte {
+	binary.BigEndian.PutUint32(dst[:4], h.seq)
+	dst[4] = h.flags
+	if h.flags&flagDeadline != 0 {
+		timeout := h.timeout
+		if timeout < 0 {
+			timeout = 0
+		}
+		binary.BigEndian.PutUint64(dst[5:13], uint64(timeout))
+	}
+	if carriesTrace(h.flags) {
+		n := h.size() - len(h.trace)
+		binary.BigEndian.PutUint16(dst[n-2:n], uint16(len(h.trace)))
+		copy(dst[n:], h.trace)
+	}
+	return dst[h.size():]
+}
+
+func decodeFrameHeader(buf []byte) (frameHeader, []byte, error) {
+	var h frameHeader
+	if len(buf) < 5 {
+		return h, nil, fmt.Errorf("no frame header to decode: %w", io.ErrUnexpectedEOF)
+	}
+	h.seq = bytesutil.Uint32BE(buf[:4])
+	h.flags = buf[4]
+	if h.flags&flagDeadline != 0 {
+		if len(buf) < 13 {
+			return h, nil, fmt.Errorf("no frame deadline to decode: %w", io.ErrUnexpectedEOF)
+		}
+		h.timeout = time.Duration(bytesutil.Uint64BE(buf[5:13]))
+	}
+	if carriesTrace(h.flags) {
+		n := h.size()
+		if len(buf) < n {
+			return h, nil, fmt.Errorf("no frame trace context length to decode: %w", io.ErrUnexpectedEOF)
+		}
+		size := int(binary.BigEndian.Uint16(buf[n-2 : n]))
+		if len(buf) < n+size {
+			return h, nil, fmt.Errorf("no frame trace context to decode: %w", io.ErrUnexpectedEOF)
+		}
+		h.trace = buf[n : n+size]
+	}
+	return h, buf[h.size():], nil
+}
@@ -0,0 +1,77 @@
+package monte
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/lithdew/bytesutil"
+	"io"
+)
+
+// Framer encodes messages into frames that are written to a byte stream, and decodes them back, such that
+// message boundaries are preserved over conns that do not preserve them. See FramedConn.
+type Framer interface {
+	// Encode appends the frame encoding msg to dst.
+	Encode(dst, msg []byte) []byte
+
+	// Decode reads the next frame from r, and appends the message it encodes to dst. It fails should the
+	// message be larger than max bytes.
+	Decode(dst []byte, r *bufio.Reader, max int) ([]byte, error)
+}
+
+var (
+	_ Framer = LengthPrefixFramer{}
+	_ Framer = VarintFramer{}
+)
+
+var DefaultFramer Framer = LengthPrefixFramer{}
+
+// LengthPrefixFramer frames every message by prefixing it with its length as an unsigned 32-bit big-endian
+// integer, the same way ReadSized and WriteSized do.
+type LengthPrefixFramer struct{}
+
+func (LengthPrefixFramer) Encode(dst, msg []byte) []byte {
+	dst = bytesutil.ExtendSlice(dst, len(dst)+4)
+	binary.BigEndian.PutUint32(dst[len(dst)-4:], uint32(len(msg)))
+	return append(dst, msg...)
+}
+
+func (LengthPrefixFramer) Decode(dst []byte, r *bufio.Reader, max int) ([]byte, error) {
+	var buf [4]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	return readFrame(dst, r, uint64(binary.BigEndian.Uint32(buf[:])), max)
+}
+
+// VarintFramer frames every message by prefixing it with its length as an unsigned varint, as encoded by
+// binary.PutUvarint.
+type VarintFramer struct{}
+
+func (VarintFramer) Encode(dst, msg []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(msg)))
+	return append(append(dst, buf[:n]...), msg...)
+}
+
+func (VarintFramer) Decode(dst []byte, r *bufio.Reader, max int) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	return readFrame(dst, r, n, max)
+}
+
+// readFrame appends the next n bytes read from r to dst, and fails should n exceed max.
+func readFrame(dst []byte, r io.Reader, n uint64, max int) ([]byte, error) {
+	if n > uint64(max) {
+		return nil, fmt.Errorf("max is %d bytes, got %d bytes: %w", max, n, ErrMessageTooLarge)
+	}
+	dst = bytesutil.ExtendSlice(dst, len(dst)+int(n))
+	_, err := io.ReadFull(r, dst[len(dst)-int(n):])
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
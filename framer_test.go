@@ -0,0 +1,97 @@
+package monte
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestVarintFramer(t *testing.T) {
+	var f VarintFramer
+
+	long := bytes.Repeat([]byte{'a'}, 300)
+
+	var buf []byte
+	buf = f.Encode(buf, []byte("hello"))
+	buf = f.Encode(buf, nil)
+	buf = f.Encode(buf, long)
+
+	require.EqualValues(t, append([]byte{5}, "hello"...), buf[:6])
+	require.EqualValues(t, []byte{0}, buf[6:7])
+	require.EqualValues(t, []byte{0xac, 0x02}, buf[7:9])
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+
+	msg, err := f.Decode(nil, r, 1024)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", msg)
+
+	msg, err = f.Decode(nil, r, 1024)
+	require.NoError(t, err)
+	require.Len(t, msg, 0)
+
+	_, err = f.Decode(nil, r, len(long)-1)
+	require.Error(t, err)
+}
+
+func TestServerFramer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	plain := HandshakerFunc(func(conn net.Conn) (BufferedConn, error) { return AsBufferedConn(conn), nil })
+
+	server := &Server{Handler: EchoHandler{}, Handshaker: plain, Framer: VarintFramer{}}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// Speak to the server over its wire format by hand: frames prefixed with their length as a varint.
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	frame := make([]byte, frameHeader{}.size())
+	frameHeader{seq: 1}.encode(frame)
+	frame = append(frame, "hello"...)
+
+	_, err = conn.Write(VarintFramer{}.Encode(nil, frame))
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+
+	n, err := binary.ReadUvarint(r)
+	require.NoError(t, err)
+
+	res := make([]byte, n)
+	_, err = io.ReadFull(r, res)
+	require.NoError(t, err)
+
+	h, data, err := decodeFrameHeader(res)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, h.seq)
+	require.Equal(t, flagResponse, h.flags)
+	require.EqualValues(t, "hello", data)
+
+	// Clients framed the same way interoperate with the server.
+
+	client := &Client{Addr: ln.Addr().String(), Handshaker: plain, Framer: VarintFramer{}}
+	defer client.Shutdown()
+
+	buf, err := client.Request(nil, []byte("world"))
+	require.NoError(t, err)
+	require.EqualValues(t, "world", buf)
+}
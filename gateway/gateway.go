@@ -0,0 +1,141 @@
+// Package gateway exposes the opcodes handled by a monte Mux over HTTP, such that curl and services that do not
+// speak monte may call them. The body of every POST made to a routed URL path is prefixed with the path's opcode
+// and forwarded as a request over a Client, whose response is written back as the body of the HTTP response.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lithdew/monte"
+	"io"
+	"net/http"
+	"sync"
+)
+
+var DefaultMaxBodySize int64 = 1024 * 1024
+
+var _ http.Handler = (*Gateway)(nil)
+
+// Gateway is an http.Handler that forwards the body of POST requests made to the URL paths registered via Route
+// as requests over Client, prefixed with the opcode of their path via monte.AppendOp such that they may be
+// dispatched by a Mux. The response of a successful request is written back with a 200 OK status, while
+// requests that fail are answered with a JSON object whose "error" field describes why:
+//
+//   - 404 Not Found, should the URL path not be routed.
+//   - 405 Method Not Allowed, should the request not be a POST.
+//   - 413 Request Entity Too Large, should the body exceed MaxBodySize.
+//   - 422 Unprocessable Entity, should the request be rejected by our peer's handler.
+//   - 504 Gateway Timeout, should the request time out.
+//   - 502 Bad Gateway, should the request fail otherwise.
+//
+// Requests are cancelled once their HTTP client goes away. The zero value of a Gateway forwards requests over a
+// nil Client, and so must be assigned a Client before use. Routes may be registered while it is in use.
+type Gateway struct {
+	// Client is the client requests are forwarded over, whose pool of connections is shared across all HTTP
+	// requests.
+	Client *monte.Client
+
+	// MaxBodySize is the maximum size of the body of a request that may be forwarded. It defaults to
+	// DefaultMaxBodySize.
+	MaxBodySize int64
+
+	// ContentType is the Content-Type of responses that are forwarded back. It defaults to "application/json".
+	ContentType string
+
+	mu     sync.RWMutex
+	routes map[string]uint16
+}
+
+// Route registers URL path path to be forwarded as requests with opcode op, replacing any opcode already
+// registered for it.
+func (g *Gateway) Route(path string, op uint16) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.routes == nil {
+		g.routes = make(map[string]uint16)
+	}
+	g.routes[path] = op
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.RLock()
+	op, exists := g.routes[r.URL.Path]
+	g.mu.RUnlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no opcode routed for path %q", r.URL.Path))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	max := g.getMaxBodySize()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if int64(len(body)) > max {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", max))
+		return
+	}
+
+	res, err := g.Client.RequestContext(r.Context(), nil, monte.AppendOp(nil, op, body))
+	if err != nil {
+		if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+			return // The HTTP client went away, and so there is no one left to respond to.
+		}
+		writeError(w, statusOf(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", g.getContentType())
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(res)
+}
+
+func (g *Gateway) getMaxBodySize() int64 {
+	if g.MaxBodySize <= 0 {
+		return DefaultMaxBodySize
+	}
+	return g.MaxBodySize
+}
+
+func (g *Gateway) getContentType() string {
+	if g.ContentType == "" {
+		return "application/json"
+	}
+	return g.ContentType
+}
+
+// statusOf returns the HTTP status a request that failed to be forwarded with err is answered with.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, monte.ErrRequestRejected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, monte.ErrRequestTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeError answers a request with status, and a JSON object whose "error" field holds the message of err.
+func writeError(w http.ResponseWriter, status int, err error) {
+	buf, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf)
+}
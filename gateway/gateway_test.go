@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lithdew/monte"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGateway(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var mux monte.Mux
+
+	mux.HandleFunc(1, func(ctx *monte.Context) error {
+		return ctx.Reply(ctx.Body())
+	})
+	mux.HandleFunc(2, func(ctx *monte.Context) error {
+		return ctx.Reject(errors.New("not today"))
+	})
+
+	srv := &monte.Server{Handler: &mux}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &monte.Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	gw := &Gateway{Client: client, MaxBodySize: 64}
+	gw.Route("/echo", 1)
+	gw.Route("/reject", 2)
+	gw.Route("/unknown", 3)
+
+	ts := httptest.NewServer(gw)
+	defer ts.Close()
+	defer ts.Client().CloseIdleConnections()
+
+	call := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		buf, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+		return res.StatusCode, string(buf)
+	}
+
+	errorOf := func(body string) string {
+		var res struct {
+			Error string `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &res))
+		return res.Error
+	}
+
+	status, body := call(http.MethodPost, "/echo", `{"hello":"world"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, `{"hello":"world"}`, body)
+
+	// Requests rejected by the handler of their opcode, or by a Mux that has no handler registered for it, are
+	// answered with the reason they were rejected.
+
+	status, body = call(http.MethodPost, "/reject", `{}`)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Contains(t, errorOf(body), "not today")
+
+	status, body = call(http.MethodPost, "/unknown", `{}`)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Contains(t, errorOf(body), "unknown opcode 3")
+
+	// Requests that may not be forwarded never reach the server.
+
+	status, _ = call(http.MethodPost, "/missing", `{}`)
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = call(http.MethodGet, "/echo", "")
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	status, _ = call(http.MethodPost, "/echo", strings.Repeat("a", 65))
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+}
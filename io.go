@@ -1,19 +1,40 @@
 package monte
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/lithdew/bytesutil"
 	"io"
 	"net"
+	"strings"
+	"sync"
 )
 
+// BufferedConn is a net.Conn whose writes are buffered until Flush is called. Should Flush fail, the connection
+// is considered dead, unless the error matches ErrFlushRetryable via errors.Is, in which case Flush is retried a
+// bounded number of times before the connection is considered dead. Implementations should only report a flush
+// as retryable should calling Flush again be able to make progress on writing out the bytes that remain buffered.
 type BufferedConn interface {
 	net.Conn
 	Flush() error
 }
 
+// MessageReader may be implemented by a BufferedConn that preserves message boundaries. ReadMessage reads the
+// next message into dst, growing dst should the message not fit, and fails should the message be larger than
+// max bytes.
+type MessageReader interface {
+	ReadMessage(dst []byte, max int) ([]byte, error)
+}
+
+// BuffersWriter may be implemented by a BufferedConn that is able to write several messages at once, such as via
+// a single writev system call. WriteBuffers must write every buffer in bufs as its own message, such that message
+// boundaries are preserved should the conn preserve them.
+type BuffersWriter interface {
+	WriteBuffers(bufs *net.Buffers) (int64, error)
+}
+
 func Read(dst []byte, r io.Reader) ([]byte, error) {
 	_, err := io.ReadFull(r, dst[:])
 	if err != nil {
@@ -38,7 +59,7 @@ func ReadSized(dst []byte, r io.Reader, max int) ([]byte, error) {
 	}
 	n := bytesutil.Uint32BE(dst[:])
 	if int(n) > max {
-		return nil, fmt.Errorf("max is %d bytes, got %d bytes", max, n)
+		return nil, fmt.Errorf("max is %d bytes, got %d bytes: %w", max, n, ErrMessageTooLarge)
 	}
 	dst = bytesutil.ExtendSlice(dst, int(n))
 	_, err = io.ReadFull(r, dst[:])
@@ -71,3 +92,254 @@ func IsEOF(err error) bool {
 	}
 	return false
 }
+
+// splitAddr splits addr into the network and address it designates. Addresses prefixed with unix:// designate
+// the path of a Unix domain socket, while all other addresses designate a TCP address.
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, "unix://") {
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	return "tcp", addr
+}
+
+// setNoDelay sets whether or not Nagle's algorithm is disabled on conn should conn be a TCP connection.
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tc.SetNoDelay(noDelay)
+}
+
+var (
+	_ BufferedConn  = (*FramedConn)(nil)
+	_ MessageReader = (*FramedConn)(nil)
+)
+
+// FramedConn is a BufferedConn that preserves message boundaries over a conn that does not, such as a plain TCP
+// connection, by framing every message written to it with a Framer. Reads are buffered, such that messages that
+// are split across or coalesced within reads of conn are reassembled. Both ends of a connection must be framed
+// the same way.
+//
+// FramedConn is not safe for concurrent use, though a single reader and a single writer may use it concurrently.
+type FramedConn struct {
+	net.Conn
+
+	// Framer frames messages written to and read from conn. It defaults to DefaultFramer, and must not be
+	// changed once the conn is in use.
+	Framer Framer
+
+	bw *bufio.Writer
+	br *bufio.Reader
+
+	rb []byte // read buffer
+	wb []byte // write buffer
+}
+
+func NewFramedConn(conn net.Conn) *FramedConn {
+	return &FramedConn{
+		Conn: conn,
+		bw:   bufio.NewWriter(conn),
+		br:   bufio.NewReader(conn),
+	}
+}
+
+func (f *FramedConn) getFramer() Framer {
+	if f.Framer == nil {
+		return DefaultFramer
+	}
+	return f.Framer
+}
+
+func (f *FramedConn) Write(b []byte) (int, error) {
+	f.wb = f.getFramer().Encode(f.wb[:0], b)
+	_, err := f.bw.Write(f.wb)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush flushes all buffered frames to conn, and flushes conn should it be a BufferedConn.
+func (f *FramedConn) Flush() error {
+	err := f.bw.Flush()
+	if bc, ok := f.Conn.(BufferedConn); ok && err == nil {
+		err = bc.Flush()
+	}
+	return err
+}
+
+func (f *FramedConn) Read(b []byte) (int, error) {
+	var err error
+	f.rb, err = f.ReadMessage(f.rb[:0], len(b))
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, f.rb), nil
+}
+
+// ReadMessage reads the next message into dst, growing dst should the message not fit.
+func (f *FramedConn) ReadMessage(dst []byte, max int) ([]byte, error) {
+	return f.getFramer().Decode(dst[:0], f.br, max)
+}
+
+var DefaultMaxStreamBufferSize = 1024 * 1024
+
+var _ io.ReadWriteCloser = (*ConnStream)(nil)
+var _ Handler = (*ConnStream)(nil)
+
+// ConnStream presents the messages sent and received over a Conn as an io.ReadWriteCloser. Every call to Write
+// sends its bytes as a single message, while Read returns the payloads of received messages in the order they
+// were received as one continuous stream of bytes. Message boundaries are therefore not preserved by Read.
+//
+// ConnStream receives messages by being the Conn's Handler, and must be called from the Conn's read loop such
+// that messages are buffered in order. It may therefore not be used with ConcurrentHandlers, nor with a Client or
+// Server, as they share a single Handler across all of their connections. Closing a ConnStream does not close its
+// Conn.
+type ConnStream struct {
+	// MaxBufferSize is the maximum number of received bytes that may be buffered before they are read. Once it
+	// is reached, HandleMessage blocks the Conn's read loop until enough bytes have been read. A message larger
+	// than MaxBufferSize is buffered on its own once all bytes before it have been read.
+	MaxBufferSize int
+
+	conn *Conn
+
+	mu     sync.Mutex
+	buf    []byte
+	off    int // number of bytes in buf that have already been read
+	closed bool
+
+	notify  chan struct{}
+	drained chan struct{}
+	done    chan struct{}
+}
+
+func NewConnStream(conn *Conn) *ConnStream {
+	conn.once.Do(conn.init)
+
+	return &ConnStream{
+		conn:    conn,
+		notify:  make(chan struct{}, 1),
+		drained: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *ConnStream) getMaxBufferSize() int {
+	if s.MaxBufferSize <= 0 {
+		return DefaultMaxStreamBufferSize
+	}
+	return s.MaxBufferSize
+}
+
+// HandleMessage implements Handler by buffering the payload of ctx to be read. It blocks while the payload does
+// not fit within MaxBufferSize, until either enough bytes have been read, or the stream or its Conn is closed.
+func (s *ConnStream) HandleMessage(ctx *Context) error {
+	body := ctx.Body()
+	max := s.getMaxBufferSize()
+
+	s.mu.Lock()
+	for !s.closed && len(s.buf)-s.off > 0 && len(s.buf)-s.off+len(body) > max {
+		s.mu.Unlock()
+
+		select {
+		case <-s.drained:
+		case <-s.done:
+		case <-s.conn.ctx.Done():
+			return nil
+		}
+
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.buf = append(s.buf, body...)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Read reads received bytes into b, blocking until at least one byte is available. It returns io.EOF once the
+// stream or its Conn has been closed and all bytes received before then have been read.
+func (s *ConnStream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.off < len(s.buf) {
+			n := copy(b, s.buf[s.off:])
+			s.off += n
+
+			// Unread bytes are only moved to the front of buf once more than half of it has been read, such
+			// that many small reads do not each move all remaining bytes.
+
+			if s.off == len(s.buf) {
+				s.buf, s.off = s.buf[:0], 0
+			} else if s.off > len(s.buf)/2 {
+				s.buf, s.off = s.buf[:copy(s.buf, s.buf[s.off:])], 0
+			}
+			s.mu.Unlock()
+
+			select {
+			case s.drained <- struct{}{}:
+			default:
+			}
+
+			return n, nil
+		}
+		closed := s.closed
+		s.mu.Unlock()
+
+		if closed {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-s.notify:
+		case <-s.done:
+		case <-s.conn.ctx.Done():
+			s.mu.Lock()
+			s.closed = true
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Write sends b as a single message, and waits until it has been written.
+func (s *ConnStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return 0, ErrConnClosed
+	}
+
+	err := s.conn.Send(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the stream, discarding any bytes that have yet to be read.
+func (s *ConnStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	s.buf, s.off = nil, 0
+	close(s.done)
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package monte
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnStream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	type message struct {
+		ID   int    `json:"id"`
+		Body string `json:"body"`
+	}
+
+	var a, b Conn
+
+	as, bs := NewConnStream(&a), NewConnStream(&b)
+	a.Handler, b.Handler = as, bs
+
+	stop := pipeConns(t, &a, &b)
+
+	enc := json.NewEncoder(as)
+	dec := json.NewDecoder(bs)
+
+	for i := 0; i < 16; i++ {
+		require.NoError(t, enc.Encode(message{ID: i, Body: "hello"}))
+	}
+
+	for i := 0; i < 16; i++ {
+		var msg message
+		require.NoError(t, dec.Decode(&msg))
+		require.EqualValues(t, message{ID: i, Body: "hello"}, msg)
+	}
+
+	stop()
+
+	_, err := bs.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, as.Close())
+
+	_, err = as.Write([]byte("hello"))
+	require.Error(t, err)
+}
+
+func TestConnStreamMaxBufferSize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var a, b Conn
+
+	as, bs := NewConnStream(&a), NewConnStream(&b)
+	a.Handler, b.Handler = as, bs
+
+	bs.MaxBufferSize = 64
+
+	stop := pipeConns(t, &a, &b)
+	defer stop()
+
+	msg := bytes.Repeat([]byte("a"), 16)
+
+	for i := 0; i < 64; i++ {
+		require.NoError(t, a.SendNoWait(msg))
+	}
+	require.NoError(t, a.Flush())
+
+	// Messages are not buffered beyond MaxBufferSize until they have been read, and reading them one byte at a
+	// time yields them all in order.
+
+	r := bufio.NewReaderSize(bs, 16)
+
+	for i := 0; i < 64*len(msg); i++ {
+		bs.mu.Lock()
+		require.True(t, len(bs.buf)-bs.off <= bs.MaxBufferSize)
+		bs.mu.Unlock()
+
+		c, err := r.ReadByte()
+		require.NoError(t, err)
+		require.EqualValues(t, 'a', c)
+	}
+}
+
+func TestConnStreamCloseWhileFull(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var a, b Conn
+
+	as, bs := NewConnStream(&a), NewConnStream(&b)
+	a.Handler, b.Handler = as, bs
+
+	bs.MaxBufferSize = 16
+
+	stop := pipeConns(t, &a, &b)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, a.SendNoWait([]byte("0123456789")))
+	}
+
+	for {
+		bs.mu.Lock()
+		n := len(bs.buf)
+		bs.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// Closing both ends while the read loop is blocked on a full stream does not deadlock.
+
+	stop()
+}
+
+func TestReadWriteSizedEmpty(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, WriteSized(&buf, []byte{}))
+	require.NoError(t, WriteSized(&buf, []byte("hello")))
+	require.NoError(t, WriteSized(&buf, nil))
+	require.EqualValues(t, 4+4+5+4, buf.Len())
+
+	for _, expected := range []string{"", "hello", ""} {
+		msg, err := ReadSized(nil, &buf, 1024)
+		require.NoError(t, err)
+		require.EqualValues(t, expected, string(msg))
+	}
+}
+
+// oneByteConn is a net.Conn whose reads return at most one byte at a time.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c oneByteConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+func TestFramedConn(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	msgs := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("monte"), 1024), []byte("world")}
+
+	// All messages are flushed at once, such that they are coalesced within reads on the other end, which in
+	// turn only ever read one byte at a time.
+
+	written := make(chan error, 1)
+	go func() {
+		w := NewFramedConn(alice)
+		for _, msg := range msgs {
+			if _, err := w.Write(msg); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- w.Flush()
+	}()
+
+	r := NewFramedConn(oneByteConn{bob})
+	for _, msg := range msgs {
+		buf, err := r.ReadMessage(nil, DefaultMaxFrameSize)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(msg, buf))
+	}
+
+	require.NoError(t, <-written)
+}
+
+func TestConnOverFramedConn(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+
+	a := &Conn{}
+	b := &Conn{Handler: EchoHandler{}}
+
+	done := make(chan struct{})
+	handled := make(chan struct{}, 2)
+
+	go func() {
+		_ = a.Handle(done, NewFramedConn(oneByteConn{alice}))
+		handled <- struct{}{}
+	}()
+
+	go func() {
+		_ = b.Handle(done, NewFramedConn(oneByteConn{bob}))
+		handled <- struct{}{}
+	}()
+
+	for _, payload := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("monte"), 4096)} {
+		res, err := a.Request(nil, payload)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(payload, res))
+	}
+
+	close(done)
+	<-handled
+	<-handled
+}
@@ -0,0 +1,120 @@
+package monte
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+func (c *Conn) getMaxMissedPongs() int {
+	if c.MaxMissedPongs <= 0 {
+		return DefaultMaxMissedPongs
+	}
+	return c.MaxMissedPongs
+}
+
+// getKeepAliveInterval returns KeepAliveInterval should it be positive, or otherwise the interval advertised by
+// our peer, which is zero should none have been adopted.
+func (c *Conn) getKeepAliveInterval() time.Duration {
+	if c.KeepAliveInterval > 0 {
+		return c.KeepAliveInterval
+	}
+	return time.Duration(atomic.LoadInt64(&c.keepAlive))
+}
+
+// keepAliveDelay returns a random duration between 80% and 100% of the keepalive interval.
+func (c *Conn) keepAliveDelay() time.Duration {
+	interval := c.getKeepAliveInterval()
+	jitter := int64(interval / 5)
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - time.Duration(rand.Int63n(jitter+1))
+}
+
+func (c *Conn) getMinKeepAliveInterval() time.Duration {
+	if c.MinKeepAliveInterval <= 0 {
+		return DefaultMinKeepAliveInterval
+	}
+	return c.MinKeepAliveInterval
+}
+
+// adoptKeepAlive adopts interval d advertised by our peer, should AdoptKeepAliveInterval be set and
+// KeepAliveInterval not be positive. Only the first interval advertised is adopted, and intervals shorter than
+// MinKeepAliveInterval are ignored.
+func (c *Conn) adoptKeepAlive(d time.Duration) {
+	if !c.AdoptKeepAliveInterval || c.KeepAliveInterval > 0 || d < c.getMinKeepAliveInterval() {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&c.keepAlive, 0, int64(d)) {
+		close(c.advertised)
+	}
+}
+
+// keepAliveLoop pings our peer until stop is closed, and fails should MaxMissedPongs consecutive pings go
+// unanswered. Should KeepAliveIdleOnly be set, pings are skipped for intervals during which frames were read from
+// our peer. A single timer is reused across pings. Should KeepAliveInterval not be positive, no pings are sent
+// until our peer advertises an interval.
+func (c *Conn) keepAliveLoop(stop chan struct{}) error {
+	if c.KeepAliveInterval <= 0 {
+		select {
+		case <-stop:
+			return nil
+		case <-c.advertised:
+		}
+	}
+
+	after := c.after
+	if after == nil {
+		timer := AcquireTimer(c.keepAliveDelay())
+		defer ReleaseTimer(timer)
+
+		if !timer.Stop() {
+			<-timer.C
+		}
+
+		after = func(d time.Duration) <-chan time.Time {
+			timer.Reset(d)
+			return timer.C
+		}
+	}
+
+	max := uint32(c.getMaxMissedPongs())
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-after(c.keepAliveDelay()):
+		}
+
+		if c.KeepAliveIdleOnly && atomic.SwapUint32(&c.active, 0) == 1 {
+			atomic.StoreUint32(&c.pings, 0)
+			continue
+		}
+
+		if missed := atomic.LoadUint32(&c.pings); missed >= max {
+			return fmt.Errorf("missed %d consecutive pongs: %w", missed, ErrPeerUnresponsive)
+		}
+
+		atomic.AddUint32(&c.pings, 1)
+
+		err := c.sendPing(frameHeader{flags: flagPing})
+		if err != nil {
+			// The connection is already being closed, and the read and write loops report why.
+			<-stop
+			return nil
+		}
+	}
+}
+
+// sendPing queues a ping or pong with header h ahead of any messages with PriorityNormal. Should flushes be
+// manual, it is flushed regardless, as our peer would otherwise consider us unresponsive.
+func (c *Conn) sendPing(h frameHeader) error {
+	err := c.sendNoWait(h, PriorityHigh, nil)
+	if err == nil && c.ManualFlush {
+		_, err = c.preparePendingWrite(nil, false, PriorityHigh, 0)
+	}
+	return err
+}
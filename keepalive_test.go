@@ -0,0 +1,352 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveDelay(t *testing.T) {
+	c := &Conn{KeepAliveInterval: 10 * time.Second}
+
+	for i := 0; i < 1000; i++ {
+		d := c.keepAliveDelay()
+		require.True(t, d >= 8*time.Second && d <= 10*time.Second)
+	}
+}
+
+func TestKeepAliveMissedPongs(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ticks := make(chan time.Time)
+	pongs := make(chan []byte)
+	closed := make(chan struct{})
+
+	var once sync.Once
+
+	conn := &mockConn{
+		read: func(b []byte) (int, error) {
+			select {
+			case pong := <-pongs:
+				return copy(b, pong), nil
+			case <-closed:
+				return 0, io.EOF
+			}
+		},
+		close: func() { once.Do(func() { close(closed) }) },
+	}
+
+	c := &Conn{
+		KeepAliveInterval: time.Second,
+		MaxMissedPongs:    2,
+		after:             func(time.Duration) <-chan time.Time { return ticks },
+	}
+
+	handleDone := make(chan error)
+	go func() {
+		handleDone <- c.Handle(make(chan struct{}), conn)
+	}()
+
+	tick := func(pings int) {
+		ticks <- time.Now()
+		for conn.numWritten() != pings {
+			time.Sleep(1 * time.Millisecond)
+		}
+	}
+
+	// An answered ping resets the number of missed pongs.
+
+	tick(1)
+
+	pong := make([]byte, frameHeader{}.size())
+	frameHeader{flags: flagPing | flagResponse}.encode(pong)
+	pongs <- pong
+
+	for atomic.LoadUint32(&c.pings) != 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	tick(2)
+	tick(3)
+
+	// The connection is torn down once MaxMissedPongs consecutive pings go unanswered.
+
+	ticks <- time.Now()
+
+	err := <-handleDone
+	require.True(t, errors.Is(err, ErrPeerUnresponsive))
+
+	require.EqualValues(t, 3, conn.numWritten())
+	for _, frame := range conn.written {
+		h, _, err := decodeFrameHeader(frame)
+		require.NoError(t, err)
+		require.Equal(t, flagPing, h.flags)
+	}
+}
+
+func TestKeepAliveIdleOnly(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ticks := make(chan time.Time)
+	frames := make(chan []byte)
+	closed := make(chan struct{})
+
+	var once sync.Once
+
+	conn := &mockConn{
+		read: func(b []byte) (int, error) {
+			select {
+			case frame := <-frames:
+				return copy(b, frame), nil
+			case <-closed:
+				return 0, io.EOF
+			}
+		},
+		close: func() { once.Do(func() { close(closed) }) },
+	}
+
+	read, waits := uint32(0), uint32(0)
+
+	c := &Conn{
+		KeepAliveInterval: time.Second,
+		KeepAliveIdleOnly: true,
+		MaxMissedPongs:    1,
+		OnRead:            func([]byte) { atomic.AddUint32(&read, 1) },
+		after: func(time.Duration) <-chan time.Time {
+			atomic.AddUint32(&waits, 1)
+			return ticks
+		},
+	}
+
+	handleDone := make(chan error)
+	go func() {
+		handleDone <- c.Handle(make(chan struct{}), conn)
+	}()
+
+	// tick waits until the keepalive loop is done with the tick, and has started waiting for the next one.
+
+	tick := func() {
+		n := atomic.LoadUint32(&waits)
+		ticks <- time.Now()
+		for atomic.LoadUint32(&waits) == n {
+			time.Sleep(1 * time.Millisecond)
+		}
+	}
+
+	message := make([]byte, frameHeader{}.size()+len("hello"))
+	copy(frameHeader{}.encode(message), "hello")
+
+	tick()
+	for conn.numWritten() != 1 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// Pings are skipped for intervals during which our peer sent us a frame, which also counts as a pong.
+
+	for i := uint32(1); i <= 3; i++ {
+		frames <- message
+		for atomic.LoadUint32(&read) != i {
+			time.Sleep(1 * time.Millisecond)
+		}
+
+		tick()
+		require.EqualValues(t, 0, atomic.LoadUint32(&c.pings))
+		require.EqualValues(t, 1, conn.numWritten())
+	}
+
+	// Idle connections are pinged, and torn down should their pings go unanswered.
+
+	tick()
+	for conn.numWritten() != 2 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	ticks <- time.Now()
+
+	err := <-handleDone
+	require.True(t, errors.Is(err, ErrPeerUnresponsive))
+}
+
+func TestKeepAlivePong(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ticks := make(chan time.Time)
+	pongs := make(chan struct{}, 1)
+
+	// Pings and pongs are flushed even though flushes are otherwise manual.
+
+	a := &Conn{
+		KeepAliveInterval: time.Second,
+		MaxMissedPongs:    1,
+		ManualFlush:       true,
+		OnRead: func(frame []byte) {
+			h, _, err := decodeFrameHeader(frame)
+			if err == nil && h.flags == flagPing|flagResponse {
+				pongs <- struct{}{}
+			}
+		},
+		after: func(time.Duration) <-chan time.Time { return ticks },
+	}
+	b := &Conn{ManualFlush: true}
+
+	defer pipeConns(t, a, b)()
+
+	// Our peer answers every ping, such that the connection is never considered dead.
+
+	for i := 0; i < 3; i++ {
+		ticks <- time.Now()
+
+		select {
+		case <-pongs:
+		case <-time.After(1 * time.Second):
+			t.Fatal("ping was not answered")
+		}
+
+		// OnRead is called before the pong is accounted for.
+
+		for atomic.LoadUint32(&a.pings) != 0 {
+			time.Sleep(1 * time.Millisecond)
+		}
+	}
+
+	require.NoError(t, a.SendNoWait([]byte("hello")))
+	require.NoError(t, a.Flush())
+}
+
+func TestClientAdoptsAdvertisedKeepAlive(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	interval := 30 * time.Millisecond
+	readTimeout := 150 * time.Millisecond
+
+	var closed uint32
+
+	server := &Server{
+		Handler:                    EchoHandler{},
+		ReadTimeout:                readTimeout,
+		AdvertiseKeepAliveInterval: interval,
+		ConnState: ConnStateHandlerFunc(func(conn *Conn, state ConnState) {
+			if state == StateClosed {
+				atomic.AddUint32(&closed, 1)
+			}
+		}),
+	}
+	client := &Client{Addr: ln.Addr().String(), MinKeepAliveInterval: interval}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	for conn.getKeepAliveInterval() == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	require.Equal(t, interval, conn.Config().KeepAliveInterval)
+
+	// Stay idle for several times the server's read timeout. Only our pings keep the connection alive.
+
+	time.Sleep(4 * readTimeout)
+
+	require.Zero(t, atomic.LoadUint32(&closed))
+
+	res, err := conn.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+}
+
+func TestClientKeepsExplicitKeepAlive(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	readTimeout := 50 * time.Millisecond
+
+	closed := make(chan struct{})
+
+	server := &Server{
+		ReadTimeout:                readTimeout,
+		AdvertiseKeepAliveInterval: readTimeout / 5,
+		ConnState: ConnStateHandlerFunc(func(conn *Conn, state ConnState) {
+			if state == StateClosed {
+				close(closed)
+			}
+		}),
+	}
+	client := &Client{Addr: ln.Addr().String(), KeepAliveInterval: time.Hour}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	// The advertised interval is ignored in favor of our own, such that the server disconnects us once idle.
+
+	select {
+	case <-closed:
+	case <-time.After(10 * readTimeout):
+		t.Fatal("idle connection was not closed")
+	}
+
+	require.Equal(t, time.Hour, conn.getKeepAliveInterval())
+}
+
+func TestClientIgnoresShortAdvertisedKeepAlive(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{Handler: EchoHandler{}, AdvertiseKeepAliveInterval: time.Nanosecond}
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	// The server advertises its interval before responding to our request, which is ignored as it is shorter
+	// than MinKeepAliveInterval, rather than having us ping the server in a tight loop.
+
+	res, err := conn.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	require.Zero(t, conn.getKeepAliveInterval())
+}
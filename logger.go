@@ -0,0 +1,37 @@
+package monte
+
+import "net"
+
+// Logger receives structured log events about the lifecycle of connections, and about errors that would otherwise
+// go unreported. Every method is passed a message followed by alternating keys and values, such that a
+// *slog.Logger may be used as a Logger as is.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// DefaultLogger discards every log event.
+var DefaultLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// remoteAddr and listenerAddr format the address of conn and ln respectively once logged, such that they are not
+// looked up otherwise.
+
+type remoteAddr struct {
+	conn net.Conn
+}
+
+type listenerAddr struct {
+	ln net.Listener
+}
+
+func (a remoteAddr) String() string   { return a.conn.RemoteAddr().String() }
+func (a listenerAddr) String() string { return a.ln.Addr().String() }
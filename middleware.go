@@ -0,0 +1,76 @@
+package monte
+
+// Middleware intercepts the messages a Conn receives and sends, such as to authenticate, log, or measure them
+// without wrapping every handler manually.
+//
+// Middleware registered via Use is layered such that the first registered is the outermost: it is the first to
+// see the messages our peer sends us, and the last to see the payloads we send our peer.
+type Middleware struct {
+	// Inbound, if set, wraps the handler that messages our peer sends us are passed to. The handler it returns
+	// may inspect or modify the message's Context, reject requests via Context.Reject, or drop messages by not
+	// calling next.
+	Inbound func(next Handler) Handler
+
+	// Outbound, if set, is called with the payload of every message, request, and response we send before it is
+	// queued to be written, and returns the payload to send in its place. Should it return an error, the message
+	// is not sent, and the error is returned to the sender. Payloads written via WriteFrom, and frames that do
+	// not carry a message such as pings and cancellations, are not passed to it.
+	Outbound func(conn *Conn, payload []byte) ([]byte, error)
+}
+
+// Use registers m to intercept the messages the connection receives and sends. It must be called before the
+// connection is handled.
+func (c *Conn) Use(m Middleware) {
+	c.middleware = append(c.middleware, m)
+}
+
+// Use registers m to intercept the messages received and sent over every connection served. It must be called
+// before the server starts serving.
+func (s *Server) Use(m Middleware) {
+	s.middleware = append(s.middleware, m)
+}
+
+// Use registers m to intercept the messages received and sent over every connection dialed. It must be called
+// before the client is used.
+func (c *Client) Use(m Middleware) {
+	c.middleware = append(c.middleware, m)
+}
+
+// chainHandler returns Handler wrapped by the Inbound of every middleware registered.
+func (c *Conn) chainHandler() Handler {
+	h := c.getHandler()
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		if c.middleware[i].Inbound != nil {
+			h = c.middleware[i].Inbound(h)
+		}
+	}
+	return h
+}
+
+// intercepts reports whether any middleware registered intercepts the payloads we send.
+func (c *Conn) intercepts() bool {
+	for _, m := range c.middleware {
+		if m.Outbound != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// intercept passes payload through the Outbound of every middleware registered, should h carry a message.
+func (c *Conn) intercept(h frameHeader, payload []byte) ([]byte, error) {
+	if len(c.middleware) == 0 || !carriesMessage(h.flags) {
+		return payload, nil
+	}
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		if c.middleware[i].Outbound == nil {
+			continue
+		}
+		var err error
+		payload, err = c.middleware[i].Outbound(c, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,103 @@
+package monte
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		trace = append(trace, event)
+	}
+
+	// The server only handles requests carrying a token, which its middleware strips off, and upper-cases the
+	// responses it sends.
+
+	auth := Middleware{
+		Inbound: func(next Handler) Handler {
+			return HandlerFunc(func(ctx *Context) error {
+				record("auth")
+				if !bytes.HasPrefix(ctx.Body(), []byte("token:")) {
+					return ctx.Reject(errors.New("unauthorized"))
+				}
+				ctx.SetBody(ctx.Body()[len("token:"):])
+				return next.HandleMessage(ctx)
+			})
+		},
+	}
+
+	upper := Middleware{
+		Inbound: func(next Handler) Handler {
+			return HandlerFunc(func(ctx *Context) error {
+				record("upper")
+				return next.HandleMessage(ctx)
+			})
+		},
+		Outbound: func(conn *Conn, payload []byte) ([]byte, error) {
+			return bytes.ToUpper(payload), nil
+		},
+	}
+
+	server := &Server{Handler: EchoHandler{}}
+	server.Use(auth)
+	server.Use(upper)
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// The client attaches the token to every message it sends, and refuses to send empty messages.
+
+	client := &Client{Addr: ln.Addr().String()}
+	client.Use(Middleware{
+		Outbound: func(conn *Conn, payload []byte) ([]byte, error) {
+			if len(payload) == 0 {
+				return nil, errors.New("empty payload")
+			}
+			return append([]byte("token:"), payload...), nil
+		},
+	})
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "HELLO", res)
+
+	require.EqualValues(t, []string{"auth", "upper"}, trace)
+
+	_, err = client.Request(nil, nil)
+	require.EqualError(t, err, "empty payload")
+
+	// Requests without a token are rejected by the server's middleware.
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	conn.middleware = nil
+
+	_, err = conn.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrRequestRejected))
+	require.Contains(t, err.Error(), "unauthorized")
+}
@@ -0,0 +1,99 @@
+// Package montetest provides utilities for testing code built on top of monte under adverse network conditions.
+package montetest
+
+import (
+	"errors"
+	"github.com/lithdew/monte"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by a FaultConn for operations that it was configured to fail.
+var ErrInjectedFault = errors.New("injected fault")
+
+var _ monte.BufferedConn = (*FaultConn)(nil)
+
+// FaultConn wraps a BufferedConn and deterministically injects faults into it. It may be used in place of any
+// BufferedConn, such as one returned by a Handshaker, to simulate adverse network conditions. The fault
+// configuration must not be changed once the FaultConn is in use.
+type FaultConn struct {
+	monte.BufferedConn
+
+	// FailWrite, if positive, fails the FailWrite-th call to Write, counting from one, and all calls to Write
+	// after it with ErrInjectedFault.
+	FailWrite int
+
+	// ShortWrites, if true, only writes the first half of the bytes passed to every call to Write, which then
+	// fails with io.ErrShortWrite.
+	ShortWrites bool
+
+	// ReadDelay is how long every call to Read is delayed by before being passed on.
+	ReadDelay time.Duration
+
+	// DropAfter, if positive, closes the underlying connection once a total of DropAfter bytes have been
+	// written to it. Writes that would exceed DropAfter bytes only write the bytes that fit before failing with
+	// ErrInjectedFault.
+	DropAfter int64
+
+	mu      sync.Mutex
+	writes  int
+	written int64
+}
+
+// NewFaultConn wraps conn with a FaultConn that injects no faults until configured to.
+func NewFaultConn(conn monte.BufferedConn) *FaultConn {
+	return &FaultConn{BufferedConn: conn}
+}
+
+func (f *FaultConn) Read(b []byte) (int, error) {
+	if f.ReadDelay > 0 {
+		time.Sleep(f.ReadDelay)
+	}
+	return f.BufferedConn.Read(b)
+}
+
+func (f *FaultConn) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.writes++
+	if f.FailWrite > 0 && f.writes >= f.FailWrite {
+		return 0, ErrInjectedFault
+	}
+
+	if f.DropAfter > 0 && f.written+int64(len(b)) > f.DropAfter {
+		n, _ := f.BufferedConn.Write(b[:f.DropAfter-f.written])
+		f.written += int64(n)
+		_ = f.BufferedConn.Flush()
+		_ = f.BufferedConn.Close()
+		return n, ErrInjectedFault
+	}
+
+	if f.ShortWrites {
+		n, err := f.BufferedConn.Write(b[:len(b)/2])
+		f.written += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+	}
+
+	n, err := f.BufferedConn.Write(b)
+	f.written += int64(n)
+	return n, err
+}
+
+// NumWrites returns the number of calls made to Write so far.
+func (f *FaultConn) NumWrites() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+// NumWritten returns the number of bytes written to the underlying connection so far.
+func (f *FaultConn) NumWritten() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written
+}
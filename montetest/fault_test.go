@@ -0,0 +1,116 @@
+package montetest
+
+import (
+	"bytes"
+	"errors"
+	"github.com/lithdew/monte"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufferConn is a BufferedConn that records all bytes written to it.
+type bufferConn struct {
+	net.Conn
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)  { return c.buf.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+func (c *bufferConn) Flush() error                { return nil }
+func (c *bufferConn) Close() error                { c.closed = true; return nil }
+
+func TestFaultConnWrites(t *testing.T) {
+	var conn bufferConn
+
+	f := NewFaultConn(&conn)
+	f.FailWrite = 3
+	f.DropAfter = 8
+
+	n, err := f.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+
+	n, err = f.Write([]byte("world"))
+	require.True(t, errors.Is(err, ErrInjectedFault))
+	require.Equal(t, 3, n)
+	require.EqualValues(t, "hellowor", conn.buf.String())
+	require.True(t, conn.closed)
+
+	_, err = f.Write([]byte("!"))
+	require.True(t, errors.Is(err, ErrInjectedFault))
+
+	require.Equal(t, 3, f.NumWrites())
+	require.EqualValues(t, 8, f.NumWritten())
+}
+
+func TestFaultConnShortWrites(t *testing.T) {
+	var conn bufferConn
+
+	f := NewFaultConn(&conn)
+	f.ShortWrites = true
+
+	n, err := f.Write([]byte("hello!"))
+	require.True(t, errors.Is(err, io.ErrShortWrite))
+	require.Equal(t, 3, n)
+	require.EqualValues(t, "hel", conn.buf.String())
+}
+
+func TestFaultConnReadDelay(t *testing.T) {
+	var conn bufferConn
+	conn.buf.WriteString("hello")
+
+	f := NewFaultConn(&conn)
+	f.ReadDelay = 20 * time.Millisecond
+
+	start := time.Now()
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(f, buf)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", buf)
+
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(f.ReadDelay))
+}
+
+// TestConnWriteFailure shows how a FaultConn may be used to assert that a monte.Conn surfaces write failures.
+func TestConnWriteFailure(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+
+	f := NewFaultConn(monte.AsBufferedConn(alice))
+	f.FailWrite = 2
+
+	var a, b monte.Conn
+
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	errs := make(chan error, 1)
+
+	go func() {
+		defer wg.Done()
+		errs <- a.Handle(done, f)
+	}()
+
+	go func() {
+		defer wg.Done()
+		_ = b.Handle(done, monte.AsBufferedConn(bob))
+	}()
+
+	require.NoError(t, a.Send([]byte("first")))
+	require.True(t, errors.Is(a.Send([]byte("second")), ErrInjectedFault))
+
+	require.True(t, errors.Is(<-errs, ErrInjectedFault))
+
+	close(done)
+	wg.Wait()
+}
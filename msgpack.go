@@ -0,0 +1,43 @@
+package monte
+
+import "fmt"
+
+// MsgpackMessage is a value whose generated code marshals and unmarshals it as MessagePack without reflection,
+// such as those generated by tinylib/msgp.
+type MsgpackMessage interface {
+	// MarshalMsg appends the encoding of the value to dst.
+	MarshalMsg(dst []byte) ([]byte, error)
+
+	// UnmarshalMsg decodes the value from the start of buf, and returns what remains of buf.
+	UnmarshalMsg(buf []byte) ([]byte, error)
+}
+
+var _ Codec = MsgpackCodec{}
+
+// MsgpackCodec is a Codec that encodes values as MessagePack via the marshalling code generated for them, which
+// must implement MsgpackMessage. As the methods of generated values have pointer receivers, values unmarshalled
+// must be pointers, as should values marshalled that do not implement MarshalMsg on their value receiver.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	m, ok := v.(MsgpackMessage)
+	if !ok {
+		return dst, fmt.Errorf("%T is not a msgpack message", v)
+	}
+	return m.MarshalMsg(dst)
+}
+
+func (MsgpackCodec) Unmarshal(buf []byte, v interface{}) error {
+	m, ok := v.(MsgpackMessage)
+	if !ok {
+		return fmt.Errorf("%T is not a msgpack message", v)
+	}
+	rest, err := m.UnmarshalMsg(buf)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("%d trailing byte(s) after msgpack message", len(rest))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// msgpackGreeting is a value holding a single string of at most 31 bytes, with marshalling code written the way
+// tinylib/msgp generates it.
+type msgpackGreeting struct {
+	Text string
+}
+
+func (g *msgpackGreeting) MarshalMsg(dst []byte) ([]byte, error) {
+	if len(g.Text) > 31 {
+		return dst, errors.New("text does not fit in a fixstr")
+	}
+	dst = append(dst, 0xa0|byte(len(g.Text)))
+	return append(dst, g.Text...), nil
+}
+
+func (g *msgpackGreeting) UnmarshalMsg(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0]&0xe0 != 0xa0 || len(buf) < 1+int(buf[0]&0x1f) {
+		return buf, errors.New("expected a fixstr")
+	}
+	n := 1 + int(buf[0]&0x1f)
+	g.Text = string(buf[1:n])
+	return buf[n:], nil
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	var codec MsgpackCodec
+
+	buf, err := codec.Marshal([]byte("prefix"), &msgpackGreeting{Text: "hello"})
+	require.NoError(t, err)
+	require.EqualValues(t, "prefix\xa5hello", buf)
+
+	var greeting msgpackGreeting
+	require.NoError(t, codec.Unmarshal(buf[len("prefix"):], &greeting))
+	require.Equal(t, "hello", greeting.Text)
+
+	// Values that are not msgpack messages, or that are followed by trailing bytes, are refused.
+
+	_, err = codec.Marshal(nil, greeting)
+	require.Error(t, err)
+	require.Error(t, codec.Unmarshal(append(buf[len("prefix"):], 0), &greeting))
+	require.Error(t, codec.Unmarshal(buf, &struct{}{}))
+}
@@ -0,0 +1,63 @@
+package monte
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+var _ Handler = (*Mux)(nil)
+
+// Mux is a Handler that dispatches every message to the handler registered for the message's opcode, which is
+// the unsigned 16-bit big-endian integer its payload is prefixed with. Handlers are passed the message with its
+// opcode stripped from its body. Requests whose opcode has no handler registered, or whose payload is too short
+// to hold an opcode, are rejected via Context.Reject, while other such messages are dropped.
+//
+// Messages may be prefixed with their opcode via AppendOp. The zero value of a Mux is ready for use, and
+// handlers may be registered while it is in use.
+type Mux struct {
+	mu       sync.RWMutex
+	handlers map[uint16]Handler
+}
+
+// Handle registers h as the handler for messages with opcode op, replacing any handler already registered for
+// it.
+func (m *Mux) Handle(op uint16, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.handlers == nil {
+		m.handlers = make(map[uint16]Handler)
+	}
+	m.handlers[op] = h
+}
+
+// HandleFunc registers fn as the handler for messages with opcode op.
+func (m *Mux) HandleFunc(op uint16, fn func(ctx *Context) error) {
+	m.Handle(op, HandlerFunc(fn))
+}
+
+func (m *Mux) HandleMessage(ctx *Context) error {
+	if len(ctx.buf) < 2 {
+		return ignoreStale(ctx.Reject(fmt.Errorf("no opcode to decode from %d byte(s)", len(ctx.buf))))
+	}
+
+	op := binary.BigEndian.Uint16(ctx.buf[:2])
+
+	m.mu.RLock()
+	h, exists := m.handlers[op]
+	m.mu.RUnlock()
+
+	if !exists {
+		return ignoreStale(ctx.Reject(fmt.Errorf("unknown opcode %d", op)))
+	}
+
+	ctx.buf = ctx.buf[2:]
+	return h.HandleMessage(ctx)
+}
+
+// AppendOp appends payload prefixed with opcode op to dst, for it to be dispatched by our peer's Mux.
+func AppendOp(dst []byte, op uint16, payload []byte) []byte {
+	dst = append(dst, byte(op>>8), byte(op))
+	return append(dst, payload...)
+}
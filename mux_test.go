@@ -0,0 +1,63 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	var mux Mux
+
+	mux.HandleFunc(1, func(ctx *Context) error { return ctx.Reply(ctx.Body()) })
+	mux.HandleFunc(2, func(ctx *Context) error { return ctx.Reply([]byte(strings.ToUpper(string(ctx.Body())))) })
+
+	server := &Server{Handler: &mux}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, AppendOp(nil, 1, []byte("hello")))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	res, err = client.Request(nil, AppendOp(nil, 2, []byte("hello")))
+	require.NoError(t, err)
+	require.EqualValues(t, "HELLO", res)
+
+	// Requests with unknown opcodes, or too short to hold one, are rejected without closing the connection.
+
+	_, err = client.Request(nil, AppendOp(nil, 3, []byte("hello")))
+	require.True(t, errors.Is(err, ErrRequestRejected))
+	require.Contains(t, err.Error(), "unknown opcode 3")
+
+	_, err = client.Request(nil, []byte{1})
+	require.True(t, errors.Is(err, ErrRequestRejected))
+
+	// Messages that are not requests are dropped, and handlers may be registered while the mux is in use.
+
+	require.NoError(t, client.Send(AppendOp(nil, 3, []byte("hello"))))
+
+	mux.HandleFunc(3, func(ctx *Context) error { return ctx.Reply(ctx.Body()) })
+
+	res, err = client.Request(nil, AppendOp(nil, 3, nil))
+	require.NoError(t, err)
+	require.Empty(t, res)
+}
@@ -1,6 +1,13 @@
 package monte
 
-import "net"
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
 
 type ConnState int
 
@@ -29,6 +36,85 @@ func (fn HandlerFunc) HandleMessage(ctx *Context) error { return fn(ctx) }
 
 var DefaultHandler HandlerFunc = func(ctx *Context) error { return nil }
 
+// MessageHandler is a higher-level alternative to Handler that is called with the payload of every message our
+// peer sends us, and whose result is written back as the response should the message be a request. The result
+// is discarded for messages that are not requests. The payload is only valid until HandleMessage returns, and
+// must be copied should it be retained. Should HandleMessage return an error, the connection is closed.
+//
+// A MessageHandler is served via HandleMessages.
+type MessageHandler interface {
+	HandleMessage(ctx context.Context, peer *Conn, payload []byte) ([]byte, error)
+}
+
+type MessageHandlerFunc func(ctx context.Context, peer *Conn, payload []byte) ([]byte, error)
+
+func (fn MessageHandlerFunc) HandleMessage(ctx context.Context, peer *Conn, payload []byte) ([]byte, error) {
+	return fn(ctx, peer, payload)
+}
+
+// HandleMessages returns a Handler that calls h with every message our peer sends us, and replies to requests
+// with the result h returns. Responses to requests that were cancelled by our peer or whose deadline has passed
+// are dropped without the connection being closed.
+func HandleMessages(h MessageHandler) Handler {
+	return HandlerFunc(func(ctx *Context) error {
+		res, err := h.HandleMessage(ctx, ctx.Conn(), ctx.Body())
+		if err != nil {
+			return err
+		}
+		if ctx.Seq() == 0 {
+			return nil
+		}
+		return ignoreStale(ctx.Reply(res))
+	})
+}
+
+// StreamHandler handles messages our peer writes in fragments, such as via SendStream or WriteFrom, as their
+// fragments arrive rather than once they have been reassembled, such that messages too large to be held in memory
+// may be received. r yields the payload of the message, and fails with an error matching io.ErrUnexpectedEOF
+// should our peer abort the message, or ErrConnClosed should the connection be closed before the message is
+// fully read. Should HandleStream return an error, the connection is closed.
+type StreamHandler interface {
+	HandleStream(ctx *Context, r io.Reader) error
+}
+
+type StreamHandlerFunc func(ctx *Context, r io.Reader) error
+
+func (fn StreamHandlerFunc) HandleStream(ctx *Context, r io.Reader) error { return fn(ctx, r) }
+
+// EchoHandler is a Handler that replies to every request with the request's body, and ignores all other
+// messages. Served over a loopback listener, it exercises the full request path of a Client, which makes it
+// suitable for benchmarking and testing.
+type EchoHandler struct{}
+
+func (EchoHandler) HandleMessage(ctx *Context) error {
+	if ctx.Seq() == 0 {
+		return nil
+	}
+	return ctx.Reply(ctx.Body())
+}
+
+// Dialer dials the connections a Client establishes to its server, such as to resolve hostnames via a custom
+// resolver, bind to a specific network interface, tunnel through Tor or a VPN, or connect to an in-memory
+// listener in tests. network is either "tcp" or "unix", and the dial should be aborted once ctx is done. The
+// websocket package's Dialer is a Dialer that carries connections over WebSocket, given a Client whose Addr is a
+// ws:// or wss:// URL.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (fn DialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return fn(ctx, network, addr)
+}
+
+// DefaultDialer dials via a net.Dialer, which, should a hostname resolve to both IPv6 and IPv4 addresses, races
+// connection attempts to both as described by RFC 6555 (Happy Eyeballs). IPv6 is attempted first, and IPv4 is
+// attempted should IPv6 not connect within 300 milliseconds, such that networks with broken IPv6 connectivity
+// do not stall dials. The stagger may be changed by setting a Client's Dialer to a net.Dialer with its
+// FallbackDelay set.
+var DefaultDialer Dialer = &net.Dialer{}
+
 type Handshaker interface {
 	Handshake(conn net.Conn) (BufferedConn, error)
 }
@@ -37,6 +123,113 @@ type HandshakerFunc func(conn net.Conn) (BufferedConn, error)
 
 func (fn HandshakerFunc) Handshake(conn net.Conn) (BufferedConn, error) { return fn(conn) }
 
+// PeerInfo describes our peer as authenticated by the handshake a connection was established with. See
+// ContextHandshaker and Conn.Peer.
+type PeerInfo struct {
+	// Identity is the identity our peer was authenticated as, such as the identity a client proved knowledge of
+	// the pre-shared key of, or the common name of the certificate a client presented. It is empty should our
+	// peer not have been authenticated.
+	Identity string
+
+	// Metadata is further metadata about our peer established by the handshake, such as the metadata of a
+	// resumed session.
+	Metadata []byte
+
+	// Protocol is the application protocol negotiated with our peer by a protocol handshake. See
+	// NewProtocolClientHandshaker.
+	Protocol string
+
+	// Negotiated is the outcome of a version handshake, which the Conn handling the connection adopts the max
+	// frame size and codec of. It is nil should no version handshake have been performed. See
+	// NewVersionClientHandshaker.
+	Negotiated *Negotiated
+}
+
+// ContextHandshaker is a Handshaker whose handshake may be cancelled via ctx, and that reports our peer as
+// authenticated by the handshake. Servers and Clients call HandshakeContext rather than Handshake on handshakers
+// that implement it, with a context that is done once their handshake timeout elapses or once they are shut down.
+// The PeerInfo returned is carried through to handlers and connection callbacks via Conn.Peer.
+//
+// Servers and Clients expire the deadline of conn once ctx is done regardless of whether their handshaker
+// implements ContextHandshaker, such that handshakes blocked reading from or writing to conn are unblocked.
+type ContextHandshaker interface {
+	Handshaker
+	HandshakeContext(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error)
+}
+
+type ContextHandshakerFunc func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error)
+
+func (fn ContextHandshakerFunc) Handshake(conn net.Conn) (BufferedConn, error) {
+	bc, _, err := fn(context.Background(), conn)
+	return bc, err
+}
+
+func (fn ContextHandshakerFunc) HandshakeContext(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+	return fn(ctx, conn)
+}
+
+// aLongTimeAgo is a deadline that has long expired, which unblocks reads from and writes to a conn it is set on.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// runHandshaker runs h over conn, via HandshakeContext should h implement ContextHandshaker.
+func runHandshaker(ctx context.Context, h Handshaker, conn net.Conn) (BufferedConn, PeerInfo, error) {
+	if ch, ok := h.(ContextHandshaker); ok {
+		return ch.HandshakeContext(ctx, conn)
+	}
+	bc, err := h.Handshake(conn)
+	return bc, PeerInfo{}, err
+}
+
+// handshakeContext runs h over conn, and expires the deadline of conn should ctx be done before h returns, in
+// which case ctx.Err() is returned.
+func handshakeContext(ctx context.Context, h Handshaker, conn net.Conn) (BufferedConn, PeerInfo, error) {
+	done := make(chan struct{})
+	expired := make(chan error, 1)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+			expired <- ctx.Err()
+		case <-done:
+			expired <- nil
+		}
+	}()
+
+	bc, info, err := runHandshaker(ctx, h, conn)
+
+	close(done)
+	if ctxErr := <-expired; ctxErr != nil {
+		return nil, PeerInfo{}, ctxErr
+	}
+
+	return bc, info, err
+}
+
+// handshakeTimeout returns a context that is done once timeout elapses, should it be positive, or once done is
+// closed.
+func handshakeTimeout(done <-chan struct{}, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
 var DefaultClientHandshaker HandshakerFunc = func(conn net.Conn) (BufferedConn, error) {
 	var session Session
 	err := session.DoClient(conn)
@@ -54,3 +247,217 @@ var DefaultServerHandshaker HandshakerFunc = func(conn net.Conn) (BufferedConn,
 	}
 	return NewSessionConn(session.Suite(), conn), nil
 }
+
+// ChaCha20Poly1305ClientHandshaker establishes a shared key with our peer the same way as
+// DefaultClientHandshaker, though rather than encrypting the connection as a whole, it frames messages over conn
+// and seals every frame with ChaCha20-Poly1305, keyed separately for each direction with keys derived from the
+// shared key. It is for deployments that want authenticated encryption without carrying a TLS stack or
+// certificates. See ChaCha20Poly1305Decorator.
+var ChaCha20Poly1305ClientHandshaker HandshakerFunc = func(conn net.Conn) (BufferedConn, error) {
+	var session Session
+	err := session.DoClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	return sealFrames(conn, session.SharedKey(), true)
+}
+
+// ChaCha20Poly1305ServerHandshaker is the server's end of ChaCha20Poly1305ClientHandshaker.
+var ChaCha20Poly1305ServerHandshaker HandshakerFunc = func(conn net.Conn) (BufferedConn, error) {
+	var session Session
+	err := session.DoServer(conn)
+	if err != nil {
+		return nil, err
+	}
+	return sealFrames(conn, session.SharedKey(), false)
+}
+
+// sealFrames frames messages over conn, and seals every frame with ChaCha20-Poly1305 keyed with keys derived from
+// secret.
+func sealFrames(conn net.Conn, secret []byte, client bool) (BufferedConn, error) {
+	decorator, err := ChaCha20Poly1305Decorator(secret, client)
+	if err != nil {
+		return nil, err
+	}
+	return decorator.Decorate(NewFramedConn(conn)), nil
+}
+
+// ChainHandshakers returns a Handshaker that runs each of hs in order, handing the BufferedConn established by
+// each handshaker to the next as its net.Conn, and returns the BufferedConn established by the last of them. This
+// allows for layering handshakes, such as an application-level authentication handshake over an encrypted one.
+// The PeerInfo reported by the chain merges those reported by each handshaker, with the fields reported by later
+// handshakers taking precedence.
+func ChainHandshakers(hs ...Handshaker) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		var info PeerInfo
+
+		bc := AsBufferedConn(conn)
+		for _, h := range hs {
+			next, peer, err := runHandshaker(ctx, h, bc)
+			if err != nil {
+				return nil, PeerInfo{}, err
+			}
+			if peer.Identity != "" {
+				info.Identity = peer.Identity
+			}
+			if peer.Metadata != nil {
+				info.Metadata = peer.Metadata
+			}
+			if peer.Protocol != "" {
+				info.Protocol = peer.Protocol
+			}
+			if peer.Negotiated != nil {
+				info.Negotiated = peer.Negotiated
+			}
+			bc = next
+		}
+		return bc, info, nil
+	})
+}
+
+// NewTLSClientHandshaker returns a Handshaker that performs a TLS handshake as a client configured with config.
+// As TLS does not preserve message boundaries, messages are framed over the established tls.Conn via a FramedConn.
+func NewTLSClientHandshaker(config *tls.Config) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		return handshakeTLS(tls.Client(conn, config), nil)
+	})
+}
+
+// NewTLSServerHandshaker returns a Handshaker that performs a TLS handshake as a server configured with config.
+// As TLS does not preserve message boundaries, messages are framed over the established tls.Conn via a FramedConn.
+func NewTLSServerHandshaker(config *tls.Config) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		return handshakeTLS(tls.Server(conn, config), nil)
+	})
+}
+
+// NewMutualTLSServerHandshaker returns a Handshaker that performs a TLS handshake as a server configured with
+// config that requires clients to present a certificate signed by one of config.ClientCAs, unless config
+// specifies its own ClientAuth policy. Once the handshake completes, verify is called with the state of the
+// connection such that clients may be authorized by the fields of their certificate before the connection is
+// handed to a Handler. Should verify return an error, the handshake fails with an error that matches
+// ErrTLSPeerRejected. The common name of the client's certificate is reported as its PeerInfo identity.
+func NewMutualTLSServerHandshaker(config *tls.Config, verify func(state tls.ConnectionState) error) Handshaker {
+	if config.ClientAuth == tls.NoClientCert {
+		config = config.Clone()
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		tc := tls.Server(conn, config)
+
+		bc, err := handshakeTLS(tc, verify)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		var info PeerInfo
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			info.Identity = certs[0].Subject.CommonName
+		}
+		return bc, info, nil
+	})
+}
+
+func handshakeTLS(tc *tls.Conn, verify func(state tls.ConnectionState) error) (BufferedConn, error) {
+	err := tc.Handshake()
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+	if verify != nil {
+		err = verify(tc.ConnectionState())
+		if err != nil {
+			return nil, wrapError(ErrTLSPeerRejected, err)
+		}
+	}
+	return NewFramedConn(tc), nil
+}
+
+// AsBufferedConn returns conn should it already be a BufferedConn, such as one established by a handshaker
+// earlier in a chain, or otherwise wraps conn with a Flush that does nothing. Handshakers that do not transform
+// the connection they are handed may return it via AsBufferedConn. As every read of conn is then taken to be a
+// single message, conns that do not preserve message boundaries, such as TCP connections, should be wrapped with
+// NewFramedConn instead.
+func AsBufferedConn(conn net.Conn) BufferedConn {
+	if bc, ok := conn.(BufferedConn); ok {
+		return bc
+	}
+	return unbufferedConn{conn}
+}
+
+// unbufferedConn is a BufferedConn over a net.Conn whose writes are not buffered.
+type unbufferedConn struct {
+	net.Conn
+}
+
+func (unbufferedConn) Flush() error { return nil }
+
+// WriteBuffers writes bufs via a single writev should conn be a TCP connection. Otherwise, each buffer in bufs
+// is written via its own call to Write, such that connections that preserve message boundaries, such as UDP
+// connections, do not have their messages coalesced.
+func (c unbufferedConn) WriteBuffers(bufs *net.Buffers) (int64, error) {
+	if _, ok := c.Conn.(*net.TCPConn); ok {
+		return bufs.WriteTo(c.Conn)
+	}
+	return bufs.WriteTo(struct{ io.Writer }{c.Conn})
+}
+
+// AllowCIDRs returns a predicate suitable for Server.AllowConn that rejects addresses within any of the deny
+// CIDR ranges, and, should any allow CIDR ranges be provided, rejects addresses that are not within any of them.
+func AllowCIDRs(allow, deny []string) (func(addr net.Addr) bool, error) {
+	allowed, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(addr net.Addr) bool {
+		ip := addrIP(addr)
+		if ip == nil {
+			return len(allowed) == 0
+		}
+		for _, n := range denied {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+		if len(allowed) == 0 {
+			return true
+		}
+		for _, n := range allowed {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse cidr %q: %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// addrIP returns the IP address of addr, or nil should addr not have one.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,438 @@
+package monte
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAllowCIDRs(t *testing.T) {
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234} }
+
+	allow, err := AllowCIDRs(nil, []string{"10.0.0.0/8", "::1/128"})
+	require.NoError(t, err)
+
+	require.False(t, allow(addr("10.1.2.3")))
+	require.False(t, allow(addr("::1")))
+	require.True(t, allow(addr("192.168.0.1")))
+
+	allow, err = AllowCIDRs([]string{"192.168.0.0/16"}, []string{"192.168.1.0/24"})
+	require.NoError(t, err)
+
+	require.True(t, allow(addr("192.168.0.1")))
+	require.False(t, allow(addr("192.168.1.1")))
+	require.False(t, allow(addr("10.1.2.3")))
+
+	_, err = AllowCIDRs([]string{"not a cidr"}, nil)
+	require.Error(t, err)
+}
+
+// selfSignedTLSConfigs returns TLS configs for a client and a server that trusts a freshly generated self-signed
+// certificate.
+func selfSignedTLSConfigs(t testing.TB) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "monte"},
+		DNSNames:     []string{"monte"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	client := &tls.Config{RootCAs: pool, ServerName: "monte"}
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	return client, server
+}
+
+func TestTLSHandshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientConfig, serverConfig := selfSignedTLSConfigs(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{Handshaker: NewTLSServerHandshaker(serverConfig), Handler: EchoHandler{}}
+	client := &Client{Addr: ln.Addr().String(), Handshaker: NewTLSClientHandshaker(clientConfig)}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	// Messages larger than a single TLS record are reassembled.
+
+	for _, payload := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("monte"), 16*1024)} {
+		res, err := client.Request(nil, payload)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(payload, res))
+	}
+
+	// Clients that do not trust the server's certificate fail to connect.
+
+	untrusted := &Client{
+		Addr:            ln.Addr().String(),
+		Handshaker:      NewTLSClientHandshaker(&tls.Config{ServerName: "monte"}),
+		NumDialAttempts: 1,
+	}
+	defer untrusted.Shutdown()
+
+	_, err = untrusted.Request(nil, []byte("hello"))
+	require.Error(t, err)
+}
+
+func TestChaCha20Poly1305Handshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{Handshaker: ChaCha20Poly1305ServerHandshaker, Handler: EchoHandler{}}
+	client := &Client{Addr: ln.Addr().String(), Handshaker: ChaCha20Poly1305ClientHandshaker}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	// Frames larger than a single sealed chunk are sealed in chunks.
+
+	for _, payload := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("monte"), 16*1024)} {
+		res, err := client.Request(nil, payload)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(payload, res))
+	}
+}
+
+func TestMutualTLSHandshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientConfig, serverConfig := selfSignedTLSConfigs(t)
+
+	// Clients present the same self-signed certificate as the server, which the server trusts.
+
+	serverConfig.ClientCAs = clientConfig.RootCAs
+	clientConfig.Certificates = serverConfig.Certificates
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	var allow uint32 = 1
+
+	verify := func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "monte" {
+			return errors.New("unknown client")
+		}
+		if atomic.LoadUint32(&allow) == 0 {
+			return errors.New("client not allowed")
+		}
+		return nil
+	}
+
+	server := &Server{Handshaker: NewMutualTLSServerHandshaker(serverConfig, verify), Handler: EchoHandler{}}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String(), Handshaker: NewTLSClientHandshaker(clientConfig)}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	// Clients that present no certificate, or that are rejected by verify, fail to be served.
+
+	for _, config := range []*tls.Config{{RootCAs: clientConfig.RootCAs, ServerName: "monte"}, clientConfig} {
+		atomic.StoreUint32(&allow, 0)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		bc, err := NewTLSClientHandshaker(config).Handshake(conn)
+		if err == nil {
+			_, err = bc.Write([]byte("hello"))
+			require.NoError(t, err)
+			require.NoError(t, bc.Flush())
+
+			_, err = bc.Read(make([]byte, 16))
+		}
+		require.Error(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	// Server configs are left untouched.
+
+	require.Equal(t, tls.NoClientCert, serverConfig.ClientAuth)
+
+	// Handshakes fail with ErrTLSPeerRejected should verify reject the client.
+
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	go func() {
+		_, _ = NewTLSClientHandshaker(clientConfig).Handshake(alice)
+	}()
+
+	_, err = NewMutualTLSServerHandshaker(serverConfig, verify).Handshake(bob)
+	require.True(t, errors.Is(err, ErrTLSPeerRejected))
+}
+
+// preambleHandshaker exchanges preamble with its peer, and fails should its peer send a different one.
+func preambleHandshaker(preamble string) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		bc := AsBufferedConn(conn)
+
+		if _, err := bc.Write([]byte(preamble)); err != nil {
+			return nil, err
+		}
+		if err := bc.Flush(); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, len(preamble))
+		if _, err := io.ReadFull(bc, buf); err != nil {
+			return nil, err
+		}
+		if string(buf) != preamble {
+			return nil, fmt.Errorf("unexpected preamble %q", buf)
+		}
+
+		return bc, nil
+	})
+}
+
+func TestChainHandshakers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientConfig, serverConfig := selfSignedTLSConfigs(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	server := &Server{
+		Handshaker: ChainHandshakers(NewTLSServerHandshaker(serverConfig), preambleHandshaker("monte/1")),
+		Handler:    HandlerFunc(func(ctx *Context) error { return ctx.Reply(ctx.Body()) }),
+	}
+	client := &Client{
+		Addr:       ln.Addr().String(),
+		Handshaker: ChainHandshakers(NewTLSClientHandshaker(clientConfig), preambleHandshaker("monte/1")),
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+}
+
+func TestHandshakeContextCancel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	// Handshakes blocked reading from their conn are unblocked once their context is done, regardless of
+	// whether they implement ContextHandshaker.
+
+	blocked := HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		_, err := conn.Read(make([]byte, 1))
+		return nil, err
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err := handshakeContext(ctx, blocked, alice)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestChainHandshakersFailure(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientConfig, serverConfig := selfSignedTLSConfigs(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	errs := make(chan error, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+
+		_, err = ChainHandshakers(NewTLSServerHandshaker(serverConfig), preambleHandshaker("monte/2")).Handshake(conn)
+		errs <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = ChainHandshakers(NewTLSClientHandshaker(clientConfig), preambleHandshaker("monte/1")).Handshake(conn)
+	require.Error(t, err)
+	require.Error(t, <-errs)
+}
+
+func TestHandleMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	messages := make(chan string, 1)
+
+	handler := func(ctx context.Context, peer *Conn, payload []byte) ([]byte, error) {
+		if string(payload) == "fail" {
+			return nil, errors.New("failed")
+		}
+		messages <- string(payload)
+		return bytes.ToUpper(payload), nil
+	}
+
+	server := &Server{Handler: HandleMessages(MessageHandlerFunc(handler))}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	// Requests are responded to with the handler's result, which is discarded for other messages.
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "HELLO", res)
+	require.EqualValues(t, "hello", <-messages)
+
+	require.NoError(t, client.Send([]byte("world")))
+	require.EqualValues(t, "world", <-messages)
+
+	// Errors returned by the handler close the connection.
+
+	_, err = client.Request(nil, []byte("fail"))
+	require.Error(t, err)
+}
+
+func TestUnbufferedConnWriteBuffers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Buffers written to a TCP connection arrive as one continuous stream of bytes.
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	peer := <-accepted
+	require.NotNil(t, peer)
+	defer peer.Close()
+
+	bufs := net.Buffers{[]byte("hello "), []byte("world")}
+	n, err := AsBufferedConn(conn).(BuffersWriter).WriteBuffers(&bufs)
+	require.NoError(t, err)
+	require.EqualValues(t, 11, n)
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(peer, buf)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello world", buf)
+
+	// Buffers written to any other connection are each written via their own call to Write.
+
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	go func() {
+		bufs := net.Buffers{[]byte("hello"), []byte("world")}
+		_, _ = AsBufferedConn(alice).(BuffersWriter).WriteBuffers(&bufs)
+	}()
+
+	for _, expected := range []string{"hello", "world"} {
+		n, err := bob.Read(buf)
+		require.NoError(t, err)
+		require.EqualValues(t, expected, buf[:n])
+	}
+}
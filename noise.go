@@ -0,0 +1,431 @@
+package monte
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"hash"
+	"io"
+	"net"
+)
+
+// NoisePattern designates the Noise handshake pattern to perform.
+type NoisePattern int
+
+const (
+	// NoiseXX has both peers transmit their static keys over the handshake, such that neither needs to know the
+	// other's static key beforehand.
+	NoiseXX NoisePattern = iota
+
+	// NoiseIK has the client know the server's static key beforehand, and transmit its own static key in the
+	// first handshake message, such that the handshake completes in a single round trip.
+	NoiseIK
+)
+
+// noisePatterns lists the tokens of every message of each handshake pattern, starting with the client's.
+var noisePatterns = map[NoisePattern]struct {
+	name string
+	msgs [][]string
+}{
+	NoiseXX: {
+		name: "Noise_XX_25519_ChaChaPoly_BLAKE2b",
+		msgs: [][]string{{"e"}, {"e", "ee", "s", "es"}, {"s", "se"}},
+	},
+	NoiseIK: {
+		name: "Noise_IK_25519_ChaChaPoly_BLAKE2b",
+		msgs: [][]string{{"e", "es", "s", "ss"}, {"e", "ee", "se"}},
+	},
+}
+
+// noiseTagSize is the size of the authentication tag appended to every encrypted handshake payload.
+const noiseTagSize = 16
+
+// NoiseKeypair is a Curve25519 keypair.
+type NoiseKeypair struct {
+	Private [32]byte
+	Public  [32]byte
+}
+
+// GenerateNoiseKeypair generates a Curve25519 keypair, suitable to be used as a static keypair in NoiseConfig.
+func GenerateNoiseKeypair() (NoiseKeypair, error) {
+	var kp NoiseKeypair
+	_, err := io.ReadFull(rand.Reader, kp.Private[:])
+	if err != nil {
+		return kp, err
+	}
+	curve25519.ScalarBaseMult(&kp.Public, &kp.Private)
+	return kp, nil
+}
+
+// NoiseConfig configures a Noise handshake.
+type NoiseConfig struct {
+	Pattern NoisePattern
+
+	// StaticKeypair is our static keypair, which identifies us to our peer.
+	StaticKeypair NoiseKeypair
+
+	// PeerStatic is our peer's static public key. It is required for clients performing NoiseIK, and ignored
+	// otherwise.
+	PeerStatic []byte
+
+	// Prologue, if set, is authenticated by the handshake, and must be the same for both peers.
+	Prologue []byte
+
+	// VerifyPeer, if set, is called with our peer's static public key once the handshake completes. Should it
+	// return an error, the handshake fails with an error that matches ErrNoisePeerKey.
+	VerifyPeer func(static []byte) error
+}
+
+// NewNoiseClientHandshaker returns a Handshaker that performs a Noise handshake as the initiator. Once the
+// handshake completes, messages are framed over conn and encrypted via an AEADConn with ChaCha20-Poly1305, keyed
+// separately for each direction with the keys established by the handshake.
+func NewNoiseClientHandshaker(config NoiseConfig) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		return handshakeNoise(conn, config, true)
+	})
+}
+
+// NewNoiseServerHandshaker returns a Handshaker that performs a Noise handshake as the responder. See
+// NewNoiseClientHandshaker.
+func NewNoiseServerHandshaker(config NoiseConfig) Handshaker {
+	return HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+		return handshakeNoise(conn, config, false)
+	})
+}
+
+func handshakeNoise(conn net.Conn, config NoiseConfig, initiator bool) (BufferedConn, error) {
+	hs, err := newNoiseHandshake(config, initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	send, recv, err := hs.run(conn)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %w", err)
+	}
+
+	if config.VerifyPeer != nil {
+		err = config.VerifyPeer(hs.rs)
+		if err != nil {
+			return nil, wrapError(ErrNoisePeerKey, err)
+		}
+	}
+
+	return NewAEADConn(NewFramedConn(conn), send, recv), nil
+}
+
+// noiseHandshake is the handshake state of a Noise handshake, as defined by the Noise Protocol Framework.
+type noiseHandshake struct {
+	ss        noiseSymmetricState
+	msgs      [][]string
+	initiator bool
+
+	s  NoiseKeypair
+	e  NoiseKeypair
+	rs []byte
+	re []byte
+}
+
+func newNoiseHandshake(config NoiseConfig, initiator bool) (*noiseHandshake, error) {
+	pattern, ok := noisePatterns[config.Pattern]
+	if !ok {
+		return nil, fmt.Errorf("unknown noise pattern %d", config.Pattern)
+	}
+
+	hs := &noiseHandshake{msgs: pattern.msgs, initiator: initiator, s: config.StaticKeypair}
+	hs.ss.initialize(pattern.name)
+	hs.ss.mixHash(config.Prologue)
+
+	// The responder's static key is known to the initiator beforehand with NoiseIK.
+
+	if config.Pattern == NoiseIK {
+		if initiator {
+			if len(config.PeerStatic) != 32 {
+				return nil, fmt.Errorf("noise ik requires the peer's 32-byte static key, got %d bytes",
+					len(config.PeerStatic))
+			}
+			hs.rs = append([]byte(nil), config.PeerStatic...)
+			hs.ss.mixHash(hs.rs)
+		} else {
+			hs.ss.mixHash(hs.s.Public[:])
+		}
+	}
+
+	return hs, nil
+}
+
+// run performs the handshake over conn, and returns the ciphers with which to seal and open messages.
+func (hs *noiseHandshake) run(conn net.Conn) (cipher.AEAD, cipher.AEAD, error) {
+	for i, tokens := range hs.msgs {
+		if (i%2 == 0) == hs.initiator {
+			msg, err := hs.writeMessage(tokens)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = writeNoiseMessage(conn, msg)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			msg, err := readNoiseMessage(conn)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = hs.readMessage(tokens, msg)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	c1, c2 := hs.ss.split()
+	if !hs.initiator {
+		c1, c2 = c2, c1
+	}
+	return c1, c2, nil
+}
+
+func (hs *noiseHandshake) writeMessage(tokens []string) ([]byte, error) {
+	var msg []byte
+
+	for _, token := range tokens {
+		var err error
+
+		switch token {
+		case "e":
+			hs.e, err = GenerateNoiseKeypair()
+			if err != nil {
+				return nil, err
+			}
+			msg = append(msg, hs.e.Public[:]...)
+			hs.ss.mixHash(hs.e.Public[:])
+		case "s":
+			msg = hs.ss.encryptAndHash(msg, hs.s.Public[:])
+		default:
+			err = hs.mixDH(token)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hs.ss.encryptAndHash(msg, nil), nil
+}
+
+func (hs *noiseHandshake) readMessage(tokens []string, msg []byte) error {
+	for _, token := range tokens {
+		var err error
+
+		switch token {
+		case "e":
+			if len(msg) < 32 {
+				return fmt.Errorf("no ephemeral key to read: %w", io.ErrUnexpectedEOF)
+			}
+			hs.re, msg = append([]byte(nil), msg[:32]...), msg[32:]
+			hs.ss.mixHash(hs.re)
+		case "s":
+			n := 32
+			if hs.ss.cs.aead != nil {
+				n += noiseTagSize
+			}
+			if len(msg) < n {
+				return fmt.Errorf("no static key to read: %w", io.ErrUnexpectedEOF)
+			}
+			hs.rs, err = hs.ss.decryptAndHash(msg[:n])
+			msg = msg[n:]
+		default:
+			err = hs.mixDH(token)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := hs.ss.decryptAndHash(msg)
+	return err
+}
+
+// mixDH mixes the result of the Diffie-Hellman exchange designated by token into the handshake's chaining key.
+func (hs *noiseHandshake) mixDH(token string) error {
+	var (
+		private []byte
+		public  []byte
+	)
+
+	// The first letter of the token designates the initiator's key, and the second the responder's.
+
+	local, remote := token[0], token[1]
+	if !hs.initiator {
+		local, remote = remote, local
+	}
+
+	switch local {
+	case 'e':
+		private = hs.e.Private[:]
+	case 's':
+		private = hs.s.Private[:]
+	}
+
+	switch remote {
+	case 'e':
+		public = hs.re
+	case 's':
+		public = hs.rs
+	}
+
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return err
+	}
+
+	hs.ss.mixKey(shared)
+	return nil
+}
+
+// writeNoiseMessage writes msg to conn prefixed with its length as an unsigned 16-bit integer.
+func writeNoiseMessage(conn net.Conn, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// readNoiseMessage reads a message written by writeNoiseMessage from conn.
+func readNoiseMessage(conn net.Conn) ([]byte, error) {
+	var buf [2]byte
+	_, err := io.ReadFull(conn, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(buf[:]))
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// noiseCipherState encrypts and decrypts handshake payloads once a key has been mixed into the handshake.
+type noiseCipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func (cs *noiseCipherState) initializeKey(k []byte) {
+	cs.aead, _ = chacha20poly1305.New(k)
+	cs.n = 0
+}
+
+func (cs *noiseCipherState) nonce() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], cs.n)
+	return nonce[:]
+}
+
+func (cs *noiseCipherState) encryptWithAd(dst, ad, plaintext []byte) []byte {
+	if cs.aead == nil {
+		return append(dst, plaintext...)
+	}
+	dst = cs.aead.Seal(dst, cs.nonce(), plaintext, ad)
+	cs.n++
+	return dst
+}
+
+func (cs *noiseCipherState) decryptWithAd(ad, ciphertext []byte) ([]byte, error) {
+	if cs.aead == nil {
+		return append([]byte(nil), ciphertext...), nil
+	}
+	plaintext, err := cs.aead.Open(nil, cs.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt handshake message: %w", ErrMessageTampered)
+	}
+	cs.n++
+	return plaintext, nil
+}
+
+// noiseSymmetricState holds the chaining key and handshake hash of a Noise handshake.
+type noiseSymmetricState struct {
+	cs noiseCipherState
+	ck []byte
+	h  []byte
+}
+
+func newNoiseHash() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+func (ss *noiseSymmetricState) initialize(name string) {
+	if len(name) <= blake2b.Size {
+		ss.h = make([]byte, blake2b.Size)
+		copy(ss.h, name)
+	} else {
+		sum := blake2b.Sum512([]byte(name))
+		ss.h = sum[:]
+	}
+	ss.ck = append([]byte(nil), ss.h...)
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) {
+	var k []byte
+	ss.ck, k = noiseHKDF(ss.ck, ikm)
+	ss.cs.initializeKey(k[:chacha20poly1305.KeySize])
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	h := newNoiseHash()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(ss.h[:0])
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(dst, plaintext []byte) []byte {
+	n := len(dst)
+	dst = ss.cs.encryptWithAd(dst, ss.h, plaintext)
+	ss.mixHash(dst[n:])
+	return dst
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decryptWithAd(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the ciphers with which the initiator and the responder respectively seal their messages once
+// the handshake completes.
+func (ss *noiseSymmetricState) split() (cipher.AEAD, cipher.AEAD) {
+	k1, k2 := noiseHKDF(ss.ck, nil)
+	c1, _ := chacha20poly1305.New(k1[:chacha20poly1305.KeySize])
+	c2, _ := chacha20poly1305.New(k2[:chacha20poly1305.KeySize])
+	return c1, c2
+}
+
+// noiseHKDF derives two outputs from the chaining key ck and input key material ikm via HKDF over HMAC-BLAKE2b.
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(newNoiseHash, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(newNoiseHash, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(newNoiseHash, temp)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
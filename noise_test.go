@@ -0,0 +1,164 @@
+package monte
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+)
+
+func testNoiseKeypair(t testing.TB) NoiseKeypair {
+	kp, err := GenerateNoiseKeypair()
+	require.NoError(t, err)
+	return kp
+}
+
+// handshakeNoisePair runs a Noise handshake between client and server over an in-memory pipe.
+func handshakeNoisePair(t testing.TB, client, server NoiseConfig) (*noiseHandshake, *noiseHandshake, error, error) {
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	a, err := newNoiseHandshake(client, true)
+	require.NoError(t, err)
+
+	b, err := newNoiseHandshake(server, false)
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := b.run(bob)
+		if err != nil {
+			bob.Close()
+		}
+		errs <- err
+	}()
+
+	_, _, err = a.run(alice)
+	if err != nil {
+		alice.Close()
+	}
+
+	return a, b, err, <-errs
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientKey, serverKey := testNoiseKeypair(t), testNoiseKeypair(t)
+
+	for name, pattern := range map[string]NoisePattern{"xx": NoiseXX, "ik": NoiseIK} {
+		t.Run(name, func(t *testing.T) {
+			client := NoiseConfig{
+				Pattern:       pattern,
+				StaticKeypair: clientKey,
+				PeerStatic:    serverKey.Public[:],
+				Prologue:      []byte("monte"),
+			}
+			server := NoiseConfig{Pattern: pattern, StaticKeypair: serverKey, Prologue: []byte("monte")}
+
+			a, b, errA, errB := handshakeNoisePair(t, client, server)
+			require.NoError(t, errA)
+			require.NoError(t, errB)
+
+			// Both peers learn each other's static keys, and agree on the handshake hash and transport keys.
+
+			require.EqualValues(t, serverKey.Public[:], a.rs)
+			require.EqualValues(t, clientKey.Public[:], b.rs)
+			require.EqualValues(t, a.ss.h, b.ss.h)
+
+			c1, c2 := a.ss.split()
+			d1, d2 := b.ss.split()
+
+			nonce := make([]byte, c1.NonceSize())
+			opened, err := d1.Open(nil, nonce, c1.Seal(nil, nonce, []byte("hello"), nil), nil)
+			require.NoError(t, err)
+			require.EqualValues(t, "hello", opened)
+
+			opened, err = c2.Open(nil, nonce, d2.Seal(nil, nonce, []byte("world"), nil), nil)
+			require.NoError(t, err)
+			require.EqualValues(t, "world", opened)
+
+			// A mismatched prologue fails the handshake.
+
+			client.Prologue = []byte("other")
+
+			_, _, errA, errB = handshakeNoisePair(t, client, server)
+			require.True(t, errors.Is(errA, ErrMessageTampered) || errors.Is(errB, ErrMessageTampered))
+		})
+	}
+}
+
+func TestNoiseIKWrongServerKey(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	other := testNoiseKeypair(t)
+
+	client := NoiseConfig{Pattern: NoiseIK, StaticKeypair: testNoiseKeypair(t), PeerStatic: other.Public[:]}
+	server := NoiseConfig{Pattern: NoiseIK, StaticKeypair: testNoiseKeypair(t)}
+
+	_, _, errA, errB := handshakeNoisePair(t, client, server)
+	require.Error(t, errA)
+	require.True(t, errors.Is(errB, ErrMessageTampered))
+
+	_, err := newNoiseHandshake(NoiseConfig{Pattern: NoiseIK}, true)
+	require.Error(t, err)
+}
+
+func TestNoiseHandshakers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientKey, serverKey := testNoiseKeypair(t), testNoiseKeypair(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	// The server only accepts clients whose static key it knows.
+
+	verify := func(static []byte) error {
+		if !bytes.Equal(static, clientKey.Public[:]) {
+			return errors.New("unknown client")
+		}
+		return nil
+	}
+
+	server := &Server{
+		Handshaker: NewNoiseServerHandshaker(NoiseConfig{StaticKeypair: serverKey, VerifyPeer: verify}),
+		Handler:    EchoHandler{},
+	}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{
+		Addr:       ln.Addr().String(),
+		Handshaker: NewNoiseClientHandshaker(NoiseConfig{StaticKeypair: clientKey}),
+	}
+	defer client.Shutdown()
+
+	for _, payload := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("monte"), 16*1024)} {
+		res, err := client.Request(nil, payload)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(payload, res))
+	}
+
+	// Servers are rejected by clients that verify their static key, and clients are rejected by the server.
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = NewNoiseClientHandshaker(NoiseConfig{
+		StaticKeypair: testNoiseKeypair(t),
+		VerifyPeer:    func(static []byte) error { return errors.New("unknown server") },
+	}).Handshake(conn)
+	require.True(t, errors.Is(err, ErrNoisePeerKey))
+}
@@ -1,20 +1,103 @@
 package monte
 
 import (
-	"github.com/valyala/bytebufferpool"
+	"context"
+	"errors"
+	"math/bits"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var _ context.Context = (*Context)(nil)
+
 type Context struct {
 	conn *Conn
 	seq  uint32
 	buf  []byte
+	body []byte // owned copy of buf for handlers that do not run on the read loop
+	ctx  context.Context
+
+	replied *uint32 // set once a response is sent, should the handler be bound by a HandlerTimeout
 }
 
-func (c *Context) Conn() *Conn            { return c.conn }
-func (c *Context) Body() []byte           { return c.buf }
-func (c *Context) Reply(buf []byte) error { return c.conn.send(c.seq, buf) }
+func (c *Context) Conn() *Conn  { return c.conn }
+func (c *Context) Body() []byte { return c.buf }
+
+// SetBody replaces the body of the message, such as for Middleware to pass a modified message to the handlers
+// that follow it.
+func (c *Context) SetBody(buf []byte) { c.buf = buf }
+
+// Seq returns the sequence number of the message being handled, which is zero should its sender not be waiting
+// on a response.
+func (c *Context) Seq() uint32 { return c.seq }
+
+// Responder returns the Responder through which responses to the message being handled may be sent without
+// waiting for them to be written.
+func (c *Context) Responder() Responder { return c.conn }
+
+// Reply sends buf as a response to the message being handled. Replies to requests that have been cancelled by
+// their sender or whose deadline has passed are dropped, as their sender is no longer waiting on them. Reply
+// then returns an error matching context.Canceled, or ErrRequestTimeout and context.DeadlineExceeded
+// respectively, which handlers that do not wish for the connection to be closed should not return.
+//
+// Reply waits until the response has been written. Handlers called from the read loop that must not block it
+// while the write loop is busy, or that should not wait on ManualFlush, should respond via Responder instead.
+func (c *Context) Reply(buf []byte) error {
+	h := frameHeader{seq: c.seq}
+	if c.seq != 0 {
+		if err := c.checkReply(); err != nil {
+			return err
+		}
+		h.flags |= flagResponse
+	}
+	return c.conn.send(h, PriorityNormal, buf)
+}
+
+// Reject fails the request being handled with an error that matches ErrRequestRejected on our peer's end, and
+// that carries the reason err gave. It is subject to the same conditions as Reply, and should it be called for
+// a message that is not a request, nothing is sent.
+func (c *Context) Reject(err error) error {
+	if c.seq == 0 {
+		return nil
+	}
+	if err := c.checkReply(); err != nil {
+		return err
+	}
+	return c.conn.send(frameHeader{seq: c.seq, flags: flagResponse | flagCancel}, PriorityNormal, []byte(err.Error()))
+}
+
+// ignoreStale ignores err should it be returned by Reply or Reject because the request was cancelled by its sender
+// or passed its deadline, which handlers that do not wish for the connection to be closed should not return.
+func ignoreStale(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrRequestTimeout) {
+		return nil
+	}
+	return err
+}
+
+// checkReply returns why the request being handled may no longer be responded to, should it have been cancelled,
+// have passed its deadline, or have already been responded to with a timeout response.
+func (c *Context) checkReply() error {
+	if err := c.ctx.Err(); err != nil && c.conn.ctx.Err() == nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return wrapError(ErrRequestTimeout, err)
+		}
+		return err
+	}
+	if c.replied != nil && !atomic.CompareAndSwapUint32(c.replied, 0, 1) {
+		return wrapError(ErrRequestTimeout, context.DeadlineExceeded) // a timeout response was already sent
+	}
+	return nil
+}
+
+// Deadline, Done, Err, and Value implement context.Context. The context is done once the connection is closed,
+// the deadline propagated by the request's sender has passed, or the request has been cancelled by its sender.
+
+func (c *Context) Deadline() (time.Time, bool)       { return c.ctx.Deadline() }
+func (c *Context) Done() <-chan struct{}             { return c.ctx.Done() }
+func (c *Context) Err() error                        { return c.ctx.Err() }
+func (c *Context) Value(key interface{}) interface{} { return c.ctx.Value(key) }
 
 var contextPool sync.Pool
 
@@ -27,21 +110,30 @@ func acquireContext(conn *Conn, seq uint32, buf []byte) *Context {
 	ctx.conn = conn
 	ctx.seq = seq
 	ctx.buf = buf
+	ctx.ctx = conn.ctx
 	return ctx
 }
 
-func releaseContext(ctx *Context) { contextPool.Put(ctx) }
+func releaseContext(ctx *Context) {
+	ctx.conn = nil
+	ctx.buf = nil
+	ctx.ctx = nil
+	ctx.replied = nil
+	contextPool.Put(ctx)
+}
 
 type pendingWrite struct {
-	buf  *bytebufferpool.ByteBuffer // payload
-	wait bool                       // signal to caller if they're waiting
-	err  error                      // keeps track of any socket errors on write
-	wg   sync.WaitGroup             // signals the caller that this write is complete
+	buf    *byteBuffer    // payload
+	wait   bool           // signal to caller if they're waiting
+	stream uint32         // stream the write was queued on, which the write loop schedules writes fairly across
+	queued time.Time      // when the write was queued, only set should the Conn report queue wait times
+	err    error          // keeps track of any socket errors on write
+	wg     sync.WaitGroup // signals the caller that this write is complete
 }
 
 var pendingWritePool sync.Pool
 
-func acquirePendingWrite(buf *bytebufferpool.ByteBuffer, wait bool) *pendingWrite {
+func acquirePendingWrite(buf *byteBuffer, wait bool) *pendingWrite {
 	v := pendingWritePool.Get()
 	if v == nil {
 		v = &pendingWrite{}
@@ -52,12 +144,94 @@ func acquirePendingWrite(buf *bytebufferpool.ByteBuffer, wait bool) *pendingWrit
 	return pw
 }
 
+// complete resolves the write with err. Callers waiting on the write are signalled, and writes that nobody is
+// waiting on are released back to their pools.
+func (pw *pendingWrite) complete(err error) {
+	if pw.wait {
+		pw.err = err
+		pw.wg.Done()
+		return
+	}
+	releaseBuffer(pw.buf)
+	releasePendingWrite(pw)
+}
+
 func releasePendingWrite(pw *pendingWrite) { pw.err = nil; pendingWritePool.Put(pw) }
 
+const (
+	minBufferClass = 6  // smallest pooled buffer capacity is 64 bytes
+	maxBufferClass = 21 // largest pooled buffer capacity is 2 MiB
+)
+
+// byteBuffer is a byte slice whose capacity is a power of two, such that it may be returned to the pool of
+// buffers of the same size class once it is no longer in use.
+type byteBuffer struct {
+	B []byte
+
+	refs int32 // number of holders beyond the first sharing the buffer, such as when broadcast, accessed atomically
+}
+
+var bufferPools [maxBufferClass - minBufferClass + 1]sync.Pool
+
+// bufferClass returns the size class of the smallest power of two that is at least n bytes.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClass {
+		return minBufferClass
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// acquireBuffer returns a buffer of length n from the pool of its size class. Buffers larger than the largest
+// size class are allocated on demand and never pooled.
+func acquireBuffer(n int) *byteBuffer {
+	class := bufferClass(n)
+	if class > maxBufferClass {
+		return &byteBuffer{B: make([]byte, n)}
+	}
+	v := bufferPools[class-minBufferClass].Get()
+	if v == nil {
+		v = &byteBuffer{B: make([]byte, 0, 1<<class)}
+	}
+	buf := v.(*byteBuffer)
+	buf.B = buf.B[:n]
+	return buf
+}
+
+// releaseBuffer returns buf to the pool of its size class once its last holder releases it. Buffers whose capacity
+// does not fall exactly on a size class are dropped.
+func releaseBuffer(buf *byteBuffer) {
+	if buf == nil {
+		return
+	}
+	if atomic.AddInt32(&buf.refs, -1) >= 0 {
+		return
+	}
+	buf.refs = 0
+	c := cap(buf.B)
+	class := bufferClass(c)
+	if class > maxBufferClass || 1<<class != c {
+		return
+	}
+	buf.B = buf.B[:0]
+	bufferPools[class-minBufferClass].Put(buf)
+}
+
+// growBuffer returns dst with room for at least n more bytes. Should it not have room, it is reallocated with the
+// capacity of a size class, such that it may be pooled once wrapped in a byteBuffer.
+func growBuffer(dst []byte, n int) []byte {
+	if cap(dst)-len(dst) >= n {
+		return dst
+	}
+	grown := make([]byte, len(dst), 1<<bufferClass(len(dst)+n))
+	copy(grown, dst)
+	return grown
+}
+
 type pendingRequest struct {
-	dst []byte         // dst to copy response to
-	err error          // error while waiting for response
-	wg  sync.WaitGroup // signals the caller that the response has been received
+	dst   []byte        // dst to copy response to
+	err   error         // error while waiting for response
+	done  chan struct{} // signals the caller that the response has been received
+	start time.Time     // when the request was made
 }
 
 var pendingRequestPool sync.Pool
@@ -65,10 +239,11 @@ var pendingRequestPool sync.Pool
 func acquirePendingRequest(dst []byte) *pendingRequest {
 	v := pendingRequestPool.Get()
 	if v == nil {
-		v = &pendingRequest{}
+		v = &pendingRequest{done: make(chan struct{}, 1)}
 	}
 	pr := v.(*pendingRequest)
 	pr.dst = dst
+	pr.start = time.Now()
 	return pr
 }
 
@@ -0,0 +1,84 @@
+package monte
+
+import (
+	"github.com/lithdew/bytesutil"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/bytebufferpool"
+	"testing"
+)
+
+func TestBufferClasses(t *testing.T) {
+	for _, n := range []int{0, 1, 64, 65, 1000, 1 << 16, 1<<16 + 1, 1 << maxBufferClass} {
+		buf := acquireBuffer(n)
+		require.Len(t, buf.B, n)
+		require.True(t, cap(buf.B) >= n)
+		require.True(t, cap(buf.B) < 2*n || cap(buf.B) == 1<<minBufferClass)
+		releaseBuffer(buf)
+	}
+
+	// Buffers larger than the largest size class are not pooled.
+
+	buf := acquireBuffer(1<<maxBufferClass + 1)
+	require.Len(t, buf.B, 1<<maxBufferClass+1)
+	require.Equal(t, 1<<maxBufferClass+1, cap(buf.B))
+	releaseBuffer(buf)
+
+	for i := range bufferPools {
+		pool := &bufferPools[i]
+		for v := pool.Get(); v != nil; v = pool.Get() {
+			require.True(t, cap(v.(*byteBuffer).B) <= 1<<maxBufferClass)
+		}
+	}
+
+	// Buffers whose capacity does not fall on a size class are dropped.
+
+	releaseBuffer(&byteBuffer{B: make([]byte, 100)})
+	require.Nil(t, bufferPools[bufferClass(100)-minBufferClass].Get())
+
+	// Shared buffers are only returned to their pool once every holder releases them.
+
+	shared := &byteBuffer{B: make([]byte, 128), refs: 1}
+
+	releaseBuffer(shared)
+	require.Len(t, shared.B, 128)
+
+	releaseBuffer(shared)
+	require.Len(t, shared.B, 0)
+	require.Zero(t, shared.refs)
+}
+
+var mixedSizes = []int{16, 4096, 128, 65536, 512, 32, 262144, 1024}
+
+// The mixed size benchmarks report the average capacity of the buffers handed out, which shows how much memory
+// is held on to by small messages after a large message has passed through the pool.
+
+func BenchmarkBufferPoolMixedSizes(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var capacity int
+
+	for i := 0; i < b.N; i++ {
+		buf := acquireBuffer(mixedSizes[i%len(mixedSizes)])
+		capacity += cap(buf.B)
+		releaseBuffer(buf)
+	}
+
+	b.ReportMetric(float64(capacity)/float64(b.N), "cap-B/op")
+}
+
+func BenchmarkByteBufferPoolMixedSizes(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var capacity int
+
+	for i := 0; i < b.N; i++ {
+		buf := bytebufferpool.Get()
+		buf.B = bytesutil.ExtendSlice(buf.B, mixedSizes[i%len(mixedSizes)])
+		capacity += cap(buf.B)
+		bytebufferpool.Put(buf)
+	}
+
+	b.ReportMetric(float64(capacity)/float64(b.N), "cap-B/op")
+}
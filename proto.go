@@ -0,0 +1,63 @@
+package monte
+
+import "fmt"
+
+// ProtoMessage is a protocol buffer message whose generated code marshals and unmarshals it without reflection,
+// such as those generated by gogo/protobuf with its marshaler and unmarshaler plugins.
+type ProtoMessage interface {
+	Reset()
+	Size() int
+	MarshalTo(dst []byte) (int, error)
+	Unmarshal(buf []byte) error
+}
+
+// vtProtoMessage is a protocol buffer message generated by planetscale/vtprotobuf.
+type vtProtoMessage interface {
+	Reset()
+	SizeVT() int
+	MarshalToVT(dst []byte) (int, error)
+	UnmarshalVT(buf []byte) error
+}
+
+var _ Codec = ProtoCodec{}
+
+// ProtoCodec is a Codec that encodes protocol buffer messages via the marshalling code generated for them, which
+// must either implement ProtoMessage, or be generated by vtprotobuf. Messages are marshalled straight into the
+// buffer they are appended to, which is grown at most once to fit them, such that they may be marshalled into
+// pooled buffers without allocating. As the methods of generated messages have pointer receivers, values
+// marshalled and unmarshalled must be pointers to messages. Messages are reset before being unmarshalled into.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Marshal(dst []byte, v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case ProtoMessage:
+		return appendProto(dst, m.Size(), m.MarshalTo)
+	case vtProtoMessage:
+		return appendProto(dst, m.SizeVT(), m.MarshalToVT)
+	}
+	return dst, fmt.Errorf("%T is not a protocol buffer message", v)
+}
+
+func (ProtoCodec) Unmarshal(buf []byte, v interface{}) error {
+	switch m := v.(type) {
+	case ProtoMessage:
+		m.Reset()
+		return m.Unmarshal(buf)
+	case vtProtoMessage:
+		m.Reset()
+		return m.UnmarshalVT(buf)
+	}
+	return fmt.Errorf("%T is not a protocol buffer message", v)
+}
+
+// appendProto appends a message of size bytes to dst via marshalTo, which marshals the message into the start of
+// the slice it is passed.
+func appendProto(dst []byte, size int, marshalTo func(dst []byte) (int, error)) ([]byte, error) {
+	dst = growBuffer(dst, size)
+
+	n, err := marshalTo(dst[len(dst) : len(dst)+size])
+	if err != nil {
+		return dst, err
+	}
+	return dst[:len(dst)+n], nil
+}
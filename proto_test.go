@@ -0,0 +1,102 @@
+package monte
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// echoMessage is a protocol buffer message holding a single string field numbered 1, with marshalling code
+// written the way gogo/protobuf generates it.
+type echoMessage struct {
+	Text string
+}
+
+func (m *echoMessage) Reset() { *m = echoMessage{} }
+
+func (m *echoMessage) Size() int {
+	if m.Text == "" {
+		return 0
+	}
+	return 1 + uvarintSize(uint64(len(m.Text))) + len(m.Text)
+}
+
+func (m *echoMessage) MarshalTo(dst []byte) (int, error) {
+	if m.Text == "" {
+		return 0, nil
+	}
+	n := copy(dst, []byte{0x0a})
+	n += binary.PutUvarint(dst[n:], uint64(len(m.Text)))
+	n += copy(dst[n:], m.Text)
+	return n, nil
+}
+
+func (m *echoMessage) Unmarshal(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if buf[0] != 0x0a {
+		return errors.New("unknown field")
+	}
+	size, n := binary.Uvarint(buf[1:])
+	if n <= 0 || uint64(len(buf)-1-n) != size {
+		return errors.New("malformed field")
+	}
+	m.Text = string(buf[1+n:])
+	return nil
+}
+
+// vtEchoMessage is an echoMessage with marshalling code named the way vtprotobuf generates it.
+type vtEchoMessage struct {
+	echoMessage
+}
+
+func (m *vtEchoMessage) Reset()                              { m.echoMessage.Reset() }
+func (m *vtEchoMessage) SizeVT() int                         { return m.echoMessage.Size() }
+func (m *vtEchoMessage) MarshalToVT(dst []byte) (int, error) { return m.echoMessage.MarshalTo(dst) }
+func (m *vtEchoMessage) UnmarshalVT(buf []byte) error        { return m.echoMessage.Unmarshal(buf) }
+
+func uvarintSize(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+func TestProtoCodec(t *testing.T) {
+	var codec ProtoCodec
+
+	buf, err := codec.Marshal([]byte("prefix"), &echoMessage{Text: "hello"})
+	require.NoError(t, err)
+	require.EqualValues(t, "prefix\x0a\x05hello", buf)
+
+	// Messages are reset before being unmarshalled into.
+
+	msg := &vtEchoMessage{echoMessage{Text: "stale"}}
+	require.NoError(t, codec.Unmarshal(nil, msg))
+	require.Empty(t, msg.Text)
+
+	require.NoError(t, codec.Unmarshal(buf[len("prefix"):], msg))
+	require.Equal(t, "hello", msg.Text)
+
+	vt, err := codec.Marshal(nil, msg)
+	require.NoError(t, err)
+	require.Equal(t, buf[len("prefix"):], vt)
+
+	_, err = codec.Marshal(nil, echoMessage{Text: "hello"})
+	require.Error(t, err)
+	require.Error(t, codec.Unmarshal(buf, &struct{}{}))
+
+	// Messages are marshalled in place into buffers with room for them, and otherwise into a buffer grown to the
+	// capacity of a size class, such that it may be pooled.
+
+	dst := make([]byte, 0, 64)
+
+	buf, err = codec.Marshal(dst, msg)
+	require.NoError(t, err)
+	require.Equal(t, &dst[:1][0], &buf[0])
+
+	buf, err = codec.Marshal(make([]byte, 60), msg)
+	require.NoError(t, err)
+	require.Len(t, buf, 60+len(vt))
+	require.Equal(t, 128, cap(buf))
+}
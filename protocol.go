@@ -0,0 +1,121 @@
+package monte
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxProtocolsSize is the maximum size of the list of application protocols that may be offered during a
+// protocol handshake.
+const maxProtocolsSize = 1024
+
+const (
+	protocolSelected byte = 0
+	protocolNone     byte = 1
+)
+
+// NewProtocolClientHandshaker returns a Handshaker that offers the application protocols named protocols to our
+// peer in order of preference, in the spirit of TLS ALPN, and reports whichever of them our peer picks via
+// NewProtocolServerHandshaker as our PeerInfo protocol. Should our peer support none of protocols, the handshake
+// fails with an error matching ErrNoProtocol. Protocol names must neither be empty nor contain a comma.
+func NewProtocolClientHandshaker(protocols ...string) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		if err := validateProtocols(protocols); err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		bc := AsBufferedConn(conn)
+
+		err := writeProtocolMessage(bc, []byte(strings.Join(protocols, ",")))
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		msg, err := readMessageFrom(bc, nil, maxProtocolsSize)
+		if err != nil {
+			return nil, PeerInfo{}, fmt.Errorf("failed to read picked protocol: %w", err)
+		}
+		if len(msg) == 0 {
+			return nil, PeerInfo{}, errors.New("malformed protocol handshake")
+		}
+		if msg[0] == protocolNone {
+			return nil, PeerInfo{}, fmt.Errorf("server supports none of %q: %w", protocols, ErrNoProtocol)
+		}
+
+		picked := string(msg[1:])
+		for _, protocol := range protocols {
+			if protocol == picked {
+				return bc, PeerInfo{Protocol: picked}, nil
+			}
+		}
+		return nil, PeerInfo{}, fmt.Errorf("server picked protocol %q, which was not offered", picked)
+	})
+}
+
+// NewProtocolServerHandshaker returns a Handshaker that picks the first of protocols that our peer offered via
+// NewProtocolClientHandshaker, and reports it as our PeerInfo protocol, such that the connection is handled by
+// the Server's Handler registered for it. See Server.Handlers. Should our peer have offered none of protocols,
+// our peer is notified, and the handshake fails with an error matching ErrNoProtocol.
+func NewProtocolServerHandshaker(protocols ...string) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		if err := validateProtocols(protocols); err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		bc := AsBufferedConn(conn)
+
+		offered, err := readMessageFrom(bc, nil, maxProtocolsSize)
+		if err != nil {
+			return nil, PeerInfo{}, fmt.Errorf("failed to read offered protocols: %w", err)
+		}
+
+		for _, protocol := range protocols {
+			for _, name := range bytes.Split(offered, []byte(",")) {
+				if protocol == string(name) {
+					err = writeProtocolMessage(bc, append([]byte{protocolSelected}, protocol...))
+					if err != nil {
+						return nil, PeerInfo{}, err
+					}
+					return bc, PeerInfo{Protocol: protocol}, nil
+				}
+			}
+		}
+
+		err = writeProtocolMessage(bc, []byte{protocolNone})
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+		return nil, PeerInfo{}, fmt.Errorf("client offered %q, we support %q: %w", offered, protocols, ErrNoProtocol)
+	})
+}
+
+func validateProtocols(protocols []string) error {
+	if len(protocols) == 0 {
+		return errors.New("at least one protocol must be supported")
+	}
+	for _, protocol := range protocols {
+		if protocol == "" || strings.Contains(protocol, ",") {
+			return fmt.Errorf("protocol name %q must neither be empty nor contain a comma", protocol)
+		}
+	}
+	if len(strings.Join(protocols, ",")) > maxProtocolsSize {
+		return fmt.Errorf("protocol names exceed %d bytes: %w", maxProtocolsSize, ErrMessageTooLarge)
+	}
+	return nil
+}
+
+// writeProtocolMessage writes and flushes the protocols offered or picked during a protocol handshake.
+func writeProtocolMessage(bc BufferedConn, msg []byte) error {
+	_, err := bc.Write(msg)
+	if err == nil {
+		err = bc.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write protocols: %w", err)
+	}
+	return nil
+}
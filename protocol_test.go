@@ -0,0 +1,72 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+)
+
+func TestServerHandlers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	reply := func(name string) Handler {
+		return HandlerFunc(func(ctx *Context) error { return ctx.Reply([]byte(name)) })
+	}
+
+	srv := &Server{
+		Handshaker: ChainHandshakers(DefaultServerHandshaker, NewProtocolServerHandshaker("kv/2", "kv/1", "pubsub")),
+		Handler:    reply("default"),
+		Handlers:   map[string]Handler{"kv/2": reply("kv/2"), "kv/1": reply("kv/1")},
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// Connections are handled by the Handler registered for the protocol picked by the server, or by Handler
+	// should there be none.
+
+	tests := []struct {
+		offered  []string
+		expected string
+	}{
+		{offered: []string{"kv/1", "kv/2"}, expected: "kv/2"},
+		{offered: []string{"kv/1"}, expected: "kv/1"},
+		{offered: []string{"pubsub"}, expected: "default"},
+	}
+
+	for _, test := range tests {
+		client := &Client{
+			Addr:       ln.Addr().String(),
+			Handshaker: ChainHandshakers(DefaultClientHandshaker, NewProtocolClientHandshaker(test.offered...)),
+		}
+
+		res, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, test.expected, res)
+
+		client.Shutdown()
+	}
+
+	// Clients that offer no protocol the server supports are rejected.
+
+	client := &Client{
+		Addr:            ln.Addr().String(),
+		Handshaker:      ChainHandshakers(DefaultClientHandshaker, NewProtocolClientHandshaker("kv/3")),
+		NumDialAttempts: 1,
+	}
+	defer client.Shutdown()
+
+	_, err = client.Request(nil, []byte("hello"))
+	require.True(t, errors.Is(err, ErrNoProtocol))
+}
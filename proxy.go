@@ -0,0 +1,151 @@
+package monte
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature prefixes every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1HeaderSize is the maximum size of a PROXY protocol v1 header, including its trailing CRLF.
+const maxProxyV1HeaderSize = 107
+
+// proxyConn is a net.Conn accepted from a proxy, whose remote address is that of the client the proxy accepted
+// the connection from.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr { return c.remote }
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from conn, and returns conn with its remote address
+// replaced by the source address the header carries. Headers that do not carry a source address, such as
+// those sent by a proxy to check our health, leave the remote address of conn as is. Nothing past the header
+// is read from conn.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	var buf [maxProxyV1HeaderSize]byte
+
+	_, err := io.ReadFull(conn, buf[:len(proxyV2Signature)])
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+
+	switch {
+	case bytes.Equal(buf[:len(proxyV2Signature)], proxyV2Signature):
+		remote, err = readProxyV2Header(conn)
+	case bytes.HasPrefix(buf[:len(proxyV2Signature)], []byte("PROXY ")):
+		remote, err = readProxyV1Header(conn, buf[:], len(proxyV2Signature))
+	default:
+		err = fmt.Errorf("%w: missing header", ErrProxyHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: remote}, nil
+}
+
+// readProxyV1Header reads the remainder of the human-readable PROXY protocol v1 header whose first n bytes were
+// read into buf, such as "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n". It is read a byte at a time, such that
+// nothing past its trailing CRLF is read from conn.
+func readProxyV1Header(conn net.Conn, buf []byte, n int) (net.Addr, error) {
+	for buf[n-1] != '\n' {
+		if n == len(buf) {
+			return nil, fmt.Errorf("%w: v1 header exceeds %d bytes", ErrProxyHeader, len(buf))
+		}
+		_, err := io.ReadFull(conn, buf[n:n+1])
+		if err != nil {
+			return nil, err
+		}
+		n++
+	}
+
+	line := string(buf[:n])
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("%w: v1 header not terminated by crlf", ErrProxyHeader)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrProxyHeader, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: malformed v1 source address %q", ErrProxyHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed v1 source port %q", ErrProxyHeader, fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads the remainder of the binary PROXY protocol v2 header that follows its signature.
+func readProxyV2Header(conn net.Conn) (net.Addr, error) {
+	var hdr [4]byte
+
+	_, err := io.ReadFull(conn, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr[0]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrProxyHeader, hdr[0]>>4)
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	switch hdr[0] & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks sent by the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrProxyHeader, hdr[0]&0x0f)
+	}
+
+	var size int
+
+	switch hdr[1] >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX, or unknown families carry no address we may take on
+		return nil, nil
+	}
+
+	if len(buf) < 2*size+4 {
+		return nil, fmt.Errorf("%w: v2 addresses truncated", ErrProxyHeader)
+	}
+
+	ip := make(net.IP, size)
+	copy(ip, buf[:size])
+	port := binary.BigEndian.Uint16(buf[2*size:])
+
+	if hdr[1]&0x0f == 0x2 { // DGRAM
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,116 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	v2 := func(cmd, fam byte, addrs ...byte) string {
+		return string(proxyV2Signature) + string([]byte{0x20 | cmd, fam, 0, byte(len(addrs))}) + string(addrs)
+	}
+
+	local := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+		err      bool
+	}{
+		{name: "v1 tcp4", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", expected: "192.0.2.1:56324"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", expected: "[2001:db8::1]:56324"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n", expected: local.String()},
+		{name: "v1 mismatched family", header: "PROXY TCP6 192.0.2.1 192.0.2.2 56324 443\r\n", err: true},
+		{name: "v1 bad port", header: "PROXY TCP4 192.0.2.1 192.0.2.2 99999 443\r\n", err: true},
+		{name: "v1 missing crlf", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", err: true},
+		{
+			name:     "v2 tcp4",
+			header:   v2(0x1, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb),
+			expected: "192.0.2.1:56324",
+		},
+		{name: "v2 local", header: v2(0x0, 0x00), expected: local.String()},
+		{name: "v2 truncated", header: v2(0x1, 0x11, 192, 0, 2, 1), err: true},
+		{name: "missing", header: "hello world!", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			// Bytes written past the header are left to be read from the returned conn.
+
+			go func() {
+				_, _ = b.Write([]byte(test.header + "data"))
+			}()
+
+			conn, err := readProxyHeader(&proxyConn{Conn: a, remote: local})
+			if test.err {
+				require.True(t, errors.Is(err, ErrProxyHeader))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, conn.RemoteAddr().String())
+
+			buf := make([]byte, 4)
+			_, err = conn.Read(buf)
+			require.NoError(t, err)
+			require.EqualValues(t, "data", buf)
+		})
+	}
+}
+
+func TestServerTrustedProxies(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	trusted, err := AllowCIDRs([]string{"127.0.0.0/8"}, nil)
+	require.NoError(t, err)
+
+	srv := &Server{
+		TrustedProxies: trusted,
+		Handler: HandlerFunc(func(ctx *Context) error {
+			return ctx.Reply([]byte(ctx.Conn().RemoteAddr().String()))
+		}),
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// Handlers see the address of the client the proxy accepted the connection from.
+
+	client := &Client{
+		Addr: ln.Addr().String(),
+		Handshaker: HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+			_, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"))
+			if err != nil {
+				return nil, err
+			}
+			return DefaultClientHandshaker(conn)
+		}),
+	}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("addr"))
+	require.NoError(t, err)
+	require.EqualValues(t, "192.0.2.1:56324", res)
+
+	infos := srv.Conns()
+	require.Len(t, infos, 1)
+	require.Equal(t, "192.0.2.1:56324", infos[0].RemoteAddr.String())
+}
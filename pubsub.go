@@ -0,0 +1,250 @@
+package monte
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// pubsubSubscribe, pubsubUnsubscribe, and pubsubPublish prefix the messages exchanged with a PubSub, which are
+// followed by the topic they concern prefixed with its 16-bit unsigned big-endian length, and, for publications,
+// by the payload published.
+const (
+	pubsubSubscribe byte = 1 + iota
+	pubsubUnsubscribe
+	pubsubPublish
+)
+
+// maxTopicSize is the maximum size of a topic.
+const maxTopicSize = 1<<16 - 1
+
+var _ Handler = (*PubSub)(nil)
+
+// PubSub is a Handler that maintains which topics the peers of the connections it handles are subscribed to, and
+// publishes payloads to the subscribers of a topic via Publish. Peers subscribe and unsubscribe via Subscribe and
+// Unsubscribe, and receive publications via HandlePublications. Subscriptions are dropped once the connection
+// they were made over is closed.
+//
+// A PubSub may be served as a Server's Handler, or be registered with a Mux alongside other handlers, in which
+// case peers must prefix their subscriptions with its opcode via AppendSubscribe and AppendUnsubscribe. The zero
+// value of a PubSub is ready for use.
+type PubSub struct {
+	// MaxPendingWrites, if positive, is the number of frames that may be queued to a subscriber before
+	// publications to it are dropped rather than queued, such that slow subscribers neither hold back
+	// publishers nor have publications buffered for them without bound.
+	MaxPendingWrites int
+
+	// OnDrop, if set, is called with the subscriber and topic of every publication dropped because its
+	// subscriber fell behind, such as to disconnect subscribers that are unable to keep up.
+	OnDrop func(conn *Conn, topic string)
+
+	mu     sync.RWMutex
+	topics map[string]map[*Conn]struct{}
+	subs   map[*Conn]map[string]struct{}
+}
+
+// HandleMessage handles subscriptions and unsubscriptions, which are acknowledged once they take effect should
+// they be requests. Malformed messages are rejected should they be requests, and dropped otherwise.
+func (p *PubSub) HandleMessage(ctx *Context) error {
+	kind, topic, _, err := decodePubSub(ctx.Body())
+	if err != nil {
+		return ignoreStale(ctx.Reject(err))
+	}
+
+	switch kind {
+	case pubsubSubscribe:
+		p.subscribe(ctx.Conn(), topic)
+	case pubsubUnsubscribe:
+		p.unsubscribe(ctx.Conn(), topic)
+	default:
+		return ignoreStale(ctx.Reject(fmt.Errorf("unexpected pubsub message kind %d", kind)))
+	}
+
+	if ctx.Seq() == 0 {
+		return nil
+	}
+	return ignoreStale(ctx.Reply(nil))
+}
+
+func (p *PubSub) subscribe(conn *Conn, topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.topics == nil {
+		p.topics = make(map[string]map[*Conn]struct{})
+		p.subs = make(map[*Conn]map[string]struct{})
+	}
+
+	topics, exists := p.subs[conn]
+	if !exists {
+		topics = make(map[string]struct{})
+		p.subs[conn] = topics
+
+		// Subscriptions are dropped once the connection is closed, which cancels its context.
+
+		conn.once.Do(conn.init)
+		go func() {
+			<-conn.ctx.Done()
+			p.drop(conn)
+		}()
+	}
+	topics[topic] = struct{}{}
+
+	if p.topics[topic] == nil {
+		p.topics[topic] = make(map[*Conn]struct{})
+	}
+	p.topics[topic][conn] = struct{}{}
+}
+
+func (p *PubSub) unsubscribe(conn *Conn, topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.subs[conn], topic)
+	delete(p.topics[topic], conn)
+	if len(p.topics[topic]) == 0 {
+		delete(p.topics, topic)
+	}
+}
+
+// drop unsubscribes conn from every topic it is subscribed to.
+func (p *PubSub) drop(conn *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for topic := range p.subs[conn] {
+		delete(p.topics[topic], conn)
+		if len(p.topics[topic]) == 0 {
+			delete(p.topics, topic)
+		}
+	}
+	delete(p.subs, conn)
+}
+
+// NumSubscribers returns the number of subscribers to topic.
+func (p *PubSub) NumSubscribers(topic string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.topics[topic])
+}
+
+// Publish queues payload to be sent to every subscriber of topic without waiting for it to be written, and
+// returns the number of subscribers it was queued to. The frame carrying payload is encoded once and shared
+// across every subscriber. Subscribers that have fallen behind by MaxPendingWrites have the publication dropped.
+func (p *PubSub) Publish(topic string, payload []byte) (int, error) {
+	if len(topic) > maxTopicSize {
+		return 0, fmt.Errorf("max topic size is %d bytes, got %d bytes", maxTopicSize, len(topic))
+	}
+
+	p.mu.RLock()
+	conns := make([]*Conn, 0, len(p.topics[topic]))
+	for conn := range p.topics[topic] {
+		conns = append(conns, conn)
+	}
+	p.mu.RUnlock()
+
+	if len(conns) == 0 {
+		return 0, nil
+	}
+
+	msg := appendPubSub(make([]byte, 0, 3+len(topic)+len(payload)), pubsubPublish, topic)
+	msg = append(msg, payload...)
+
+	h := frameHeader{}
+
+	shared := acquireBuffer(h.size() + len(msg))
+	defer releaseBuffer(shared)
+
+	copy(h.encode(shared.B), msg)
+
+	n := 0
+	for _, conn := range conns {
+		if p.MaxPendingWrites > 0 && conn.NumPendingWrites() >= p.MaxPendingWrites {
+			if p.OnDrop != nil {
+				p.OnDrop(conn, topic)
+			}
+			continue
+		}
+		if conn.sendSharedNoWait(shared, msg) == nil {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// AppendSubscribe appends a subscription to topic to dst, for it to be sent to our peer's PubSub.
+func AppendSubscribe(dst []byte, topic string) []byte {
+	return appendPubSub(dst, pubsubSubscribe, topic)
+}
+
+// AppendUnsubscribe appends an unsubscription from topic to dst, for it to be sent to our peer's PubSub.
+func AppendUnsubscribe(dst []byte, topic string) []byte {
+	return appendPubSub(dst, pubsubUnsubscribe, topic)
+}
+
+// Requester sends requests and waits for their responses. It is implemented by both Conn and Client.
+type Requester interface {
+	RequestContext(ctx context.Context, dst []byte, payload []byte) ([]byte, error)
+}
+
+var (
+	_ Requester = (*Conn)(nil)
+	_ Requester = (*Client)(nil)
+)
+
+// Subscribe subscribes to topic with our peer's PubSub, and waits for the subscription to take effect.
+func Subscribe(ctx context.Context, r Requester, topic string) error {
+	if len(topic) > maxTopicSize {
+		return fmt.Errorf("max topic size is %d bytes, got %d bytes", maxTopicSize, len(topic))
+	}
+	_, err := r.RequestContext(ctx, nil, AppendSubscribe(nil, topic))
+	return err
+}
+
+// Unsubscribe unsubscribes from topic with our peer's PubSub, and waits for the unsubscription to take effect.
+func Unsubscribe(ctx context.Context, r Requester, topic string) error {
+	if len(topic) > maxTopicSize {
+		return fmt.Errorf("max topic size is %d bytes, got %d bytes", maxTopicSize, len(topic))
+	}
+	_, err := r.RequestContext(ctx, nil, AppendUnsubscribe(nil, topic))
+	return err
+}
+
+// HandlePublications returns a Handler that calls fn with the topic and payload of every publication our peer's
+// PubSub sends us, and passes every other message to next, should it not be nil. As publications are recognized
+// by their prefix, other messages our peer sends us must not be mistakable for them, such as by being prefixed
+// with an opcode. The payload is only valid until fn returns.
+func HandlePublications(fn func(topic string, payload []byte), next Handler) Handler {
+	return HandlerFunc(func(ctx *Context) error {
+		if ctx.Seq() == 0 {
+			kind, topic, payload, err := decodePubSub(ctx.Body())
+			if err == nil && kind == pubsubPublish {
+				fn(topic, payload)
+				return nil
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		return next.HandleMessage(ctx)
+	})
+}
+
+func appendPubSub(dst []byte, kind byte, topic string) []byte {
+	dst = append(dst, kind, byte(len(topic)>>8), byte(len(topic)))
+	return append(dst, topic...)
+}
+
+func decodePubSub(buf []byte) (byte, string, []byte, error) {
+	if len(buf) < 3 {
+		return 0, "", nil, fmt.Errorf("no pubsub message to decode from %d byte(s)", len(buf))
+	}
+	n := int(binary.BigEndian.Uint16(buf[1:3]))
+	if len(buf) < 3+n {
+		return 0, "", nil, fmt.Errorf("no topic to decode: expected %d byte(s), got %d byte(s)", n, len(buf)-3)
+	}
+	return buf[0], string(buf[3 : 3+n]), buf[3+n:], nil
+}
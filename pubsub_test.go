@@ -0,0 +1,168 @@
+package monte
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var ps PubSub
+
+	srv := &Server{Handler: &ps}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	subscriber := func() (*Client, chan string) {
+		received := make(chan string, 8)
+		client := &Client{
+			Addr: ln.Addr().String(),
+			Handler: HandlePublications(func(topic string, payload []byte) {
+				received <- topic + ":" + string(payload)
+			}, nil),
+		}
+		return client, received
+	}
+
+	alice, aliceReceived := subscriber()
+	defer alice.Shutdown()
+
+	bob, bobReceived := subscriber()
+	defer bob.Shutdown()
+
+	ctx := context.Background()
+
+	require.NoError(t, Subscribe(ctx, alice, "a"))
+	require.NoError(t, Subscribe(ctx, bob, "a"))
+	require.NoError(t, Subscribe(ctx, bob, "b"))
+
+	// Publications are only sent to the subscribers of their topic.
+
+	n, err := ps.Publish("a", []byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = ps.Publish("b", []byte("world"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = ps.Publish("c", []byte("nobody"))
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.Equal(t, "a:hello", <-aliceReceived)
+	require.Equal(t, "a:hello", <-bobReceived)
+	require.Equal(t, "b:world", <-bobReceived)
+
+	// Unsubscribed peers no longer receive publications.
+
+	require.NoError(t, Unsubscribe(ctx, bob, "a"))
+
+	n, err = ps.Publish("a", []byte("again"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, "a:again", <-aliceReceived)
+
+	// Subscriptions are dropped once their connection is closed.
+
+	bob.Shutdown()
+	require.Eventually(t, func() bool { return ps.NumSubscribers("b") == 0 }, time.Second, time.Millisecond)
+	require.Equal(t, 1, ps.NumSubscribers("a"))
+
+	// Malformed subscriptions are rejected.
+
+	_, err = alice.Request(nil, []byte{pubsubSubscribe, 0, 5, 'a'})
+	require.True(t, errors.Is(err, ErrRequestRejected))
+}
+
+func TestPubSubMaxPendingWrites(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var dropped []string
+
+	ps := PubSub{
+		MaxPendingWrites: 1,
+		OnDrop:           func(conn *Conn, topic string) { dropped = append(dropped, topic) },
+	}
+
+	// The connection is never handled, such that nothing queued to it is ever written.
+
+	var c Conn
+	ps.subscribe(&c, "a")
+
+	n, err := ps.Publish("a", []byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = ps.Publish("a", []byte("hello"))
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Equal(t, []string{"a"}, dropped)
+
+	c.cancel()
+	require.Eventually(t, func() bool { return ps.NumSubscribers("a") == 0 }, time.Second, time.Millisecond)
+}
+
+func TestPubSubLargePublication(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var ps PubSub
+
+	srv := &Server{Handler: &ps, MaxFrameSize: 1024}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	received := make(chan string, 1)
+
+	client := &Client{
+		Addr:         ln.Addr().String(),
+		MaxFrameSize: 1024,
+		Handler: HandlePublications(func(topic string, payload []byte) {
+			received <- topic + ":" + string(payload)
+		}, nil),
+	}
+	defer client.Shutdown()
+
+	ctx := context.Background()
+
+	require.NoError(t, Subscribe(ctx, client, "a"))
+
+	// Publications that do not fit within MaxFrameSize are fragmented rather than sent in a frame our peer may
+	// not read.
+
+	payload := strings.Repeat("monte", 1024)
+
+	n, err := ps.Publish("a", []byte(payload))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, "a:"+payload, <-received)
+
+	require.NoError(t, Unsubscribe(ctx, client, "a"))
+}
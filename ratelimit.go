@@ -0,0 +1,182 @@
+package monte
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter bounds the rate at which frames are read from a connection. Reserve is called from the read loop
+// with the size of every frame read, and returns how long to wait before the next frame may be read, such that
+// peers that exceed their budget are throttled, or, should CloseOnRateLimit be set, disconnected. A RateLimiter
+// may be shared across connections, such as to bound the rate of all connections from a single IP address.
+type RateLimiter interface {
+	Reserve(n int) time.Duration
+}
+
+type RateLimiterFunc func(n int) time.Duration
+
+func (fn RateLimiterFunc) Reserve(n int) time.Duration { return fn(n) }
+
+// NewRateLimiter returns a RateLimiter that allows for up to framesPerSecond frames and bytesPerSecond bytes to be
+// read per second via token buckets, each of which may burst up to a second's worth of budget. Should either
+// rate not be positive, the corresponding budget is unlimited.
+func NewRateLimiter(framesPerSecond, bytesPerSecond int) RateLimiter {
+	var l rateLimiter
+	if framesPerSecond > 0 {
+		l.frames = newTokenBucket(float64(framesPerSecond), float64(framesPerSecond))
+	}
+	if bytesPerSecond > 0 {
+		l.bytes = newTokenBucket(float64(bytesPerSecond), float64(bytesPerSecond))
+	}
+	return &l
+}
+
+// rateLimiter bounds the rate of frames and bytes read, should either of its buckets be set.
+type rateLimiter struct {
+	frames *tokenBucket
+	bytes  *tokenBucket
+}
+
+func (l *rateLimiter) Reserve(n int) time.Duration {
+	now := time.Now()
+
+	var d time.Duration
+	if l.frames != nil {
+		d = l.frames.reserve(now, 1)
+	}
+	if l.bytes != nil {
+		if bd := l.bytes.reserve(now, float64(n)); bd > d {
+			d = bd
+		}
+	}
+	return d
+}
+
+// tokenBucket is a token bucket that refills at rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64 // may be negative should more tokens be reserved than were available
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// reserve takes n tokens from the bucket, and returns how long to wait until the bucket is no longer in debt.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= n
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes a token from the bucket should one be available, and reports whether it did.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket is full, such that it may be discarded without affecting the rate it bounds.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// getRateLimiter returns the RateLimiter that bounds the rate at which frames are read from the connection, or nil
+// should there be none.
+func (c *Conn) getRateLimiter() RateLimiter {
+	if c.RateLimiter != nil {
+		return c.RateLimiter
+	}
+	if c.MaxFramesPerSecond > 0 || c.MaxBytesPerSecond > 0 {
+		return NewRateLimiter(c.MaxFramesPerSecond, c.MaxBytesPerSecond)
+	}
+	return nil
+}
+
+// throttle waits for d to elapse or for the connection to be closed.
+func (c *Conn) throttle(d time.Duration) {
+	timer := AcquireTimer(d)
+	defer ReleaseTimer(timer)
+
+	select {
+	case <-timer.C:
+	case <-c.ctx.Done():
+	}
+}
+
+// connRates tracks the rate at which connections are accepted from each IP address.
+type connRates struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time // when buckets that are full were last discarded
+}
+
+// allow reports whether a connection from addr may be accepted without exceeding perSecond connections accepted
+// from its IP address per second.
+func (r *connRates) allow(addr net.Addr, perSecond int) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.buckets == nil {
+		r.buckets = make(map[string]*tokenBucket)
+	}
+
+	// Buckets that have refilled are discarded at most once per second, such that addresses that stopped
+	// connecting are not tracked forever.
+
+	if now.Sub(r.pruned) >= time.Second {
+		for key, b := range r.buckets {
+			if b.full(now) {
+				delete(r.buckets, key)
+			}
+		}
+		r.pruned = now
+	}
+
+	key := string(ip.To16())
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = newTokenBucket(float64(perSecond), float64(perSecond))
+		r.buckets[key] = b
+	}
+	return b.allow(now)
+}
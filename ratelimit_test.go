@@ -0,0 +1,114 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+
+	b := newTokenBucket(10, 2)
+
+	// Reservations that exceed the burst put the bucket into debt, which is paid off at its rate.
+
+	require.Zero(t, b.reserve(now, 1))
+	require.Zero(t, b.reserve(now, 1))
+	require.Equal(t, 100*time.Millisecond, b.reserve(now, 1))
+	require.Equal(t, 50*time.Millisecond, b.reserve(now.Add(150*time.Millisecond), 1))
+
+	// Tokens are only taken by allow should one be available.
+
+	require.False(t, b.allow(now.Add(200*time.Millisecond)))
+	require.True(t, b.allow(now.Add(300*time.Millisecond)))
+	require.False(t, b.full(now.Add(300*time.Millisecond)))
+	require.True(t, b.full(now.Add(time.Second)))
+}
+
+func TestConnRateLimiter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var reserved uint32
+
+	a := &Conn{}
+	b := &Conn{
+		Handler: EchoHandler{},
+		RateLimiter: RateLimiterFunc(func(n int) time.Duration {
+			atomic.AddUint32(&reserved, 1)
+			return 10 * time.Millisecond
+		}),
+	}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	// Every frame read waits for the duration returned by the rate limiter before the next is read.
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		res, err := a.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+	require.EqualValues(t, 5, atomic.LoadUint32(&reserved))
+}
+
+func TestConnCloseOnRateLimit(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	disconnected := make(chan error, 1)
+
+	a := &Conn{}
+	b := &Conn{
+		MaxFramesPerSecond: 1,
+		CloseOnRateLimit:   true,
+		OnDisconnect:       func(conn *Conn, err error) { disconnected <- err },
+	}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	require.NoError(t, a.Send([]byte("hello")))
+	require.NoError(t, a.Send([]byte("hello")))
+
+	require.True(t, errors.Is(<-disconnected, ErrRateLimited))
+}
+
+func TestServerMaxConnsPerSecondPerIP(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{Handler: EchoHandler{}, MaxConnsPerSecondPerIP: 1}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	first := &Client{Addr: ln.Addr().String()}
+	defer first.Shutdown()
+
+	_, err = first.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+
+	// A second connection from the same IP address within the same second is rejected.
+
+	second := &Client{Addr: ln.Addr().String()}
+	defer second.Shutdown()
+
+	_, err = second.Request(nil, []byte("hello"))
+	require.Error(t, err)
+	require.EqualValues(t, 1, srv.NumRejectedConns())
+}
@@ -0,0 +1,217 @@
+package monte
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var DefaultResolveInterval = 30 * time.Second
+
+// Resolver resolves the address of the server a Client connects to into the addresses of every endpoint serving
+// it, such as every pod backing a Kubernetes headless service or every instance of a Consul service.
+type Resolver interface {
+	Resolve(ctx context.Context, addr string) ([]string, error)
+}
+
+type ResolverFunc func(ctx context.Context, addr string) ([]string, error)
+
+func (fn ResolverFunc) Resolve(ctx context.Context, addr string) ([]string, error) {
+	return fn(ctx, addr)
+}
+
+// DefaultResolver resolves addresses prefixed with srv://, such as srv://_monte._tcp.example.com, via a DNS SRV
+// lookup of the name that follows into the targets of the records with the highest priority. The host of all
+// other TCP addresses is resolved via a DNS A and AAAA lookup into one endpoint per IP address. Addresses of Unix
+// domain sockets resolve to themselves.
+var DefaultResolver ResolverFunc = func(ctx context.Context, addr string) ([]string, error) {
+	if strings.HasPrefix(addr, "unix://") {
+		return []string{addr}, nil
+	}
+
+	if strings.HasPrefix(addr, "srv://") {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", strings.TrimPrefix(addr, "srv://"))
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints := make([]string, 0, len(records))
+		for _, record := range records {
+			if record.Priority != records[0].Priority {
+				break
+			}
+			host := strings.TrimSuffix(record.Target, ".")
+			endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		return endpoints, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		endpoints = append(endpoints, net.JoinHostPort(ip, port))
+	}
+	return endpoints, nil
+}
+
+// errNoEndpoints is returned when dialing a Client whose address has yet to be resolved into any endpoints.
+var errNoEndpoints = errors.New("no endpoints resolved")
+
+// discovers reports whether the client resolves Addr into the endpoints serving it.
+func (c *Client) discovers() bool {
+	return c.ResolveInterval > 0 || strings.HasPrefix(c.Addr, "srv://")
+}
+
+// resolveLoop resolves Addr every ResolveInterval until the client is shut down.
+func (c *Client) resolveLoop() {
+	for {
+		c.resolve()
+
+		timer := AcquireTimer(c.getResolveInterval())
+
+		select {
+		case <-timer.C:
+			ReleaseTimer(timer)
+		case <-c.done:
+			ReleaseTimer(timer)
+			return
+		}
+	}
+}
+
+// resolve resolves Addr into the endpoints serving it. Should the client have established any connections, a
+// connection is dialed to every endpoint that was not resolved before, bounded by MaxConns. Connections to
+// endpoints that are no longer resolved are gracefully closed. Should Addr fail to resolve, or resolve into no
+// endpoints, the endpoints resolved before are kept.
+func (c *Client) resolve() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.getDialTimeout())
+	endpoints, err := c.getResolver().Resolve(ctx, c.Addr)
+	cancel()
+
+	if err == nil && len(endpoints) == 0 {
+		err = errNoEndpoints
+	}
+
+	c.mu.Lock()
+
+	select {
+	case <-c.resolved:
+	default:
+		defer close(c.resolved)
+	}
+
+	if err != nil {
+		c.resolveErr = err
+		c.mu.Unlock()
+
+		c.getLogger().Warn("failed to resolve endpoints", "addr", c.Addr, "err", err)
+		return
+	}
+
+	resolved := make(map[string]struct{}, len(endpoints))
+	for _, endpoint := range endpoints {
+		resolved[endpoint] = struct{}{}
+	}
+
+	var removed []*clientConn
+
+	conns := c.conns[:0]
+	for _, cc := range c.conns {
+		if _, ok := resolved[cc.addr]; !ok && cc.addr != "" && !cc.backup {
+			removed = append(removed, cc)
+			continue
+		}
+		conns = append(conns, cc)
+	}
+	c.conns = conns
+
+	previous := make(map[string]struct{}, len(c.endpoints))
+	for _, endpoint := range c.endpoints {
+		previous[endpoint] = struct{}{}
+	}
+
+	c.endpoints, c.resolveErr = endpoints, nil
+
+	if len(c.conns) > 0 {
+		for _, endpoint := range endpoints {
+			if _, ok := previous[endpoint]; !ok && len(c.conns) < c.getMaxConns() {
+				c.newClientConn()
+			}
+		}
+	}
+
+	c.mu.Unlock()
+
+	for _, cc := range removed {
+		c.getLogger().Info("draining connection to endpoint that is no longer resolved", "addr", cc.addr)
+		go cc.conn.CloseGracefully(context.Background())
+	}
+}
+
+// primaryAddr returns the address to dial as the primary address of the client. Should the client resolve Addr
+// into the endpoints serving it, the endpoint with the fewest connections is returned, and, should cc not be nil,
+// cc is counted as a connection to it.
+func (c *Client) primaryAddr(cc *clientConn) (string, error) {
+	if !c.discovers() {
+		return c.Addr, nil
+	}
+
+	select {
+	case <-c.resolved:
+	case <-c.done:
+		return "", ErrConnClosed
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.endpoints) == 0 {
+		return "", c.resolveErr
+	}
+
+	counts := make(map[string]int, len(c.endpoints))
+	for _, cc := range c.conns {
+		if !cc.backup {
+			counts[cc.addr]++
+		}
+	}
+
+	best := c.endpoints[0]
+	for _, endpoint := range c.endpoints[1:] {
+		if counts[endpoint] < counts[best] {
+			best = endpoint
+		}
+	}
+
+	if cc != nil {
+		cc.addr = best
+	}
+
+	return best, nil
+}
+
+func (c *Client) getResolver() Resolver {
+	if c.Resolver == nil {
+		return DefaultResolver
+	}
+	return c.Resolver
+}
+
+func (c *Client) getResolveInterval() time.Duration {
+	if c.ResolveInterval <= 0 {
+		return DefaultResolveInterval
+	}
+	return c.ResolveInterval
+}
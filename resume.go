@@ -0,0 +1,420 @@
+package monte
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/oasislabs/ed25519/extra/x25519"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var DefaultSessionTicketLifetime = 24 * time.Hour
+
+// maxSessionTicketSize is the maximum size of a session ticket, which bounds the size of session metadata.
+const maxSessionTicketSize = 4096
+
+// resumeNonceSize is the size of the nonces exchanged by a resumed handshake.
+const resumeNonceSize = 32
+
+// sessionTicketOverhead is the size of a session ticket sans metadata: its nonce, the time its session was
+// established, its resumption secret, and its authentication tag.
+const sessionTicketOverhead = chacha20poly1305.NonceSize + 8 + 32 + 16
+
+const (
+	handshakeFull    byte = 0
+	handshakeResumed byte = 1
+)
+
+// SessionTicketConfig configures a server handshaker returned by NewResumableServerHandshaker.
+type SessionTicketConfig struct {
+	// Key seals the session tickets issued to clients, such that only servers configured with the same Key may
+	// resume the sessions they describe. Changing Key invalidates all tickets sealed with it.
+	Key [32]byte
+
+	// Lifetime bounds how long after a session was established via key agreement it may be resumed, regardless
+	// of how many times it was resumed since. It defaults to DefaultSessionTicketLifetime.
+	Lifetime time.Duration
+
+	// Metadata, if set, is called once a session is established via key agreement, and returns metadata to seal
+	// into the session's tickets, such as the identity of the client. The metadata of a resumed session is
+	// restored from its ticket rather than by calling Metadata. It must be at most 4028 bytes.
+	Metadata func(conn net.Conn) []byte
+}
+
+func (c SessionTicketConfig) getLifetime() time.Duration {
+	if c.Lifetime <= 0 {
+		return DefaultSessionTicketLifetime
+	}
+	return c.Lifetime
+}
+
+// SessionState describes the session that a connection established by a resumable handshaker belongs to. See
+// Conn.Session.
+type SessionState struct {
+	// Resumed reports whether the session was resumed via a session ticket rather than established via key
+	// agreement.
+	Resumed bool
+
+	// EstablishedAt is when the session was established via key agreement.
+	EstablishedAt time.Time
+
+	// Metadata is the metadata sealed into the session's tickets. See SessionTicketConfig.Metadata.
+	Metadata []byte
+}
+
+// SessionCache caches the session tickets issued to a client handshaker returned by
+// NewResumableClientHandshaker, keyed by the address of the server that issued them. Tickets are only ever
+// presented once, such that connections resumed from the same session may not be linked by an observer. The
+// zero value is ready to use, and a SessionCache may be shared across clients.
+type SessionCache struct {
+	mu       sync.Mutex
+	sessions map[string]cachedSession
+}
+
+// cachedSession is a session ticket along with the secret it was issued for.
+type cachedSession struct {
+	ticket []byte
+	secret []byte
+	state  SessionState
+}
+
+func (c *SessionCache) take(addr string) (cachedSession, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, ok := c.sessions[addr]
+	if ok {
+		delete(c.sessions, addr)
+	}
+	return session, ok
+}
+
+func (c *SessionCache) put(addr string, session cachedSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sessions == nil {
+		c.sessions = make(map[string]cachedSession)
+	}
+	c.sessions[addr] = session
+}
+
+// NewResumableClientHandshaker returns a Handshaker that establishes an encrypted session with a server
+// handshaker returned by NewResumableServerHandshaker. Should cache hold a session ticket issued by the server,
+// the ticket is presented such that the server may resume its session, which skips key agreement. Otherwise,
+// or should the server not accept the ticket, a new session is established via X25519 key agreement. Either way,
+// the server issues a new ticket, which is stored in cache for the next connection to the server to present.
+//
+// Messages are then framed over conn and encrypted via an AEADConn with AES-256 GCM, keyed separately for each
+// direction with keys derived from the session's secret and, should the session have been resumed, random
+// nonces exchanged by both ends, such that no two connections are keyed the same. The metadata of the session is
+// reported as its PeerInfo metadata.
+func NewResumableClientHandshaker(cache *SessionCache) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		bc, err := handshakeResumableClient(conn, cache)
+		if err != nil {
+			return nil, PeerInfo{}, fmt.Errorf("resumable handshake failed: %w", err)
+		}
+		return bc, PeerInfo{Metadata: bc.state.Metadata}, nil
+	})
+}
+
+// NewResumableServerHandshaker returns a Handshaker that establishes or resumes an encrypted session with a
+// client handshaker returned by NewResumableClientHandshaker, and issues the client a session ticket sealed with
+// config.Key with which it may resume the session on reconnect. Tickets that fail to open, or that describe a
+// session established more than config.Lifetime ago, are ignored, and a new session is established instead.
+// The metadata of the session is reported as its PeerInfo metadata.
+func NewResumableServerHandshaker(config SessionTicketConfig) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		bc, err := handshakeResumableServer(conn, config)
+		if err != nil {
+			return nil, PeerInfo{}, fmt.Errorf("resumable handshake failed: %w", err)
+		}
+		return bc, PeerInfo{Metadata: bc.state.Metadata}, nil
+	})
+}
+
+// handshakeResumableClient sends our ephemeral public key, a random nonce, and a session ticket should cache
+// hold one for the address of our peer. Our peer responds with whether it resumed the session, followed by
+// either its ephemeral public key or a random nonce of its own.
+func handshakeResumableClient(conn net.Conn, cache *SessionCache) (*resumableConn, error) {
+	addr := conn.RemoteAddr().String()
+	cached, ok := cache.take(addr)
+
+	var session Session
+
+	ourPub, ourPriv, err := session.GenerateEphemeralKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	ourNonce := make([]byte, resumeNonceSize)
+
+	_, err = rand.Read(ourNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := make([]byte, 0, x25519.PointSize+resumeNonceSize+len(cached.ticket))
+	hello = append(hello, ourPub...)
+	hello = append(hello, ourNonce...)
+	hello = append(hello, cached.ticket...)
+
+	err = WriteSized(conn, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := ReadSized(nil, conn, 1+x25519.PointSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 1+x25519.PointSize {
+		return nil, fmt.Errorf("malformed server hello of %d bytes", len(reply))
+	}
+
+	var secret []byte
+
+	switch reply[0] {
+	case handshakeFull:
+		session.theirPub = reply[1:]
+		err = session.Establish(ourPriv)
+		if err != nil {
+			return nil, err
+		}
+		secret = session.SharedKey()
+	case handshakeResumed:
+		if !ok {
+			return nil, errors.New("server resumed a session that was never presented")
+		}
+		secret = resumedSecret(cached.secret, ourNonce, reply[1:])
+	default:
+		return nil, fmt.Errorf("unknown server hello mode %d", reply[0])
+	}
+
+	decorator, err := AEADDecorator(secret, true)
+	if err != nil {
+		return nil, err
+	}
+	bc := decorator.Decorate(NewFramedConn(conn))
+
+	msg := make([]byte, 8+2+2*maxSessionTicketSize)
+
+	n, err := bc.Read(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session ticket: %w", err)
+	}
+	msg = msg[:n]
+
+	if len(msg) < 10 || len(msg) < 10+int(binary.BigEndian.Uint16(msg[8:10])) {
+		return nil, errors.New("malformed session ticket")
+	}
+
+	ticketLen := int(binary.BigEndian.Uint16(msg[8:10]))
+
+	state := SessionState{
+		Resumed:       reply[0] == handshakeResumed,
+		EstablishedAt: time.Unix(0, int64(binary.BigEndian.Uint64(msg[:8]))),
+		Metadata:      msg[10+ticketLen:],
+	}
+
+	cache.put(addr, cachedSession{
+		ticket: msg[10 : 10+ticketLen],
+		secret: resumptionSecret(secret),
+		state:  state,
+	})
+
+	return &resumableConn{BufferedConn: bc, state: state}, nil
+}
+
+// handshakeResumableServer reads our peer's hello, resumes the session described by the ticket it presented
+// should the ticket be valid, and otherwise establishes a new session via key agreement. A new ticket for the
+// session is then sent over the encrypted connection.
+func handshakeResumableServer(conn net.Conn, config SessionTicketConfig) (*resumableConn, error) {
+	hello, err := ReadSized(nil, conn, x25519.PointSize+resumeNonceSize+maxSessionTicketSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(hello) < x25519.PointSize+resumeNonceSize {
+		return nil, fmt.Errorf("malformed client hello of %d bytes", len(hello))
+	}
+
+	theirPub := hello[:x25519.PointSize]
+	theirNonce := hello[x25519.PointSize : x25519.PointSize+resumeNonceSize]
+	ticket := hello[x25519.PointSize+resumeNonceSize:]
+
+	var (
+		state  SessionState
+		secret []byte
+		reply  []byte
+	)
+
+	resumed, ticketSecret, ok := openSessionTicket(config, ticket)
+	if ok {
+		ourNonce := make([]byte, resumeNonceSize)
+
+		_, err = rand.Read(ourNonce)
+		if err != nil {
+			return nil, err
+		}
+
+		state = resumed
+		secret = resumedSecret(ticketSecret, theirNonce, ourNonce)
+		reply = append([]byte{handshakeResumed}, ourNonce...)
+	} else {
+		session := Session{theirPub: theirPub}
+
+		ourPub, ourPriv, err := session.GenerateEphemeralKeys()
+		if err != nil {
+			return nil, err
+		}
+
+		err = session.Establish(ourPriv)
+		if err != nil {
+			return nil, err
+		}
+
+		state = SessionState{EstablishedAt: time.Now()}
+		if config.Metadata != nil {
+			state.Metadata = config.Metadata(conn)
+		}
+		if len(state.Metadata) > maxSessionTicketSize-sessionTicketOverhead {
+			return nil, fmt.Errorf("session metadata exceeds %d bytes: %w",
+				maxSessionTicketSize-sessionTicketOverhead, ErrMessageTooLarge)
+		}
+
+		secret = session.SharedKey()
+		reply = append([]byte{handshakeFull}, ourPub...)
+	}
+
+	err = WriteSized(conn, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	decorator, err := AEADDecorator(secret, false)
+	if err != nil {
+		return nil, err
+	}
+	bc := decorator.Decorate(NewFramedConn(conn))
+
+	ticket, err = sealSessionTicket(config, state, resumptionSecret(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 10, 10+len(ticket)+len(state.Metadata))
+	binary.BigEndian.PutUint64(msg[:8], uint64(state.EstablishedAt.UnixNano()))
+	binary.BigEndian.PutUint16(msg[8:10], uint16(len(ticket)))
+	msg = append(msg, ticket...)
+	msg = append(msg, state.Metadata...)
+
+	_, err = bc.Write(msg)
+	if err == nil {
+		err = bc.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write session ticket: %w", err)
+	}
+
+	return &resumableConn{BufferedConn: bc, state: state}, nil
+}
+
+// sealSessionTicket seals the state of a session along with its resumption secret with config.Key via
+// ChaCha20-Poly1305 under a random nonce, which prefixes the ticket.
+func sealSessionTicket(config SessionTicketConfig, state SessionState, secret []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(config.Key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, 8, 8+len(secret)+len(state.Metadata))
+	binary.BigEndian.PutUint64(plaintext, uint64(state.EstablishedAt.UnixNano()))
+	plaintext = append(plaintext, secret...)
+	plaintext = append(plaintext, state.Metadata...)
+
+	ticket := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+
+	_, err = io.ReadFull(rand.Reader, ticket)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(ticket, ticket, plaintext, []byte("monte ticket")), nil
+}
+
+// openSessionTicket opens a ticket sealed by sealSessionTicket, and reports whether the session it describes
+// may be resumed.
+func openSessionTicket(config SessionTicketConfig, ticket []byte) (SessionState, []byte, bool) {
+	if len(ticket) < sessionTicketOverhead {
+		return SessionState{}, nil, false
+	}
+
+	aead, err := chacha20poly1305.New(config.Key[:])
+	if err != nil {
+		return SessionState{}, nil, false
+	}
+
+	plaintext, err := aead.Open(nil, ticket[:aead.NonceSize()], ticket[aead.NonceSize():], []byte("monte ticket"))
+	if err != nil {
+		return SessionState{}, nil, false
+	}
+
+	state := SessionState{
+		Resumed:       true,
+		EstablishedAt: time.Unix(0, int64(binary.BigEndian.Uint64(plaintext[:8]))),
+		Metadata:      plaintext[8+32:],
+	}
+
+	if time.Since(state.EstablishedAt) > config.getLifetime() {
+		return SessionState{}, nil, false
+	}
+
+	return state, plaintext[8 : 8+32], true
+}
+
+// resumptionSecret derives the secret with which a session may be resumed from the secret of a connection that
+// belongs to it.
+func resumptionSecret(secret []byte) []byte {
+	h, _ := blake2b.New256(secret)
+	h.Write([]byte("monte resumption"))
+	return h.Sum(nil)
+}
+
+// resumedSecret derives the secret of a connection that resumes a session from the session's resumption secret
+// and the nonces exchanged by the client and the server.
+func resumedSecret(secret, clientNonce, serverNonce []byte) []byte {
+	h, _ := blake2b.New256(secret)
+	h.Write([]byte("monte resume"))
+	h.Write(clientNonce)
+	h.Write(serverNonce)
+	return h.Sum(nil)
+}
+
+// resumableConn is a BufferedConn established by a resumable handshaker.
+type resumableConn struct {
+	BufferedConn
+	state SessionState
+}
+
+// Session returns the state of the session that the connection belongs to, and whether the connection was
+// established by a resumable handshaker. See NewResumableClientHandshaker and NewResumableServerHandshaker.
+// Connections whose handshaker wrapped the connection established by the resumable handshaker, such as via a
+// Decorator, do not report their session.
+func (c *Conn) Session() (SessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rc, ok := c.handled.(*resumableConn)
+	if !ok {
+		return SessionState{}, false
+	}
+	return rc.state, true
+}
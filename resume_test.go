@@ -0,0 +1,139 @@
+package monte
+
+import (
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+	"time"
+)
+
+// resumePipe performs a resumable handshake over a pipe, and checks that messages may be exchanged over the
+// established connections.
+func resumePipe(t *testing.T, cache *SessionCache, config SessionTicketConfig) (client, server SessionState) {
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	type result struct {
+		bc  BufferedConn
+		err error
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		bc, err := NewResumableServerHandshaker(config).Handshake(bob)
+		results <- result{bc: bc, err: err}
+	}()
+
+	cbc, err := NewResumableClientHandshaker(cache).Handshake(alice)
+	require.NoError(t, err)
+
+	res := <-results
+	require.NoError(t, res.err)
+
+	go func() {
+		_, err := cbc.Write([]byte("hello"))
+		if err == nil {
+			err = cbc.Flush()
+		}
+		results <- result{err: err}
+	}()
+
+	buf := make([]byte, 16)
+	n, err := res.bc.Read(buf)
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", buf[:n])
+	require.NoError(t, (<-results).err)
+
+	return cbc.(*resumableConn).state, res.bc.(*resumableConn).state
+}
+
+func TestResumableHandshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var cache SessionCache
+
+	config := SessionTicketConfig{
+		Key:      [32]byte{1},
+		Metadata: func(conn net.Conn) []byte { return []byte("alice") },
+	}
+
+	client, server := resumePipe(t, &cache, config)
+	require.False(t, client.Resumed)
+	require.False(t, server.Resumed)
+	require.EqualValues(t, "alice", client.Metadata)
+	require.EqualValues(t, "alice", server.Metadata)
+
+	// Reconnecting resumes the session, whose metadata is restored from its ticket.
+
+	config.Metadata = func(conn net.Conn) []byte { return []byte("bob") }
+
+	client, server = resumePipe(t, &cache, config)
+	require.True(t, client.Resumed)
+	require.True(t, server.Resumed)
+	require.EqualValues(t, "alice", client.Metadata)
+	require.EqualValues(t, "alice", server.Metadata)
+	require.True(t, client.EstablishedAt.Equal(server.EstablishedAt))
+
+	// Tickets sealed with another key, or that have outlived their lifetime, fall back to key agreement.
+
+	other := config
+	other.Key = [32]byte{2}
+
+	_, server = resumePipe(t, &cache, other)
+	require.False(t, server.Resumed)
+	require.EqualValues(t, "bob", server.Metadata)
+
+	expired := other
+	expired.Lifetime = time.Nanosecond
+
+	time.Sleep(time.Millisecond)
+
+	_, server = resumePipe(t, &cache, expired)
+	require.False(t, server.Resumed)
+}
+
+func TestConnSession(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	sessions := make(chan SessionState, 2)
+
+	srv := &Server{
+		Handler:    EchoHandler{},
+		Handshaker: NewResumableServerHandshaker(SessionTicketConfig{Key: [32]byte{1}}),
+		OnConnect: func(conn *Conn) error {
+			state, ok := conn.Session()
+			require.True(t, ok)
+			sessions <- state
+			return nil
+		},
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	var cache SessionCache
+
+	for _, resumed := range []bool{false, true} {
+		client := &Client{Addr: ln.Addr().String(), Handshaker: NewResumableClientHandshaker(&cache)}
+
+		res, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+
+		client.Shutdown()
+
+		require.Equal(t, resumed, (<-sessions).Resumed)
+	}
+}
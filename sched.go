@@ -0,0 +1,63 @@
+package monte
+
+// streamScheduler reorders writes queued on multiple streams such that they are written in round-robin order
+// across streams, while writes queued on the same stream keep their relative order. Its buffers are reused
+// across calls to avoid allocating on every drain of the write loop.
+type streamScheduler struct {
+	heads []int // index of the next write to schedule of each stream, or -1 once exhausted
+	tails []int // index of the last write queued on each stream
+	ids   []uint32
+	next  []int // index of the next write queued on the same stream as each write, or -1
+	out   []*pendingWrite
+}
+
+// interleave reorders queue in place. Queues whose writes were all queued on the same stream, which is the
+// common case, are left untouched.
+func (s *streamScheduler) interleave(queue []*pendingWrite) {
+	i := 1
+	for i < len(queue) && queue[i].stream == queue[0].stream {
+		i++
+	}
+	if i >= len(queue) {
+		return
+	}
+
+	s.heads, s.tails, s.ids, s.next = s.heads[:0], s.tails[:0], s.ids[:0], s.next[:0]
+
+	for i, pw := range queue {
+		s.next = append(s.next, -1)
+
+		k := 0
+		for k < len(s.ids) && s.ids[k] != pw.stream {
+			k++
+		}
+
+		if k == len(s.ids) {
+			s.ids = append(s.ids, pw.stream)
+			s.heads = append(s.heads, i)
+			s.tails = append(s.tails, i)
+			continue
+		}
+
+		s.next[s.tails[k]] = i
+		s.tails[k] = i
+	}
+
+	s.out = s.out[:0]
+
+	for len(s.out) < len(queue) {
+		for k, head := range s.heads {
+			if head < 0 {
+				continue
+			}
+			s.out = append(s.out, queue[head])
+			s.heads[k] = s.next[head]
+		}
+	}
+
+	copy(queue, s.out)
+
+	for i := range s.out {
+		s.out[i] = nil
+	}
+}
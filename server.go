@@ -1,10 +1,16 @@
 package monte
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,36 +22,307 @@ var DefaultMaxConnWaitTimeout = 3 * time.Second
 var DefaultServerSeqOffset uint32 = 2
 var DefaultServerSeqDelta uint32 = 2
 
+// AcceptAction designates how Serve reacts to an error returned by its listener's Accept.
+type AcceptAction int
+
+const (
+	// AcceptStop stops Serve, which then returns nil.
+	AcceptStop AcceptAction = iota
+
+	// AcceptRetry waits for a short while before attempting to accept connections again.
+	AcceptRetry
+
+	// AcceptFatal stops Serve, which then returns the error.
+	AcceptFatal
+)
+
+// DefaultClassifyAcceptError stops serving once the listener is closed, retries on temporary errors, and treats
+// all other errors as fatal.
+var DefaultClassifyAcceptError = func(err error) AcceptAction {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+		return AcceptStop
+	}
+	var tempErr interface{ Temporary() bool }
+	if errors.As(err, &tempErr) && tempErr.Temporary() {
+		return AcceptRetry
+	}
+	return AcceptFatal
+}
+
+// Limiter is a semaphore that caps the number of connections that may be served at once. A single Limiter may be
+// shared across multiple servers to cap the number of connections served by all of them combined.
+type Limiter chan struct{}
+
+// NewLimiter returns a Limiter that allows for at most n connections to be served at once.
+func NewLimiter(n int) Limiter {
+	return make(Limiter, n)
+}
+
+// slots is a counting semaphore whose limit may be changed while it is in use.
+type slots struct {
+	mu     sync.Mutex
+	active int
+	max    int
+	freed  chan struct{} // closed and replaced whenever a slot may have become available
+}
+
+func newSlots(max int) *slots {
+	return &slots{max: max, freed: make(chan struct{})}
+}
+
+// tryAcquire acquires a slot should one be available, or otherwise returns a channel that is closed once one
+// may have become available.
+func (s *slots) tryAcquire() (bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active < s.max {
+		s.active++
+		return true, nil
+	}
+	return false, s.freed
+}
+
+func (s *slots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	s.notify()
+}
+
+func (s *slots) setMax(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.max = max
+	s.notify()
+}
+
+func (s *slots) getMax() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+func (s *slots) notify() {
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
 type Server struct {
 	Handler   Handler
 	ConnState ConnStateHandler
 
+	// StreamHandler, if set, handles messages our peer writes in fragments as their fragments arrive. See
+	// Conn.StreamHandler.
+	StreamHandler StreamHandler
+
+	// Handlers, if set, maps the names of application protocols to the Handler that handles connections whose
+	// handshake negotiated them, such that a single listener may serve several protocols built on monte.
+	// Protocols are negotiated by chaining a handshaker returned by NewProtocolServerHandshaker into Handshaker.
+	// Connections whose protocol has no Handler registered for it are handled by Handler.
+	Handlers map[string]Handler
+
+	// AllowConn, if set, is called with the remote address of every accepted connection before a slot is
+	// acquired for it. Connections for which it returns false are immediately closed.
+	AllowConn func(addr net.Addr) bool
+
+	// AcceptFilter, if set, is called with every accepted connection after AllowConn and before a slot is
+	// acquired for it or it is handshaked, such as to implement IP allow and deny lists, GeoIP blocks, or early
+	// load shedding. Connections for which it returns an error are immediately closed, and are counted by
+	// NumRejectedConns. It is called from the accept loop, such that it should return quickly.
+	AcceptFilter func(conn net.Conn) error
+
+	// TrustedProxies, if set, is called with the remote address of every accepted connection before it is
+	// handshaked. Connections for which it returns true are taken to be accepted from a proxy, such as HAProxy or
+	// a network load balancer, and must begin with a PROXY protocol v1 or v2 header. The client address the
+	// header carries then replaces the connection's remote address, such as reported by Conn.RemoteAddr and
+	// ConnInfo. Connections from other addresses are served as is. AllowCIDRs may be used to build it from a
+	// list of the proxies' CIDR ranges. AllowConn is called with the address of the proxy rather than that of
+	// the client.
+	TrustedProxies func(addr net.Addr) bool
+
+	// MaxConnsPerSecondPerIP, if positive, bounds the rate at which connections are accepted from any single IP
+	// address via a token bucket that may burst up to a second's worth of connections. Connections that exceed
+	// it are immediately closed, and are counted by NumRejectedConns.
+	MaxConnsPerSecondPerIP int
+
+	// ClassifyAcceptError, if set, is called with every error returned by the listener's Accept to decide
+	// whether Serve should stop, retry, or fail. It defaults to DefaultClassifyAcceptError.
+	ClassifyAcceptError func(err error) AcceptAction
+
+	// OnHandshakeError, if set, is called with the remote address and error of every accepted connection that
+	// failed to complete its handshake.
+	OnHandshakeError func(addr net.Addr, err error)
+
+	OnConnect    func(conn *Conn) error
+	OnDisconnect func(conn *Conn, err error)
+
+	// OnError, if set, is called with errors that the server recovers from, such as accept errors that are
+	// retried and handshake failures, in which case conn is nil, and with errors that every connection served
+	// suppresses. See Conn.OnError.
+	OnError func(conn *Conn, err error)
+
+	// Logger, if set, logs accept errors, rejected connections, handshake failures, and the lifecycle of every
+	// connection served. See Conn.Logger.
+	Logger Logger
+
+	// Tracer, if set, instruments requests sent and handled over every connection with distributed tracing. See
+	// Conn.Tracer.
+	Tracer Tracer
+
+	// Codec marshals and unmarshals the values sent and received over every connection via Call and HandleCall.
+	// See Conn.Codec.
+	Codec Codec
+
 	Handshaker       Handshaker
 	HandshakeTimeout time.Duration
 
+	// MaxConns is the maximum number of connections that may be served at once. It is only read once the server
+	// starts, after which the limit may be changed via SetMaxConns.
 	MaxConns           int
 	MaxConnWaitTimeout time.Duration
 
+	// WaitTimeoutFunc, if set, is called with every accepted connection to compute how long to wait for a slot
+	// to serve it in place of MaxConnWaitTimeout, such that e.g. connections from trusted subnets may wait
+	// longer while others fail fast. Should it return zero or less, the connection is rejected immediately
+	// should no slot be available.
+	WaitTimeoutFunc func(conn net.Conn) time.Duration
+
+	// Limiter, if set, is consulted in addition to MaxConns before a connection is served, such that a limit
+	// may be imposed on the number of connections served across multiple servers.
+	Limiter Limiter
+
 	ReadBufferSize  int
 	WriteBufferSize int
 
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// IdleTimeout, if positive, closes connections from which no frame was read within it, such that clients
+	// that abandoned their connection do not hold on to a slot bounded by MaxConns forever. See Conn.IdleTimeout.
+	IdleTimeout time.Duration
+
+	// RequestTimeout, if positive, bounds how long requests sent over every connection wait for their response.
+	// See Conn.RequestTimeout.
+	RequestTimeout time.Duration
+
+	// Framer, if set, frames messages over every connection once its handshake completes. See Conn.Framer.
+	Framer Framer
+
+	MaxFrameSize   int
+	MaxMessageSize int
+	MaxWriteSize   int
+
+	// MaxFramesPerSecond and MaxBytesPerSecond, if positive, bound the rate at which frames and bytes are read
+	// from every connection. See Conn.MaxFramesPerSecond. ConnRateLimiter, if set, is instead called with every
+	// connection once its handshake completes to return the RateLimiter that bounds it, which may be shared
+	// across connections, such as to bound the rate of all connections from a single IP address.
+	MaxFramesPerSecond int
+	MaxBytesPerSecond  int
+	ConnRateLimiter    func(conn net.Conn) RateLimiter
+	CloseOnRateLimit   bool
+
 	SeqOffset uint32
 	SeqDelta  uint32
 
-	once sync.Once
-	mu   sync.Mutex
-	wg   sync.WaitGroup
+	// ManualFlush, if true, only flushes messages written to a connection once Flush is called on it. See
+	// Conn.ManualFlush.
+	ManualFlush bool
+
+	// FlushInterval and MaxBatchBytes, if positive, coalesce small writes to every connection into fewer
+	// flushes. See Conn.FlushInterval.
+	FlushInterval time.Duration
+	MaxBatchBytes int
+
+	// MaxPendingWrites and MaxPendingBytes, if positive, bound the number of messages and bytes that may be
+	// queued to be written to every connection. See Conn.MaxPendingWrites.
+	MaxPendingWrites    int
+	MaxPendingBytes     int
+	FailFastIfQueueFull bool
+
+	MaxFlushRetries        int
+	AbortWritesOnReadError bool
+	ConcurrentHandlers     bool
+
+	// HandlerTimeout, if positive, bounds how long Handler may take to respond to a request, after which the
+	// request fails with ErrHandlerTimeout. See Conn.HandlerTimeout.
+	HandlerTimeout time.Duration
+
+	KeepAliveInterval time.Duration
+	MaxMissedPongs    int
+	KeepAliveIdleOnly bool
+
+	// AdvertiseKeepAliveInterval, if positive, is advertised to every client once its connection is established
+	// as the interval at which it should ping us, which clients that have not set their own KeepAliveInterval
+	// adopt. It should be set comfortably below ReadTimeout, such that idle clients are not disconnected.
+	AdvertiseKeepAliveInterval time.Duration
+
+	OnRead      func(frame []byte)
+	OnWrite     func(frame []byte)
+	OnQueueWait func(d time.Duration)
+
+	// Nagle enables Nagle's algorithm on TCP connections, which is otherwise disabled by default.
+	Nagle bool
+
+	// UnixSocketMode, if non-zero, sets the permissions of the socket files created by ListenAndServe and
+	// ListenAndServeTLS for unix:// addresses, such as to only allow processes of the same user to connect.
+	UnixSocketMode os.FileMode
+
+	middleware []Middleware // registered via Use
+
+	once     sync.Once
+	shutdown sync.Once
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+
+	slots     *slots
+	done      chan struct{}
+	draining  chan struct{}             // closed once ShutdownContext is called, after which no conns are accepted
+	listeners map[net.Listener]struct{} // listeners opened by ListenAndServe and ListenAndServeTLS
+	conns     map[*Conn]*servedConn     // conns being served
+	lastID    uint64                    // ID assigned to the last conn served
+
+	closedStats ConnStats // traffic of every connection that has since been closed
 
-	sem  chan struct{}
-	done chan struct{}
+	rejected          uint64 // number of connections rejected once accepted, accessed atomically
+	handshakeFailures uint64 // number of connections that failed to complete their handshake, accessed atomically
+
+	connRates connRates // rate at which connections are accepted from each IP address
 }
 
 func (s *Server) init() {
-	s.sem = make(chan struct{}, s.getMaxConns())
+	s.slots = newSlots(s.getMaxConns())
 	s.done = make(chan struct{})
+	s.draining = make(chan struct{})
+	s.listeners = make(map[net.Listener]struct{})
+	s.conns = make(map[*Conn]*servedConn)
+}
+
+// ServerConfig is the configuration a Server is running with, once defaults have been applied to settings that
+// were left unset. The embedded ConnConfig is the configuration every connection served is running with.
+type ServerConfig struct {
+	ConnConfig
+
+	HandshakeTimeout   time.Duration
+	MaxConns           int
+	MaxConnWaitTimeout time.Duration
+	Nagle              bool
+}
+
+// Config returns the configuration the server is running with, which is handy for logging and debugging.
+// MaxConns reflects any changes made via SetMaxConns.
+func (s *Server) Config() ServerConfig {
+	s.once.Do(s.init)
+
+	return ServerConfig{
+		ConnConfig:         s.newConn().Config(),
+		HandshakeTimeout:   s.getHandshakeTimeout(),
+		MaxConns:           s.slots.getMax(),
+		MaxConnWaitTimeout: s.getMaxConnWaitTimeout(),
+		Nagle:              s.Nagle,
+	}
 }
 
 func (s *Server) getHandler() Handler {
@@ -55,6 +332,20 @@ func (s *Server) getHandler() Handler {
 	return s.Handler
 }
 
+func (s *Server) getLogger() Logger {
+	if s.Logger == nil {
+		return DefaultLogger
+	}
+	return s.Logger
+}
+
+func (s *Server) getClassifyAcceptError() func(err error) AcceptAction {
+	if s.ClassifyAcceptError == nil {
+		return DefaultClassifyAcceptError
+	}
+	return s.ClassifyAcceptError
+}
+
 func (s *Server) getConnStateHandler() ConnStateHandler {
 	if s.ConnState == nil {
 		return DefaultConnStateHandler
@@ -132,27 +423,117 @@ func (s *Server) getSeqDelta() uint32 {
 	return s.SeqDelta
 }
 
-func (s *Server) serverAvailable() bool {
-	select {
-	case <-s.done:
+func (s *Server) getConnWaitTimeout(conn net.Conn) time.Duration {
+	if s.WaitTimeoutFunc == nil {
+		return s.getMaxConnWaitTimeout()
+	}
+	return s.WaitTimeoutFunc(conn)
+}
+
+func (s *Server) serverAvailable(conn net.Conn) bool {
+	timeout := s.getConnWaitTimeout(conn)
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			ReleaseTimer(timer)
+		}
+	}()
+
+	if !s.acquireSlot(timeout, &timer) {
 		return false
-	case s.sem <- struct{}{}:
-		return true
-	default:
-		timer := AcquireTimer(s.getMaxConnWaitTimeout())
-		defer ReleaseTimer(timer)
+	}
+
+	if s.Limiter != nil && !s.acquire(s.Limiter, timeout, &timer) {
+		s.slots.release()
+		return false
+	}
+
+	return true
+}
+
+// acquireSlot acquires one of the slots bounded by MaxConns, waiting up to timeout for one to become available.
+// See acquire.
+func (s *Server) acquireSlot(timeout time.Duration, timer **time.Timer) bool {
+	for {
+		ok, freed := s.slots.tryAcquire()
+		if ok {
+			return true
+		}
+
+		select {
+		case <-s.done:
+			return false
+		default:
+		}
+
+		if timeout <= 0 {
+			return false
+		}
+
+		if *timer == nil {
+			*timer = AcquireTimer(timeout)
+		}
 
 		select {
-		case <-timer.C:
+		case <-(*timer).C:
 			return false
 		case <-s.done:
 			return false
-		case s.sem <- struct{}{}:
-			return true
+		case <-freed:
 		}
 	}
 }
 
+// acquire acquires a slot from sem, waiting up to timeout for one to become available. The timer is lazily
+// created and shared across calls, such that acquiring from multiple semaphores waits no longer than timeout in
+// total.
+func (s *Server) acquire(sem chan struct{}, timeout time.Duration, timer **time.Timer) bool {
+	select {
+	case <-s.done:
+		return false
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if timeout <= 0 {
+		return false
+	}
+
+	if *timer == nil {
+		*timer = AcquireTimer(timeout)
+	}
+
+	select {
+	case <-(*timer).C:
+		return false
+	case <-s.done:
+		return false
+	case sem <- struct{}{}:
+		return true
+	}
+}
+
+func (s *Server) release() {
+	if s.Limiter != nil {
+		<-s.Limiter
+	}
+	s.slots.release()
+}
+
+// SetMaxConns changes the maximum number of connections that may be served at once to n, or to
+// DefaultMaxServerConns should n be zero or less. Should the limit be lowered below the number of connections
+// being served, no connections are closed, though no new connections are served until enough of them are.
+func (s *Server) SetMaxConns(n int) {
+	s.once.Do(s.init)
+
+	if n <= 0 {
+		n = DefaultMaxServerConns
+	}
+	s.slots.setMax(n)
+}
+
 func (s *Server) wait(duration time.Duration) bool {
 	timer := AcquireTimer(duration)
 	defer ReleaseTimer(timer)
@@ -165,76 +546,344 @@ func (s *Server) wait(duration time.Duration) bool {
 	}
 }
 
-func (s *Server) client(conn net.Conn) error {
-	defer func() { <-s.sem }()
+func (s *Server) client(conn net.Conn, handshaker Handshaker) error {
+	defer s.release()
+
+	if s.Nagle {
+		err := setNoDelay(conn, false)
+		if err != nil {
+			return err
+		}
+	}
 
+	conn, bufConn, peer, err := s.handshake(conn, handshaker)
+	if err != nil {
+		atomic.AddUint64(&s.handshakeFailures, 1)
+		s.getLogger().Warn("handshake failed", "remote_addr", remoteAddr{conn}, "err", err)
+		if s.OnError != nil {
+			s.OnError(nil, fmt.Errorf("handshake failed: %w", err))
+		}
+		if s.OnHandshakeError != nil {
+			s.OnHandshakeError(conn.RemoteAddr(), err)
+		}
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	cc := s.newConn()
+	cc.peer = peer
+	if h, ok := s.Handlers[peer.Protocol]; ok && peer.Protocol != "" {
+		cc.Handler = h
+	}
+	if s.ConnRateLimiter != nil {
+		cc.RateLimiter = s.ConnRateLimiter(conn)
+	}
+
+	if !s.track(cc, conn) {
+		return nil
+	}
+	defer s.untrack(cc)
+
+	s.getConnStateHandler().HandleConnState(cc, StateNew)
+
+	cc.close(cc.Handle(s.done, bufConn))
+
+	s.getConnStateHandler().HandleConnState(cc, StateClosed)
+
+	return nil
+}
+
+// track registers cc as being served over conn, and reports false should the server be draining, in which case
+// cc is not to be served.
+func (s *Server) track(cc *Conn, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.draining:
+		return false
+	default:
+	}
+
+	s.lastID++
+	s.conns[cc] = &servedConn{
+		info: ConnInfo{
+			ID:          s.lastID,
+			Conn:        cc,
+			RemoteAddr:  conn.RemoteAddr(),
+			LocalAddr:   conn.LocalAddr(),
+			ConnectedAt: time.Now(),
+		},
+		conn: conn,
+	}
+	return true
+}
+
+func (s *Server) untrack(cc *Conn) {
+	stats := cc.Stats()
+	stats.PendingWrites, stats.PendingBytes, stats.PendingRequests = 0, 0, 0
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, cc)
+	s.closedStats.add(stats)
+}
+
+// newConn returns a Conn configured with the settings that the server applies to every connection it serves.
+func (s *Server) newConn() *Conn {
+	return &Conn{
+		SeqOffset:                  s.getSeqOffset(),
+		SeqDelta:                   s.getSeqDelta(),
+		Handler:                    s.getHandler(),
+		StreamHandler:              s.StreamHandler,
+		OnConnect:                  s.OnConnect,
+		OnDisconnect:               s.OnDisconnect,
+		OnError:                    s.OnError,
+		Logger:                     s.Logger,
+		Tracer:                     s.Tracer,
+		Codec:                      s.Codec,
+		ReadBufferSize:             s.getReadBufferSize(),
+		WriteBufferSize:            s.getWriteBufferSize(),
+		ReadTimeout:                s.getReadTimeout(),
+		WriteTimeout:               s.getWriteTimeout(),
+		IdleTimeout:                s.IdleTimeout,
+		RequestTimeout:             s.RequestTimeout,
+		Framer:                     s.Framer,
+		MaxFrameSize:               s.MaxFrameSize,
+		MaxMessageSize:             s.MaxMessageSize,
+		MaxWriteSize:               s.MaxWriteSize,
+		MaxFramesPerSecond:         s.MaxFramesPerSecond,
+		MaxBytesPerSecond:          s.MaxBytesPerSecond,
+		CloseOnRateLimit:           s.CloseOnRateLimit,
+		FlushInterval:              s.FlushInterval,
+		MaxBatchBytes:              s.MaxBatchBytes,
+		MaxPendingWrites:           s.MaxPendingWrites,
+		MaxPendingBytes:            s.MaxPendingBytes,
+		FailFastIfQueueFull:        s.FailFastIfQueueFull,
+		ManualFlush:                s.ManualFlush,
+		MaxFlushRetries:            s.MaxFlushRetries,
+		AbortWritesOnReadError:     s.AbortWritesOnReadError,
+		ConcurrentHandlers:         s.ConcurrentHandlers,
+		HandlerTimeout:             s.HandlerTimeout,
+		KeepAliveInterval:          s.KeepAliveInterval,
+		AdvertiseKeepAliveInterval: s.AdvertiseKeepAliveInterval,
+		MaxMissedPongs:             s.MaxMissedPongs,
+		KeepAliveIdleOnly:          s.KeepAliveIdleOnly,
+		OnRead:                     s.OnRead,
+		OnWrite:                    s.OnWrite,
+		OnQueueWait:                s.OnQueueWait,
+		middleware:                 append([]Middleware(nil), s.middleware...),
+	}
+}
+
+// handshake handshakes conn, having first read its PROXY protocol header should it be accepted from a trusted
+// proxy. It returns conn with its remote address replaced by the one the header carries.
+func (s *Server) handshake(conn net.Conn, handshaker Handshaker) (net.Conn, BufferedConn, PeerInfo, error) {
 	timeout := s.getHandshakeTimeout()
 
 	if timeout != 0 {
 		err := conn.SetDeadline(time.Now().Add(timeout))
 		if err != nil {
-			return err
+			return conn, nil, PeerInfo{}, err
+		}
+	}
+
+	if s.TrustedProxies != nil && s.TrustedProxies(conn.RemoteAddr()) {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			return conn, nil, PeerInfo{}, err
 		}
+		conn = proxied
 	}
 
-	bufConn, err := s.getHandshaker().Handshake(conn)
+	ctx, cancel := handshakeTimeout(s.done, timeout)
+	defer cancel()
+
+	bufConn, peer, err := handshakeContext(ctx, handshaker, conn)
 	if err != nil {
-		return err
+		return conn, nil, PeerInfo{}, err
 	}
 
 	if timeout != 0 {
 		err = conn.SetDeadline(zeroTime)
 		if err != nil {
-			return err
+			return conn, nil, PeerInfo{}, err
 		}
 	}
 
-	cc := &Conn{
-		SeqOffset:       s.getSeqOffset(),
-		SeqDelta:        s.getSeqDelta(),
-		Handler:         s.getHandler(),
-		ReadBufferSize:  s.getReadBufferSize(),
-		WriteBufferSize: s.getWriteBufferSize(),
-		ReadTimeout:     s.getReadTimeout(),
-		WriteTimeout:    s.getWriteTimeout(),
+	return conn, bufConn, peer, nil
+}
+
+// Serve serves connections accepted from ln, which may be any net.Listener whose connections are reliable, ordered
+// byte streams. Listeners that accept the streams of QUIC connections as net.Conns may therefore be served, in which
+// case every stream is handshaked and served as a connection of its own.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.serve(ln, s.getHandshaker())
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections accepted from it. Should addr be prefixed
+// with unix://, it instead listens on the Unix domain socket at the path that follows, whose socket file is
+// removed once the listener is closed. A stale socket file left behind by a server that is no longer running is
+// replaced. The listener is closed once the server is shut down, after which ListenAndServe returns nil.
+func (s *Server) ListenAndServe(addr string) error {
+	return s.listenAndServe(addr, s.getHandshaker())
+}
+
+// ListenAndServeTLS listens on the TCP address addr and serves connections accepted from it over TLS, with the
+// certificate and matching private key loaded from the PEM-encoded certFile and keyFile. Connections are
+// handshaked via NewTLSServerHandshaker in place of the default handshaker, such that messages are encrypted by
+// TLS alone. Should Handshaker be set, it is run over the established TLS connection, such as to authenticate
+// clients. The listener is closed once the server is shut down, after which ListenAndServeTLS returns nil.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	var handshaker Handshaker = NewTLSServerHandshaker(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if s.Handshaker != nil {
+		handshaker = ChainHandshakers(handshaker, s.Handshaker)
 	}
 
-	s.getConnStateHandler().HandleConnState(cc, StateNew)
+	return s.listenAndServe(addr, handshaker)
+}
 
-	cc.close(cc.Handle(s.done, bufConn))
+func (s *Server) listenAndServe(addr string, handshaker Handshaker) error {
+	s.once.Do(s.init)
 
-	s.getConnStateHandler().HandleConnState(cc, StateClosed)
+	ln, err := s.listen(addr)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	s.mu.Lock()
+	select {
+	case <-s.draining:
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	default:
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+
+		ln.Close()
+	}()
+
+	return s.serve(ln, handshaker)
 }
 
-func (s *Server) Serve(ln net.Listener) error {
+// listen listens on the address addr designates. See splitAddr.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	// A socket file that refuses connections was left behind by a server that is no longer running.
+
+	if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial(network, address); err == nil {
+			conn.Close()
+		} else if err := os.Remove(address); err != nil {
+			return nil, fmt.Errorf("failed to remove stale unix socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(true)
+
+	if s.UnixSocketMode != 0 {
+		if err := os.Chmod(address, s.UnixSocketMode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set unix socket permissions: %w", err)
+		}
+	}
+
+	return ln, nil
+}
+
+// Addrs returns the addresses of the listeners opened by ListenAndServe and ListenAndServeTLS that are being
+// served.
+func (s *Server) Addrs() []net.Addr {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for ln := range s.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+func (s *Server) serve(ln net.Listener, handshaker Handshaker) error {
 	s.once.Do(s.init)
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			var netErr *net.OpError
-			if !errors.As(err, &netErr) {
-				return err
-			}
-			if netErr.Err.Error() == "use of closed network connection" {
+			switch s.getClassifyAcceptError()(err) {
+			case AcceptStop:
 				return nil
-			}
-			if !netErr.Temporary() {
+			case AcceptRetry:
+				s.getLogger().Warn("accept failed, retrying", "addr", listenerAddr{ln}, "err", err)
+				if s.OnError != nil {
+					s.OnError(nil, fmt.Errorf("accept failed: %w", err))
+				}
+				ok := s.wait(100 * time.Millisecond)
+				if !ok {
+					return nil
+				}
+				continue
+			default:
+				s.getLogger().Error("accept failed", "addr", listenerAddr{ln}, "err", err)
 				return err
 			}
-			ok := s.wait(100 * time.Millisecond)
-			if !ok {
-				return nil
+		}
+
+		select {
+		case <-s.draining:
+			conn.Close()
+			continue
+		default:
+		}
+
+		if s.AllowConn != nil && !s.AllowConn(conn.RemoteAddr()) {
+			atomic.AddUint64(&s.rejected, 1)
+			s.getLogger().Debug("connection rejected", "remote_addr", remoteAddr{conn})
+			conn.Close()
+			continue
+		}
+
+		if s.AcceptFilter != nil {
+			if err := s.AcceptFilter(conn); err != nil {
+				atomic.AddUint64(&s.rejected, 1)
+				s.getLogger().Debug("connection rejected by accept filter", "remote_addr", remoteAddr{conn}, "err", err)
+				conn.Close()
+				continue
 			}
+		}
+
+		if s.MaxConnsPerSecondPerIP > 0 && !s.connRates.allow(conn.RemoteAddr(), s.MaxConnsPerSecondPerIP) {
+			atomic.AddUint64(&s.rejected, 1)
+			s.getLogger().Debug("connection rejected as its ip address exceeded its connection rate",
+				"remote_addr", remoteAddr{conn})
+			conn.Close()
 			continue
 		}
 
-		if !s.serverAvailable() {
+		if !s.serverAvailable(conn) {
+			s.getLogger().Warn("connection dropped as the server is at capacity", "remote_addr", remoteAddr{conn})
 			conn.Close()
 			continue
 		}
@@ -243,15 +892,220 @@ func (s *Server) Serve(ln net.Listener) error {
 
 		go func() {
 			defer s.wg.Done()
-			s.client(conn)
+			s.client(conn, handshaker)
 			conn.Close()
 		}()
 	}
 }
 
+// ConnInfo describes a connection being served by a Server.
+type ConnInfo struct {
+	ID          uint64 // identifies the connection, and is never reused by the server
+	Conn        *Conn
+	RemoteAddr  net.Addr
+	LocalAddr   net.Addr
+	ConnectedAt time.Time // when the connection completed its handshake
+}
+
+// servedConn is a connection being served, alongside the underlying connection it is served over.
+type servedConn struct {
+	info ConnInfo
+	conn net.Conn
+}
+
+// Conns returns a snapshot of the connections being served, ordered by ID.
+func (s *Server) Conns() []ConnInfo {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(s.conns))
+	for _, sc := range s.conns {
+		infos = append(infos, sc.info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	return infos
+}
+
+// Conn returns the connection being served with the given ID, and reports false should no such connection be
+// served.
+func (s *Server) Conn(id uint64) (ConnInfo, bool) {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc := s.lookup(id)
+	if sc == nil {
+		return ConnInfo{}, false
+	}
+	return sc.info, true
+}
+
+// CloseConn forcibly closes the connection being served with the given ID, and reports false should no such
+// connection be served. Connections may instead be closed gracefully via Conn.CloseGracefully.
+func (s *Server) CloseConn(id uint64) bool {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc := s.lookup(id)
+	if sc == nil {
+		return false
+	}
+	sc.conn.Close()
+	return true
+}
+
+// Broadcast queues buf to be sent to every connection being served without waiting for it to be written. See
+// BroadcastFunc.
+func (s *Server) Broadcast(buf []byte) error {
+	return s.BroadcastFunc(buf, nil)
+}
+
+// BroadcastFunc queues buf to be sent to every connection being served for which filter, if not nil, reports
+// true. The frame carrying buf is encoded once and shared across the write queues of every connection, unless
+// the connection has middleware that intercepts the payloads it sends. Connections that are closing, or that have
+// closed since being listed, are skipped.
+// Should buf fail to be queued to any connection, the first such error is returned once buf has been queued to
+// every other connection.
+func (s *Server) BroadcastFunc(buf []byte, filter func(info ConnInfo) bool) error {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for cc, sc := range s.conns {
+		if filter == nil || filter(sc.info) {
+			conns = append(conns, cc)
+		}
+	}
+	s.mu.Unlock()
+
+	h := frameHeader{}
+
+	shared := acquireBuffer(h.size() + len(buf))
+	defer releaseBuffer(shared)
+
+	copy(h.encode(shared.B), buf)
+
+	var first error
+
+	for _, cc := range conns {
+		err := cc.sendSharedNoWait(shared, buf)
+		if err == nil || errors.Is(err, ErrConnClosing) || errors.Is(err, ErrConnClosed) {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// lookup returns the connection being served with the given ID, or nil should there be none. s.mu must be held.
+func (s *Server) lookup(id uint64) *servedConn {
+	for _, sc := range s.conns {
+		if sc.info.ID == id {
+			return sc
+		}
+	}
+	return nil
+}
+
+// NumRejectedConns returns the number of connections that have been rejected by AllowConn or AcceptFilter, or for
+// exceeding MaxConnsPerSecondPerIP.
+func (s *Server) NumRejectedConns() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
+
+// NumHandshakeFailures returns the number of accepted connections that failed to complete their handshake.
+func (s *Server) NumHandshakeFailures() uint64 {
+	return atomic.LoadUint64(&s.handshakeFailures)
+}
+
+// Shutdown stops the server, closes the listeners opened by ListenAndServe and ListenAndServeTLS, and waits for
+// every connection being served to be closed. Listeners passed to Serve are left for the caller to close.
 func (s *Server) Shutdown() {
 	s.once.Do(s.init)
 
-	close(s.done)
+	s.stop()
 	s.wg.Wait()
 }
+
+// ShutdownContext gracefully shuts down the server. It stops accepting connections, closes the listeners opened
+// by ListenAndServe and ListenAndServeTLS, and drains every connection being served via Conn.CloseGracefully,
+// such that requests being handled are responded to before their connection is closed. Should ctx be done
+// before every connection is drained, the remaining connections are forcibly closed and ctx.Err() is returned
+// once they are. Listeners passed to Serve are left for the caller to close, and connections accepted from them
+// in the meantime are closed immediately.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	select {
+	case <-s.draining:
+	default:
+		close(s.draining)
+	}
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	conns := make([]*Conn, 0, len(s.conns))
+	for cc := range s.conns {
+		conns = append(conns, cc)
+	}
+	s.mu.Unlock()
+
+	for _, cc := range conns {
+		go cc.CloseGracefully(ctx)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+
+		s.mu.Lock()
+		for _, sc := range s.conns {
+			sc.conn.Close()
+		}
+		s.mu.Unlock()
+	}
+
+	s.stop()
+	<-drained
+
+	return err
+}
+
+// stop closes done and the listeners opened by ListenAndServe and ListenAndServeTLS.
+func (s *Server) stop() {
+	s.shutdown.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		select {
+		case <-s.draining:
+		default:
+			close(s.draining)
+		}
+
+		close(s.done)
+		for ln := range s.listeners {
+			ln.Close()
+		}
+	})
+}
@@ -1,10 +1,24 @@
 package monte
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestServerShutdown(t *testing.T) {
@@ -22,3 +36,846 @@ func TestServerShutdown(t *testing.T) {
 
 	require.NoError(t, srv.Serve(ln))
 }
+
+func TestServerListenAndServe(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	clientConfig, serverConfig := selfSignedTLSConfigs(t)
+
+	// Write the server's certificate and private key out as PEM files for ListenAndServeTLS to load.
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	cert := serverConfig.Certificates[0]
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	for _, test := range []struct {
+		name       string
+		serve      func(srv *Server) error
+		handshaker Handshaker
+	}{
+		{
+			name:       "tcp",
+			serve:      func(srv *Server) error { return srv.ListenAndServe("127.0.0.1:0") },
+			handshaker: DefaultClientHandshaker,
+		},
+		{
+			name:       "tls",
+			serve:      func(srv *Server) error { return srv.ListenAndServeTLS("127.0.0.1:0", certFile, keyFile) },
+			handshaker: NewTLSClientHandshaker(clientConfig),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := &Server{Handler: EchoHandler{}}
+
+			served := make(chan error, 1)
+			go func() {
+				served <- test.serve(srv)
+			}()
+
+			require.Eventually(t, func() bool { return len(srv.Addrs()) == 1 }, time.Second, time.Millisecond)
+
+			client := &Client{Addr: srv.Addrs()[0].String(), Handshaker: test.handshaker}
+			defer client.Shutdown()
+
+			res, err := client.Request(nil, []byte("hello"))
+			require.NoError(t, err)
+			require.EqualValues(t, "hello", res)
+
+			// Shutting down the server closes its listener.
+
+			srv.Shutdown()
+
+			require.NoError(t, <-served)
+			require.Empty(t, srv.Addrs())
+
+			require.NoError(t, srv.ListenAndServe("127.0.0.1:0"))
+		})
+	}
+
+	require.Error(t, (&Server{}).ListenAndServeTLS("127.0.0.1:0", filepath.Join(dir, "missing.pem"), keyFile))
+}
+
+func TestServerListenAndServeUnix(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	path := filepath.Join(t.TempDir(), "monte.sock")
+
+	// Stale socket files left behind by servers that are no longer running are replaced.
+
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	srv := &Server{Handler: EchoHandler{}, UnixSocketMode: 0600}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe("unix://" + path)
+	}()
+
+	require.Eventually(t, func() bool { return len(srv.Addrs()) == 1 }, time.Second, time.Millisecond)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := &Client{Addr: "unix://" + path}
+	defer client.Shutdown()
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	// Shutting down the server removes its socket file.
+
+	srv.Shutdown()
+	require.NoError(t, <-served)
+
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestServerShutdownContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	srv := &Server{Handler: HandlerFunc(func(ctx *Context) error {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return ctx.Reply(ctx.Body())
+		case <-ctx.Done():
+			return nil
+		}
+	})}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe("127.0.0.1:0")
+	}()
+
+	require.Eventually(t, func() bool { return len(srv.Addrs()) == 1 }, time.Second, time.Millisecond)
+	addr := srv.Addrs()[0].String()
+
+	// Requests being handled are responded to before their connection is closed.
+
+	client := &Client{Addr: addr}
+	defer client.Shutdown()
+
+	responses := make(chan error, 1)
+	go func() {
+		res, err := client.Request(nil, []byte("hello"))
+		if err == nil && string(res) != "hello" {
+			err = fmt.Errorf("unexpected response %q", res)
+		}
+		responses <- err
+	}()
+
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.ShutdownContext(context.Background())
+	}()
+
+	require.NoError(t, <-served)
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before draining: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	require.NoError(t, <-responses)
+	require.NoError(t, <-shutdown)
+}
+
+func TestServerShutdownContextTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	started := make(chan struct{}, 1)
+
+	srv := &Server{Handler: HandlerFunc(func(ctx *Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil
+	})}
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	responses := make(chan error, 1)
+	go func() {
+		_, err := client.Request(nil, []byte("hello"))
+		responses <- err
+	}()
+
+	<-started
+
+	// Connections that fail to drain in time are forcibly closed.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	require.True(t, errors.Is(srv.ShutdownContext(ctx), context.DeadlineExceeded))
+	require.Error(t, <-responses)
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	disconnected := make(chan error, 1)
+
+	srv := &Server{
+		Handler:      EchoHandler{},
+		IdleTimeout:  50 * time.Millisecond,
+		OnDisconnect: func(conn *Conn, err error) { disconnected <- err },
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String(), KeepAliveInterval: -1}
+	defer client.Shutdown()
+
+	// Connections are kept open for as long as frames are read from them within the idle timeout.
+
+	for i := 0; i < 5; i++ {
+		res, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Connections that go idle are closed.
+
+	select {
+	case err := <-disconnected:
+		require.True(t, errors.Is(err, ErrIdleTimeout))
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+func TestServerAllowConn(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	allow, err := AllowCIDRs(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+
+	handshakes := uint32(0)
+
+	srv := &Server{
+		AllowConn: allow,
+		Handshaker: HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+			atomic.AddUint32(&handshakes, 1)
+			return DefaultServerHandshaker(conn)
+		}),
+	}
+
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	require.Error(t, client.Send([]byte("hello")))
+	require.EqualValues(t, 1, srv.NumRejectedConns())
+	require.EqualValues(t, 0, atomic.LoadUint32(&handshakes))
+}
+
+func TestServerAcceptFilter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	handshakes := uint32(0)
+	shedding := uint32(1)
+
+	srv := &Server{
+		Handler: EchoHandler{},
+		AcceptFilter: func(conn net.Conn) error {
+			if atomic.LoadUint32(&shedding) == 1 {
+				return errors.New("shedding load")
+			}
+			return nil
+		},
+		Handshaker: HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+			atomic.AddUint32(&handshakes, 1)
+			return DefaultServerHandshaker(conn)
+		}),
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// Connections rejected by the filter are closed before they are handshaked.
+
+	rejected := &Client{Addr: ln.Addr().String()}
+	defer rejected.Shutdown()
+
+	require.Error(t, rejected.Send([]byte("hello")))
+	require.EqualValues(t, 1, srv.NumRejectedConns())
+	require.EqualValues(t, 0, atomic.LoadUint32(&handshakes))
+
+	atomic.StoreUint32(&shedding, 0)
+
+	accepted := &Client{Addr: ln.Addr().String()}
+	defer accepted.Shutdown()
+
+	res, err := accepted.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+	require.EqualValues(t, 1, atomic.LoadUint32(&handshakes))
+}
+
+func TestServerHandshakeFailures(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	errHandshake := errors.New("handshake failed")
+
+	failures := make(chan net.Addr, 2)
+
+	srv := &Server{
+		Handshaker: HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+			return nil, errHandshake
+		}),
+		OnHandshakeError: func(addr net.Addr, err error) {
+			require.True(t, errors.Is(err, errHandshake))
+			failures <- addr
+		},
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		require.EqualValues(t, conn.LocalAddr().String(), (<-failures).String())
+
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	require.EqualValues(t, 2, srv.NumHandshakeFailures())
+}
+
+// recordLogger records the message and arguments of every event logged to it.
+type recordLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordLogger) log(level, msg string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprint(append([]interface{}{level, msg}, args...)...))
+}
+
+func (r *recordLogger) Debug(msg string, args ...interface{}) { r.log("DEBUG", msg, args...) }
+func (r *recordLogger) Info(msg string, args ...interface{})  { r.log("INFO", msg, args...) }
+func (r *recordLogger) Warn(msg string, args ...interface{})  { r.log("WARN", msg, args...) }
+func (r *recordLogger) Error(msg string, args ...interface{}) { r.log("ERROR", msg, args...) }
+
+func (r *recordLogger) logged(prefix string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, event := range r.events {
+		if strings.HasPrefix(event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerLogger(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	logger := &recordLogger{}
+
+	srv := &Server{
+		Handshaker: HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+			buf := make([]byte, 1)
+			if _, err := conn.Read(buf); err != nil {
+				return nil, err
+			}
+			if buf[0] != 1 {
+				return nil, errors.New("unexpected preamble")
+			}
+			return AsBufferedConn(conn), nil
+		}),
+		Logger: logger,
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// The lifecycle of connections is logged, alongside their remote address.
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte{1})
+	require.NoError(t, err)
+
+	established := fmt.Sprint("DEBUG", "connection established", "remote_addr", conn.LocalAddr().String())
+	require.Eventually(t, func() bool { return logger.logged(established) }, time.Second, time.Millisecond)
+
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool { return logger.logged("DEBUGconnection closed") }, time.Second, time.Millisecond)
+
+	// Handshake failures are logged as warnings.
+
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{2})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return logger.logged("WARNhandshake failed") }, time.Second, time.Millisecond)
+}
+
+func TestServerConns(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{Handler: EchoHandler{}}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	// Connections are listed in the order they were served.
+
+	for i := 0; i < 2; i++ {
+		client := &Client{Addr: ln.Addr().String(), MaxConns: 1}
+		defer client.Shutdown()
+
+		_, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+	}
+
+	conns := srv.Conns()
+	require.Len(t, conns, 2)
+	require.EqualValues(t, 1, conns[0].ID)
+	require.EqualValues(t, 2, conns[1].ID)
+
+	info, exists := srv.Conn(2)
+	require.True(t, exists)
+	require.Equal(t, conns[1].Conn, info.Conn)
+	require.Equal(t, ln.Addr().String(), info.LocalAddr.String())
+	require.NotNil(t, info.RemoteAddr)
+
+	// Connections may be kicked by their ID.
+
+	require.True(t, srv.CloseConn(1))
+	require.False(t, srv.CloseConn(3))
+
+	require.Eventually(t, func() bool { return len(srv.Conns()) == 1 }, time.Second, time.Millisecond)
+
+	_, exists = srv.Conn(1)
+	require.False(t, exists)
+	require.EqualValues(t, 2, srv.Conns()[0].ID)
+}
+
+func TestServerBroadcast(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{Handler: EchoHandler{}}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	received := make([]chan string, 3)
+	for i := range received {
+		ch := make(chan string, 2)
+		received[i] = ch
+
+		client := &Client{
+			Addr:     ln.Addr().String(),
+			MaxConns: 1,
+			Handler:  HandlerFunc(func(ctx *Context) error { ch <- string(ctx.Body()); return nil }),
+		}
+		defer client.Shutdown()
+
+		_, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+	}
+
+	// Every connection receives the broadcast, or only those picked by the filter.
+
+	require.NoError(t, srv.Broadcast([]byte("everyone")))
+	require.NoError(t, srv.BroadcastFunc([]byte("odd"), func(info ConnInfo) bool { return info.ID%2 == 1 }))
+
+	for i, ch := range received {
+		require.Equal(t, "everyone", <-ch)
+		if i%2 == 0 {
+			require.Equal(t, "odd", <-ch)
+		}
+	}
+
+	select {
+	case msg := <-received[1]:
+		t.Fatalf("unexpected broadcast %q", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServerSharedLimiter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	limiter := NewLimiter(1)
+
+	var active, peak int32
+
+	state := ConnStateHandlerFunc(func(conn *Conn, state ConnState) {
+		switch state {
+		case StateNew:
+			n := atomic.AddInt32(&active, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+		case StateClosed:
+			atomic.AddInt32(&active, -1)
+		}
+	})
+
+	var (
+		servers   []*Server
+		listeners []net.Listener
+		clients   []*Client
+	)
+
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv := &Server{ConnState: state, Limiter: limiter, MaxConnWaitTimeout: 50 * time.Millisecond}
+
+		go func() {
+			require.NoError(t, srv.Serve(ln))
+		}()
+
+		servers = append(servers, srv)
+		listeners = append(listeners, ln)
+		clients = append(clients, &Client{Addr: ln.Addr().String()})
+	}
+
+	defer func() {
+		for i := range servers {
+			servers[i].Shutdown()
+			clients[i].Shutdown()
+
+			require.NoError(t, listeners[i].Close())
+		}
+	}()
+
+	// The first server takes up the only slot of the shared limiter, such that the second server may not serve
+	// any connections despite having slots of its own available.
+
+	require.NoError(t, clients[0].Send([]byte("hello")))
+	require.Error(t, clients[1].Send([]byte("hello")))
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&peak))
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Temporary() bool { return true }
+
+func TestDefaultClassifyAcceptError(t *testing.T) {
+	closed := &net.OpError{Op: "accept", Net: "tcp", Err: net.ErrClosed}
+	transient := &net.OpError{Op: "accept", Net: "tcp", Err: temporaryError{}}
+	fatal := errors.New("fatal error")
+
+	require.Equal(t, AcceptStop, DefaultClassifyAcceptError(closed))
+	require.Equal(t, AcceptStop, DefaultClassifyAcceptError(io.EOF))
+	require.Equal(t, AcceptRetry, DefaultClassifyAcceptError(transient))
+	require.Equal(t, AcceptFatal, DefaultClassifyAcceptError(fatal))
+}
+
+// errListener is a net.Listener whose Accept returns errors from a channel.
+type errListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (ln *errListener) Accept() (net.Conn, error) { return nil, <-ln.errs }
+
+func TestServerClassifyAcceptError(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	transient := errors.New("transient error")
+	fatal := errors.New("fatal error")
+
+	var classified []error
+
+	srv := &Server{ClassifyAcceptError: func(err error) AcceptAction {
+		classified = append(classified, err)
+		switch err {
+		case transient:
+			return AcceptRetry
+		case fatal:
+			return AcceptFatal
+		}
+		return AcceptStop
+	}}
+	defer srv.Shutdown()
+
+	ln := &errListener{errs: make(chan error, 3)}
+
+	ln.errs <- transient
+	ln.errs <- transient
+	ln.errs <- fatal
+
+	require.Equal(t, fatal, srv.Serve(ln))
+	require.Equal(t, []error{transient, transient, fatal}, classified)
+
+	ln.errs <- net.ErrClosed
+
+	require.NoError(t, srv.Serve(ln))
+}
+
+func TestServerWaitTimeoutFunc(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	trusted := net.ParseIP("127.0.0.1")
+
+	srv := &Server{
+		MaxConns: 1,
+		WaitTimeoutFunc: func(conn net.Conn) time.Duration {
+			if addrIP(conn.RemoteAddr()).Equal(trusted) {
+				return 200 * time.Millisecond
+			}
+			return 0
+		},
+	}
+	client := &Client{Addr: ln.Addr().String()}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		client.Shutdown()
+
+		require.NoError(t, ln.Close())
+	}()
+
+	// The client takes up the only slot available.
+
+	require.NoError(t, client.Send([]byte("hello")))
+
+	// rejectedAfter dials the server from local address from, and returns how long it took for the server to
+	// close the connection.
+	rejectedAfter := func(from string) time.Duration {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(from)}}
+
+		conn, err := dialer.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+
+		return time.Since(start)
+	}
+
+	require.Less(t, int64(rejectedAfter("127.0.0.2")), int64(100*time.Millisecond))
+	require.GreaterOrEqual(t, int64(rejectedAfter("127.0.0.1")), int64(150*time.Millisecond))
+}
+
+func TestServerSetMaxConns(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{Handler: EchoHandler{}, MaxConns: 2, MaxConnWaitTimeout: 50 * time.Millisecond}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	var clients []*Client
+
+	newClient := func() *Client {
+		client := &Client{Addr: ln.Addr().String()}
+		clients = append(clients, client)
+		return client
+	}
+
+	defer func() {
+		srv.Shutdown()
+		for _, client := range clients {
+			client.Shutdown()
+		}
+		require.NoError(t, ln.Close())
+	}()
+
+	a, b := newClient(), newClient()
+
+	for _, client := range []*Client{a, b} {
+		_, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+	}
+
+	// Lowering the limit rejects new connections while existing connections continue to be served.
+
+	srv.SetMaxConns(1)
+
+	_, err = newClient().Request(nil, []byte("hello"))
+	require.Error(t, err)
+
+	for _, client := range []*Client{a, b} {
+		res, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+	}
+
+	// Raising the limit admits new connections.
+
+	srv.SetMaxConns(3)
+
+	res, err := newClient().Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+}
+
+func TestServerConfig(t *testing.T) {
+	s := &Server{
+		ReadBufferSize:    8192,
+		ReadTimeout:       -1,
+		HandshakeTimeout:  -1,
+		MaxConns:          16,
+		MaxMessageSize:    1024,
+		KeepAliveInterval: time.Second,
+		Nagle:             true,
+	}
+
+	cfg := s.Config()
+
+	// Explicit settings are reported as is.
+
+	require.Equal(t, 8192, cfg.ReadBufferSize)
+	require.Equal(t, 16, cfg.MaxConns)
+	require.Equal(t, 1024, cfg.MaxMessageSize)
+	require.Equal(t, time.Second, cfg.KeepAliveInterval)
+	require.True(t, cfg.Nagle)
+
+	// Settings left unset are reported with defaults applied.
+
+	require.Equal(t, DefaultReadTimeout, cfg.ReadTimeout)
+	require.Equal(t, DefaultWriteBufferSize, cfg.WriteBufferSize)
+	require.Equal(t, DefaultHandshakeTimeout, cfg.HandshakeTimeout)
+	require.Equal(t, DefaultMaxConnWaitTimeout, cfg.MaxConnWaitTimeout)
+	require.Equal(t, DefaultMaxFrameSize, cfg.MaxFrameSize)
+	require.Equal(t, DefaultMaxFlushRetries, cfg.MaxFlushRetries)
+	require.Equal(t, DefaultMaxMissedPongs, cfg.MaxMissedPongs)
+	require.Equal(t, DefaultServerSeqOffset, cfg.SeqOffset)
+	require.Equal(t, DefaultServerSeqDelta, cfg.SeqDelta)
+
+	// Changes made at runtime are reflected.
+
+	s.SetMaxConns(4)
+	require.Equal(t, 4, s.Config().MaxConns)
+}
@@ -0,0 +1,140 @@
+package monte
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var _ Handler = (*ServiceMux)(nil)
+
+// MethodFunc is the signature of the methods of a service registered with a ServiceMux. It is passed the body of
+// a request, and returns the body of its response, or an error for the request to be rejected with.
+type MethodFunc func(ctx *Context, req []byte) ([]byte, error)
+
+// ServiceMux is a Handler that dispatches every message to the method it names, such that services may be
+// implemented as plain Go types rather than as switch statements over opcodes. Messages name their method as
+// "Service.Method", prefixed to their payload via AppendMethod. Handlers are passed the message with the name of
+// its method stripped from its body.
+//
+// Methods that return an error have their request rejected via Context.Reject with the error, and otherwise
+// have the body they return sent as their response via Context.Reply. Requests that name no registered method,
+// or whose payload is too short to name a method, are rejected, while other such messages are dropped, as are
+// the results of methods called for messages that are not requests.
+//
+// A ServiceMux may be mounted under an opcode of a Mux. The zero value of a ServiceMux is ready for use, and
+// services may be registered while it is in use.
+type ServiceMux struct {
+	mu      sync.RWMutex
+	methods map[string]MethodFunc
+}
+
+// RegisterService registers the exported methods of impl that have the signature of a MethodFunc as the methods
+// of the service name, which defaults to the name of impl's type should it be empty. Methods of impl with any
+// other signature are ignored. It returns an error should the service already be registered, or impl have no
+// such methods.
+func (s *ServiceMux) RegisterService(name string, impl interface{}) error {
+	v := reflect.ValueOf(impl)
+	if name == "" {
+		name = reflect.Indirect(v).Type().Name()
+	}
+	if name == "" {
+		return fmt.Errorf("no service name given for unnamed type %s", v.Type())
+	}
+
+	methods := make(map[string]MethodFunc)
+
+	for i := 0; i < v.NumMethod(); i++ {
+		if v.Type().Method(i).PkgPath != "" {
+			continue
+		}
+		fn, ok := v.Method(i).Interface().(func(ctx *Context, req []byte) ([]byte, error))
+		if !ok {
+			continue
+		}
+		methods[name+"."+v.Type().Method(i).Name] = fn
+	}
+
+	if len(methods) == 0 {
+		return fmt.Errorf("service %q has no methods of type func(*monte.Context, []byte) ([]byte, error)", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for method := range s.methods {
+		if strings.HasPrefix(method, name+".") {
+			return fmt.Errorf("service %q already registered", name)
+		}
+	}
+
+	if s.methods == nil {
+		s.methods = make(map[string]MethodFunc)
+	}
+	for method, fn := range methods {
+		s.methods[method] = fn
+	}
+
+	return nil
+}
+
+// HandleMethod registers fn as the method named method, which should be of the form "Service.Method", replacing
+// any method already registered under it.
+func (s *ServiceMux) HandleMethod(method string, fn MethodFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.methods == nil {
+		s.methods = make(map[string]MethodFunc)
+	}
+	s.methods[method] = fn
+}
+
+func (s *ServiceMux) HandleMessage(ctx *Context) error {
+	method, body, err := decodeMethod(ctx.buf)
+	if err != nil {
+		return ignoreStale(ctx.Reject(err))
+	}
+
+	s.mu.RLock()
+	fn, exists := s.methods[method]
+	s.mu.RUnlock()
+
+	if !exists {
+		return ignoreStale(ctx.Reject(fmt.Errorf("unknown method %q", method)))
+	}
+
+	ctx.buf = body
+
+	res, err := fn(ctx, body)
+	if ctx.seq == 0 {
+		return nil
+	}
+	if err != nil {
+		return ignoreStale(ctx.Reject(err))
+	}
+	return ignoreStale(ctx.Reply(res))
+}
+
+// AppendMethod appends payload prefixed with the name of method, of the form "Service.Method", to dst, for it to
+// be dispatched by our peer's ServiceMux.
+func AppendMethod(dst []byte, method string, payload []byte) []byte {
+	dst = append(dst, byte(len(method)>>8), byte(len(method)))
+	dst = append(dst, method...)
+	return append(dst, payload...)
+}
+
+// decodeMethod splits buf into the name of the method it is prefixed with via AppendMethod, and its payload.
+func decodeMethod(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", nil, fmt.Errorf("no method to decode from %d byte(s)", len(buf))
+	}
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+	if len(buf) < 2+n {
+		return "", nil, errors.New("method name is truncated")
+	}
+	return string(buf[2 : 2+n]), buf[2+n:], nil
+}
@@ -0,0 +1,86 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"strings"
+	"testing"
+)
+
+type greeter struct{}
+
+func (greeter) Hello(ctx *Context, req []byte) ([]byte, error) {
+	return append([]byte("hello "), req...), nil
+}
+
+func (greeter) Fail(ctx *Context, req []byte) ([]byte, error) {
+	return nil, errors.New("failed on purpose")
+}
+
+// Methods without the signature of a MethodFunc, and unexported methods, are not registered.
+
+func (greeter) Ignored(req []byte) []byte                           { return req }
+func (greeter) unexported(ctx *Context, req []byte) ([]byte, error) { return req, nil }
+
+func TestServiceMux(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var services ServiceMux
+
+	require.NoError(t, services.RegisterService("", greeter{}))
+	require.Error(t, services.RegisterService("greeter", &greeter{}))
+	require.Error(t, services.RegisterService("empty", struct{}{}))
+
+	services.HandleMethod("upper.Upper", func(ctx *Context, req []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(req))), nil
+	})
+
+	// A ServiceMux may be mounted under an opcode of a Mux.
+
+	var mux Mux
+	mux.Handle(1, &services)
+
+	server := &Server{Handler: &mux}
+
+	go func() {
+		require.NoError(t, server.Serve(ln))
+	}()
+
+	defer func() {
+		server.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String()}
+	defer client.Shutdown()
+
+	call := func(method, req string) ([]byte, error) {
+		return client.Request(nil, AppendOp(nil, 1, AppendMethod(nil, method, []byte(req))))
+	}
+
+	res, err := call("greeter.Hello", "world")
+	require.NoError(t, err)
+	require.EqualValues(t, "hello world", res)
+
+	res, err = call("upper.Upper", "world")
+	require.NoError(t, err)
+	require.EqualValues(t, "WORLD", res)
+
+	_, err = call("greeter.Fail", "")
+	require.True(t, errors.Is(err, ErrRequestRejected))
+	require.Contains(t, err.Error(), "failed on purpose")
+
+	for _, method := range []string{"greeter.Ignored", "greeter.unexported", "greeter.Missing"} {
+		_, err = call(method, "")
+		require.True(t, errors.Is(err, ErrRequestRejected))
+		require.Contains(t, err.Error(), "unknown method")
+	}
+
+	_, err = client.Request(nil, AppendOp(nil, 1, []byte{0}))
+	require.True(t, errors.Is(err, ErrRequestRejected))
+}
@@ -32,6 +32,7 @@ type SessionConn struct {
 	br *bufio.Reader
 
 	rb []byte // read buffer
+	cb []byte // ciphertext buffer
 	wb []byte // write buffer
 	wn uint64 // write nonce
 	rn uint64 // read nonce
@@ -47,34 +48,43 @@ func NewSessionConn(suite cipher.AEAD, conn net.Conn) *SessionConn {
 	}
 }
 
+var _ MessageReader = (*SessionConn)(nil)
+
 func (s *SessionConn) Read(b []byte) (int, error) {
 	var err error
-	s.rb, err = ReadSized(s.rb[:0], s.br, cap(b))
+	s.rb, err = s.ReadMessage(s.rb[:0], cap(b))
 	if err != nil {
 		return 0, err
 	}
+	return copy(b, s.rb), err
+}
 
-	s.rb = bytesutil.ExtendSlice(s.rb, len(s.rb)+s.suite.NonceSize())
-	for i := len(s.rb) - s.suite.NonceSize(); i < len(s.rb); i++ {
-		s.rb[i] = 0
+// ReadMessage reads and decrypts the next message into dst, growing dst should the message not fit.
+func (s *SessionConn) ReadMessage(dst []byte, max int) ([]byte, error) {
+	var err error
+	s.cb, err = ReadSized(s.cb[:0], s.br, max+s.suite.Overhead())
+	if err != nil {
+		return nil, err
 	}
-	binary.BigEndian.PutUint64(s.rb[len(s.rb)-s.suite.NonceSize():], s.rn)
+
+	s.cb = bytesutil.ExtendSlice(s.cb, len(s.cb)+s.suite.NonceSize())
+	for i := len(s.cb) - s.suite.NonceSize(); i < len(s.cb); i++ {
+		s.cb[i] = 0
+	}
+	binary.BigEndian.PutUint64(s.cb[len(s.cb)-s.suite.NonceSize():], s.rn)
 	s.rn++
 
-	s.rb, err = s.suite.Open(
-		s.rb[:0],
-		s.rb[len(s.rb)-s.suite.NonceSize():],
-		s.rb[:len(s.rb)-s.suite.NonceSize()],
+	return s.suite.Open(
+		dst[:0],
+		s.cb[len(s.cb)-s.suite.NonceSize():],
+		s.cb[:len(s.cb)-s.suite.NonceSize()],
 		nil,
 	)
-	if err != nil {
-		return 0, err
-	}
-	return copy(b, s.rb), err
 }
 
 func (s *SessionConn) Write(b []byte) (int, error) {
-	s.wb = bytesutil.ExtendSlice(s.wb, s.suite.NonceSize()+len(b)+s.suite.Overhead())
+	// Reserve 4 extra bytes so that WriteSized may append the length prefix without reallocating.
+	s.wb = bytesutil.ExtendSlice(s.wb, s.suite.NonceSize()+len(b)+s.suite.Overhead()+4)
 	binary.BigEndian.PutUint64(s.wb[:8], s.wn)
 	for i := 8; i < s.suite.NonceSize(); i++ {
 		s.wb[i] = 0
@@ -94,3 +94,50 @@ func TestSession(t *testing.T) {
 	require.NoError(t, conn.Close())
 	require.NoError(t, bob.Close())
 }
+
+func TestSessionConnEmptyMessages(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+	defer func() {
+		require.NoError(t, alice.Close())
+		require.NoError(t, bob.Close())
+	}()
+
+	var a Session
+	var b Session
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		require.NoError(t, a.DoClient(alice))
+	}()
+
+	go func() {
+		defer wg.Done()
+		require.NoError(t, b.DoServer(bob))
+	}()
+
+	wg.Wait()
+
+	aliceConn := NewSessionConn(a.Suite(), alice)
+	bobConn := NewSessionConn(b.Suite(), bob)
+
+	messages := []string{"", "hello", "", "", "world", ""}
+
+	go func() {
+		for _, msg := range messages {
+			_, err := aliceConn.Write([]byte(msg))
+			require.NoError(t, err)
+		}
+		require.NoError(t, aliceConn.Flush())
+	}()
+
+	for _, msg := range messages {
+		buf, err := bobConn.ReadMessage(nil, 1024)
+		require.NoError(t, err)
+		require.EqualValues(t, msg, string(buf))
+	}
+}
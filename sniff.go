@@ -0,0 +1,194 @@
+package monte
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+var DefaultSniffTimeout = 10 * time.Second
+
+// httpPrefixes are the prefixes of the first bytes sent over HTTP/1.x and HTTP/2 connections.
+var httpPrefixes = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("CONNECT "),
+	[]byte("OPTIONS "),
+	[]byte("TRACE "),
+	[]byte("PATCH "),
+	[]byte("PRI * HTTP/2.0"),
+}
+
+// SniffMux shares a single listener between a Server and an http.Server by inspecting the first bytes of every
+// accepted connection. Connections that begin with an HTTP/1.x request line or the HTTP/2 connection preface are
+// routed to HTTPListener, and all others to MonteListener, such that health checks and RPC traffic may share a
+// port. To share a port that serves TLS, ln should be a listener returned by tls.NewListener, such that the bytes
+// inspected are those decrypted from the connection.
+//
+// As the clients of a Server send the first bytes of a connection, connections are only routed once their first
+// bytes arrive, and are closed should they not arrive within SniffTimeout. A monte client whose random handshake
+// happens to begin with an HTTP method followed by a space is misrouted, which is vanishingly unlikely.
+type SniffMux struct {
+	// SniffTimeout bounds how long to wait for the first bytes of a connection. It defaults to
+	// DefaultSniffTimeout.
+	SniffTimeout time.Duration
+
+	ln    net.Listener
+	monte *sniffListener
+	http  *sniffListener
+}
+
+// NewSniffMux returns a SniffMux that routes connections accepted from ln once Serve is called.
+func NewSniffMux(ln net.Listener) *SniffMux {
+	return &SniffMux{
+		ln:    ln,
+		monte: newSniffListener(ln.Addr()),
+		http:  newSniffListener(ln.Addr()),
+	}
+}
+
+// MonteListener returns the listener that accepts connections that are not HTTP, which should be served by a
+// Server.
+func (m *SniffMux) MonteListener() net.Listener { return m.monte }
+
+// HTTPListener returns the listener that accepts HTTP connections, which should be served by an http.Server.
+func (m *SniffMux) HTTPListener() net.Listener { return m.http }
+
+// Serve accepts connections from ln and routes them until ln is closed or fails, after which both MonteListener
+// and HTTPListener are closed and the error ln failed with is returned. Connections are inspected on a goroutine
+// of their own, such that slow clients do not hold up others from being accepted. Connections still being
+// inspected once both listeners are closed are closed.
+func (m *SniffMux) Serve() error {
+	defer func() {
+		m.monte.Close()
+		m.http.Close()
+	}()
+
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go m.route(conn)
+	}
+}
+
+// route inspects the first bytes of conn, and hands it to the listener it is routed to.
+func (m *SniffMux) route(conn net.Conn) {
+	err := conn.SetReadDeadline(time.Now().Add(m.getSniffTimeout()))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var (
+		buf    [16]byte
+		n      int
+		isHTTP bool
+	)
+
+	for {
+		read, err := conn.Read(buf[n:])
+		n += read
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		var undecided bool
+		isHTTP, undecided = sniffHTTP(buf[:n])
+		if !undecided {
+			break
+		}
+	}
+
+	err = conn.SetReadDeadline(zeroTime)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	sniffed := &sniffedConn{Conn: conn, prefix: append([]byte(nil), buf[:n]...)}
+	if isHTTP {
+		m.http.push(sniffed)
+	} else {
+		m.monte.push(sniffed)
+	}
+}
+
+func (m *SniffMux) getSniffTimeout() time.Duration {
+	if m.SniffTimeout <= 0 {
+		return DefaultSniffTimeout
+	}
+	return m.SniffTimeout
+}
+
+// sniffHTTP reports whether the first bytes of a connection belong to HTTP, and whether more bytes must be read
+// before it may be decided.
+func sniffHTTP(b []byte) (isHTTP, undecided bool) {
+	for _, prefix := range httpPrefixes {
+		if bytes.HasPrefix(b, prefix) {
+			return true, false
+		}
+		if bytes.HasPrefix(prefix, b) {
+			undecided = true
+		}
+	}
+	return false, undecided
+}
+
+// sniffedConn is a net.Conn whose first bytes were read while it was inspected, and are read back first.
+type sniffedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// sniffListener is a net.Listener that accepts the connections routed to it by a SniffMux.
+type sniffListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newSniffListener(addr net.Addr) *sniffListener {
+	return &sniffListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// push hands conn to the goroutine accepting from the listener, or closes conn should the listener be closed.
+func (l *sniffListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniffListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *sniffListener) Addr() net.Addr { return l.addr }
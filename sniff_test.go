@@ -0,0 +1,80 @@
+package monte
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		prefix            string
+		isHTTP, undecided bool
+	}{
+		{prefix: "GET / HTTP/1.1", isHTTP: true},
+		{prefix: "PO", undecided: true},
+		{prefix: "PRI * HTTP/2.0", isHTTP: true},
+		{prefix: "PROXY TCP4", isHTTP: false},
+		{prefix: "\x8f\x12", isHTTP: false},
+	}
+
+	for _, test := range tests {
+		isHTTP, undecided := sniffHTTP([]byte(test.prefix))
+		require.Equal(t, test.isHTTP, isHTTP, test.prefix)
+		require.Equal(t, test.undecided, undecided, test.prefix)
+	}
+}
+
+func TestSniffMux(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	mux := NewSniffMux(ln)
+
+	srv := &Server{Handler: EchoHandler{}}
+	httpSrv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})}
+
+	errs := make(chan error, 3)
+
+	go func() { errs <- mux.Serve() }()
+	go func() { errs <- srv.Serve(mux.MonteListener()) }()
+	go func() { errs <- httpSrv.Serve(mux.HTTPListener()) }()
+
+	// Both monte and HTTP traffic are served over the same port.
+
+	client := &Client{Addr: ln.Addr().String()}
+
+	res, err := client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "hello", res)
+
+	transport := &http.Transport{}
+
+	resp, err := (&http.Client{Transport: transport}).Get("http://" + ln.Addr().String() + "/health")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.EqualValues(t, "ok", body)
+
+	client.Shutdown()
+	transport.CloseIdleConnections()
+	srv.Shutdown()
+
+	// Closing the shared listener closes both of the listeners it was split into.
+
+	require.NoError(t, ln.Close())
+
+	for i := 0; i < 3; i++ {
+		err := <-errs
+		require.True(t, err == nil || errors.Is(err, net.ErrClosed), err)
+	}
+}
@@ -0,0 +1,98 @@
+package monte
+
+import "sync/atomic"
+
+// ConnStats is a snapshot of the traffic that has gone over a connection, and of the work it has yet to do.
+// Bytes are those of the frames written and read, excluding any overhead added by the BufferedConn the connection
+// is handled over, such as framing or encryption.
+type ConnStats struct {
+	BytesRead     uint64
+	BytesWritten  uint64
+	FramesRead    uint64
+	FramesWritten uint64
+
+	PendingWrites   int // number of frames queued for the write loop to pick up
+	PendingBytes    int // number of bytes queued for the write loop to pick up
+	PendingRequests int // number of requests awaiting a response
+}
+
+// add adds the counters of o to s.
+func (s *ConnStats) add(o ConnStats) {
+	s.BytesRead += o.BytesRead
+	s.BytesWritten += o.BytesWritten
+	s.FramesRead += o.FramesRead
+	s.FramesWritten += o.FramesWritten
+	s.PendingWrites += o.PendingWrites
+	s.PendingBytes += o.PendingBytes
+	s.PendingRequests += o.PendingRequests
+}
+
+// connCounters holds the traffic counters of a Conn, which are accessed atomically such that the read and write
+// loops do not contend over them.
+type connCounters struct {
+	bytesRead     uint64
+	bytesWritten  uint64
+	framesRead    uint64
+	framesWritten uint64
+}
+
+func (c *connCounters) read(n int) {
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	atomic.AddUint64(&c.framesRead, 1)
+}
+
+func (c *connCounters) wrote(n int) {
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	atomic.AddUint64(&c.framesWritten, 1)
+}
+
+// Stats returns a snapshot of the traffic that has gone over the connection, and of the work it has yet to do.
+func (c *Conn) Stats() ConnStats {
+	c.once.Do(c.init)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ConnStats{
+		BytesRead:       atomic.LoadUint64(&c.counters.bytesRead),
+		BytesWritten:    atomic.LoadUint64(&c.counters.bytesWritten),
+		FramesRead:      atomic.LoadUint64(&c.counters.framesRead),
+		FramesWritten:   atomic.LoadUint64(&c.counters.framesWritten),
+		PendingWrites:   len(c.writerQueue) + len(c.writerUrgent),
+		PendingBytes:    c.queuedBytes,
+		PendingRequests: len(c.reqs),
+	}
+}
+
+// ServerStats is a snapshot of the traffic that has gone over every connection a Server has served, and of the
+// connections it is serving.
+type ServerStats struct {
+	// ConnStats sums the traffic of every connection served, including those that have since been closed, and
+	// the work that the connections being served have yet to do.
+	ConnStats
+
+	ActiveConns       int
+	RejectedConns     uint64
+	HandshakeFailures uint64
+}
+
+// Stats returns a snapshot of the traffic that has gone over every connection the server has served, and of the
+// connections it is serving.
+func (s *Server) Stats() ServerStats {
+	s.once.Do(s.init)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := ServerStats{
+		ConnStats:         s.closedStats,
+		ActiveConns:       len(s.conns),
+		RejectedConns:     s.NumRejectedConns(),
+		HandshakeFailures: s.NumHandshakeFailures(),
+	}
+	for cc := range s.conns {
+		stats.add(cc.Stats())
+	}
+
+	return stats
+}
@@ -0,0 +1,84 @@
+package monte
+
+import (
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var c Conn
+	c.once.Do(c.init)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, c.SendNoWait([]byte("hello")))
+	}
+
+	stats := c.Stats()
+	require.Equal(t, 2, stats.PendingWrites)
+	require.Greater(t, stats.PendingBytes, 2*len("hello"))
+	require.Zero(t, stats.FramesWritten)
+
+	conn := &mockConn{}
+
+	writerDone := make(chan error)
+	go func() {
+		writerDone <- c.writeLoop(conn)
+	}()
+
+	c.closeWriter()
+	require.NoError(t, <-writerDone)
+
+	stats = c.Stats()
+	require.Zero(t, stats.PendingWrites)
+	require.Zero(t, stats.PendingBytes)
+	require.EqualValues(t, 2, stats.FramesWritten)
+	require.EqualValues(t, len(conn.written[0])+len(conn.written[1]), stats.BytesWritten)
+}
+
+func TestServerStats(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	srv := &Server{Handler: EchoHandler{}}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{Addr: ln.Addr().String(), MaxConns: 1, KeepAliveInterval: -1}
+
+	for i := 0; i < 3; i++ {
+		res, err := client.Request(nil, []byte("hello"))
+		require.NoError(t, err)
+		require.EqualValues(t, "hello", res)
+	}
+
+	stats := srv.Stats()
+	require.Equal(t, 1, stats.ActiveConns)
+	require.GreaterOrEqual(t, stats.FramesRead, uint64(3))
+	require.GreaterOrEqual(t, stats.FramesWritten, uint64(3))
+	require.GreaterOrEqual(t, stats.BytesRead, uint64(3*len("hello")))
+
+	// The traffic of connections that have since been closed is retained.
+
+	client.Shutdown()
+
+	require.Eventually(t, func() bool { return srv.Stats().ActiveConns == 0 }, 3*time.Second, 10*time.Millisecond)
+
+	closed := srv.Stats()
+	require.GreaterOrEqual(t, closed.FramesRead, stats.FramesRead)
+	require.GreaterOrEqual(t, closed.FramesWritten, stats.FramesWritten)
+	require.Zero(t, closed.PendingRequests)
+}
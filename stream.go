@@ -0,0 +1,553 @@
+package monte
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streamOpen, streamData, streamWindow, streamClose, and streamReset prefix the payloads of stream frames, which
+// respectively open a stream, carry data written to it, grant the receiver of the frame more window as a 32-bit
+// unsigned big-endian number of bytes, half-close the sender's end of it, and abort it.
+const (
+	streamOpen byte = 1 + iota
+	streamData
+	streamWindow
+	streamClose
+	streamReset
+)
+
+const (
+	// streamWindowSize is the number of bytes that may be written to a stream before the reader of the stream
+	// grants the writer more window by reading them.
+	streamWindowSize = 256 * 1024
+
+	// streamBacklog is the number of streams opened by our peer that may be pending acceptance via AcceptStream
+	// before further streams are refused.
+	streamBacklog = 64
+
+	// streamAcceptor is set on the stream IDs of frames sent by the end of a stream that did not open it, such
+	// that the streams opened by both ends never have their IDs collide.
+	streamAcceptor uint32 = 1 << 31
+)
+
+// streamSet tracks the streams opened over a connection.
+type streamSet struct {
+	mu       sync.Mutex
+	last     uint32             // ID of the last stream we opened
+	opened   map[uint32]*Stream // streams we opened
+	accepted map[uint32]*Stream // streams our peer opened
+	backlog  chan *Stream       // streams our peer opened that are pending acceptance
+}
+
+func (c *Conn) getStreams() *streamSet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.streams == nil {
+		c.streams = &streamSet{
+			opened:   make(map[uint32]*Stream),
+			accepted: make(map[uint32]*Stream),
+			backlog:  make(chan *Stream, streamBacklog),
+		}
+	}
+	return c.streams
+}
+
+func (set *streamSet) remove(s *Stream) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if s.opened {
+		delete(set.opened, s.id)
+	} else {
+		delete(set.accepted, s.id)
+	}
+}
+
+// OpenStream opens a logical stream over the connection, which our peer accepts via AcceptStream. Streams carry
+// ordered bytes independently of one another and of the messages sent over the connection: each stream has its
+// own flow-control window, such that a stream whose reader falls behind only holds back writes to that stream,
+// and the writes of different streams are interleaved rather than written one after the other.
+func (c *Conn) OpenStream() (*Stream, error) {
+	c.once.Do(c.init)
+	if err := c.checkClosing(); err != nil {
+		return nil, err
+	}
+
+	set := c.getStreams()
+
+	set.mu.Lock()
+	if set.last == streamAcceptor-1 {
+		set.mu.Unlock()
+		return nil, errors.New("stream ids exhausted")
+	}
+	set.last++
+	s := newStream(c, set.last, true)
+	set.opened[s.id] = s
+	set.mu.Unlock()
+
+	if err := s.send(streamOpen, nil); err != nil {
+		set.remove(s)
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by our peer via OpenStream. Streams our peer opens
+// while 64 others are pending acceptance are refused, such that writes to them fail with ErrStreamReset.
+func (c *Conn) AcceptStream(ctx context.Context) (*Stream, error) {
+	c.once.Do(c.init)
+
+	select {
+	case s := <-c.getStreams().backlog:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, ErrConnClosed
+	}
+}
+
+// handleStreamFrame handles a stream frame read from our peer. Frames belonging to streams that were already
+// closed or refused are dropped.
+func (c *Conn) handleStreamFrame(wire uint32, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("stream frame for stream %d carries no kind", wire)
+	}
+	kind, data := data[0], data[1:]
+
+	set := c.getStreams()
+
+	// Frames sent by the acceptor of a stream belong to a stream we opened.
+
+	id, opened := wire&^streamAcceptor, wire&streamAcceptor != 0
+
+	if kind == streamOpen {
+		if opened {
+			return fmt.Errorf("peer opened stream %d as its acceptor", id)
+		}
+		return c.acceptStream(id)
+	}
+
+	set.mu.Lock()
+	s := set.accepted[id]
+	if opened {
+		s = set.opened[id]
+	}
+	set.mu.Unlock()
+
+	if s == nil {
+		return nil
+	}
+	return s.receive(kind, data)
+}
+
+func (c *Conn) acceptStream(id uint32) error {
+	set := c.getStreams()
+	s := newStream(c, id, false)
+
+	set.mu.Lock()
+	if _, exists := set.accepted[id]; exists {
+		set.mu.Unlock()
+		return fmt.Errorf("peer opened stream %d twice", id)
+	}
+	select {
+	case set.backlog <- s:
+		set.accepted[id] = s
+		set.mu.Unlock()
+		return nil
+	default:
+	}
+	set.mu.Unlock()
+
+	if err := s.send(streamReset, nil); err != nil {
+		c.suppress("failed to refuse stream", err, "stream", id)
+	}
+	return nil
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+// Stream is a logical stream opened over a Conn via OpenStream or AcceptStream. It implements net.Conn, such that
+// it may be used wherever a net.Conn is expected. Deadlines bound how long reads wait for data to arrive, and
+// how long writes wait for our peer to grant window and for their data to be written to the connection.
+type Stream struct {
+	conn   *Conn
+	id     uint32
+	opened bool // whether we opened the stream, rather than our peer
+
+	writeMu sync.Mutex // serializes writes, such that the data they write is not interleaved
+
+	mu            sync.Mutex
+	changed       chan struct{} // closed and replaced whenever the state of the stream changes
+	buf           []byte        // data read from our peer that is yet to be read from the stream
+	consumed      int           // number of bytes read from the stream since our peer was last granted window
+	window        int           // number of bytes we may write before our peer grants us more window
+	readClosed    bool          // set once our peer half-closes its end of the stream
+	writeClosed   bool          // set once we half-close our end of the stream
+	closed        bool          // set once Close is called
+	err           error         // set should the stream be reset
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(conn *Conn, id uint32, opened bool) *Stream {
+	return &Stream{
+		conn:    conn,
+		id:      id,
+		opened:  opened,
+		changed: make(chan struct{}),
+		window:  streamWindowSize,
+	}
+}
+
+// ID returns the ID of the stream, which is unique among the streams opened by the same end of a connection.
+func (s *Stream) ID() uint32 { return s.id }
+
+// Conn returns the connection the stream was opened over.
+func (s *Stream) Conn() *Conn { return s.conn }
+
+// wireID returns the stream ID carried by the frames we send over the stream.
+func (s *Stream) wireID() uint32 {
+	if s.opened {
+		return s.id
+	}
+	return s.id | streamAcceptor
+}
+
+// Read reads data our peer wrote to the stream. It returns io.EOF once our peer closed its end of the stream and
+// all data it wrote was read.
+func (s *Stream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.buf) == 0 {
+		switch {
+		case s.closed:
+			return 0, net.ErrClosed
+		case s.err != nil:
+			return 0, s.err
+		case s.readClosed:
+			return 0, io.EOF
+		}
+		if err := s.wait(s.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+
+	// Window is granted back in bulk rather than after every read, such that small reads do not each cost a
+	// frame.
+
+	s.consumed += n
+	if s.consumed >= streamWindowSize/2 && !s.readClosed && s.err == nil {
+		s.grant(s.consumed)
+		s.consumed = 0
+	}
+
+	return n, nil
+}
+
+// Write writes b to the stream, waiting for our peer to grant window should it have fallen behind in reading
+// from the stream. The data is written in chunks that each fit within the connection's WriteBufferSize.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	chunk := s.conn.getWriteBufferSize() - frameHeader{}.size() - 1
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	n := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > chunk {
+			size = chunk
+		}
+
+		size, deadline, err := s.reserve(size)
+		if err != nil {
+			return n, err
+		}
+
+		err = s.sendData(b[:size], deadline)
+		if err != nil {
+			return n, err
+		}
+
+		n += size
+		b = b[size:]
+	}
+
+	return n, nil
+}
+
+// reserve waits for window to write up to max bytes, and returns the number of bytes reserved along with the
+// write deadline.
+func (s *Stream) reserve(max int) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.window == 0 {
+		if err := s.checkWritable(); err != nil {
+			return 0, time.Time{}, err
+		}
+		if err := s.wait(s.writeDeadline); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	if err := s.checkWritable(); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if max > s.window {
+		max = s.window
+	}
+	s.window -= max
+
+	return max, s.writeDeadline, nil
+}
+
+func (s *Stream) checkWritable() error {
+	switch {
+	case s.closed || s.writeClosed:
+		return net.ErrClosed
+	case s.err != nil:
+		return s.err
+	}
+	return nil
+}
+
+// sendData writes data to the stream, waiting until it has been written or deadline passes, in which case the
+// window reserved for data is freed should it not have been written.
+func (s *Stream) sendData(data []byte, deadline time.Time) error {
+	h := frameHeader{seq: s.wireID(), flags: flagMore | flagLast}
+
+	buf := acquireBuffer(h.size() + 1 + len(data))
+	defer releaseBuffer(buf)
+
+	dst := h.encode(buf.B)
+	dst[0] = streamData
+	copy(dst[1:], data)
+
+	if deadline.IsZero() {
+		return s.conn.write(buf, PriorityNormal, h.seq)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	err := s.conn.writeContext(ctx, buf, PriorityNormal, h.seq)
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.mu.Lock()
+		s.window += len(data)
+		s.broadcast()
+		s.mu.Unlock()
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// send queues a frame of the given kind carrying payload to be sent over the stream without waiting for it to
+// be written.
+func (s *Stream) send(kind byte, payload []byte) error {
+	h := frameHeader{seq: s.wireID(), flags: flagMore | flagLast}
+
+	buf := acquireBuffer(h.size() + 1 + len(payload))
+
+	dst := h.encode(buf.B)
+	dst[0] = kind
+	copy(dst[1:], payload)
+
+	return s.conn.writeNoWait(buf, PriorityNormal, h.seq)
+}
+
+// grant grants our peer n more bytes of window.
+func (s *Stream) grant(n int) {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(n))
+
+	if err := s.send(streamWindow, payload[:]); err != nil {
+		s.conn.suppress("failed to grant stream window", err, "stream", s.id)
+	}
+}
+
+// receive handles a frame of the given kind our peer sent over the stream.
+func (s *Stream) receive(kind byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch kind {
+	case streamData:
+		// Data our peer wrote before learning that we closed the stream is dropped, and its window granted back
+		// such that our peer does not wait on it.
+
+		if s.closed {
+			s.grant(len(data))
+			return nil
+		}
+		if s.readClosed {
+			return nil
+		}
+		if len(s.buf)+s.consumed+len(data) > streamWindowSize {
+			return fmt.Errorf("peer exceeded the window of stream %d of %d bytes", s.id, streamWindowSize)
+		}
+		s.buf = append(s.buf, data...)
+	case streamWindow:
+		if len(data) < 4 {
+			return fmt.Errorf("no stream window to decode from %d byte(s)", len(data))
+		}
+		s.window += int(binary.BigEndian.Uint32(data))
+	case streamClose:
+		s.readClosed = true
+		if s.writeClosed {
+			s.conn.streams.remove(s)
+		}
+	case streamReset:
+		s.err = ErrStreamReset
+		s.conn.streams.remove(s)
+	default:
+		return fmt.Errorf("unexpected stream frame kind %d", kind)
+	}
+
+	s.broadcast()
+	return nil
+}
+
+// CloseWrite half-closes our end of the stream, such that our peer reads io.EOF once it has read all data
+// written to the stream, while we may still read what our peer writes to it.
+func (s *Stream) CloseWrite() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	s.writeClosed = true
+	s.broadcast()
+
+	if s.readClosed {
+		s.conn.streams.remove(s)
+	}
+	return s.send(streamClose, nil)
+}
+
+// Close closes the stream. Our end of the stream is half-closed should it not already be, and data our peer
+// writes to the stream afterwards is dropped.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return net.ErrClosed
+	}
+	s.closed = true
+	s.broadcast()
+
+	// Data that was never read is dropped, and its window granted back.
+
+	if !s.readClosed && s.err == nil && len(s.buf)+s.consumed > 0 {
+		s.grant(len(s.buf) + s.consumed)
+	}
+	s.buf, s.consumed = nil, 0
+
+	if s.readClosed || s.err != nil {
+		s.conn.streams.remove(s)
+	}
+	if s.writeClosed || s.err != nil {
+		return nil
+	}
+	s.writeClosed = true
+	return s.send(streamClose, nil)
+}
+
+// LocalAddr returns the ID of the stream as a net.Addr.
+func (s *Stream) LocalAddr() net.Addr { return streamAddr(s.id) }
+
+// RemoteAddr returns the ID of the stream as a net.Addr.
+func (s *Stream) RemoteAddr() net.Addr { return streamAddr(s.id) }
+
+// SetDeadline sets both the read and write deadlines of the stream.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readDeadline, s.writeDeadline = t, t
+	s.broadcast()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for reads from the stream.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readDeadline = t
+	s.broadcast()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes to the stream.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeDeadline = t
+	s.broadcast()
+	return nil
+}
+
+// broadcast wakes up all reads and writes waiting on the stream. It must be called with s.mu held.
+func (s *Stream) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until the state of the stream changes, deadline passes, or the connection is closed. It must be
+// called with s.mu held, which is released while waiting.
+func (s *Stream) wait(deadline time.Time) error {
+	changed := s.changed
+
+	s.mu.Unlock()
+	defer s.mu.Lock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.conn.ctx.Done():
+		return ErrConnClosed
+	}
+}
+
+// streamAddr is the address of a Stream, which is its ID.
+type streamAddr uint32
+
+func (a streamAddr) Network() string { return "monte" }
+func (a streamAddr) String() string  { return strconv.FormatUint(uint64(a), 10) }
@@ -0,0 +1,140 @@
+package monte
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	a := &Conn{}
+	b := &Conn{}
+
+	closer := pipeConns(t, a, b)
+
+	// b echoes back everything written to the streams a opens.
+
+	var wg sync.WaitGroup
+
+	defer func() {
+		closer()
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			s, err := b.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := io.Copy(s, s)
+				require.NoError(t, err)
+				require.NoError(t, s.Close())
+			}()
+		}
+	}()
+
+	// Several streams exchange more than their window at once, which the echo may only keep up with should
+	// window be granted back as data is read.
+
+	var streams sync.WaitGroup
+	streams.Add(4)
+
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer streams.Done()
+
+			s, err := a.OpenStream()
+			require.NoError(t, err)
+
+			expected := make([]byte, 4*streamWindowSize+123)
+			_, err = rand.Read(expected)
+			require.NoError(t, err)
+
+			go func() {
+				_, err := s.Write(expected)
+				require.NoError(t, err)
+				require.NoError(t, s.CloseWrite())
+			}()
+
+			actual, err := ioutil.ReadAll(s)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(expected, actual))
+			require.NoError(t, s.Close())
+		}()
+	}
+
+	streams.Wait()
+
+	require.Eventually(t, func() bool {
+		a.streams.mu.Lock()
+		defer a.streams.mu.Unlock()
+		return len(a.streams.opened) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestStreamDeadline(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	a := &Conn{}
+	b := &Conn{}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	s, err := a.OpenStream()
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = s.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// Writes wait for our peer to grant window until the deadline passes, as our peer never reads.
+
+	require.NoError(t, s.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	n, err := s.Write(make([]byte, streamWindowSize+1))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.Equal(t, streamWindowSize, n)
+}
+
+func TestStreamRefused(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	a := &Conn{}
+	b := &Conn{}
+
+	closer := pipeConns(t, a, b)
+	defer closer()
+
+	// Streams opened while the backlog of streams pending acceptance is full are reset.
+
+	var s *Stream
+	for i := 0; i <= streamBacklog; i++ {
+		var err error
+		s, err = a.OpenStream()
+		require.NoError(t, err)
+	}
+
+	_, err := s.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, ErrStreamReset))
+
+	accepted, err := b.AcceptStream(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, accepted.ID())
+}
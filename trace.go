@@ -0,0 +1,19 @@
+package monte
+
+import "context"
+
+// Tracer instruments requests with distributed tracing, such as via OpenTelemetry. The trace context returned by
+// StartRequest is carried alongside the request to our peer, which passes it to Extract such that the spans of
+// the request's handler are linked to those of its sender.
+type Tracer interface {
+	// StartRequest is called with the context of every request sent over conn before it is sent. It returns the
+	// trace context to carry alongside the request, which may be no larger than 65535 bytes, such as the encoded
+	// span context of a span it started, and a function that is called with the request's outcome once it
+	// completes, such as to end the span. Should it return nil trace context, the request carries none.
+	StartRequest(ctx context.Context, conn *Conn, payload []byte) (trace []byte, end func(err error))
+
+	// Extract is called with the context passed to the handler of every request received over conn that carries
+	// trace context, and returns the context to pass to the handler in its place, such as one carrying the span
+	// context decoded from trace. Trace is only valid until Extract returns.
+	Extract(ctx context.Context, conn *Conn, trace []byte) context.Context
+}
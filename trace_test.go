@@ -0,0 +1,83 @@
+package monte
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type traceKey struct{}
+
+// testTracer propagates the trace ID stored in a context under traceKey, and records the outcome of every
+// request it instruments.
+type testTracer struct {
+	mu    sync.Mutex
+	ended []error
+}
+
+func (t *testTracer) StartRequest(ctx context.Context, conn *Conn, payload []byte) ([]byte, func(err error)) {
+	id, _ := ctx.Value(traceKey{}).(string)
+	if id == "" {
+		return nil, func(err error) {}
+	}
+	return []byte(id), func(err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.ended = append(t.ended, err)
+	}
+}
+
+func (t *testTracer) Extract(ctx context.Context, conn *Conn, trace []byte) context.Context {
+	return context.WithValue(ctx, traceKey{}, string(trace))
+}
+
+func TestTracer(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	// Handlers reply with the trace ID their context carries, along with the request they were sent.
+
+	handler := HandlerFunc(func(ctx *Context) error {
+		id, _ := ctx.Value(traceKey{}).(string)
+		return ctx.Reply(append([]byte(id+":"), ctx.Body()...))
+	})
+
+	srv := &Server{Handler: handler, Tracer: &testTracer{}}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	tracer := &testTracer{}
+
+	client := &Client{Addr: ln.Addr().String(), Tracer: tracer}
+	defer client.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), traceKey{}, "abc"), time.Second)
+	defer cancel()
+
+	res, err := client.RequestContext(ctx, nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, "abc:hello", res)
+
+	tracer.mu.Lock()
+	require.Equal(t, []error{nil}, tracer.ended)
+	tracer.mu.Unlock()
+
+	// Requests whose context carries no trace ID carry no trace context.
+
+	res, err = client.Request(nil, []byte("hello"))
+	require.NoError(t, err)
+	require.EqualValues(t, ":hello", res)
+}
@@ -0,0 +1,220 @@
+package monte
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxTunnelResponseSize is the maximum size of the response an HTTP proxy may reply to a CONNECT request with.
+const maxTunnelResponseSize = 8192
+
+// dialTunnel dials the proxy at proxyURL via dialer, and establishes a tunnel through it to the TCP address addr.
+// Proxies with a socks5:// or socks5h:// URL are spoken to via SOCKS5, and those with an http:// URL via HTTP
+// CONNECT. Credentials held by proxyURL are used to authenticate with the proxy. Establishing the tunnel must
+// complete before the deadline of ctx should it have one.
+func dialTunnel(ctx context.Context, dialer Dialer, proxyURL, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxy url: %w", err)
+	}
+
+	var tunnel func(conn net.Conn, u *url.URL, addr string) error
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		tunnel = socks5Tunnel
+	case "http":
+		tunnel = httpTunnel
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		err = conn.SetDeadline(deadline)
+	}
+	if err == nil {
+		err = tunnel(conn, u, addr)
+	}
+	if err == nil && ok {
+		err = conn.SetDeadline(zeroTime)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// socks5Tunnel establishes a tunnel to addr through the SOCKS5 proxy conn is connected to as described by RFC
+// 1928, authenticating with the username and password held by u should it hold any as described by RFC 1929.
+// Hostnames are resolved by the proxy.
+func socks5Tunnel(conn net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	method := byte(0x00) // no authentication required
+	if u.User != nil {
+		method = 0x02 // username/password
+	}
+
+	_, err = conn.Write([]byte{0x05, 1, method})
+	if err != nil {
+		return err
+	}
+
+	var buf [4]byte
+
+	_, err = io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return err
+	}
+	if buf[0] != 0x05 {
+		return fmt.Errorf("%w: unexpected socks version %d", ErrProxyRefused, buf[0])
+	}
+	if buf[1] != method {
+		return fmt.Errorf("%w: no acceptable socks authentication method", ErrProxyRefused)
+	}
+
+	if method == 0x02 {
+		username := u.User.Username()
+		password, _ := u.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks username and password must be at most 255 bytes")
+		}
+
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+
+		_, err = conn.Write(req)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadFull(conn, buf[:2])
+		if err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return fmt.Errorf("%w: socks authentication failed", ErrProxyRefused)
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00} // CONNECT
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("socks hostname %q must be at most 255 bytes", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(conn, buf[:4])
+	if err != nil {
+		return err
+	}
+	if buf[1] != 0x00 {
+		return fmt.Errorf("%w: socks connect failed with reply code %d", ErrProxyRefused, buf[1])
+	}
+
+	// Skip the address the proxy bound to reach addr, which follows its reply.
+
+	var size int
+
+	switch buf[3] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x04:
+		size = net.IPv6len
+	case 0x03:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err != nil {
+			return err
+		}
+		size = int(buf[0])
+	default:
+		return fmt.Errorf("%w: unexpected socks address type %d", ErrProxyRefused, buf[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+// httpTunnel establishes a tunnel to addr through the HTTP proxy conn is connected to via a CONNECT request,
+// authenticating with the username and password held by u should it hold any via basic authentication. The
+// response is read a byte at a time, such that nothing our peer sends through the tunnel is read.
+func httpTunnel(conn net.Conn, u *url.URL, addr string) error {
+	var req bytes.Buffer
+
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		fmt.Fprintf(&req, "Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	req.WriteString("\r\n")
+
+	_, err := conn.Write(req.Bytes())
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, maxTunnelResponseSize)
+
+	for !bytes.HasSuffix(buf, []byte("\r\n\r\n")) {
+		if len(buf) == cap(buf) {
+			return fmt.Errorf("%w: response exceeds %d bytes", ErrProxyRefused, cap(buf))
+		}
+		_, err = io.ReadFull(conn, buf[len(buf):len(buf)+1])
+		if err != nil {
+			return err
+		}
+		buf = buf[:len(buf)+1]
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrProxyRefused, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrProxyRefused, res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package monte
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// serveSOCKS5 is a SOCKS5 proxy that only accepts the username user and the password pass, and only supports
+// tunneling to IPv4 addresses.
+func serveSOCKS5(conn net.Conn) (net.Conn, error) {
+	buf := make([]byte, 256)
+
+	_, err := io.ReadFull(conn, buf[:3])
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte{0x05, 0x02})
+	if err != nil {
+		return nil, err
+	}
+
+	readString := func(n int) (string, error) {
+		_, err := io.ReadFull(conn, buf[:n])
+		return string(buf[:n]), err
+	}
+
+	_, err = io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return nil, err
+	}
+	username, err := readString(int(buf[1]))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return nil, err
+	}
+	password, err := readString(int(buf[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "user" || password != "pass" {
+		_, err = conn.Write([]byte{0x01, 0x01})
+		return nil, errors.New("bad credentials")
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(conn, buf[:10])
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(buf[8])<<8 | int(buf[9])}
+
+	upstream, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// serveHTTPConnect is an HTTP proxy that only accepts the username user and the password pass.
+func serveHTTPConnect(conn net.Conn) (net.Conn, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method != http.MethodConnect ||
+		req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+		_, err = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return nil, errors.New("bad credentials")
+	}
+
+	upstream, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	return upstream, nil
+}
+
+func TestClientProxy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{Handler: EchoHandler{}}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	tests := []struct {
+		scheme string
+		serve  func(conn net.Conn) (net.Conn, error)
+	}{
+		{scheme: "socks5", serve: serveSOCKS5},
+		{scheme: "http", serve: serveHTTPConnect},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scheme, func(t *testing.T) {
+			proxy, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			var wg sync.WaitGroup
+
+			defer func() {
+				require.NoError(t, proxy.Close())
+				wg.Wait()
+			}()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					conn, err := proxy.Accept()
+					if err != nil {
+						return
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						defer conn.Close()
+
+						upstream, err := test.serve(conn)
+						if err != nil {
+							return
+						}
+						defer upstream.Close()
+
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							_, _ = io.Copy(upstream, conn)
+							upstream.Close()
+						}()
+						_, _ = io.Copy(conn, upstream)
+					}()
+				}
+			}()
+
+			client := &Client{
+				Addr:            ln.Addr().String(),
+				Proxy:           test.scheme + "://user:pass@" + proxy.Addr().String(),
+				NumDialAttempts: 1,
+			}
+			defer client.Shutdown()
+
+			res, err := client.Request(nil, []byte("hello"))
+			require.NoError(t, err)
+			require.EqualValues(t, "hello", res)
+
+			// Proxies that refuse to authenticate us refuse to establish a tunnel.
+
+			refused := &Client{
+				Addr:            ln.Addr().String(),
+				Proxy:           test.scheme + "://user:wrong@" + proxy.Addr().String(),
+				NumDialAttempts: 1,
+			}
+			defer refused.Shutdown()
+
+			_, err = refused.Request(nil, []byte("hello"))
+			require.True(t, errors.Is(err, ErrProxyRefused))
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package monte
+
+import "context"
+
+// Context returns the connection's context, which is cancelled once the connection is closed and which carries
+// the values set via SetValue. The contexts of messages handled on the connection are derived from it.
+func (c *Conn) Context() context.Context {
+	c.once.Do(c.init)
+	return c.ctx
+}
+
+// SetValue associates value with key for the lifetime of the connection, such that it may be looked up by
+// handlers via Context.Value. This allows for middleware or OnConnect to stash per-connection state, such as the
+// identity of an authenticated peer, for inner handlers to read. Keys should follow the same conventions as keys
+// passed to context.WithValue.
+func (c *Conn) SetValue(key, value interface{}) {
+	c.once.Do(c.init)
+	c.values.Store(key, value)
+}
+
+// Value returns the value associated with key via SetValue, or nil should there be none.
+func (c *Conn) Value(key interface{}) interface{} {
+	c.once.Do(c.init)
+	return c.ctx.Value(key)
+}
+
+// connContext is the context of a Conn. Values set on the Conn take precedence over those of the embedded
+// context.
+type connContext struct {
+	context.Context
+	conn *Conn
+}
+
+func (c *connContext) Value(key interface{}) interface{} {
+	if v, ok := c.conn.values.Load(key); ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
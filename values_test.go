@@ -0,0 +1,58 @@
+package monte
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"testing"
+)
+
+type userKey struct{}
+
+// authenticate is a middleware that associates the connection with the user named by an "auth:" message.
+func authenticate(next Handler) Handler {
+	return HandlerFunc(func(ctx *Context) error {
+		if name := bytes.TrimPrefix(ctx.Body(), []byte("auth:")); len(name) < len(ctx.Body()) {
+			ctx.Conn().SetValue(userKey{}, string(name))
+			return nil
+		}
+		return next.HandleMessage(ctx)
+	})
+}
+
+func TestConnValues(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	whoami := HandlerFunc(func(ctx *Context) error {
+		user, ok := ctx.Value(userKey{}).(string)
+		if !ok {
+			user = "anonymous"
+		}
+		return ctx.Reply([]byte(user))
+	})
+
+	a := &Conn{}
+	b := &Conn{Handler: authenticate(whoami)}
+
+	closer := pipeConns(t, a, b)
+
+	res, err := a.Request(nil, []byte("whoami"))
+	require.NoError(t, err)
+	require.EqualValues(t, "anonymous", res)
+
+	require.NoError(t, a.Send([]byte("auth:alice")))
+
+	res, err = a.Request(nil, []byte("whoami"))
+	require.NoError(t, err)
+	require.EqualValues(t, "alice", res)
+
+	require.Equal(t, "alice", b.Value(userKey{}))
+	require.Equal(t, "alice", b.Context().Value(userKey{}))
+	require.Nil(t, a.Value(userKey{}))
+
+	closer()
+
+	// The connection's context is cancelled once the connection is closed.
+
+	<-b.Context().Done()
+}
@@ -0,0 +1,435 @@
+package monte
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ProtocolVersion is the version of the wire protocol spoken by this package, which is offered by version
+// handshakers unless configured otherwise.
+const ProtocolVersion uint16 = 1
+
+// versionMagic prefixes every message exchanged by a version handshake, such that peers that do not perform one
+// are detected rather than misread.
+var versionMagic = []byte("MNTE")
+
+// maxVersionMessageSize is the maximum size of a message exchanged by a version handshake.
+const maxVersionMessageSize = 4096
+
+const (
+	versionAccepted byte = 0
+	versionRejected byte = 1
+)
+
+// Capabilities are what our end of a connection supports, which are exchanged with our peer by a version
+// handshake. See NewVersionClientHandshaker.
+type Capabilities struct {
+	// MinVersion and MaxVersion bound the protocol versions we speak. They default to ProtocolVersion. The
+	// highest version spoken by both ends is picked.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// Compressors are the compression algorithms we support. The server picks the first of its compressors that
+	// the client also supports, and the connection is compressed with it. Should there be none, messages are
+	// left uncompressed.
+	Compressors []Compressor
+
+	// MaxFrameSize is the maximum size of a frame that we read, which should match the MaxFrameSize of our Conn.
+	// It defaults to DefaultMaxFrameSize, and may be no smaller than MinFrameSize. The smaller of the sizes of
+	// both ends is picked, and the Conn handling the connection lowers its MaxFrameSize to it, such that larger
+	// messages are fragmented. Peers that advertise a size smaller than MinFrameSize are rejected.
+	MaxFrameSize int
+
+	// Extensions are the names of the optional protocol extensions we support, each of which must be at most 255
+	// bytes. Only the extensions supported by both ends are enabled.
+	Extensions []string
+
+	// Codecs are the codecs we support for values sent via Call and HandleCall. The server picks the first of its
+	// codecs that the client also supports, and the Conn handling the connection uses it in place of its Codec.
+	// Should there be none, the Codec of the Conn is used.
+	Codecs []NamedCodec
+}
+
+// validate checks that caps may be encoded into a version handshake.
+func (c Capabilities) validate() error {
+	if c.getMinVersion() > c.getMaxVersion() {
+		return fmt.Errorf("min version %d exceeds max version %d", c.getMinVersion(), c.getMaxVersion())
+	}
+	if c.getMaxFrameSize() < MinFrameSize {
+		return fmt.Errorf("max frame size %d is smaller than the minimum of %d", c.getMaxFrameSize(), MinFrameSize)
+	}
+	for _, names := range [][]string{compressorNames(c.Compressors), c.Extensions, codecNames(c.Codecs)} {
+		if len(names) > 255 {
+			return errors.New("at most 255 compressors, extensions, and codecs may be offered")
+		}
+		for _, name := range names {
+			if len(name) == 0 || len(name) > 255 {
+				return fmt.Errorf("compressor, extension, or codec name %q must be 1 to 255 bytes", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c Capabilities) getMinVersion() uint16 {
+	if c.MinVersion == 0 {
+		return ProtocolVersion
+	}
+	return c.MinVersion
+}
+
+func (c Capabilities) getMaxVersion() uint16 {
+	if c.MaxVersion == 0 {
+		return ProtocolVersion
+	}
+	return c.MaxVersion
+}
+
+func (c Capabilities) getMaxFrameSize() int {
+	if c.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return c.MaxFrameSize
+}
+
+// Negotiated is the outcome of a version handshake. See Conn.Negotiated.
+type Negotiated struct {
+	Version      uint16
+	Compressor   string // empty should messages be left uncompressed
+	MaxFrameSize int
+	Extensions   []string
+	Codec        string // empty should the Codec of the Conn be used
+
+	codec Codec // the codec named Codec
+}
+
+// HasExtension reports whether the extension named name was enabled.
+func (n Negotiated) HasExtension(name string) bool {
+	for _, ext := range n.Extensions {
+		if ext == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewVersionClientHandshaker returns a Handshaker that exchanges caps with a server handshaker returned by
+// NewVersionServerHandshaker, such that peers running different versions of monte agree on the protocol
+// version, compression, maximum frame size, extensions, and codec of the connection before it is handled. Should the
+// server speak none of the protocol versions we speak, or not perform a version handshake at all, the
+// handshake fails with an error matching ErrUnsupportedVersion that describes the versions each end speaks. It
+// relies on the connection preserving message boundaries, and as such should be chained after a handshaker that
+// encrypts the connection via ChainHandshakers.
+func NewVersionClientHandshaker(caps Capabilities) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		if err := caps.validate(); err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		bc := AsBufferedConn(conn)
+
+		msg := append([]byte(nil), versionMagic...)
+		msg = appendUint16(msg, caps.getMinVersion())
+		msg = appendUint16(msg, caps.getMaxVersion())
+		msg = appendUint32(msg, uint32(caps.getMaxFrameSize()))
+		msg = appendNames(msg, compressorNames(caps.Compressors))
+		msg = appendNames(msg, caps.Extensions)
+		msg = appendNames(msg, codecNames(caps.Codecs))
+
+		err := writeVersionMessage(bc, msg)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		msg, err = readVersionMessage(bc)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		r := versionReader{buf: msg}
+
+		switch r.byte() {
+		case versionAccepted:
+		case versionRejected:
+			min, max := r.uint16(), r.uint16()
+			if r.err != nil {
+				return nil, PeerInfo{}, r.err
+			}
+			return nil, PeerInfo{}, fmt.Errorf("server speaks versions %d to %d, we speak versions %d to %d: %w",
+				min, max, caps.getMinVersion(), caps.getMaxVersion(), ErrUnsupportedVersion)
+		default:
+			return nil, PeerInfo{}, errors.New("malformed version handshake")
+		}
+
+		n := Negotiated{
+			Version:      r.uint16(),
+			MaxFrameSize: int(r.uint32()),
+			Compressor:   r.name(),
+			Extensions:   r.names(),
+		}
+		if len(r.buf) > 0 { // servers that predate codec negotiation do not reply with a codec
+			n.Codec = r.name()
+		}
+		if r.err != nil {
+			return nil, PeerInfo{}, r.err
+		}
+
+		if n.Version < caps.getMinVersion() || n.Version > caps.getMaxVersion() {
+			return nil, PeerInfo{}, fmt.Errorf("server picked version %d, which was not offered: %w",
+				n.Version, ErrUnsupportedVersion)
+		}
+
+		return negotiate(bc, caps, n)
+	})
+}
+
+// NewVersionServerHandshaker returns a Handshaker that exchanges caps with a client handshaker returned by
+// NewVersionClientHandshaker. See NewVersionClientHandshaker.
+func NewVersionServerHandshaker(caps Capabilities) Handshaker {
+	return ContextHandshakerFunc(func(ctx context.Context, conn net.Conn) (BufferedConn, PeerInfo, error) {
+		if err := caps.validate(); err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		bc := AsBufferedConn(conn)
+
+		msg, err := readVersionMessage(bc)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		r := versionReader{buf: msg}
+
+		theirMin, theirMax := r.uint16(), r.uint16()
+		theirMaxFrameSize := int(r.uint32())
+		theirCompressors, theirExtensions := r.names(), r.names()
+
+		var theirCodecs []string
+		if len(r.buf) > 0 { // clients that predate codec negotiation do not offer codecs
+			theirCodecs = r.names()
+		}
+		if r.err != nil {
+			return nil, PeerInfo{}, r.err
+		}
+
+		ourMin, ourMax := caps.getMinVersion(), caps.getMaxVersion()
+
+		if theirMax < ourMin || theirMin > ourMax {
+			reply := append([]byte(nil), versionMagic...)
+			reply = append(reply, versionRejected)
+			reply = appendUint16(reply, ourMin)
+			reply = appendUint16(reply, ourMax)
+
+			err = writeVersionMessage(bc, reply)
+			if err != nil {
+				return nil, PeerInfo{}, err
+			}
+			return nil, PeerInfo{}, fmt.Errorf("client speaks versions %d to %d, we speak versions %d to %d: %w",
+				theirMin, theirMax, ourMin, ourMax, ErrUnsupportedVersion)
+		}
+
+		n := Negotiated{Version: ourMax, MaxFrameSize: caps.getMaxFrameSize()}
+		if theirMax < n.Version {
+			n.Version = theirMax
+		}
+		if theirMaxFrameSize < n.MaxFrameSize {
+			n.MaxFrameSize = theirMaxFrameSize
+		}
+
+		n.Compressor = pickName(compressorNames(caps.Compressors), theirCompressors)
+		n.Codec = pickName(codecNames(caps.Codecs), theirCodecs)
+
+		for _, ext := range caps.Extensions {
+			for _, name := range theirExtensions {
+				if ext == name {
+					n.Extensions = append(n.Extensions, ext)
+					break
+				}
+			}
+		}
+
+		reply := append([]byte(nil), versionMagic...)
+		reply = append(reply, versionAccepted)
+		reply = appendUint16(reply, n.Version)
+		reply = appendUint32(reply, uint32(n.MaxFrameSize))
+		reply = appendNames(reply, pickedNames(n.Compressor))
+		reply = appendNames(reply, n.Extensions)
+		reply = appendNames(reply, pickedNames(n.Codec))
+
+		err = writeVersionMessage(bc, reply)
+		if err != nil {
+			return nil, PeerInfo{}, err
+		}
+
+		return negotiate(bc, caps, n)
+	})
+}
+
+// negotiate wraps bc with the compressor that was negotiated, should there be one, and reports the outcome of the
+// handshake along with the codec that was negotiated as the PeerInfo of our peer.
+func negotiate(bc BufferedConn, caps Capabilities, n Negotiated) (BufferedConn, PeerInfo, error) {
+	if n.MaxFrameSize < MinFrameSize {
+		return nil, PeerInfo{}, fmt.Errorf("negotiated max frame size %d is smaller than the minimum of %d",
+			n.MaxFrameSize, MinFrameSize)
+	}
+	if n.Compressor != "" {
+		var found bool
+		for _, c := range caps.Compressors {
+			if c.Name == n.Compressor {
+				bc, found = c.Decorator.Decorate(bc), true
+				break
+			}
+		}
+		if !found {
+			return nil, PeerInfo{}, fmt.Errorf("peer picked compressor %q, which was not offered", n.Compressor)
+		}
+	}
+	if n.Codec != "" {
+		for _, c := range caps.Codecs {
+			if c.Name == n.Codec {
+				n.codec = c.Codec
+				break
+			}
+		}
+		if n.codec == nil {
+			return nil, PeerInfo{}, fmt.Errorf("peer picked codec %q, which was not offered", n.Codec)
+		}
+	}
+	return bc, PeerInfo{Negotiated: &n}, nil
+}
+
+// Negotiated returns the outcome of the version handshake the connection was established with, and whether it
+// was established with one. See NewVersionClientHandshaker.
+func (c *Conn) Negotiated() (Negotiated, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.peer.Negotiated == nil {
+		return Negotiated{}, false
+	}
+	return *c.peer.Negotiated, true
+}
+
+func compressorNames(cs []Compressor) []string {
+	names := make([]string, 0, len(cs))
+	for _, c := range cs {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func codecNames(cs []NamedCodec) []string {
+	names := make([]string, 0, len(cs))
+	for _, c := range cs {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// pickName returns the first of ours that is also in theirs, or an empty string should there be none.
+func pickName(ours, theirs []string) string {
+	for _, name := range ours {
+		for _, their := range theirs {
+			if name == their {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// pickedNames returns the list of names a picked name, which is empty should nothing have been picked, is
+// written as.
+func pickedNames(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return []string{name}
+}
+
+func appendUint16(dst []byte, v uint16) []byte {
+	return append(dst, byte(v>>8), byte(v))
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendNames appends names prefixed with their count, each of which is prefixed with its 8-bit length.
+func appendNames(dst []byte, names []string) []byte {
+	dst = append(dst, byte(len(names)))
+	for _, name := range names {
+		dst = append(dst, byte(len(name)))
+		dst = append(dst, name...)
+	}
+	return dst
+}
+
+func writeVersionMessage(bc BufferedConn, msg []byte) error {
+	_, err := bc.Write(msg)
+	if err == nil {
+		err = bc.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write version handshake: %w", err)
+	}
+	return nil
+}
+
+// readVersionMessage reads a message written by writeVersionMessage, and strips its magic.
+func readVersionMessage(bc BufferedConn) ([]byte, error) {
+	msg, err := readMessageFrom(bc, nil, maxVersionMessageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version handshake: %w", err)
+	}
+	if !bytes.HasPrefix(msg, versionMagic) {
+		return nil, fmt.Errorf("peer did not perform a version handshake: %w", ErrUnsupportedVersion)
+	}
+	return msg[len(versionMagic):], nil
+}
+
+// versionReader decodes a message exchanged by a version handshake, recording the first error encountered.
+type versionReader struct {
+	buf []byte
+	err error
+}
+
+func (r *versionReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.buf) < n {
+		r.err = errors.New("malformed version handshake")
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *versionReader) byte() byte     { return r.next(1)[0] }
+func (r *versionReader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *versionReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+
+// names reads names written by appendNames.
+func (r *versionReader) names() []string {
+	n := int(r.byte())
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		names = append(names, string(r.next(int(r.byte()))))
+	}
+	return names
+}
+
+// name reads the first of the names written by appendNames, or an empty string should none have been written.
+func (r *versionReader) name() string {
+	names := r.names()
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
@@ -0,0 +1,279 @@
+package monte
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"net"
+	"testing"
+)
+
+// negotiatePipe runs version handshakers configured with client and server over either end of an encrypted
+// in-memory connection, and returns what each end negotiated.
+func negotiatePipe(t *testing.T, client, server Capabilities) (Negotiated, Negotiated, error, error) {
+	alice, bob := net.Pipe()
+	defer alice.Close()
+	defer bob.Close()
+
+	type result struct {
+		peer PeerInfo
+		err  error
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		_, peer, err := runHandshaker(context.Background(),
+			ChainHandshakers(DefaultServerHandshaker, NewVersionServerHandshaker(server)), bob)
+		if err != nil {
+			bob.Close()
+		}
+		results <- result{peer: peer, err: err}
+	}()
+
+	_, peer, clientErr := runHandshaker(context.Background(),
+		ChainHandshakers(DefaultClientHandshaker, NewVersionClientHandshaker(client)), alice)
+	if clientErr != nil {
+		alice.Close()
+	}
+	res := <-results
+
+	var a, b Negotiated
+	if clientErr == nil {
+		a = *peer.Negotiated
+	}
+	if res.err == nil {
+		b = *res.peer.Negotiated
+	}
+	return a, b, clientErr, res.err
+}
+
+func TestVersionHandshaker(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	client := Capabilities{
+		MaxVersion:   3,
+		Compressors:  []Compressor{DeflateCompressor(flate.BestSpeed)},
+		MaxFrameSize: 1024,
+		Extensions:   []string{"streams", "tracing"},
+		Codecs:       []NamedCodec{MsgpackNamedCodec(), JSONNamedCodec()},
+	}
+	server := Capabilities{
+		MaxVersion:  2,
+		Compressors: []Compressor{DeflateCompressor(flate.BestSpeed)},
+		Extensions:  []string{"tracing", "priorities"},
+		Codecs:      []NamedCodec{ProtoNamedCodec(), JSONNamedCodec(), MsgpackNamedCodec()},
+	}
+
+	// Both ends agree on the highest version, the smallest max frame size, and the compressor, extensions, and
+	// codec supported by both, preferring the server's codecs in order.
+
+	a, b, errA, errB := negotiatePipe(t, client, server)
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+	require.Equal(t, a, b)
+	require.EqualValues(t, 2, a.Version)
+	require.Equal(t, 1024, a.MaxFrameSize)
+	require.Equal(t, "deflate", a.Compressor)
+	require.Equal(t, []string{"tracing"}, a.Extensions)
+	require.True(t, a.HasExtension("tracing"))
+	require.False(t, a.HasExtension("streams"))
+	require.Equal(t, "json", a.Codec)
+
+	// Peers that speak no versions in common are rejected by both ends.
+
+	server.MinVersion, server.MaxVersion = 4, 5
+
+	_, _, errA, errB = negotiatePipe(t, client, server)
+	require.True(t, errors.Is(errA, ErrUnsupportedVersion))
+	require.True(t, errors.Is(errB, ErrUnsupportedVersion))
+	require.Contains(t, errA.Error(), "server speaks versions 4 to 5")
+}
+
+func TestVersionHandshakerPeerWithout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+	defer alice.Close()
+
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := NewVersionServerHandshaker(Capabilities{}).Handshake(NewFramedConn(bob))
+		bob.Close()
+		errs <- err
+	}()
+
+	// Peers that do not perform a version handshake are rejected rather than misread.
+
+	_, err := NewTokenClientHandshaker("secret").Handshake(NewFramedConn(alice))
+	require.Error(t, err)
+	require.True(t, errors.Is(<-errs, ErrUnsupportedVersion))
+}
+
+func TestVersionHandshakerMinFrameSize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// Capabilities with a max frame size too small to fit a fragment are refused by both ends.
+
+	_, _, errA, errB := negotiatePipe(t, Capabilities{MaxFrameSize: 3}, Capabilities{})
+	require.Error(t, errA)
+	require.Error(t, errB)
+
+	_, _, errA, errB = negotiatePipe(t, Capabilities{}, Capabilities{MaxFrameSize: 5})
+	require.Error(t, errA)
+	require.Error(t, errB)
+
+	// Peers that advertise such a max frame size regardless are rejected, be they a client or a server.
+
+	tiny := func(msg []byte) []byte {
+		return appendNames(appendNames(appendUint32(msg, 3), nil), nil)
+	}
+
+	alice, bob := net.Pipe()
+
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := NewVersionServerHandshaker(Capabilities{}).Handshake(NewFramedConn(bob))
+		bob.Close()
+		errs <- err
+	}()
+
+	client := AsBufferedConn(NewFramedConn(alice))
+
+	hello := append(append([]byte(nil), versionMagic...), 0, 1, 0, 1)
+	require.NoError(t, writeVersionMessage(client, tiny(hello)))
+	_, _ = readVersionMessage(client)
+	require.Contains(t, (<-errs).Error(), "max frame size 3")
+	alice.Close()
+
+	alice, bob = net.Pipe()
+
+	go func() {
+		_, err := NewVersionClientHandshaker(Capabilities{}).Handshake(NewFramedConn(alice))
+		alice.Close()
+		errs <- err
+	}()
+
+	server := AsBufferedConn(NewFramedConn(bob))
+
+	_, err := readVersionMessage(server)
+	require.NoError(t, err)
+
+	reply := append(append([]byte(nil), versionMagic...), versionAccepted, 0, 1)
+	require.NoError(t, writeVersionMessage(server, tiny(reply)))
+	require.Contains(t, (<-errs).Error(), "max frame size 3")
+	bob.Close()
+}
+
+// opaqueConn hides the concrete type of the BufferedConn it wraps, as do the conns established by decorators and
+// handshakers chained after a version handshaker.
+type opaqueConn struct {
+	BufferedConn
+}
+
+var opaqueHandshaker = HandshakerFunc(func(conn net.Conn) (BufferedConn, error) {
+	return opaqueConn{AsBufferedConn(conn)}, nil
+})
+
+func TestConnNegotiatedMaxFrameSize(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &Server{
+		Handler: EchoHandler{},
+		Handshaker: ChainHandshakers(
+			DefaultServerHandshaker,
+			NewVersionServerHandshaker(Capabilities{}),
+			opaqueHandshaker,
+		),
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{
+		Addr:         ln.Addr().String(),
+		MaxFrameSize: 1024,
+		Handshaker: ChainHandshakers(
+			DefaultClientHandshaker,
+			NewVersionClientHandshaker(Capabilities{MaxFrameSize: 1024}),
+		),
+	}
+	defer client.Shutdown()
+
+	// The server fragments responses that exceed the max frame size negotiated with the client, even though
+	// the conn it handles is not the one established by its version handshaker.
+
+	payload := bytes.Repeat([]byte("monte"), 1024)
+
+	res, err := client.Request(nil, payload)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(payload, res))
+}
+
+func TestConnNegotiatedCodec(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	codecs := make(chan Codec, 1)
+
+	srv := &Server{
+		Handler: EchoHandler{},
+		Handshaker: ChainHandshakers(
+			DefaultServerHandshaker,
+			NewVersionServerHandshaker(Capabilities{Codecs: []NamedCodec{MsgpackNamedCodec(), JSONNamedCodec()}}),
+			opaqueHandshaker,
+		),
+		OnConnect: func(conn *Conn) error {
+			codecs <- conn.getCodec()
+			return nil
+		},
+	}
+
+	go func() {
+		require.NoError(t, srv.Serve(ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+	}()
+
+	client := &Client{
+		Addr: ln.Addr().String(),
+		Handshaker: ChainHandshakers(
+			DefaultClientHandshaker,
+			NewVersionClientHandshaker(Capabilities{Codecs: []NamedCodec{MsgpackNamedCodec()}}),
+			opaqueHandshaker,
+		),
+	}
+	defer client.Shutdown()
+
+	conn, err := client.Get()
+	require.NoError(t, err)
+
+	// Both ends marshal values with the codec they negotiated in place of the default codec, even though the
+	// conns they handle are not the ones established by their version handshakers.
+
+	require.Equal(t, MsgpackCodec{}, conn.getCodec())
+	require.Equal(t, MsgpackCodec{}, <-codecs)
+
+	negotiated, ok := conn.Negotiated()
+	require.True(t, ok)
+	require.Equal(t, "msgpack", negotiated.Codec)
+}
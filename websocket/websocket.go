@@ -0,0 +1,474 @@
+// Package websocket carries monte connections over WebSocket, such that browsers and clients that may only reach
+// a Server through HTTP proxies may participate. Every write made to a connection is sent as a binary WebSocket
+// message, while reads return the payloads of received messages as one continuous stream of bytes.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptGUID is appended to the key of an opening handshake to derive the accept key of its response.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+// maxControlPayloadSize is the maximum size of the payload of a control frame.
+const maxControlPayloadSize = 125
+
+// ErrProtocol is returned when reading a frame that violates the WebSocket protocol.
+var ErrProtocol = errors.New("websocket protocol violation")
+
+// Addr is the address of a Listener.
+type Addr struct{}
+
+func (Addr) Network() string { return "websocket" }
+func (Addr) String() string  { return "websocket" }
+
+var (
+	_ net.Listener = (*Listener)(nil)
+	_ http.Handler = (*Listener)(nil)
+)
+
+// Listener is a net.Listener whose connections are WebSocket connections upgraded by its ServeHTTP, such that it
+// may be registered as an http.Handler with an HTTP server while being served by a monte Server. Upgrade requests
+// block until their connection is accepted, or the Listener is closed. The zero value of a Listener is ready for
+// use.
+type Listener struct {
+	// CheckOrigin, if set, is called with every upgrade request, which is rejected with 403 Forbidden should it
+	// return false, such as to only accept browsers visiting certain origins. All requests are accepted
+	// otherwise.
+	CheckOrigin func(r *http.Request) bool
+
+	once      sync.Once
+	closeOnce sync.Once
+	conns     chan net.Conn
+	done      chan struct{}
+}
+
+func (l *Listener) init() {
+	l.conns = make(chan net.Conn)
+	l.done = make(chan struct{})
+}
+
+// ServeHTTP upgrades r to a WebSocket connection, and hands the connection off to Accept.
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.once.Do(l.init)
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "websocket upgrade requires GET", http.StatusMethodNotAllowed)
+		return
+	case !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "not a websocket upgrade", http.StatusBadRequest)
+		return
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	case key == "":
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return
+	case l.CheckOrigin != nil && !l.CheckOrigin(r):
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	c := newConn(conn, rw.Reader, false)
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// Accept waits for and returns the next connection upgraded by ServeHTTP.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.once.Do(l.init)
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the Listener, after which upgrade requests are closed rather than accepted. It does not close the
+// connections that were already accepted.
+func (l *Listener) Close() error {
+	l.once.Do(l.init)
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the address of the Listener.
+func (l *Listener) Addr() net.Addr { return Addr{} }
+
+// Dialer dials servers over WebSocket. Its zero value is ready for use.
+type Dialer struct {
+	// Header, if set, is sent along with every upgrade request, such as to authenticate with the server or with
+	// proxies in front of it.
+	Header http.Header
+
+	// TLSConfig, if set, configures the TLS client used to dial wss URLs.
+	TLSConfig *tls.Config
+}
+
+// DialContext dials the ws or wss URL addr and upgrades the connection to a WebSocket connection. network is
+// ignored, as the URL designates how addr is to be dialed. Should ctx have a deadline, it bounds both dialing and
+// the upgrade.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported websocket url scheme %q", u.Scheme)
+	}
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if u.Scheme == "wss" {
+		config := d.TLSConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+
+		tc := tls.Client(conn, config)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	c, err := d.upgrade(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (d *Dialer) upgrade(conn net.Conn, u *url.URL) (net.Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for name, values := range d.Header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to write upgrade request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upgrade response: %w", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade failed: %s", res.Status)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("websocket upgrade failed: mismatched accept key: %w", ErrProtocol)
+	}
+
+	return newConn(conn, br, true), nil
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// Conn is a WebSocket connection. Every call to Write sends its bytes as a single binary message, while Read
+// returns the payloads of received text and binary messages as one continuous stream of bytes. Pings are answered
+// as they are read, and a close frame read from our peer is answered and then reported as io.EOF.
+type Conn struct {
+	net.Conn
+
+	br     *bufio.Reader
+	client bool // whether we are the client, which must mask the frames it writes and read unmasked frames
+
+	wmu sync.Mutex // serializes frames being written
+
+	remaining uint64  // number of bytes left to be read of the payload of the current data frame
+	masked    bool    // whether the payload of the current data frame is masked
+	mask      [4]byte // mask of the payload of the current data frame
+	maskPos   int     // position within mask of the next byte of the payload of the current data frame
+
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{Conn: conn, br: br, client: client}
+}
+
+// Read reads the payloads of the data frames our peer sends.
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+
+	return n, err
+}
+
+// nextFrame reads the header of the next frame, and handles it should it be a control frame.
+func (c *Conn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return err
+	}
+
+	op := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	size := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 {
+		return fmt.Errorf("unexpected reserved bits set: %w", ErrProtocol)
+	}
+	if masked == c.client {
+		return fmt.Errorf("unexpected frame masking: %w", ErrProtocol)
+	}
+
+	switch size {
+	case 126:
+		var buf [2]byte
+		if _, err := io.ReadFull(c.br, buf[:]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(buf[:]))
+	case 127:
+		var buf [8]byte
+		if _, err := io.ReadFull(c.br, buf[:]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(buf[:])
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opContinuation, opText, opBinary:
+		c.remaining, c.masked, c.mask, c.maskPos = size, masked, mask, 0
+		return nil
+	case opClose, opPing, opPong:
+	default:
+		return fmt.Errorf("unexpected opcode %d: %w", op, ErrProtocol)
+	}
+
+	if size > maxControlPayloadSize || header[0]&0x80 == 0 {
+		return fmt.Errorf("malformed control frame: %w", ErrProtocol)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+
+	switch op {
+	case opPing:
+		return c.writeFrame(opPong, payload)
+	case opClose:
+		c.closeOnce.Do(func() { _ = c.writeFrame(opClose, payload) })
+		return io.EOF
+	}
+	return nil
+}
+
+// Write sends b as a single binary message.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes a final frame with opcode op carrying payload, which is masked should we be the client.
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op)
+
+	var bit byte
+	if c.client {
+		bit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, bit|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, bit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, bit|127)
+		buf = append(buf, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i&3])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// closeTimeout bounds how long Close waits for its close frame to be written.
+const closeTimeout = time.Second
+
+// Close sends our peer a close frame, should one not have been sent already, and closes the connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		_ = c.writeFrame(opClose, []byte{0x03, 0xE8}) // 1000: normal closure
+	})
+	return c.Conn.Close()
+}
+
+// acceptKey returns the accept key of the response to an opening handshake with the given key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether the comma-separated values of the header name contain token, ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
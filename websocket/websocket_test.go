@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/lithdew/monte"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var ln Listener
+
+	ts := httptest.NewServer(&ln)
+
+	srv := &monte.Server{Handler: monte.EchoHandler{}}
+
+	go func() {
+		require.NoError(t, srv.Serve(&ln))
+	}()
+
+	defer func() {
+		srv.Shutdown()
+		require.NoError(t, ln.Close())
+		ts.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var dialer Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", "ws"+strings.TrimPrefix(ts.URL, "http")+"/monte")
+	require.NoError(t, err)
+
+	bufConn, err := monte.DefaultClientHandshaker.Handshake(conn)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	handled := make(chan struct{})
+
+	c := &monte.Conn{}
+
+	go func() {
+		defer close(handled)
+		_ = c.Handle(done, bufConn)
+	}()
+
+	defer func() {
+		close(done)
+		<-handled
+	}()
+
+	payload := make([]byte, 100*1024)
+	_, err = rand.Read(payload)
+	require.NoError(t, err)
+
+	for _, req := range [][]byte{[]byte("hello"), payload} {
+		res, err := c.Request(nil, req)
+		require.NoError(t, err)
+		require.Equal(t, req, res)
+	}
+}
+
+func TestListenerRejectsNonUpgrades(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ln := Listener{CheckOrigin: func(r *http.Request) bool { return r.Header.Get("Origin") == "https://allowed" }}
+	defer ln.Close()
+
+	ts := httptest.NewServer(&ln)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	dialer := Dialer{Header: http.Header{"Origin": {"https://denied"}}}
+
+	_, err = dialer.DialContext(context.Background(), "tcp", "ws"+strings.TrimPrefix(ts.URL, "http"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "403")
+}
+
+func TestConnFrames(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alice, bob := net.Pipe()
+
+	client := newConn(alice, bufio.NewReader(alice), true)
+	server := newConn(bob, bufio.NewReader(bob), false)
+
+	// Payloads of every length encoding are carried intact, and pings are answered as they are read.
+
+	payloads := [][]byte{nil, make([]byte, 125), make([]byte, 126), make([]byte, 70000)}
+	for _, payload := range payloads {
+		_, err := rand.Read(payload)
+		require.NoError(t, err)
+	}
+
+	// The client reads the pong its ping is answered with, as writes to the pipe block until they are read.
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		_, _ = io.Copy(io.Discard, client)
+	}()
+
+	go func() {
+		require.NoError(t, client.writeFrame(opPing, []byte("ping")))
+		for _, payload := range payloads {
+			_, err := client.Write(payload)
+			require.NoError(t, err)
+		}
+		require.NoError(t, client.Close())
+	}()
+
+	received, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(bytes.Join(payloads, nil), received))
+
+	require.NoError(t, server.Close())
+	<-drained
+}